@@ -1,16 +1,19 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	goflag "flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
-	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/clientcmd"
 	cliflag "k8s.io/component-base/cli/flag"
 	"k8s.io/component-base/logs"
 	_ "k8s.io/component-base/metrics/prometheus/clientgo" // for client metric registration
@@ -34,17 +37,80 @@ const (
 	envVarAnnotationPeerIPs            = "METAL_ANNOTATION_PEER_IPS"
 	envVarAnnotationSrcIP              = "METAL_ANNOTATION_SRC_IP"
 	envVarAnnotationBGPPass            = "METAL_ANNOTATION_BGP_PASS"
+	envVarAnnotationBGPHoldTime        = "METAL_ANNOTATION_BGP_HOLD_TIME"
+	envVarAnnotationBGPKeepalive       = "METAL_ANNOTATION_BGP_KEEPALIVE"
+	envVarBGPHoldTime                  = "METAL_BGP_HOLD_TIME"
+	envVarBGPKeepalive                 = "METAL_BGP_KEEPALIVE"
 	envVarAnnotationNetworkIPv4Private = "METAL_ANNOTATION_NETWORK_IPV4_PRIVATE"
 	envVarEIPTag                       = "METAL_EIP_TAG"
 	envVarAPIServerPort                = "METAL_API_SERVER_PORT"
 	envVarBGPNodeSelector              = "METAL_BGP_NODE_SELECTOR"
-	defaultLoadBalancerConfigMap       = "metallb-system:config"
+	envVarReservationEventsURL         = "METAL_RESERVATION_EVENTS_URL"
+	envVarReconcileTimeout             = "METAL_RECONCILE_TIMEOUT"
+	envVarResyncPeriod                 = "METAL_RESYNC_PERIOD"
+	envVarReconcileMinInterval         = "METAL_RECONCILE_MIN_INTERVAL"
+	envVarReservationCIDR              = "METAL_RESERVATION_CIDR"
+	envVarDefaultEIPBlockSize          = "METAL_DEFAULT_EIP_BLOCK_SIZE"
+	envVarReservationReuseScope        = "METAL_RESERVATION_REUSE_SCOPE"
+	envVarManageExternalIPs            = "METAL_MANAGE_EXTERNAL_IPS"
+	envVarReservationLabelTags         = "METAL_RESERVATION_LABEL_TAGS"
+	envVarEIPAdditionalTags            = "METAL_EIP_TAGS"
+	envVarEIPDescriptionTemplate       = "METAL_EIP_DESCRIPTION_TEMPLATE"
+	envVarEIPPoolPriority              = "METAL_EIP_POOL_PRIORITY"
+	envVarWarnDuplicateSelectors       = "METAL_WARN_DUPLICATE_SELECTORS"
+	envVarCheckManageable              = "METAL_CHECK_MANAGEABLE"
+	envVarDegradedReconcile            = "METAL_DEGRADED_RECONCILE"
+	envVarWaitForIPApproval            = "METAL_WAIT_FOR_IP_APPROVAL"
+	envVarFacilitySelection            = "METAL_FACILITY_SELECTION"
+	envVarFacilityCandidates           = "METAL_FACILITY_CANDIDATES"
+	envVarDesiredConfigAddress         = "METAL_DESIRED_CONFIG_ADDRESS"
+	envVarDesiredConfigToken           = "METAL_DESIRED_CONFIG_TOKEN"
+	envVarReconcileErrorsURL           = "METAL_RECONCILE_ERRORS_URL"
+	envVarMetricsGranularity           = "METAL_METRICS_GRANULARITY"
+	envVarStandbyFacility              = "METAL_STANDBY_FACILITY"
+	envVarPeerCacheTTL                 = "METAL_PEER_CACHE_TTL"
+	envVarIPCacheTTL                   = "METAL_IP_CACHE_TTL"
+	envVarReservationApprovedCIDR      = "METAL_RESERVATION_APPROVED_CIDR"
+	envVarHoldWithoutReadyNodes        = "METAL_HOLD_WITHOUT_READY_NODES"
+	envVarWithdrawBGPOnCordon          = "METAL_WITHDRAW_BGP_ON_CORDON"
+	envVarWithdrawBGPTaint             = "METAL_WITHDRAW_BGP_TAINT"
+	envVarAPIRetryCount                = "METAL_API_RETRY_COUNT"
+	envVarAPIRetryBaseDelay            = "METAL_API_RETRY_BASE_DELAY"
+	envVarAPITimeout                   = "METAL_API_TIMEOUT"
+	envVarOrphanSweepInterval          = "METAL_ORPHAN_SWEEP_INTERVAL"
+	envVarLoadBalancerClass            = "METAL_LB_CLASS"
+	envVarExcludedNamespaces           = "METAL_EXCLUDE_NAMESPACES"
+	envVarMetalLBMode                  = "METAL_METALLB_MODE"
+	envVarCreateMetalLBConfigMap       = "METAL_CREATE_METALLB_CONFIGMAP"
+	envVarDryRun                       = "METAL_DRY_RUN"
+	envVarWriteServiceLoadBalancerIP   = "METAL_WRITE_SERVICE_LOAD_BALANCER_IP"
+	envVarHealthPort                   = "METAL_HEALTH_PORT"
+	envVarAPIURL                       = "METAL_API_URL"
+	envVarMetadataURL                  = "METAL_METADATA_URL"
+	envVarLeaderElectionResourceName   = "METAL_LEADER_ELECTION_RESOURCE_NAME"
+	envVarLeaderElectionNamespace      = "METAL_LEADER_ELECTION_NAMESPACE"
+	flagLeaderElectionResourceName     = "leader-elect-resource-name"
+	flagLeaderElectionNamespace        = "leader-elect-resource-namespace"
+	flagKubeconfig                     = "kubeconfig"
+	flagMaster                         = "master"
 )
 
 var (
 	providerConfig string
+	// validateConfigOnly check the config and exit, rather than start the controllers
+	validateConfigOnly bool
+	// teardownOnly remove all the state the CCM manages and exit, rather than start the controllers
+	teardownOnly bool
+	// deviceMetadata the metadata of the device the CCM runs on, for the facility if none is set
+	deviceMetadata = newDeviceMetadata()
 )
 
+// newDeviceMetadata get the cache of the metadata of the device, from the base URL of the env var
+// if it is set, e.g. of a proxy in an air-gapped network, else from the standard metadata service
+func newDeviceMetadata() *metal.MetadataCache {
+	return metal.NewMetadataCache(os.Getenv(envVarMetadataURL))
+}
+
 func main() {
 	rand.Seed(time.Now().UTC().UnixNano())
 
@@ -55,6 +121,8 @@ func main() {
 
 	// add our config
 	command.PersistentFlags().StringVar(&providerConfig, "provider-config", "", "path to provider config file")
+	command.PersistentFlags().BoolVar(&validateConfigOnly, "validate-config", false, "load and validate the provider config, print it with secrets masked, and exit 0 if it is valid, else 1")
+	command.PersistentFlags().BoolVar(&teardownOnly, "teardown", false, "remove all EIP reservations of the cluster and all loadbalancer config the CCM manages, and exit 0 if all was removed, else 1")
 
 	logs.InitLogs()
 	defer logs.FlushLogs()
@@ -62,6 +130,10 @@ func main() {
 	// parse our flags so we get the providerConfig
 	command.ParseFlags(os.Args[1:])
 
+	if validateConfigOnly {
+		os.Exit(validateConfig(providerConfig, os.Stdout, os.Stderr))
+	}
+
 	// register the provider
 	config, err := getMetalConfig(providerConfig)
 	if err != nil {
@@ -71,6 +143,16 @@ func main() {
 	// report the config
 	printMetalConfig(config)
 
+	if teardownOnly {
+		os.Exit(teardown(config, command.Flags(), os.Stderr))
+	}
+
+	// give the controller manager our leader election lock, unless it was set on the command-line
+	if err := setLeaderElectionFlags(command.Flags(), config); err != nil {
+		fmt.Fprintf(os.Stderr, "leader election config error: %v\n", err)
+		os.Exit(1)
+	}
+
 	// register the provider
 	if err := metal.InitializeProvider(config); err != nil {
 		fmt.Fprintf(os.Stderr, "provider initialization error: %v\n", err)
@@ -86,6 +168,8 @@ func main() {
 func getMetalConfig(providerConfig string) (metal.Config, error) {
 	// get our token and project
 	var config, rawConfig metal.Config
+	// on unless the file turns it off
+	rawConfig.WriteServiceLoadBalancerIP = true
 	if providerConfig != "" {
 		configBytes, err := ioutil.ReadFile(providerConfig)
 		if err != nil {
@@ -104,43 +188,48 @@ func getMetalConfig(providerConfig string) (metal.Config, error) {
 	}
 	config.AuthToken = apiToken
 
+	config.BaseURL = rawConfig.BaseURL
+	if v := os.Getenv(envVarAPIURL); v != "" {
+		config.BaseURL = &v
+	}
+
 	projectID := os.Getenv(projectIDName)
 	if projectID == "" {
 		projectID = rawConfig.ProjectID
 	}
+	// if the project was not defined, it is that of our device; without a token, it cannot be got
+	if projectID == "" && config.AuthToken != "" {
+		var err error
+		projectID, err = deviceMetadata.Project(config)
+		if err != nil {
+			return config, fmt.Errorf("project ID not set in environment variable %q or config file, and unable to get the project of this device: %v; set it in either to the project in which to manage EIPs", projectIDName, err)
+		}
+	}
 	config.ProjectID = projectID
 
-	loadBalancerSetting := os.Getenv(loadBalancerSettingName)
-	config.LoadBalancerSetting = rawConfig.LoadBalancerSetting
+	// surrounding whitespace, e.g. from a templated manifest, is not part of the setting
+	loadBalancerSetting := strings.TrimSpace(os.Getenv(loadBalancerSettingName))
+	config.LoadBalancerSetting = strings.TrimSpace(rawConfig.LoadBalancerSetting)
 	// rule for processing: any setting in env var overrides setting from file
 	if loadBalancerSetting != "" {
 		config.LoadBalancerSetting = loadBalancerSetting
 	}
-	// and set for default
-	if config.LoadBalancerSetting == "" {
-		config.LoadBalancerSetting = defaultLoadBalancerConfigMap
-	}
 
 	facility := os.Getenv(facilityName)
 	if facility == "" {
 		facility = rawConfig.Facility
 	}
 
-	if apiToken == "" {
-		return config, fmt.Errorf("environment variable %q is required", apiKeyName)
-	}
-
-	if projectID == "" {
-		return config, fmt.Errorf("environment variable %q is required", projectIDName)
-	}
-
 	// if facility was not defined, retrieve it from our metadata
 	if facility == "" {
-		metadata, err := metal.GetAndParseMetadata("")
-		if err != nil {
+		var err error
+		facility, err = deviceMetadata.Facility()
+		switch {
+		case err == metal.ErrNoMetadataFacility:
+			return config, fmt.Errorf("facility not set in environment variable %q or config file, and %v; set it in either to the facility in which to reserve EIPs", facilityName, err)
+		case err != nil:
 			return config, fmt.Errorf("facility not set in environment variable %q or config file, and error reading metadata: %v", facilityName, err)
 		}
-		facility = metadata.Facility
 	}
 	config.Facility = facility
 
@@ -164,6 +253,21 @@ func getMetalConfig(providerConfig string) (metal.Config, error) {
 		config.BGPPass = bgpPass
 	}
 
+	if v := os.Getenv(envVarBGPHoldTime); v != "" {
+		hold, err := time.ParseDuration(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a duration, was %s: %v", envVarBGPHoldTime, v, err)
+		}
+		config.BGPHoldTime = hold
+	}
+	if v := os.Getenv(envVarBGPKeepalive); v != "" {
+		keepalive, err := time.ParseDuration(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a duration, was %s: %v", envVarBGPKeepalive, v, err)
+		}
+		config.BGPKeepalive = keepalive
+	}
+
 	// set the annotations
 	config.AnnotationLocalASN = metal.DefaultAnnotationNodeASN
 	annotationLocalASN := os.Getenv(envVarAnnotationLocalASN)
@@ -191,6 +295,14 @@ func getMetalConfig(providerConfig string) (metal.Config, error) {
 	if annotationBGPPass != "" {
 		config.AnnotationBGPPass = annotationBGPPass
 	}
+	config.AnnotationBGPHoldTime = metal.DefaultAnnotationBGPHoldTime
+	if v := os.Getenv(envVarAnnotationBGPHoldTime); v != "" {
+		config.AnnotationBGPHoldTime = v
+	}
+	config.AnnotationBGPKeepalive = metal.DefaultAnnotationBGPKeepalive
+	if v := os.Getenv(envVarAnnotationBGPKeepalive); v != "" {
+		config.AnnotationBGPKeepalive = v
+	}
 
 	config.AnnotationNetworkIPv4Private = metal.DefaultAnnotationNetworkIPv4Private
 	annotationNetworkIPv4Private := os.Getenv(envVarAnnotationNetworkIPv4Private)
@@ -226,17 +338,407 @@ func getMetalConfig(providerConfig string) (metal.Config, error) {
 		config.BGPNodeSelector = v
 	}
 
-	if _, err := labels.Parse(config.BGPNodeSelector); err != nil {
-		return config, fmt.Errorf("BGP Node Selector must be valid Kubernetes selector: %w", err)
+	config.ReservationEventsURL = rawConfig.ReservationEventsURL
+	if v := os.Getenv(envVarReservationEventsURL); v != "" {
+		config.ReservationEventsURL = v
+	}
+
+	if v := os.Getenv(envVarReconcileTimeout); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a duration, was %s: %v", envVarReconcileTimeout, v, err)
+		}
+		config.ReconcileTimeout = timeout
+	}
+
+	config.ResyncPeriod = metal.DefaultResyncPeriod
+	if v := os.Getenv(envVarResyncPeriod); v != "" {
+		period, err := time.ParseDuration(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a duration, was %s: %v", envVarResyncPeriod, v, err)
+		}
+		config.ResyncPeriod = period
+	}
+
+	config.ReconcileMinInterval = metal.DefaultReconcileMinInterval
+	if v := os.Getenv(envVarReconcileMinInterval); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a duration, was %s: %v", envVarReconcileMinInterval, v, err)
+		}
+		config.ReconcileMinInterval = interval
+	}
+
+	reservationCIDR := os.Getenv(envVarReservationCIDR)
+	switch {
+	case reservationCIDR != "":
+		reservationCIDRNo, err := strconv.Atoi(reservationCIDR)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a number, was %s: %v", envVarReservationCIDR, reservationCIDR, err)
+		}
+		config.ReservationCIDR = reservationCIDRNo
+	case rawConfig.ReservationCIDR != 0:
+		config.ReservationCIDR = rawConfig.ReservationCIDR
+	default:
+		config.ReservationCIDR = metal.DefaultReservationCIDR
+	}
+
+	config.DefaultEIPBlockSize = rawConfig.DefaultEIPBlockSize
+	if v := os.Getenv(envVarDefaultEIPBlockSize); v != "" {
+		size, err := strconv.Atoi(strings.TrimPrefix(v, "/"))
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a number, was %s: %v", envVarDefaultEIPBlockSize, v, err)
+		}
+		config.DefaultEIPBlockSize = size
+	}
+
+	config.ReservationReuseScope = rawConfig.ReservationReuseScope
+	if v := os.Getenv(envVarReservationReuseScope); v != "" {
+		config.ReservationReuseScope = v
+	}
+	if config.ReservationReuseScope == "" {
+		config.ReservationReuseScope = metal.ReuseScopeService
+	}
+
+	config.ManageExternalIPs = rawConfig.ManageExternalIPs
+	if v := os.Getenv(envVarManageExternalIPs); v != "" {
+		manage, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %v", envVarManageExternalIPs, v, err)
+		}
+		config.ManageExternalIPs = manage
+	}
+
+	config.ReservationLabelTags = rawConfig.ReservationLabelTags
+	if v := os.Getenv(envVarReservationLabelTags); v != "" {
+		config.ReservationLabelTags = splitList(v)
+	}
+	config.EIPAdditionalTags = rawConfig.EIPAdditionalTags
+	if v := os.Getenv(envVarEIPAdditionalTags); v != "" {
+		config.EIPAdditionalTags = splitList(v)
+	}
+	config.EIPDescriptionTemplate = rawConfig.EIPDescriptionTemplate
+	if v := os.Getenv(envVarEIPDescriptionTemplate); v != "" {
+		config.EIPDescriptionTemplate = v
+	}
+	config.EIPPoolPriority = rawConfig.EIPPoolPriority
+	if v := os.Getenv(envVarEIPPoolPriority); v != "" {
+		config.EIPPoolPriority = splitList(v)
+	}
+
+	config.FacilitySelection = rawConfig.FacilitySelection
+	if v := os.Getenv(envVarFacilitySelection); v != "" {
+		config.FacilitySelection = v
+	}
+	config.FacilityCandidates = rawConfig.FacilityCandidates
+	if v := os.Getenv(envVarFacilityCandidates); v != "" {
+		config.FacilityCandidates = splitList(v)
+	}
+	if config.FacilitySelection == "" {
+		config.FacilitySelection = metal.FacilitySelectionFixed
+	}
+
+	config.WarnDuplicateSelectors = rawConfig.WarnDuplicateSelectors
+	if v := os.Getenv(envVarWarnDuplicateSelectors); v != "" {
+		warn, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %v", envVarWarnDuplicateSelectors, v, err)
+		}
+		config.WarnDuplicateSelectors = warn
+	}
+
+	config.CheckManageable = rawConfig.CheckManageable
+	if v := os.Getenv(envVarCheckManageable); v != "" {
+		check, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %v", envVarCheckManageable, v, err)
+		}
+		config.CheckManageable = check
+	}
+
+	config.DegradedReconcile = rawConfig.DegradedReconcile
+	if v := os.Getenv(envVarDegradedReconcile); v != "" {
+		degraded, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %v", envVarDegradedReconcile, v, err)
+		}
+		config.DegradedReconcile = degraded
 	}
 
+	config.WaitForIPApproval = rawConfig.WaitForIPApproval
+	if v := os.Getenv(envVarWaitForIPApproval); v != "" {
+		wait, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %v", envVarWaitForIPApproval, v, err)
+		}
+		config.WaitForIPApproval = wait
+	}
+
+	config.DesiredConfigAddress = rawConfig.DesiredConfigAddress
+	if v := os.Getenv(envVarDesiredConfigAddress); v != "" {
+		config.DesiredConfigAddress = v
+	}
+
+	config.DesiredConfigToken = rawConfig.DesiredConfigToken
+	if v := os.Getenv(envVarDesiredConfigToken); v != "" {
+		config.DesiredConfigToken = v
+	}
+
+	config.ReconcileErrorsURL = rawConfig.ReconcileErrorsURL
+	if v := os.Getenv(envVarReconcileErrorsURL); v != "" {
+		config.ReconcileErrorsURL = v
+	}
+
+	config.MetricsGranularity = rawConfig.MetricsGranularity
+	if v := os.Getenv(envVarMetricsGranularity); v != "" {
+		config.MetricsGranularity = v
+	}
+	if config.MetricsGranularity == "" {
+		config.MetricsGranularity = metal.MetricsGranularityAggregate
+	}
+
+	config.StandbyFacility = rawConfig.StandbyFacility
+	if v := os.Getenv(envVarStandbyFacility); v != "" {
+		config.StandbyFacility = v
+	}
+
+	if v := os.Getenv(envVarPeerCacheTTL); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a duration, was %s: %v", envVarPeerCacheTTL, v, err)
+		}
+		config.PeerCacheTTL = ttl
+	}
+
+	config.IPCacheTTL = metal.DefaultIPCacheTTL
+	if v := os.Getenv(envVarIPCacheTTL); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a duration, was %s: %v", envVarIPCacheTTL, v, err)
+		}
+		config.IPCacheTTL = ttl
+	}
+
+	config.ReservationApprovedCIDR = rawConfig.ReservationApprovedCIDR
+	if v := os.Getenv(envVarReservationApprovedCIDR); v != "" {
+		config.ReservationApprovedCIDR = v
+	}
+
+	config.HoldWithoutReadyNodes = rawConfig.HoldWithoutReadyNodes
+	if v := os.Getenv(envVarHoldWithoutReadyNodes); v != "" {
+		hold, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %v", envVarHoldWithoutReadyNodes, v, err)
+		}
+		config.HoldWithoutReadyNodes = hold
+	}
+
+	config.WithdrawBGPOnCordon = rawConfig.WithdrawBGPOnCordon
+	if v := os.Getenv(envVarWithdrawBGPOnCordon); v != "" {
+		withdraw, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %v", envVarWithdrawBGPOnCordon, v, err)
+		}
+		config.WithdrawBGPOnCordon = withdraw
+	}
+	config.WithdrawBGPTaint = rawConfig.WithdrawBGPTaint
+	if v := os.Getenv(envVarWithdrawBGPTaint); v != "" {
+		config.WithdrawBGPTaint = v
+	}
+
+	apiRetryCount := os.Getenv(envVarAPIRetryCount)
+	switch {
+	case apiRetryCount != "":
+		count, err := strconv.Atoi(apiRetryCount)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a number, was %s: %v", envVarAPIRetryCount, apiRetryCount, err)
+		}
+		config.APIRetryCount = count
+	case rawConfig.APIRetryCount != 0:
+		config.APIRetryCount = rawConfig.APIRetryCount
+	default:
+		config.APIRetryCount = metal.DefaultAPIRetryCount
+	}
+
+	config.APIRetryBaseDelay = metal.DefaultAPIRetryBaseDelay
+	if v := os.Getenv(envVarAPIRetryBaseDelay); v != "" {
+		delay, err := time.ParseDuration(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a duration, was %s: %v", envVarAPIRetryBaseDelay, v, err)
+		}
+		config.APIRetryBaseDelay = delay
+	}
+
+	config.APITimeout = metal.DefaultAPITimeout
+	if v := os.Getenv(envVarAPITimeout); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a duration, was %s: %v", envVarAPITimeout, v, err)
+		}
+		config.APITimeout = timeout
+	}
+
+	config.OrphanSweepInterval = metal.DefaultOrphanSweepInterval
+	if v := os.Getenv(envVarOrphanSweepInterval); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a duration, was %s: %v", envVarOrphanSweepInterval, v, err)
+		}
+		config.OrphanSweepInterval = interval
+	}
+
+	config.LoadBalancerClass = rawConfig.LoadBalancerClass
+	if v := os.Getenv(envVarLoadBalancerClass); v != "" {
+		config.LoadBalancerClass = v
+	}
+	if config.LoadBalancerClass == "" {
+		config.LoadBalancerClass = metal.DefaultLoadBalancerClass
+	}
+	config.ExcludedNamespaces = rawConfig.ExcludedNamespaces
+	if v := os.Getenv(envVarExcludedNamespaces); v != "" {
+		config.ExcludedNamespaces = splitList(v)
+	}
+
+	config.MetalLBMode = rawConfig.MetalLBMode
+	if v := os.Getenv(envVarMetalLBMode); v != "" {
+		config.MetalLBMode = v
+	}
+	if config.MetalLBMode == "" {
+		config.MetalLBMode = metal.MetalLBModeConfigMap
+	}
+	config.CreateMetalLBConfigMap = rawConfig.CreateMetalLBConfigMap
+	if v := os.Getenv(envVarCreateMetalLBConfigMap); v != "" {
+		create, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %v", envVarCreateMetalLBConfigMap, v, err)
+		}
+		config.CreateMetalLBConfigMap = create
+	}
+
+	config.DryRun = rawConfig.DryRun
+	if v := os.Getenv(envVarDryRun); v != "" {
+		dryRun, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %v", envVarDryRun, v, err)
+		}
+		config.DryRun = dryRun
+	}
+
+	config.WriteServiceLoadBalancerIP = rawConfig.WriteServiceLoadBalancerIP
+	if v := os.Getenv(envVarWriteServiceLoadBalancerIP); v != "" {
+		write, err := strconv.ParseBool(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a boolean, was %s: %v", envVarWriteServiceLoadBalancerIP, v, err)
+		}
+		config.WriteServiceLoadBalancerIP = write
+	}
+
+	config.HealthPort = rawConfig.HealthPort
+	if v := os.Getenv(envVarHealthPort); v != "" {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return config, fmt.Errorf("env var %s must be a number, was %s: %v", envVarHealthPort, v, err)
+		}
+		config.HealthPort = port
+	}
+
+	config.LeaderElectionResourceName = rawConfig.LeaderElectionResourceName
+	if v := os.Getenv(envVarLeaderElectionResourceName); v != "" {
+		config.LeaderElectionResourceName = v
+	}
+	config.LeaderElectionNamespace = rawConfig.LeaderElectionNamespace
+	if v := os.Getenv(envVarLeaderElectionNamespace); v != "" {
+		config.LeaderElectionNamespace = v
+	}
+
+	// the values are checked together, once they all are loaded and defaulted
+	if err := config.Validate(); err != nil {
+		return config, fmt.Errorf("invalid configuration: %w", err)
+	}
 	return config, nil
 }
 
+// setLeaderElectionFlags set the leader election lock of the controller manager from our config,
+// so that separate deployments, e.g. one for services and one for nodes, do not contend for
+// the same lock. An explicit command-line flag takes precedence.
+func setLeaderElectionFlags(flags *pflag.FlagSet, config metal.Config) error {
+	for name, value := range map[string]string{
+		flagLeaderElectionResourceName: config.LeaderElectionResourceName,
+		flagLeaderElectionNamespace:    config.LeaderElectionNamespace,
+	} {
+		if value == "" {
+			continue
+		}
+		flag := flags.Lookup(name)
+		if flag == nil {
+			return fmt.Errorf("controller manager has no flag %s", name)
+		}
+		if flag.Changed {
+			klog.Infof("flag --%s set on command-line, ignoring leader election config %s", name, value)
+			continue
+		}
+		if err := flags.Set(name, value); err != nil {
+			return fmt.Errorf("unable to set flag %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// teardown remove all the state the CCM manages from the cluster of the kubeconfig and master of
+// the flags, or the one it runs in if neither is set, printing the error to errOut, and get the
+// exit code
+func teardown(config metal.Config, flags *pflag.FlagSet, errOut io.Writer) int {
+	var kubeconfig, master string
+	if flag := flags.Lookup(flagKubeconfig); flag != nil {
+		kubeconfig = flag.Value.String()
+	}
+	if flag := flags.Lookup(flagMaster); flag != nil {
+		master = flag.Value.String()
+	}
+	restConfig, err := clientcmd.BuildConfigFromFlags(master, kubeconfig)
+	if err != nil {
+		fmt.Fprintf(errOut, "kubernetes client config error: %v\n", err)
+		return 1
+	}
+	if err := metal.Teardown(context.Background(), config, restConfig); err != nil {
+		fmt.Fprintf(errOut, "teardown error: %v\n", err)
+		return 1
+	}
+	klog.Info("teardown complete")
+	return 0
+}
+
 // printMetalConfig report the config to startup logs
+// validateConfig load and check the config as the CCM does when it starts, printing it, masked, to
+// out, or the error to errOut, and get the exit code, so that it can be checked, e.g. in CI or an
+// init container, without starting the controllers
+func validateConfig(providerConfig string, out, errOut io.Writer) int {
+	config, err := getMetalConfig(providerConfig)
+	if err != nil {
+		fmt.Fprintf(errOut, "provider config error: %v\n", err)
+		return 1
+	}
+	for _, l := range config.Strings() {
+		fmt.Fprintln(out, l)
+	}
+	fmt.Fprintln(out, "provider config is valid")
+	return 0
+}
+
 func printMetalConfig(config metal.Config) {
 	lines := config.Strings()
 	for _, l := range lines {
 		klog.Infof(l)
 	}
 }
+
+// splitList split a comma-separated list, e.g. from an env var, dropping empty entries
+func splitList(v string) []string {
+	ret := []string{}
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal"
+	"k8s.io/kubernetes/cmd/cloud-controller-manager/app"
+)
+
+func TestSetLeaderElectionFlags(t *testing.T) {
+	tests := []struct {
+		args              []string
+		config            metal.Config
+		expectedName      string
+		expectedNamespace string
+	}{
+		// defaults of the controller manager
+		{nil, metal.Config{}, "cloud-controller-manager", "kube-system"},
+		// from config
+		{nil, metal.Config{LeaderElectionResourceName: "ccm-services", LeaderElectionNamespace: "metal"}, "ccm-services", "metal"},
+		// only the name
+		{nil, metal.Config{LeaderElectionResourceName: "ccm-nodes"}, "ccm-nodes", "kube-system"},
+		// command-line wins
+		{[]string{"--leader-elect-resource-name=from-flag"}, metal.Config{LeaderElectionResourceName: "ccm-services"}, "from-flag", "kube-system"},
+	}
+	for i, tt := range tests {
+		command := app.NewCloudControllerManagerCommand()
+		if err := command.ParseFlags(tt.args); err != nil {
+			t.Fatalf("%d: unable to parse flags: %v", i, err)
+		}
+		if err := setLeaderElectionFlags(command.Flags(), tt.config); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		name := command.Flags().Lookup(flagLeaderElectionResourceName).Value.String()
+		namespace := command.Flags().Lookup(flagLeaderElectionNamespace).Value.String()
+		if name != tt.expectedName {
+			t.Errorf("%d: mismatched lease name, actual %s expected %s", i, name, tt.expectedName)
+		}
+		if namespace != tt.expectedNamespace {
+			t.Errorf("%d: mismatched lease namespace, actual %s expected %s", i, namespace, tt.expectedNamespace)
+		}
+	}
+}
+
+func TestGetMetalConfigLoadBalancerSetting(t *testing.T) {
+	for name, value := range map[string]string{apiKeyName: "token", projectIDName: "project", facilityName: "ewr1"} {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+	dir, err := ioutil.TempDir("", "ccm-config")
+	if err != nil {
+		t.Fatalf("unable to create config dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		env      string
+		file     string
+		expected string
+		err      bool
+	}{
+		// unset disables
+		{"", "", "", false},
+		// from the file, or the env var, which wins
+		{"", "metallb:///ns/cm", "metallb:///ns/cm", false},
+		{"kube-vip://", "", "kube-vip://", false},
+		{"empty://", "metallb:///ns/cm", "empty://", false},
+		// surrounding whitespace is trimmed
+		{" metallb:///ns/cm\n", "", "metallb:///ns/cm", false},
+		{"", " metallb:///ns/cm ", "metallb:///ns/cm", false},
+		// malformed fails at startup rather than disabling
+		{"metallb-system:config", "", "", true},
+		{"", "unknown:///ns/cm", "", true},
+		{"metallb:///metallb-system:config", "", "", true},
+	}
+	for i, tt := range tests {
+		providerConfig := filepath.Join(dir, "config.json")
+		if err := ioutil.WriteFile(providerConfig, []byte(`{"loadbalancer": "`+tt.file+`"}`), 0600); err != nil {
+			t.Fatalf("%d: unable to write config: %v", i, err)
+		}
+		os.Setenv(loadBalancerSettingName, tt.env)
+		config, err := getMetalConfig(providerConfig)
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("%d: expected an error, had none", i)
+		case !tt.err && err != nil:
+			t.Errorf("%d: unexpected error: %v", i, err)
+		case !tt.err && config.LoadBalancerSetting != tt.expected:
+			t.Errorf("%d: mismatched setting, actual %q expected %q", i, config.LoadBalancerSetting, tt.expected)
+		}
+	}
+	os.Unsetenv(loadBalancerSettingName)
+}
+
+func TestGetMetalConfigWriteServiceLoadBalancerIP(t *testing.T) {
+	for name, value := range map[string]string{apiKeyName: "token", projectIDName: "project", facilityName: "ewr1"} {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+	dir, err := ioutil.TempDir("", "ccm-config")
+	if err != nil {
+		t.Fatalf("unable to create config dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		env      string
+		file     string
+		expected bool
+	}{
+		// on unless turned off
+		{"", `{}`, true},
+		{"", `{"writeServiceLoadBalancerIP": false}`, false},
+		{"false", `{}`, false},
+		{"true", `{"writeServiceLoadBalancerIP": false}`, true},
+	}
+	for i, tt := range tests {
+		providerConfig := filepath.Join(dir, "config.json")
+		if err := ioutil.WriteFile(providerConfig, []byte(tt.file), 0600); err != nil {
+			t.Fatalf("%d: unable to write config: %v", i, err)
+		}
+		os.Setenv(envVarWriteServiceLoadBalancerIP, tt.env)
+		config, err := getMetalConfig(providerConfig)
+		switch {
+		case err != nil:
+			t.Errorf("%d: unexpected error: %v", i, err)
+		case config.WriteServiceLoadBalancerIP != tt.expected:
+			t.Errorf("%d: mismatched setting, actual %t expected %t", i, config.WriteServiceLoadBalancerIP, tt.expected)
+		}
+	}
+	os.Unsetenv(envVarWriteServiceLoadBalancerIP)
+}
+
+func TestGetMetalConfigAPIURL(t *testing.T) {
+	for name, value := range map[string]string{apiKeyName: "token", projectIDName: "project", facilityName: "ewr1"} {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+	dir, err := ioutil.TempDir("", "ccm-config")
+	if err != nil {
+		t.Fatalf("unable to create config dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		env      string
+		file     string
+		expected string
+		err      string
+	}{
+		// the standard one unless set
+		{"", `{}`, "", ""},
+		{"", `{"base-url": "https://staging.example.com/metal/v1/"}`, "https://staging.example.com/metal/v1/", ""},
+		{"http://localhost:8080/", `{}`, "http://localhost:8080/", ""},
+		{"http://localhost:8080/", `{"base-url": "https://staging.example.com/metal/v1/"}`, "http://localhost:8080/", ""},
+		// invalid
+		{"api.equinix.com/metal/v1", `{}`, "", "API base URL must be an absolute URL"},
+		{"", `{"base-url": "://nothing"}`, "", "API base URL must be an absolute URL"},
+	}
+	for i, tt := range tests {
+		providerConfig := filepath.Join(dir, "config.json")
+		if err := ioutil.WriteFile(providerConfig, []byte(tt.file), 0600); err != nil {
+			t.Fatalf("%d: unable to write config: %v", i, err)
+		}
+		os.Setenv(envVarAPIURL, tt.env)
+		config, err := getMetalConfig(providerConfig)
+		var actual string
+		if config.BaseURL != nil {
+			actual = *config.BaseURL
+		}
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%d: unexpected error: %v", i, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%d: mismatched error, actual %v expected to contain %q", i, err, tt.err)
+		case tt.err == "" && actual != tt.expected:
+			t.Errorf("%d: mismatched base URL, actual %q expected %q", i, actual, tt.expected)
+		}
+	}
+	os.Unsetenv(envVarAPIURL)
+}
+
+func TestValidateConfig(t *testing.T) {
+	const token = "secret-token-1234"
+	dir, err := ioutil.TempDir("", "ccm-config")
+	if err != nil {
+		t.Fatalf("unable to create config dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		description string
+		file        string
+		code        int
+		output      string
+	}{
+		{"valid", `{"apiKey": "` + token + `", "projectID": "project", "facility": "ewr1"}`, 0, "provider config is valid"},
+		{"bad selector", `{"apiKey": "` + token + `", "projectID": "project", "facility": "ewr1", "bgpNodeSelector": "a b c"}`, 1, "BGP Node Selector must be valid"},
+		{"missing token", `{"projectID": "project", "facility": "ewr1"}`, 1, "auth token is required"},
+		{"bad file", `{"apiKey": "` + token + `",`, 1, "failed to process json"},
+	}
+	for _, tt := range tests {
+		providerConfig := filepath.Join(dir, "config.json")
+		if err := ioutil.WriteFile(providerConfig, []byte(tt.file), 0600); err != nil {
+			t.Fatalf("%s: unable to write config: %v", tt.description, err)
+		}
+		var out, errOut bytes.Buffer
+		if code := validateConfig(providerConfig, &out, &errOut); code != tt.code {
+			t.Errorf("%s: mismatched exit code, actual %d expected %d: %s%s", tt.description, code, tt.code, out.String(), errOut.String())
+		}
+		if all := out.String() + errOut.String(); !strings.Contains(all, tt.output) {
+			t.Errorf("%s: output does not contain %q: %s", tt.description, tt.output, all)
+		}
+		if strings.Contains(out.String()+errOut.String(), token) {
+			t.Errorf("%s: output has the token", tt.description)
+		}
+		if tt.code == 0 && !strings.Contains(out.String(), "authToken: '<masked>'") {
+			t.Errorf("%s: output does not have the masked token: %s", tt.description, out.String())
+		}
+	}
+}
+
+func TestGetMetalConfigMetadataProject(t *testing.T) {
+	for name, value := range map[string]string{apiKeyName: "token", facilityName: "ewr1"} {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+	defer func(m *metal.MetadataCache) { deviceMetadata = m }(deviceMetadata)
+	var (
+		metadata string
+		device   string
+		devices  int
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/metal/v1/devices/") {
+			_, _ = w.Write([]byte(metadata))
+			return
+		}
+		devices++
+		w.Header().Set("Content-Type", "application/json")
+		if device == "" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"errors": ["Not found"]}`))
+			return
+		}
+		_, _ = w.Write([]byte(device))
+	}))
+	defer ts.Close()
+	os.Setenv(envVarAPIURL, ts.URL+"/metal/v1/")
+	defer os.Unsetenv(envVarAPIURL)
+
+	tests := []struct {
+		description string
+		env         string
+		metadata    string
+		device      string
+		project     string
+		err         string
+	}{
+		{"explicit", "project", `{}`, "", "project", ""},
+		{"from metadata", "", `{"id": "device-1"}`, `{"id": "device-1", "project": {"href": "/metal/v1/projects/project-1"}}`, "project-1", ""},
+		{"from metadata with ID", "", `{"id": "device-1"}`, `{"id": "device-1", "project": {"id": "project-2"}}`, "project-2", ""},
+		// neither
+		{"no device ID", "", `{}`, "", "", "has no device ID; set it"},
+		{"no device", "", `{"id": "device-1"}`, "", "", "unable to get device device-1"},
+		{"no project", "", `{"id": "device-1"}`, `{"id": "device-1"}`, "", "device device-1 has no project"},
+	}
+	for _, tt := range tests {
+		metadata, device, devices = tt.metadata, tt.device, 0
+		deviceMetadata = metal.NewMetadataCache(ts.URL)
+		os.Setenv(projectIDName, tt.env)
+		config, err := getMetalConfig("")
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.description, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: mismatched error, actual %v expected to contain %q", tt.description, err, tt.err)
+		case config.ProjectID != tt.project:
+			t.Errorf("%s: mismatched project, actual %q expected %q", tt.description, config.ProjectID, tt.project)
+		}
+		// an explicit project needs no lookup
+		if tt.env != "" && devices != 0 {
+			t.Errorf("%s: unexpected lookup of the device", tt.description)
+		}
+	}
+	os.Unsetenv(projectIDName)
+}
+
+func TestGetMetalConfigMetadataFacility(t *testing.T) {
+	for name, value := range map[string]string{apiKeyName: "token", projectIDName: "project"} {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+	defer func(m *metal.MetadataCache) { deviceMetadata = m }(deviceMetadata)
+	var (
+		status int
+		body   string
+		calls  int
+	)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		status   int
+		body     string
+		facility string
+		err      string
+	}{
+		{http.StatusOK, `{"id": "device", "facility": "ewr1"}`, "ewr1", ""},
+		// empty
+		{http.StatusOK, `{"id": "device", "facility": ""}`, "", "has no facility; set it"},
+		{http.StatusOK, `{}`, "", "has no facility; set it"},
+		// error
+		{http.StatusInternalServerError, `oops`, "", "error reading metadata: 500 Internal Server Error"},
+		{http.StatusOK, `{"error": "not found"}`, "", "error reading metadata: not found"},
+	}
+	for i, tt := range tests {
+		status, body = tt.status, tt.body
+		deviceMetadata = metal.NewMetadataCache(ts.URL)
+		config, err := getMetalConfig("")
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%d: unexpected error: %v", i, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%d: mismatched error, actual %v expected to contain %q", i, err, tt.err)
+		case config.Facility != tt.facility:
+			t.Errorf("%d: mismatched facility, actual %q expected %q", i, config.Facility, tt.facility)
+		}
+	}
+
+	// the metadata is retrieved once
+	calls = 0
+	status, body = http.StatusOK, `{"id": "device", "facility": "ewr1"}`
+	deviceMetadata = metal.NewMetadataCache(ts.URL)
+	for i := 0; i < 2; i++ {
+		if _, err := getMetalConfig(""); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("expected the metadata retrieved once, was %d times", calls)
+	}
+}
+
+func TestGetMetalConfigMetadataURL(t *testing.T) {
+	for name, value := range map[string]string{apiKeyName: "token", projectIDName: "project"} {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+	defer func(m *metal.MetadataCache) { deviceMetadata = m }(deviceMetadata)
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		_, _ = w.Write([]byte(`{
+			"id": "device-1",
+			"hostname": "node-a",
+			"plan": "c3.small.x86",
+			"facility": "da11",
+			"metro": "da",
+			"tags": ["k8s"],
+			"network": {"bonding": {"mode": 4}, "interfaces": [], "addresses": []}
+		}`))
+	}))
+	defer ts.Close()
+
+	// of a proxy, e.g. in an air-gapped network
+	os.Setenv(envVarMetadataURL, ts.URL+"/proxy")
+	defer os.Unsetenv(envVarMetadataURL)
+	deviceMetadata = newDeviceMetadata()
+	config, err := getMetalConfig("")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.Facility != "da11" {
+		t.Errorf("mismatched facility, actual %q expected da11", config.Facility)
+	}
+	if strings.Join(paths, ",") != "/proxy/metadata" {
+		t.Errorf("mismatched metadata requests %v, expected /proxy/metadata", paths)
+	}
+}
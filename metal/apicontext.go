@@ -0,0 +1,62 @@
+package metal
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// DefaultAPITimeout the time a single call to the Equinix Metal API may take before it is aborted
+const DefaultAPITimeout = 30 * time.Second
+
+// contextTransport binds every request to the Equinix Metal API to a context, so that the requests
+// in flight are aborted once it is done, e.g. on shutdown. packngo makes its requests without one.
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.base.RoundTrip(req.WithContext(t.ctx))
+}
+
+// newAPIHTTPClient get the HTTP client for calls to the Equinix Metal API, which aborts each call
+// after the timeout, unless it is 0, and every call in flight once ctx is done, and records the rate
+// limit of the API from each response
+func newAPIHTTPClient(ctx context.Context, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: contextTransport{ctx: ctx, base: newRateLimitTransport(http.DefaultTransport)},
+	}
+}
+
+// callWithContext call op, a call to the Equinix Metal API, which packngo makes without a context,
+// returning the error of ctx as soon as it is done, rather than waiting for op to return. op then
+// runs to its end in the background, which the API timeout bounds, so its results must not be
+// used by the caller after an error of ctx. It is only for calls that read, see callToEnd.
+func callWithContext(ctx context.Context, op func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- op()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// callToEnd call op, a call to the Equinix Metal API that changes state, e.g. the request of a
+// reservation, unless ctx already is done, and wait for it to return even if ctx is done in the
+// meantime. An abandoned call would still take effect, and its result, e.g. the reservation it
+// requested, would be lost; the API timeout bounds how long it takes.
+func callToEnd(ctx context.Context, op func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return op()
+}
@@ -0,0 +1,84 @@
+package metal
+
+import (
+	"context"
+	"net"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// approved report if an address may be assigned to a service: it is within the approved CIDR, if
+// there is one. Only addresses of the same family as the approved CIDR are held to it.
+func (l *loadBalancers) approved(addr string) bool {
+	if l.approvedCIDR == nil {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	if (ip.To4() != nil) != (l.approvedCIDR.IP.To4() != nil) {
+		return true
+	}
+	return l.approvedCIDR.Contains(ip)
+}
+
+// withinApproved get the reservations whose address may be assigned, so that only those are
+// candidates for reuse
+func (l *loadBalancers) withinApproved(ips []packngo.IPAddressReservation) []packngo.IPAddressReservation {
+	if l.approvedCIDR == nil {
+		return ips
+	}
+	within := []packngo.IPAddressReservation{}
+	for _, ipr := range ips {
+		if l.approved(ipr.Address) {
+			within = append(within, ipr)
+		}
+	}
+	return within
+}
+
+// rejectUnapproved report if the address is outside the approved CIDR, and if so log it, record an
+// event on the service and publish a rejected event, so that the service is left without it. What
+// becomes of the reservation, if any, is for the caller, see releaseRejected.
+func (l *loadBalancers) rejectUnapproved(svc *v1.Service, addr string, ipr *packngo.IPAddressReservation) bool {
+	if l.approved(addr) {
+		return false
+	}
+	svcName := serviceRep(svc)
+	klog.Errorf("IP %s for service %s is outside the approved CIDR %s, not assigning it", addr, svcName, l.approvedCIDR)
+	l.serviceEvent(svc, v1.EventTypeWarning, eventReasonEIPNotApproved, "EIP %s is outside the approved CIDR %s, not assigning it", addr, l.approvedCIDR)
+	if l.events == nil {
+		return true
+	}
+	e := reservationEvent{
+		Type:    reservationEventRejected,
+		Service: svcName,
+		Address: addr,
+	}
+	if ipr != nil {
+		e.ReservationID = ipr.ID
+	}
+	l.events.emit(e)
+	return true
+}
+
+// releaseRejected release a reservation that was rejected, see rejectUnapproved, before it was
+// assigned to the service, e.g. just requested, as the API cannot be asked for an address within
+// the approved CIDR. Kept, the service would hold it, without an address, forever; released as for
+// a removed service, see releaseReservations, the next reconcile gets it another. One the service
+// shares with others is theirs as well, and is kept.
+func (l *loadBalancers) releaseRejected(ctx context.Context, svc *v1.Service, ipr *packngo.IPAddressReservation) error {
+	sharing, err := l.sharingServices(ctx, svc)
+	if err != nil {
+		return err
+	}
+	if len(sharing) > 0 {
+		klog.V(2).Infof("rejected EIP reservation %s of %s still is shared by %s, keeping it", ipr.ID, serviceRep(svc), sharing)
+		return nil
+	}
+	klog.V(2).Infof("releasing rejected EIP reservation %s of %s", ipr.ID, serviceRep(svc))
+	return l.releaseReservations(ctx, svc, []*packngo.IPAddressReservation{ipr})
+}
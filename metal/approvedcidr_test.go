@@ -0,0 +1,143 @@
+package metal
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestReconcileServicesApprovedCIDR(t *testing.T) {
+	tests := []struct {
+		name       string
+		approved   string
+		svcIP      string
+		advertised string
+		rejected   string
+	}{
+		// the fake gives out 147.75.100.x
+		{"new in range", "147.75.100.0/24", "", "147.75.100.1/32", ""},
+		{"new out of range", "10.0.0.0/8", "", "", "147.75.100."},
+		{"user in range", "147.75.0.0/16", "147.75.200.1", "147.75.200.1/32", ""},
+		{"user out of range", "147.75.100.0/24", "147.75.200.1", "", "147.75.200.1"},
+		// only addresses of the same family are held to it
+		{"other family", "2604:1380::/32", "", "147.75.100.1/32", ""},
+	}
+	for _, tt := range tests {
+		svc := testLoadBalancerService("default", "web", nil)
+		svc.Spec.LoadBalancerIP = tt.svcIP
+		ips := &fakeProjectIPs{}
+		// the address the user sets must be of the project
+		if tt.svcIP != "" {
+			ips.reservations = []packngo.IPAddressReservation{{IpAddressCommon: packngo.IpAddressCommon{ID: "user", Address: tt.svcIP, CIDR: 32}}}
+		}
+		l, lb := testGetLoadBalancers(ips, svc)
+		_, l.approvedCIDR, _ = net.ParseCIDR(tt.approved)
+		events := &recordingEventSink{}
+		l.events = events
+		recorder := record.NewFakeRecorder(10)
+		l.recorder = recorder
+		for _, step := range []string{"add", "again"} {
+			if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+				t.Fatalf("%s %s: unexpected error: %v", tt.name, step, err)
+			}
+		}
+		if tt.advertised != "" && (len(lb.services) != 1 || lb.services[tt.advertised] != "default/web") {
+			t.Errorf("%s: expected %s advertised, have %v", tt.name, tt.advertised, lb.services)
+		}
+		if tt.rejected == "" {
+			for _, e := range events.events {
+				if e.Type == reservationEventRejected {
+					t.Errorf("%s: unexpected rejected event %v", tt.name, e)
+				}
+			}
+			continue
+		}
+		if len(lb.services) != 0 {
+			t.Errorf("%s: expected nothing advertised, have %v", tt.name, lb.services)
+		}
+		var rejected int
+		for _, e := range events.events {
+			if e.Type == reservationEventRejected {
+				rejected++
+				if !strings.HasPrefix(e.Address, tt.rejected) || e.Service != "default/web" {
+					t.Errorf("%s: mismatched rejected event %v", tt.name, e)
+				}
+			}
+		}
+		if rejected == 0 {
+			t.Errorf("%s: no rejected event, have %v", tt.name, events.events)
+		}
+		reasons := testEventReasons(recorder)
+		if !strings.Contains(strings.Join(reasons, ","), eventReasonEIPNotApproved) {
+			t.Errorf("%s: no %s event on the service, have %v", tt.name, eventReasonEIPNotApproved, reasons)
+		}
+		// the service is left without it; a reservation requested for it is released, so that the
+		// next reconcile requests another, rather than the service holding it forever
+		updated, err := l.k8sclient.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("%s: unable to get service: %v", tt.name, err)
+		}
+		if tt.svcIP == "" && updated.Spec.LoadBalancerIP != "" {
+			t.Errorf("%s: unexpected loadBalancerIP %s", tt.name, updated.Spec.LoadBalancerIP)
+		}
+		expected := 0
+		if tt.svcIP == "" {
+			expected = 2
+		}
+		if len(ips.requests) != expected || len(ips.removed) != expected {
+			t.Errorf("%s: mismatched requests and removals, actual %d and %d expected %d", tt.name, len(ips.requests), len(ips.removed), expected)
+		}
+	}
+}
+
+func TestReconcileServicesApprovedCIDRReuse(t *testing.T) {
+	// a retained reservation outside the approved CIDR is not reused, so a new one is requested
+	svc := testLoadBalancerService("default", "web", nil)
+	ips := &fakeProjectIPs{reservations: []packngo.IPAddressReservation{{
+		IpAddressCommon: packngo.IpAddressCommon{
+			ID:      "retained",
+			Address: "10.1.1.1",
+			CIDR:    32,
+			Public:  true,
+			Tags:    []string{emRetainedTag, clusterTag(testClusterID)},
+		},
+	}}}
+	l, lb := testGetLoadBalancers(ips, svc)
+	l.reuseScope = ReuseScopeCluster
+	_, l.approvedCIDR, _ = net.ParseCIDR("147.75.100.0/24")
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.requests) != 1 {
+		t.Errorf("expected a new request, had %d", len(ips.requests))
+	}
+	if len(lb.services) != 1 || lb.services["147.75.100.1/32"] != "default/web" {
+		t.Errorf("expected the new reservation advertised, have %v", lb.services)
+	}
+}
+
+func TestReconcileServicesApprovedCIDRPool(t *testing.T) {
+	// a free reservation of the pool outside the approved CIDR is not drawn, only to be returned
+	svc := testLoadBalancerService("default", "web", map[string]string{annotationEIPPool: "public"})
+	ips := &fakeProjectIPs{reservations: []packngo.IPAddressReservation{
+		testPoolReservation("outside", "10.1.1.1", "public"),
+		testPoolReservation("within", "147.75.100.7", "public"),
+	}}
+	l, lb := testGetLoadBalancers(ips, svc)
+	_, l.approvedCIDR, _ = net.ParseCIDR("147.75.100.0/24")
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(lb.services) != 1 || lb.services["147.75.100.7/32"] != "default/web" {
+		t.Errorf("expected the reservation within the approved CIDR advertised, have %v", lb.services)
+	}
+	if outside := ipReservationByAllTags([]string{poolTag("public")}, ips.reservations[:1]); outside == nil || len(outside.Tags) != 2 {
+		t.Errorf("expected the reservation outside the approved CIDR left free, have %v", ips.reservations[0])
+	}
+}
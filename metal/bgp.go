@@ -32,9 +32,10 @@ type bgp struct {
 	annotationSrcIP    string
 	annotationBgpPass  string
 	nodeSelector       labels.Selector
+	dryRun             bool
 }
 
-func newBGP(client *packngo.Client, project string, localASN int, bgpPass string, annotationLocalASN, annotationPeerASNs, annotationPeerIPs, annotationSrcIP, annotationBgpPass string, nodeSelector string) *bgp {
+func newBGP(client *packngo.Client, project string, localASN int, bgpPass string, annotationLocalASN, annotationPeerASNs, annotationPeerIPs, annotationSrcIP, annotationBgpPass string, nodeSelector string, dryRun bool) *bgp {
 
 	selector := labels.Everything()
 	if nodeSelector != "" {
@@ -52,6 +53,7 @@ func newBGP(client *packngo.Client, project string, localASN int, bgpPass string
 		annotationSrcIP:    annotationSrcIP,
 		annotationBgpPass:  annotationBgpPass,
 		nodeSelector:       selector,
+		dryRun:             dryRun,
 	}
 }
 
@@ -98,14 +100,17 @@ func (b *bgp) reconcileNodes(ctx context.Context, nodes []*v1.Node, mode UpdateM
 	case ModeAdd, ModeSync:
 		for _, node := range filteredNodes {
 			klog.V(2).Infof("bgp.reconcileNodes(): add node %s", node.Name)
-			// get the node provider ID
+			// get the node provider ID; a node that just joined may not have it yet
 			id := node.Spec.ProviderID
 			if id == "" {
-				return fmt.Errorf("no provider ID given")
+				klog.Warningf("bgp.reconcileNodes(): no provider ID given for node %s, skipping until next sync", node.Name)
+				continue
 			}
 			klog.V(2).Infof("bgp.reconcileNodes(): enabling BGP on node %s", node.Name)
 			// ensure BGP is enabled for the node
-			if err := ensureNodeBGPEnabled(id, b.client); err != nil {
+			if b.dryRun {
+				klog.InfoS("dry run: would enable BGP session", "node", node.Name)
+			} else if err := ensureNodeBGPEnabled(id, b.client); err != nil {
 				klog.Errorf("could not ensure BGP enabled for node %s: %v", node.Name, err)
 			}
 			klog.V(2).Infof("bgp.reconcileNodes(): bgp enabled on node %s", node.Name)
@@ -155,7 +160,16 @@ func (b *bgp) reconcileNodes(ctx context.Context, nodes []*v1.Node, mode UpdateM
 				}
 
 				// patch the node with the new annotations
-				if len(newAnnotations) > 0 {
+				switch {
+				case len(newAnnotations) > 0 && b.dryRun:
+					// the values are not logged, as one is the BGP password
+					keys := []string{}
+					for k := range newAnnotations {
+						keys = append(keys, k)
+					}
+					sort.Strings(keys)
+					klog.InfoS("dry run: would set node annotations", "node", node.Name, "annotations", keys)
+				case len(newAnnotations) > 0:
 					mergePatch, _ := json.Marshal(map[string]interface{}{
 						"metadata": map[string]interface{}{
 							"annotations": newAnnotations,
@@ -167,7 +181,7 @@ func (b *bgp) reconcileNodes(ctx context.Context, nodes []*v1.Node, mode UpdateM
 					} else {
 						klog.V(2).Infof("bgp.reconcileNodes(): annotations set on node %s", node.Name)
 					}
-				} else {
+				default:
 					klog.V(2).Infof("bgp.reconcileNodes(): no change to annotations for %s", node.Name)
 				}
 			}
@@ -196,6 +210,10 @@ func (b *bgp) enableBGP() error {
 	}
 
 	// we did not have a valid one, so create it
+	if b.dryRun {
+		klog.InfoS("dry run: would enable BGP on project", "project", b.project, "localASN", b.localASN)
+		return nil
+	}
 	req := packngo.CreateBGPConfigRequest{
 		Asn:            b.localASN,
 		Md5:            b.bgpPass,
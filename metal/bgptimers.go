@@ -0,0 +1,64 @@
+package metal
+
+import (
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// defaultBGPHoldTime the hold time of the BGP sessions of metallb when none is set
+	defaultBGPHoldTime = 90 * time.Second
+	// minBGPHoldTime the least hold time of a BGP session, see RFC 4271
+	minBGPHoldTime = 3 * time.Second
+)
+
+// validateBGPTimers check that the hold time and keepalive of BGP peers are valid, where 0 is the
+// default of the load balancer: neither may be negative, a hold time must be at least 3s, and it
+// must be at least thrice the keepalive, else a single lost keepalive drops the session.
+func validateBGPTimers(hold, keepalive time.Duration) error {
+	switch {
+	case hold < 0:
+		return fmt.Errorf("BGP hold time must not be negative, was %s", hold)
+	case keepalive < 0:
+		return fmt.Errorf("BGP keepalive must not be negative, was %s", keepalive)
+	case hold != 0 && hold < minBGPHoldTime:
+		return fmt.Errorf("BGP hold time must be at least %s, was %s", minBGPHoldTime, hold)
+	}
+	effective := hold
+	if effective == 0 {
+		effective = defaultBGPHoldTime
+	}
+	if keepalive != 0 && effective < 3*keepalive {
+		return fmt.Errorf("BGP hold time %s must be at least 3 times the keepalive %s", effective, keepalive)
+	}
+	return nil
+}
+
+// bgpTimers get the hold time and keepalive for the peers of a node: those of its annotations,
+// else those of the config. An annotation that does not parse, or that gives timers that are not
+// valid together, see validateBGPTimers, is ignored, with an error.
+func (l *loadBalancers) bgpTimers(node *v1.Node) (time.Duration, time.Duration) {
+	hold, keepalive := l.bgpHoldTime, l.bgpKeepalive
+	annotation := func(name string, d *time.Duration) {
+		v := node.Annotations[name]
+		if name == "" || v == "" {
+			return
+		}
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			klog.Errorf("invalid %s annotation %q on node %s, must be a duration, ignoring", name, v, node.Name)
+			return
+		}
+		*d = parsed
+	}
+	annotation(l.bgpAnnotations.holdTime, &hold)
+	annotation(l.bgpAnnotations.keepalive, &keepalive)
+	if err := validateBGPTimers(hold, keepalive); err != nil {
+		klog.Errorf("invalid BGP timers of the annotations on node %s, ignoring: %v", node.Name, err)
+		return l.bgpHoldTime, l.bgpKeepalive
+	}
+	return hold, keepalive
+}
@@ -0,0 +1,55 @@
+package metal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidateBGPTimers(t *testing.T) {
+	tests := []struct {
+		hold      time.Duration
+		keepalive time.Duration
+		valid     bool
+	}{
+		{0, 0, true},
+		{30 * time.Second, 10 * time.Second, true},
+		{30 * time.Second, 0, true},
+		// against the default hold time of metallb
+		{0, 30 * time.Second, true},
+		{0, 31 * time.Second, false},
+		{30 * time.Second, 11 * time.Second, false},
+		{time.Second, 0, false},
+		{-time.Second, 0, false},
+		{0, -time.Second, false},
+	}
+	for i, tt := range tests {
+		if err := validateBGPTimers(tt.hold, tt.keepalive); (err == nil) != tt.valid {
+			t.Errorf("%d: hold %s keepalive %s: mismatched error %v, expected valid %t", i, tt.hold, tt.keepalive, err, tt.valid)
+		}
+	}
+}
+
+func TestBGPTimers(t *testing.T) {
+	l, _ := testGetLoadBalancers(&fakeProjectIPs{})
+	l.bgpAnnotations = bgpAnnotations{holdTime: DefaultAnnotationBGPHoldTime, keepalive: DefaultAnnotationBGPKeepalive}
+	l.bgpHoldTime, l.bgpKeepalive = 90*time.Second, 30*time.Second
+	tests := []struct {
+		description string
+		annotations map[string]string
+		hold        time.Duration
+		keepalive   time.Duration
+	}{
+		{"none", nil, 90 * time.Second, 30 * time.Second},
+		{"both", map[string]string{DefaultAnnotationBGPHoldTime: "9s", DefaultAnnotationBGPKeepalive: "3s"}, 9 * time.Second, 3 * time.Second},
+		{"keepalive", map[string]string{DefaultAnnotationBGPKeepalive: "10s"}, 90 * time.Second, 10 * time.Second},
+		// less than thrice the keepalive of the config
+		{"too short a hold time", map[string]string{DefaultAnnotationBGPHoldTime: "60s"}, 90 * time.Second, 30 * time.Second},
+		{"invalid", map[string]string{DefaultAnnotationBGPHoldTime: "forever"}, 90 * time.Second, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		hold, keepalive := l.bgpTimers(testBGPNode("a", tt.annotations))
+		if hold != tt.hold || keepalive != tt.keepalive {
+			t.Errorf("%s: mismatched timers, actual %s and %s expected %s and %s", tt.description, hold, keepalive, tt.hold, tt.keepalive)
+		}
+	}
+}
@@ -4,12 +4,17 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"reflect"
+	"strings"
 	"time"
 
 	"github.com/packethost/packngo"
 
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/cache"
@@ -25,8 +30,7 @@ const (
 	deprecatedProviderName string = "packet"
 
 	// ConsumerToken token for metal consumer
-	ConsumerToken         string = "cloud-provider-equinix-metal"
-	checkLoopTimerSeconds        = 60
+	ConsumerToken string = "cloud-provider-equinix-metal"
 )
 
 type nodeReconciler func(ctx context.Context, nodes []*v1.Node, mode UpdateMode) error
@@ -42,6 +46,7 @@ type cloudService interface {
 
 type cloudInstances interface {
 	cloudprovider.Instances
+	cloudprovider.InstancesV2
 	cloudService
 }
 type cloudLoadBalancers interface {
@@ -59,31 +64,56 @@ type cloud struct {
 	instances                   cloudInstances
 	zones                       cloudZones
 	loadBalancer                cloudLoadBalancers
-	facility                    string
+	reconcileTimeout            time.Duration
+	resyncPeriod                time.Duration
+	reconcileMinInterval        time.Duration
+	orphanSweepInterval         time.Duration
+	desiredConfigAddress        string
+	desiredConfigToken          string
+	reconcileErrorsURL          string
+	healthPort                  int
+	health                      *apiHealth
 	controlPlaneEndpointManager *controlPlaneEndpointManager
+	// cancelAPI aborts the calls to the Equinix Metal API in flight, on shutdown
+	cancelAPI context.CancelFunc
 	// holds our bgp service handler
 	bgp *bgp
 }
 
-func newCloud(metalConfig Config, client *packngo.Client) (cloudprovider.Interface, error) {
+func newCloud(metalConfig Config, client *packngo.Client, cancelAPI context.CancelFunc) (cloudprovider.Interface, error) {
 	i := newInstances(client, metalConfig.ProjectID, metalConfig.AnnotationNetworkIPv4Private)
+	events := newReservationEventSink(metalConfig.ReservationEventsURL)
 	return &cloud{
 		client:                      client,
-		facility:                    metalConfig.Facility,
+		reconcileTimeout:            metalConfig.ReconcileTimeout,
+		resyncPeriod:                metalConfig.ResyncPeriod,
+		reconcileMinInterval:        metalConfig.ReconcileMinInterval,
+		orphanSweepInterval:         metalConfig.OrphanSweepInterval,
+		cancelAPI:                   cancelAPI,
+		desiredConfigAddress:        metalConfig.DesiredConfigAddress,
+		desiredConfigToken:          metalConfig.DesiredConfigToken,
+		reconcileErrorsURL:          metalConfig.ReconcileErrorsURL,
+		healthPort:                  metalConfig.HealthPort,
+		health:                      newAPIHealth(client, metalConfig.ProjectID),
 		instances:                   i,
 		zones:                       newZones(client, metalConfig.ProjectID),
-		loadBalancer:                newLoadBalancers(client, metalConfig.ProjectID, metalConfig.Facility, metalConfig.LoadBalancerSetting),
-		bgp:                         newBGP(client, metalConfig.ProjectID, metalConfig.LocalASN, metalConfig.BGPPass, metalConfig.AnnotationLocalASN, metalConfig.AnnotationPeerASNs, metalConfig.AnnotationPeerIPs, metalConfig.AnnotationSrcIP, metalConfig.AnnotationBGPPass, metalConfig.BGPNodeSelector),
-		controlPlaneEndpointManager: newControlPlaneEndpointManager(metalConfig.EIPTag, metalConfig.ProjectID, client.DeviceIPs, client.ProjectIPs, i, metalConfig.APIServerPort),
+		loadBalancer:                newLoadBalancers(client, metalConfig, events),
+		bgp:                         newBGP(client, metalConfig.ProjectID, metalConfig.LocalASN, metalConfig.BGPPass, metalConfig.AnnotationLocalASN, metalConfig.AnnotationPeerASNs, metalConfig.AnnotationPeerIPs, metalConfig.AnnotationSrcIP, metalConfig.AnnotationBGPPass, metalConfig.BGPNodeSelector, metalConfig.DryRun),
+		controlPlaneEndpointManager: newControlPlaneEndpointManager(metalConfig.EIPTag, metalConfig.ProjectID, client.DeviceIPs, client.ProjectIPs, i, metalConfig.APIServerPort, metalConfig.DryRun, events),
 	}, nil
 }
 
 func InitializeProvider(metalConfig Config) error {
-	// set up our client and create the cloud interface
-	client := packngo.NewClientWithAuth("", metalConfig.AuthToken, nil)
-	client.UserAgent = fmt.Sprintf("cloud-provider-equinix-metal/%s %s", VERSION, client.UserAgent)
-	cloud, err := newCloud(metalConfig, client)
+	// set up our client and create the cloud interface; its calls in flight are aborted on shutdown
+	apiCtx, cancelAPI := context.WithCancel(context.Background())
+	client, err := newMetalClient(apiCtx, metalConfig)
+	if err != nil {
+		cancelAPI()
+		return err
+	}
+	cloud, err := newCloud(metalConfig, client, cancelAPI)
 	if err != nil {
+		cancelAPI()
 		return fmt.Errorf("failed to create new cloud handler: %v", err)
 	}
 
@@ -96,6 +126,26 @@ func InitializeProvider(metalConfig Config) error {
 	return nil
 }
 
+// newMetalClient get a client of the Equinix Metal API, at the base URL of the config if it has
+// one, e.g. a staging endpoint or a proxy, else at the standard one. Each call is aborted after
+// the API timeout of the config, and every call in flight once ctx is done.
+func newMetalClient(ctx context.Context, metalConfig Config) (*packngo.Client, error) {
+	var client *packngo.Client
+	httpClient := newAPIHTTPClient(ctx, metalConfig.APITimeout)
+	if metalConfig.BaseURL != nil {
+		// the paths of requests are relative to it, so without a trailing slash, its last element would be dropped
+		baseURL := strings.TrimSuffix(*metalConfig.BaseURL, "/") + "/"
+		var err error
+		if client, err = packngo.NewClientWithBaseURL("", metalConfig.AuthToken, httpClient, baseURL); err != nil {
+			return nil, fmt.Errorf("invalid Equinix Metal API base URL %s: %v", *metalConfig.BaseURL, err)
+		}
+	} else {
+		client = packngo.NewClientWithAuth("", metalConfig.AuthToken, httpClient)
+	}
+	client.UserAgent = fmt.Sprintf("cloud-provider-equinix-metal/%s %s", VERSION, client.UserAgent)
+	return client, nil
+}
+
 // services get those elements that are initializable
 func (c *cloud) services() []cloudService {
 	return []cloudService{c.loadBalancer, c.instances, c.zones, c.bgp, c.controlPlaneEndpointManager}
@@ -106,7 +156,15 @@ func (c *cloud) services() []cloudService {
 func (c *cloud) Initialize(clientBuilder cloudprovider.ControllerClientBuilder, stop <-chan struct{}) {
 	klog.V(5).Info("called Initialize")
 	clientset := clientBuilder.ClientOrDie("cloud-provider-equinix-metal-shared-informers")
+	// only the custom resources of metallb need a dynamic client
+	if lb, ok := c.loadBalancer.(*loadBalancers); ok && lb.metallbMode == MetalLBModeCRD {
+		lb.dynamicClient = dynamic.NewForConfigOrDie(clientBuilder.ConfigOrDie("cloud-provider-equinix-metal-metallb"))
+	}
 	sharedInformer := informers.NewSharedInformerFactory(clientset, 0)
+	// the services watcher starts the endpoints informer, and waits for it, before any reconcile
+	if lb, ok := c.loadBalancer.(*loadBalancers); ok {
+		lb.endpointsLister = sharedInformer.Core().V1().Endpoints().Lister()
+	}
 	// if we have services that want to reconcile, we will start node loop
 	nodeReconcilers := []nodeReconciler{}
 	serviceReconcilers := []serviceReconciler{}
@@ -126,23 +184,57 @@ func (c *cloud) Initialize(clientBuilder cloudprovider.ControllerClientBuilder,
 	go func() {
 		<-stop
 		cancel()
+		if c.cancelAPI != nil {
+			c.cancelAPI()
+		}
 	}()
 
-	if err := startNodesWatcher(ctx, sharedInformer, nodeReconcilers); err != nil {
+	registerMetrics()
+	errs := c.reconcileErrorSink(clientset)
+	if err := startNodesWatcher(ctx, sharedInformer, nodeReconcilers, c.reconcileMinInterval, c.reconcileTimeout, errs); err != nil {
 		klog.Errorf("nodes watcher initialization failed: %v", err)
 	}
-	if err := startServicesWatcher(ctx, sharedInformer, serviceReconcilers); err != nil {
+	if err := startServicesWatcher(ctx, sharedInformer, serviceReconcilers, c.reconcileMinInterval, c.reconcileTimeout, errs); err != nil {
 		klog.Errorf("services watcher initialization failed: %v", err)
 	}
-	go timerLoop(ctx, sharedInformer, nodeReconcilers, serviceReconcilers)
+	go timerLoop(ctx, clock.RealClock{}, sharedInformer, nodeReconcilers, serviceReconcilers, c.resyncPeriod, c.reconcileTimeout, errs)
+	if lb, ok := c.loadBalancer.(*loadBalancers); ok && lb.implementor != nil {
+		go orphansLoop(ctx, lb, c.orphanSweepInterval, c.reconcileTimeout, errs)
+	}
+	if lb, ok := c.loadBalancer.(*loadBalancers); ok && c.desiredConfigAddress != "" {
+		go serveDesiredMetalLBConfig(ctx, c.desiredConfigAddress, c.desiredConfigToken, lb, sharedInformer)
+	}
+	if c.healthPort != 0 {
+		go serveHealth(ctx, fmt.Sprintf(":%d", c.healthPort), c.health)
+	}
 	klog.V(5).Info("Initialize complete")
 }
 
+// reconcileErrorSink get the sink for reconcile errors. These are collected across clusters, so
+// each is labelled with the cluster ID, the UID of the kube-system namespace, as for reservations.
+func (c *cloud) reconcileErrorSink(clientset kubernetes.Interface) reconcileErrorSink {
+	if c.reconcileErrorsURL == "" {
+		return nopReconcileErrorSink{}
+	}
+	var clusterID string
+	systemNamespace, err := clientset.CoreV1().Namespaces().Get(context.Background(), "kube-system", metav1.GetOptions{})
+	if err != nil {
+		klog.Errorf("failed to get kube-system namespace, reconcile errors will have no cluster ID: %v", err)
+	} else {
+		clusterID = string(systemNamespace.UID)
+	}
+	return newReconcileErrorSink(c.reconcileErrorsURL, clusterID)
+}
+
 // LoadBalancer returns a balancer interface. Also returns true if the interface is supported, false otherwise.
-// TODO unimplemented
+// The reconcilers reserve and map the EIPs; through this, the service controller writes the status
+// of each service, and releases its reservations once it is deleted.
 func (c *cloud) LoadBalancer() (cloudprovider.LoadBalancer, bool) {
 	klog.V(5).Info("called LoadBalancer")
-	return nil, false
+	if c.loadBalancer == nil {
+		return nil, false
+	}
+	return c.loadBalancer, true
 }
 
 // Instances returns an instances interface. Also returns true if the interface is supported, false otherwise.
@@ -153,8 +245,8 @@ func (c *cloud) Instances() (cloudprovider.Instances, bool) {
 
 // InstancesV2 returns an implementation of cloudprovider.InstancesV2.
 func (c *cloud) InstancesV2() (cloudprovider.InstancesV2, bool) {
-	klog.Warning("The Equinix Metal cloud provider does not support InstancesV2")
-	return nil, false
+	klog.V(5).Info("called InstancesV2")
+	return c.instances, true
 }
 
 // Zones returns a zones interface. Also returns true if the interface is supported, false otherwise.
@@ -187,33 +279,43 @@ func (c *cloud) HasClusterID() bool {
 	return true
 }
 
-// startNodesWatcher start a goroutine that watches k8s for nodes and calls any handlers
-func startNodesWatcher(ctx context.Context, informer informers.SharedInformerFactory, handlers []nodeReconciler) error {
+// startNodesWatcher start a goroutine that watches k8s for nodes and calls any handlers, with the
+// events of all nodes since the last call, no more often than minInterval
+func startNodesWatcher(ctx context.Context, informer informers.SharedInformerFactory, handlers []nodeReconciler, minInterval, timeout time.Duration, errs reconcileErrorSink) error {
 	klog.V(5).Info("called startNodesWatcher")
 	if len(handlers) == 0 {
 		klog.V(5).Info("no node handlers to process")
 		return nil
 	}
 
+	queue := newReconcileQueue(clock.RealClock{}, minInterval, func(ctx context.Context, objs []interface{}, mode UpdateMode) {
+		nodes := make([]*v1.Node, 0, len(objs))
+		names := make([]string, 0, len(objs))
+		for _, obj := range objs {
+			n := obj.(*v1.Node)
+			nodes = append(nodes, n)
+			names = append(names, n.Name)
+		}
+		for _, h := range handlers {
+			if err := runReconciler(ctx, timeout, func(ctx context.Context) error { return h(ctx, nodes, mode) }); err != nil {
+				klog.Errorf("failed to update and sync nodes for %s %s for handler: %v", mode, strings.Join(names, ", "), err)
+				errs.report(mode.String()+" node", fmt.Errorf("node %s: %v", strings.Join(names, ", "), err))
+			}
+		}
+	})
+	go queue.run(ctx)
+
 	klog.V(5).Info("startNodesWatcher(): creating nodesInformer")
 	nodesInformer := informer.Core().V1().Nodes().Informer()
 	klog.V(5).Info("startNodesWatcher(): adding event handlers")
 	nodesInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			n := obj.(*v1.Node)
-			for _, h := range handlers {
-				if err := h(ctx, []*v1.Node{n}, ModeAdd); err != nil {
-					klog.Errorf("failed to update and sync node for add %s for handler: %v", n.Name, err)
-				}
-			}
+			queue.add(n.Name, n, ModeAdd)
 		},
 		DeleteFunc: func(obj interface{}) {
 			n := obj.(*v1.Node)
-			for _, h := range handlers {
-				if err := h(ctx, []*v1.Node{n}, ModeRemove); err != nil {
-					klog.Errorf("failed to update and sync node for remove %s for handler: %v", n.Name, err)
-				}
-			}
+			queue.add(n.Name, n, ModeRemove)
 		},
 	})
 
@@ -244,31 +346,72 @@ func startNodesWatcher(ctx context.Context, informer informers.SharedInformerFac
 }
 
 // startServicesWatcher start a goroutine that watches k8s for services and calls
-// any handlers
-func startServicesWatcher(ctx context.Context, informer informers.SharedInformerFactory, handlers []serviceReconciler) error {
+// any handlers, with the events of all services since the last call, no more often than
+// minInterval
+func startServicesWatcher(ctx context.Context, informer informers.SharedInformerFactory, handlers []serviceReconciler, minInterval, timeout time.Duration, errs reconcileErrorSink) error {
 	klog.V(5).Info("called startServicesWatcher")
 	if len(handlers) == 0 {
 		klog.V(5).Info("no service handlers to process")
 		return nil
 	}
 
-	// register to capture all new services
+	queue := newReconcileQueue(clock.RealClock{}, minInterval, func(ctx context.Context, objs []interface{}, mode UpdateMode) {
+		svcs := make([]*v1.Service, 0, len(objs))
+		names := make([]string, 0, len(objs))
+		for _, obj := range objs {
+			svc := obj.(*v1.Service)
+			svcs = append(svcs, svc)
+			names = append(names, svc.Namespace+"/"+svc.Name)
+		}
+		for _, h := range handlers {
+			if err := runReconciler(ctx, timeout, func(ctx context.Context) error { return h(ctx, svcs, mode) }); err != nil {
+				klog.Errorf("failed to update and sync services for %s %s: %v", mode, strings.Join(names, ", "), err)
+				errs.report(mode.String()+" service", fmt.Errorf("service %s: %v", strings.Join(names, ", "), err))
+			}
+		}
+	})
+	go queue.run(ctx)
+
+	// register to capture all new services; an update is reconciled as an add
 	servicesInformer := informer.Core().V1().Services().Informer()
 	servicesInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			svc := obj.(*v1.Service)
-			for _, h := range handlers {
-				if err := h(ctx, []*v1.Service{svc}, ModeAdd); err != nil {
-					klog.Errorf("failed to update and sync service for add %s/%s: %v", svc.Namespace, svc.Name, err)
-				}
+			queue.add(svc.Namespace+"/"+svc.Name, svc, ModeAdd)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			old, svc := oldObj.(*v1.Service), newObj.(*v1.Service)
+			// every change fires, e.g. of the status, or of annotations of other controllers
+			if !serviceChanged(old, svc) {
+				klog.V(5).Infof("service %s/%s changed in nothing we manage, not reconciling", svc.Namespace, svc.Name)
+				return
 			}
+			queue.add(svc.Namespace+"/"+svc.Name, svc, ModeAdd)
 		},
 		DeleteFunc: func(obj interface{}) {
 			svc := obj.(*v1.Service)
-			for _, h := range handlers {
-				if err := h(ctx, []*v1.Service{svc}, ModeRemove); err != nil {
-					klog.Errorf("failed to update and sync service for remove %s/%s: %v", svc.Namespace, svc.Name, err)
-				}
+			queue.add(svc.Namespace+"/"+svc.Name, svc, ModeRemove)
+		},
+	})
+	// a service of local traffic policy is advertised only from the nodes of its endpoints, so
+	// when those change, it is reconciled as an add; the endpoints of any other service do not matter
+	servicesLister := informer.Core().V1().Services().Lister()
+	endpointsChanged := func(endpoints *v1.Endpoints) {
+		svc, err := servicesLister.Services(endpoints.Namespace).Get(endpoints.Name)
+		if err != nil || svc.Spec.Type != v1.ServiceTypeLoadBalancer || !localTrafficPolicy(svc) {
+			return
+		}
+		queue.add(svc.Namespace+"/"+svc.Name, svc, ModeAdd)
+	}
+	endpointsInformer := informer.Core().V1().Endpoints().Informer()
+	endpointsInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			endpointsChanged(obj.(*v1.Endpoints))
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			old, endpoints := oldObj.(*v1.Endpoints), newObj.(*v1.Endpoints)
+			if endpointsNodesChanged(old, endpoints) {
+				endpointsChanged(endpoints)
 			}
 		},
 	})
@@ -287,8 +430,10 @@ func startServicesWatcher(ctx context.Context, informer informers.SharedInformer
 	// for a good overview of controllers and their lifecycle, see https://engineering.bitnami.com/articles/a-deep-dive-into-kubernetes-controllers.html
 	klog.V(5).Info("startServicesWatcher(): servicesInformer.Run()")
 	go servicesInformer.Run(ctx.Done())
+	go endpointsInformer.Run(ctx.Done())
 	syncFuncs := []cache.InformerSynced{
 		servicesInformer.HasSynced,
+		endpointsInformer.HasSynced,
 	}
 	klog.V(4).Infof("startServicesWatcher(): waiting for caches to sync")
 	if !cache.WaitForCacheSync(ctx.Done(), syncFuncs...) {
@@ -299,28 +444,75 @@ func startServicesWatcher(ctx context.Context, informer informers.SharedInformer
 	return nil
 }
 
-func timerLoop(ctx context.Context, informer informers.SharedInformerFactory, nodesHandlers []nodeReconciler, servicesHandlers []serviceReconciler) {
+// serviceChanged report if a service changed in anything that decides how we reconcile it: the
+// fields of the spec we read, its labels, which may be copied to tags, or any of our annotations.
+// Anything else can wait for the next sync.
+func serviceChanged(old, svc *v1.Service) bool {
+	if old.Spec.Type != svc.Spec.Type ||
+		old.Spec.LoadBalancerIP != svc.Spec.LoadBalancerIP ||
+		old.Spec.SessionAffinity != svc.Spec.SessionAffinity ||
+		old.Spec.ExternalTrafficPolicy != svc.Spec.ExternalTrafficPolicy ||
+		!reflect.DeepEqual(old.Spec.ExternalIPs, svc.Spec.ExternalIPs) ||
+		!reflect.DeepEqual(old.Spec.Selector, svc.Spec.Selector) ||
+		!reflect.DeepEqual(old.Labels, svc.Labels) {
+		return true
+	}
+	return !reflect.DeepEqual(ccmAnnotations(old), ccmAnnotations(svc))
+}
+
+// ccmAnnotations get the annotations of the object that are ours
+func ccmAnnotations(obj metav1.Object) map[string]string {
+	ret := map[string]string{}
+	for k, v := range obj.GetAnnotations() {
+		if strings.HasPrefix(k, annotationPrefix) {
+			ret[k] = v
+		}
+	}
+	return ret
+}
+
+// runReconciler run a single reconcile pass, cancelling its context if it takes longer than
+// timeout. Reconcilers stop when the context is done and leave the rest for the next pass.
+// A timeout of 0 means no limit.
+func runReconciler(ctx context.Context, timeout time.Duration, f func(ctx context.Context) error) error {
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+	return f(ctx)
+}
+
+// timerLoop sync all services and nodes every period, by the clock. The sync is with all of those
+// in the informer, so it catches up with any event that was missed, e.g. while the CCM was down: the
+// peers of nodes that no longer exist are removed, as are the reservations of deleted services. If
+// either cannot be listed, its sync is skipped until the next period, as it would remove all of them.
+func timerLoop(ctx context.Context, clk clock.Clock, informer informers.SharedInformerFactory, nodesHandlers []nodeReconciler, servicesHandlers []serviceReconciler, period, timeout time.Duration, errs reconcileErrorSink) {
 	servicesLister := informer.Core().V1().Services().Lister()
 	nodesLister := informer.Core().V1().Nodes().Lister()
 	for {
 		select {
-		case <-time.After(checkLoopTimerSeconds * time.Second):
-			servicesList, err := servicesLister.List(labels.Everything())
-			if err != nil {
-				klog.Errorf("timed reservations watcher: failed to list services: %v", err)
-			}
-			for _, h := range servicesHandlers {
-				if err := h(ctx, servicesList, ModeSync); err != nil {
-					klog.Errorf("failed to update and sync services: %v", err)
+		case <-clk.After(period):
+			if servicesList, err := servicesLister.List(labels.Everything()); err != nil {
+				klog.Errorf("timed reservations watcher: failed to list services, skipping their sync: %v", err)
+			} else {
+				for _, h := range servicesHandlers {
+					if err := runReconciler(ctx, timeout, func(ctx context.Context) error { return h(ctx, servicesList, ModeSync) }); err != nil {
+						klog.Errorf("failed to update and sync services: %v", err)
+						errs.report("sync services", err)
+					}
 				}
 			}
-			nodesList, err := nodesLister.List(labels.Everything())
-			if err != nil {
-				klog.Errorf("timed reservations watcher: failed to list nodes: %v", err)
-			}
-			for _, h := range nodesHandlers {
-				if err := h(ctx, nodesList, ModeSync); err != nil {
-					klog.Errorf("failed to update and sync nodes: %v", err)
+			if nodesList, err := nodesLister.List(labels.Everything()); err != nil {
+				klog.Errorf("timed reservations watcher: failed to list nodes, skipping their sync: %v", err)
+			} else {
+				for _, h := range nodesHandlers {
+					if err := runReconciler(ctx, timeout, func(ctx context.Context) error { return h(ctx, nodesList, ModeSync) }); err != nil {
+						klog.Errorf("failed to update and sync nodes: %v", err)
+						errs.report("sync nodes", err)
+					}
 				}
 			}
 		case <-ctx.Done():
@@ -1,15 +1,22 @@
 package metal
 
 import (
+	"context"
+	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	retryablehttp "github.com/hashicorp/go-retryablehttp"
 	emServer "github.com/packethost/packet-api-server/pkg/server"
 	"github.com/packethost/packet-api-server/pkg/store"
 	"github.com/packethost/packngo"
 
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
 	cloudprovider "k8s.io/cloud-provider"
 )
 
@@ -63,7 +70,7 @@ func testGetValidCloud(t *testing.T) (*cloud, *store.Memory) {
 	config := Config{
 		ProjectID: projectID,
 	}
-	c, _ := newCloud(config, client)
+	c, _ := newCloud(config, client, nil)
 	validCloud = c.(*cloud)
 	return validCloud, backend
 }
@@ -71,18 +78,88 @@ func testGetValidCloud(t *testing.T) (*cloud, *store.Memory) {
 func TestLoadBalancer(t *testing.T) {
 	vc, _ := testGetValidCloud(t)
 	response, supported := vc.LoadBalancer()
-	var (
-		expectedSupported = false
-		expectedResponse  cloudprovider.LoadBalancer // defaults to nil
-	)
+	expectedSupported := true
+	var expectedResponse cloudprovider.LoadBalancer = vc.loadBalancer
 	if supported != expectedSupported {
 		t.Errorf("supported returned %v instead of expected %v", supported, expectedSupported)
 	}
-	if response != expectedResponse {
+	if response == nil || response != expectedResponse {
 		t.Errorf("value returned %v instead of expected %v", response, expectedResponse)
 	}
 }
 
+func TestLoadBalancerStatus(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", nil)
+	ips := &fakeProjectIPs{}
+	l, _ := testGetLoadBalancers(ips, svc)
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// as the service controller gets it, through the cloud
+	c := &cloud{loadBalancer: l}
+	lb, ok := c.LoadBalancer()
+	if !ok {
+		t.Fatalf("load balancer not supported")
+	}
+	status, err := lb.EnsureLoadBalancer(context.Background(), "", svc, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(status.Ingress) != 1 || status.Ingress[0].IP != ips.reservations[0].Address {
+		t.Errorf("mismatched ingress, actual %v expected %s", status.Ingress, ips.reservations[0].Address)
+	}
+}
+
+func TestLoadBalancerDeleted(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", nil)
+	ips := &fakeProjectIPs{}
+	l, lb := testGetLoadBalancers(ips, svc)
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	id := ips.reservations[0].ID
+	// as the service controller deletes it, through the cloud, before any reconcile of the removal
+	c := &cloud{loadBalancer: l}
+	balancer, ok := c.LoadBalancer()
+	if !ok {
+		t.Fatalf("load balancer not supported")
+	}
+	if err := balancer.EnsureLoadBalancerDeleted(context.Background(), "", svc); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.removed) != 1 || ips.removed[0] != id {
+		t.Errorf("expected reservation %s released, removed %v", id, ips.removed)
+	}
+	if len(lb.services) != 0 {
+		t.Errorf("expected the address withdrawn, load balancer %v", lb.services)
+	}
+	if _, exists, err := balancer.GetLoadBalancer(context.Background(), "", svc); err != nil || exists {
+		t.Errorf("expected no load balancer once deleted, exists %t, error %v", exists, err)
+	}
+}
+
+func TestLoadBalancerOptedOut(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", map[string]string{annotationDisableLoadBalancer: "true"})
+	ips := &fakeProjectIPs{}
+	l, _ := testGetLoadBalancers(ips, svc)
+	c := &cloud{loadBalancer: l}
+	balancer, ok := c.LoadBalancer()
+	if !ok {
+		t.Fatalf("load balancer not supported")
+	}
+	// as the service controller ensures it, the status is left as it is, with no ingress of ours
+	status, err := balancer.EnsureLoadBalancer(context.Background(), "", svc, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(status.Ingress) != 0 {
+		t.Errorf("expected no ingress for the opted out service, had %v", status.Ingress)
+	}
+	if len(ips.requests) != 0 || len(ips.reservations) != 0 {
+		t.Errorf("expected no reservation for the opted out service, requests %v", ips.requests)
+	}
+}
+
 func TestInstances(t *testing.T) {
 	vc, _ := testGetValidCloud(t)
 	response, supported := vc.Instances()
@@ -96,6 +173,19 @@ func TestInstances(t *testing.T) {
 	}
 }
 
+func TestInstancesV2(t *testing.T) {
+	vc, _ := testGetValidCloud(t)
+	response, supported := vc.InstancesV2()
+	expectedSupported := true
+	expectedResponse := vc.instances
+	if supported != expectedSupported {
+		t.Errorf("supported returned %v instead of expected %v", supported, expectedSupported)
+	}
+	if response != expectedResponse {
+		t.Errorf("value returned %v instead of expected %v", response, expectedResponse)
+	}
+}
+
 func TestZones(t *testing.T) {
 	vc, _ := testGetValidCloud(t)
 	response, supported := vc.Zones()
@@ -159,6 +249,69 @@ func TestHasClusterID(t *testing.T) {
 
 }
 
+func TestNewMetalClient(t *testing.T) {
+	staging, noSlash := "https://staging.example.com/metal/v1/", "https://staging.example.com/metal/v1"
+	tests := []struct {
+		baseURL  *string
+		expected string
+	}{
+		{nil, "https://api.equinix.com/metal/v1/"},
+		{&staging, staging},
+		// the last element of the path is kept
+		{&noSlash, staging},
+	}
+	for i, tt := range tests {
+		client, err := newMetalClient(context.Background(), Config{AuthToken: token, BaseURL: tt.baseURL})
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+			continue
+		}
+		if actual := client.BaseURL.String(); actual != tt.expected {
+			t.Errorf("%d: mismatched base URL, actual %s expected %s", i, actual, tt.expected)
+		}
+	}
+}
+
+func TestNewMetalClientAborts(t *testing.T) {
+	// the API hangs until the request is aborted, or the test ends
+	release := make(chan struct{})
+	defer close(release)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		description string
+		timeout     time.Duration
+		cancel      bool
+	}{
+		{"API timeout", 50 * time.Millisecond, false},
+		{"shutdown", 0, true},
+	}
+	for _, tt := range tests {
+		ctx, cancel := context.WithCancel(context.Background())
+		client, err := newMetalClient(ctx, Config{AuthToken: token, BaseURL: &ts.URL, APITimeout: tt.timeout})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.description, err)
+		}
+		if tt.cancel {
+			time.AfterFunc(50*time.Millisecond, cancel)
+		}
+		start := time.Now()
+		if _, _, err := client.Projects.List(nil); err == nil {
+			t.Errorf("%s: expected an error of the hung call", tt.description)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: call returned after %s, rather than being aborted", tt.description, elapsed)
+		}
+		cancel()
+	}
+}
+
 // builds an Equinix Metal client
 func constructClient(authToken string, baseURL *string) *packngo.Client {
 	/*
@@ -178,3 +331,129 @@ func constructClient(authToken string, baseURL *string) *packngo.Client {
 	}
 	return packngo.NewClientWithAuth(ConsumerToken, authToken, client.StandardClient())
 }
+
+func TestRunReconciler(t *testing.T) {
+	tests := []struct {
+		timeout     time.Duration
+		hasDeadline bool
+	}{
+		{0, false},
+		{time.Minute, true},
+	}
+	for i, tt := range tests {
+		var passCtx context.Context
+		err := runReconciler(context.Background(), tt.timeout, func(ctx context.Context) error {
+			passCtx = ctx
+			_, ok := ctx.Deadline()
+			if ok != tt.hasDeadline {
+				t.Errorf("%d: mismatched deadline, actual %v expected %v", i, ok, tt.hasDeadline)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+		}
+		// the context of a pass always ends with the pass
+		if passCtx.Err() == nil {
+			t.Errorf("%d: context not cancelled after pass completed", i)
+		}
+	}
+
+	err := runReconciler(context.Background(), time.Millisecond, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, received %v", err)
+	}
+}
+
+func TestServiceChanged(t *testing.T) {
+	base := func() *v1.Service {
+		svc := testLoadBalancerService("default", "web", map[string]string{annotationEIPRetain: "false", "other.example.com/owner": "team-a"})
+		svc.Labels = map[string]string{"app": "web"}
+		return svc
+	}
+	tests := []struct {
+		description string
+		change      func(svc *v1.Service)
+		changed     bool
+	}{
+		{"nothing", func(svc *v1.Service) {}, false},
+		{"status", func(svc *v1.Service) {
+			svc.Status.LoadBalancer.Ingress = []v1.LoadBalancerIngress{{IP: "147.75.100.1"}}
+		}, false},
+		{"other annotation", func(svc *v1.Service) { svc.Annotations["other.example.com/owner"] = "team-b" }, false},
+		{"other annotation added", func(svc *v1.Service) { svc.Annotations["kubectl.kubernetes.io/last-applied-configuration"] = "{}" }, false},
+		{"resource version", func(svc *v1.Service) { svc.ResourceVersion = "2" }, false},
+		{"ccm annotation", func(svc *v1.Service) { svc.Annotations[annotationEIPRetain] = "true" }, true},
+		{"ccm annotation added", func(svc *v1.Service) { svc.Annotations[annotationEIPDualStack] = "true" }, true},
+		{"ccm annotation removed", func(svc *v1.Service) { delete(svc.Annotations, annotationEIPRetain) }, true},
+		{"type", func(svc *v1.Service) { svc.Spec.Type = v1.ServiceTypeClusterIP }, true},
+		{"loadBalancerIP", func(svc *v1.Service) { svc.Spec.LoadBalancerIP = "147.75.100.1" }, true},
+		{"externalIPs", func(svc *v1.Service) { svc.Spec.ExternalIPs = []string{"147.75.200.1"} }, true},
+		{"externalTrafficPolicy", func(svc *v1.Service) { svc.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyTypeLocal }, true},
+		{"labels", func(svc *v1.Service) { svc.Labels["cost-center"] = "42" }, true},
+	}
+	for i, tt := range tests {
+		old, svc := base(), base()
+		tt.change(svc)
+		if changed := serviceChanged(old, svc); changed != tt.changed {
+			t.Errorf("%d: %s: mismatched changed, actual %t expected %t", i, tt.description, changed, tt.changed)
+		}
+	}
+}
+
+func TestServicesWatcherUpdates(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	svc := testLoadBalancerService("default", "web", nil)
+	client := fake.NewSimpleClientset(svc)
+	informer := informers.NewSharedInformerFactory(client, 0)
+	calls := make(chan *v1.Service, 10)
+	recording := func(ctx context.Context, svcs []*v1.Service, mode UpdateMode) error {
+		if mode == ModeAdd {
+			calls <- svcs[0]
+		}
+		return nil
+	}
+	if err := startServicesWatcher(ctx, informer, []serviceReconciler{recording}, 0, 0, nopReconcileErrorSink{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	next := func(step string) *v1.Service {
+		select {
+		case svc := <-calls:
+			return svc
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out waiting for reconcile", step)
+		}
+		return nil
+	}
+	none := func(step string) {
+		select {
+		case svc := <-calls:
+			t.Errorf("%s: unexpected reconcile of %v", step, svc.Annotations)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+	update := func(step string, annotations map[string]string) {
+		current, err := client.CoreV1().Services("default").Get(ctx, "web", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("%s: unable to get service: %v", step, err)
+		}
+		current.Annotations = annotations
+		if _, err := client.CoreV1().Services("default").Update(ctx, current, metav1.UpdateOptions{}); err != nil {
+			t.Fatalf("%s: unable to update service: %v", step, err)
+		}
+	}
+	next("add")
+
+	update("irrelevant", map[string]string{"other.example.com/owner": "team-a"})
+	none("irrelevant")
+
+	update("relevant", map[string]string{"other.example.com/owner": "team-a", annotationEIPDualStack: "true"})
+	if reconciled := next("relevant"); reconciled.Annotations[annotationEIPDualStack] != "true" {
+		t.Errorf("reconciled with stale annotations %v", reconciled.Annotations)
+	}
+	none("after relevant")
+}
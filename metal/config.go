@@ -1,25 +1,81 @@
 package metal
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
 
 // Config configuration for a provider, includes authentication token, project ID ID, and optional override URL to talk to a different Equinix Metal API endpoint
 type Config struct {
-	AuthToken                    string  `json:"apiKey"`
-	ProjectID                    string  `json:"projectId"`
-	BaseURL                      *string `json:"base-url,omitempty"`
-	LoadBalancerSetting          string  `json:"loadbalancer"`
-	Facility                     string  `json:"facility,omitempty"`
-	LocalASN                     int     `json:"localASN,omitempty"`
-	BGPPass                      string  `json:"bgpPass,omitempty"`
-	AnnotationLocalASN           string  `json:"annotationLocalASN,omitEmpty"`
-	AnnotationPeerASNs           string  `json:"annotationPeerASNs,omitEmpty"`
-	AnnotationPeerIPs            string  `json:"annotationPeerIPs,omitEmpty"`
-	AnnotationSrcIP              string  `json:"annotationSrcIP,omitEmpty"`
-	AnnotationBGPPass            string  `json:"annotationBGPPass,omitEmpty"`
-	AnnotationNetworkIPv4Private string  `json:"annotationNetworkIPv4Private,omitEmpty"`
-	EIPTag                       string  `json:"eipTag,omitEmpty"`
-	APIServerPort                int32   `json:"apiServerPort,omitEmpty"`
-	BGPNodeSelector              string  `json:"bgpNodeSelector,omitEmpty"`
+	AuthToken                    string        `json:"apiKey"`
+	ProjectID                    string        `json:"projectId"`
+	BaseURL                      *string       `json:"base-url,omitempty"`
+	LoadBalancerSetting          string        `json:"loadbalancer"`
+	Facility                     string        `json:"facility,omitempty"`
+	LocalASN                     int           `json:"localASN,omitempty"`
+	BGPPass                      string        `json:"bgpPass,omitempty"`
+	BGPHoldTime                  time.Duration `json:"-"`
+	BGPKeepalive                 time.Duration `json:"-"`
+	AnnotationLocalASN           string        `json:"annotationLocalASN,omitEmpty"`
+	AnnotationPeerASNs           string        `json:"annotationPeerASNs,omitEmpty"`
+	AnnotationPeerIPs            string        `json:"annotationPeerIPs,omitEmpty"`
+	AnnotationSrcIP              string        `json:"annotationSrcIP,omitEmpty"`
+	AnnotationBGPPass            string        `json:"annotationBGPPass,omitEmpty"`
+	AnnotationBGPHoldTime        string        `json:"annotationBGPHoldTime,omitempty"`
+	AnnotationBGPKeepalive       string        `json:"annotationBGPKeepalive,omitempty"`
+	AnnotationNetworkIPv4Private string        `json:"annotationNetworkIPv4Private,omitEmpty"`
+	EIPTag                       string        `json:"eipTag,omitEmpty"`
+	APIServerPort                int32         `json:"apiServerPort,omitEmpty"`
+	BGPNodeSelector              string        `json:"bgpNodeSelector,omitEmpty"`
+	ReservationEventsURL         string        `json:"reservationEventsURL,omitempty"`
+	ReservationCIDR              int           `json:"reservationCIDR,omitempty"`
+	DefaultEIPBlockSize          int           `json:"defaultEIPBlockSize,omitempty"`
+	ReservationReuseScope        string        `json:"reservationReuseScope,omitempty"`
+	ManageExternalIPs            bool          `json:"manageExternalIPs,omitempty"`
+	ReservationLabelTags         []string      `json:"reservationLabelTags,omitempty"`
+	EIPAdditionalTags            []string      `json:"eipAdditionalTags,omitempty"`
+	EIPDescriptionTemplate       string        `json:"eipDescriptionTemplate,omitempty"`
+	EIPPoolPriority              []string      `json:"eipPoolPriority,omitempty"`
+	FacilitySelection            string        `json:"facilitySelection,omitempty"`
+	FacilityCandidates           []string      `json:"facilityCandidates,omitempty"`
+	WarnDuplicateSelectors       bool          `json:"warnDuplicateSelectors,omitempty"`
+	CheckManageable              bool          `json:"checkManageable,omitempty"`
+	DegradedReconcile            bool          `json:"degradedReconcile,omitempty"`
+	WaitForIPApproval            bool          `json:"waitForIPApproval,omitempty"`
+	DesiredConfigAddress         string        `json:"desiredConfigAddress,omitempty"`
+	DesiredConfigToken           string        `json:"desiredConfigToken,omitempty"`
+	ReconcileErrorsURL           string        `json:"reconcileErrorsURL,omitempty"`
+	MetricsGranularity           string        `json:"metricsGranularity,omitempty"`
+	StandbyFacility              string        `json:"standbyFacility,omitempty"`
+	PeerCacheTTL                 time.Duration `json:"-"`
+	IPCacheTTL                   time.Duration `json:"-"`
+	ReservationApprovedCIDR      string        `json:"reservationApprovedCIDR,omitempty"`
+	HoldWithoutReadyNodes        bool          `json:"holdWithoutReadyNodes,omitempty"`
+	WithdrawBGPOnCordon          bool          `json:"withdrawBGPOnCordon,omitempty"`
+	WithdrawBGPTaint             string        `json:"withdrawBGPTaint,omitempty"`
+	LeaderElectionResourceName   string        `json:"leaderElectionResourceName,omitempty"`
+	LeaderElectionNamespace      string        `json:"leaderElectionNamespace,omitempty"`
+	ReconcileTimeout             time.Duration `json:"-"`
+	ResyncPeriod                 time.Duration `json:"-"`
+	ReconcileMinInterval         time.Duration `json:"-"`
+	APIRetryCount                int           `json:"apiRetryCount,omitempty"`
+	APIRetryBaseDelay            time.Duration `json:"-"`
+	APITimeout                   time.Duration `json:"-"`
+	OrphanSweepInterval          time.Duration `json:"-"`
+	LoadBalancerClass            string        `json:"loadBalancerClass,omitempty"`
+	ExcludedNamespaces           []string      `json:"excludedNamespaces,omitempty"`
+	MetalLBMode                  string        `json:"metalLBMode,omitempty"`
+	CreateMetalLBConfigMap       bool          `json:"createMetalLBConfigMap,omitempty"`
+	DryRun                       bool          `json:"dryRun,omitempty"`
+	WriteServiceLoadBalancerIP   bool          `json:"writeServiceLoadBalancerIP"`
+	HealthPort                   int           `json:"healthPort,omitempty"`
 }
 
 // String converts the Config structure to a string, while masking hidden fields.
@@ -33,6 +89,9 @@ func (c Config) Strings() []string {
 		ret = append(ret, "authToken: ''")
 	}
 	ret = append(ret, fmt.Sprintf("projectID: '%s'", c.ProjectID))
+	if c.BaseURL != nil {
+		ret = append(ret, fmt.Sprintf("API base URL: '%s'", *c.BaseURL))
+	}
 	if c.LoadBalancerSetting == "" {
 		ret = append(ret, "loadbalancer config: disabled")
 	} else {
@@ -40,9 +99,187 @@ func (c Config) Strings() []string {
 	}
 	ret = append(ret, fmt.Sprintf("facility: '%s'", c.Facility))
 	ret = append(ret, fmt.Sprintf("local ASN: '%d'", c.LocalASN))
+	ret = append(ret, fmt.Sprintf("BGP hold time: '%s'", c.BGPHoldTime))
+	ret = append(ret, fmt.Sprintf("BGP keepalive: '%s'", c.BGPKeepalive))
 	ret = append(ret, fmt.Sprintf("Elastic IP Tag: '%s'", c.EIPTag))
 	ret = append(ret, fmt.Sprintf("API Server Port: '%d'", c.APIServerPort))
 	ret = append(ret, fmt.Sprintf("BGP Node Selector: '%s'", c.BGPNodeSelector))
+	ret = append(ret, fmt.Sprintf("reservation events URL: '%s'", c.ReservationEventsURL))
+	ret = append(ret, fmt.Sprintf("reservation CIDR: '/%d'", c.ReservationCIDR))
+	ret = append(ret, fmt.Sprintf("default EIP block size: '/%d'", c.DefaultEIPBlockSize))
+	ret = append(ret, fmt.Sprintf("reservation reuse scope: '%s'", c.ReservationReuseScope))
+	ret = append(ret, fmt.Sprintf("manage external IPs: '%t'", c.ManageExternalIPs))
+	ret = append(ret, fmt.Sprintf("reservation label tags: '%s'", strings.Join(c.ReservationLabelTags, ",")))
+	ret = append(ret, fmt.Sprintf("EIP additional tags: '%s'", strings.Join(c.EIPAdditionalTags, ",")))
+	ret = append(ret, fmt.Sprintf("EIP description template: '%s'", c.EIPDescriptionTemplate))
+	ret = append(ret, fmt.Sprintf("EIP pool priority: '%s'", strings.Join(c.EIPPoolPriority, ",")))
+	ret = append(ret, fmt.Sprintf("facility selection: '%s'", c.FacilitySelection))
+	ret = append(ret, fmt.Sprintf("facility candidates: '%s'", strings.Join(c.FacilityCandidates, ",")))
+	ret = append(ret, fmt.Sprintf("warn duplicate selectors: '%t'", c.WarnDuplicateSelectors))
+	ret = append(ret, fmt.Sprintf("check manageable: '%t'", c.CheckManageable))
+	ret = append(ret, fmt.Sprintf("degraded reconcile: '%t'", c.DegradedReconcile))
+	ret = append(ret, fmt.Sprintf("wait for IP approval: '%t'", c.WaitForIPApproval))
+	ret = append(ret, fmt.Sprintf("desired config address: '%s'", c.DesiredConfigAddress))
+	if c.DesiredConfigToken != "" {
+		ret = append(ret, "desired config token: '<masked>'")
+	} else {
+		ret = append(ret, "desired config token: ''")
+	}
+	ret = append(ret, fmt.Sprintf("reconcile errors URL: '%s'", c.ReconcileErrorsURL))
+	ret = append(ret, fmt.Sprintf("metrics granularity: '%s'", c.MetricsGranularity))
+	ret = append(ret, fmt.Sprintf("standby facility: '%s'", c.StandbyFacility))
+	ret = append(ret, fmt.Sprintf("peer cache TTL: '%s'", c.PeerCacheTTL))
+	ret = append(ret, fmt.Sprintf("IP cache TTL: '%s'", c.IPCacheTTL))
+	ret = append(ret, fmt.Sprintf("reservation approved CIDR: '%s'", c.ReservationApprovedCIDR))
+	ret = append(ret, fmt.Sprintf("hold without ready nodes: '%t'", c.HoldWithoutReadyNodes))
+	ret = append(ret, fmt.Sprintf("withdraw BGP on cordon: '%t'", c.WithdrawBGPOnCordon))
+	ret = append(ret, fmt.Sprintf("withdraw BGP taint: '%s'", c.WithdrawBGPTaint))
+	ret = append(ret, fmt.Sprintf("leader election resource name: '%s'", c.LeaderElectionResourceName))
+	ret = append(ret, fmt.Sprintf("leader election namespace: '%s'", c.LeaderElectionNamespace))
+	ret = append(ret, fmt.Sprintf("reconcile timeout: '%s'", c.ReconcileTimeout))
+	ret = append(ret, fmt.Sprintf("resync period: '%s'", c.ResyncPeriod))
+	ret = append(ret, fmt.Sprintf("reconcile min interval: '%s'", c.ReconcileMinInterval))
+	ret = append(ret, fmt.Sprintf("API retry count: '%d'", c.APIRetryCount))
+	ret = append(ret, fmt.Sprintf("API retry base delay: '%s'", c.APIRetryBaseDelay))
+	ret = append(ret, fmt.Sprintf("API timeout: '%s'", c.APITimeout))
+	ret = append(ret, fmt.Sprintf("orphan sweep interval: '%s'", c.OrphanSweepInterval))
+	ret = append(ret, fmt.Sprintf("load balancer class: '%s'", c.LoadBalancerClass))
+	ret = append(ret, fmt.Sprintf("excluded namespaces: '%s'", strings.Join(c.ExcludedNamespaces, ",")))
+	ret = append(ret, fmt.Sprintf("metallb mode: '%s'", c.MetalLBMode))
+	ret = append(ret, fmt.Sprintf("create metallb configmap: '%t'", c.CreateMetalLBConfigMap))
+	ret = append(ret, fmt.Sprintf("dry run: '%t'", c.DryRun))
+	ret = append(ret, fmt.Sprintf("write service loadBalancerIP: '%t'", c.WriteServiceLoadBalancerIP))
+	ret = append(ret, fmt.Sprintf("health port: '%d'", c.HealthPort))
 
 	return ret
 }
+
+// Validate check the whole configuration, as it is used, i.e. with the defaults applied, and return
+// every problem found together rather than only the first, so that a broken config is fixed in one
+// go. It does not depend on how the config was loaded, so it can check one from anywhere.
+func (c Config) Validate() error {
+	var errs []error
+	if c.AuthToken == "" {
+		errs = append(errs, errors.New("auth token is required"))
+	}
+	if c.ProjectID == "" {
+		errs = append(errs, errors.New("project ID is required"))
+	}
+	if c.Facility == "" {
+		errs = append(errs, errors.New("facility is required"))
+	}
+	if c.WithdrawBGPTaint != "" && !c.WithdrawBGPOnCordon {
+		errs = append(errs, fmt.Errorf("withdraw BGP taint %s is used only to withdraw BGP on cordon, which is not enabled", c.WithdrawBGPTaint))
+	}
+	if c.BaseURL != nil {
+		if u, err := url.Parse(*c.BaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("API base URL must be an absolute URL, e.g. https://api.equinix.com/metal/v1/, was %q", *c.BaseURL))
+		}
+	}
+	if _, _, err := ParseLoadBalancerSetting(c.LoadBalancerSetting); err != nil {
+		errs = append(errs, err)
+	}
+	if c.LocalASN <= 0 || int64(c.LocalASN) > 4294967295 {
+		errs = append(errs, fmt.Errorf("local ASN must be between 1 and 4294967295, was %d", c.LocalASN))
+	}
+	if err := validateBGPTimers(c.BGPHoldTime, c.BGPKeepalive); err != nil {
+		errs = append(errs, err)
+	}
+	if c.APIServerPort < 0 || c.APIServerPort > 65535 {
+		errs = append(errs, fmt.Errorf("API server port must be between 0 and 65535, was %d", c.APIServerPort))
+	}
+	if _, err := labels.Parse(c.BGPNodeSelector); err != nil {
+		errs = append(errs, fmt.Errorf("BGP Node Selector must be valid Kubernetes selector: %w", err))
+	}
+	if c.ReservationCIDR < MinReservationCIDR || c.ReservationCIDR > 32 {
+		errs = append(errs, fmt.Errorf("reservation CIDR must be between /%d and /32, was /%d", MinReservationCIDR, c.ReservationCIDR))
+	}
+	if c.DefaultEIPBlockSize != 0 && (c.DefaultEIPBlockSize < MinReservationCIDR || c.DefaultEIPBlockSize > 32) {
+		errs = append(errs, fmt.Errorf("default EIP block size must be 0, or between /%d and /32, was /%d", MinReservationCIDR, c.DefaultEIPBlockSize))
+	}
+	switch c.ReservationReuseScope {
+	case ReuseScopeService, ReuseScopeCluster, ReuseScopeProject:
+	default:
+		errs = append(errs, fmt.Errorf("reservation reuse scope must be one of %s, %s or %s, was %s", ReuseScopeService, ReuseScopeCluster, ReuseScopeProject, c.ReservationReuseScope))
+	}
+	switch c.FacilitySelection {
+	case FacilitySelectionFixed, FacilitySelectionEndpoints:
+	case FacilitySelectionLeastUtilized, FacilitySelectionRoundRobin:
+		if len(c.FacilityCandidates) == 0 {
+			errs = append(errs, fmt.Errorf("facility selection %s requires at least one facility candidate", c.FacilitySelection))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("facility selection must be one of %s, %s, %s or %s, was %s", FacilitySelectionFixed, FacilitySelectionLeastUtilized, FacilitySelectionRoundRobin, FacilitySelectionEndpoints, c.FacilitySelection))
+	}
+	switch c.MetricsGranularity {
+	case MetricsGranularityAggregate, MetricsGranularityPerObject:
+	default:
+		errs = append(errs, fmt.Errorf("metrics granularity must be one of %s or %s, was %s", MetricsGranularityAggregate, MetricsGranularityPerObject, c.MetricsGranularity))
+	}
+	if c.StandbyFacility != "" && c.StandbyFacility == c.Facility {
+		errs = append(errs, fmt.Errorf("standby facility must differ from the facility %s", c.Facility))
+	}
+	if c.ReservationApprovedCIDR != "" {
+		if _, _, err := net.ParseCIDR(c.ReservationApprovedCIDR); err != nil {
+			errs = append(errs, fmt.Errorf("reservation approved CIDR must be a CIDR, e.g. 147.75.0.0/16, was %s: %v", c.ReservationApprovedCIDR, err))
+		}
+	}
+	if c.DesiredConfigAddress != "" {
+		if host, _, err := net.SplitHostPort(c.DesiredConfigAddress); err != nil {
+			errs = append(errs, fmt.Errorf("desired config address must be host:port, e.g. :8080, was %s: %v", c.DesiredConfigAddress, err))
+		} else if host != "" && !isLoopbackHost(host) && c.DesiredConfigToken == "" {
+			errs = append(errs, fmt.Errorf("desired config address %s is not on localhost, which requires a desired config token", c.DesiredConfigAddress))
+		}
+	}
+	if c.PeerCacheTTL < 0 {
+		errs = append(errs, fmt.Errorf("peer cache TTL must not be negative, was %s", c.PeerCacheTTL))
+	}
+	if c.IPCacheTTL < 0 {
+		errs = append(errs, fmt.Errorf("IP cache TTL must not be negative, was %s", c.IPCacheTTL))
+	}
+	if c.ReconcileTimeout < 0 {
+		errs = append(errs, fmt.Errorf("reconcile timeout must not be negative, was %s", c.ReconcileTimeout))
+	}
+	if c.ResyncPeriod <= 0 {
+		errs = append(errs, fmt.Errorf("resync period must be positive, was %s", c.ResyncPeriod))
+	}
+	if c.ReconcileMinInterval < 0 {
+		errs = append(errs, fmt.Errorf("reconcile min interval must not be negative, was %s", c.ReconcileMinInterval))
+	}
+	switch c.MetalLBMode {
+	case MetalLBModeConfigMap, MetalLBModeCRD:
+	default:
+		errs = append(errs, fmt.Errorf("metallb mode must be one of %s or %s, was %s", MetalLBModeConfigMap, MetalLBModeCRD, c.MetalLBMode))
+	}
+	if c.LoadBalancerClass == "" {
+		errs = append(errs, errors.New("load balancer class is required"))
+	}
+	if c.APIRetryCount < 0 {
+		errs = append(errs, fmt.Errorf("API retry count must not be negative, was %d", c.APIRetryCount))
+	}
+	if c.APIRetryBaseDelay < 0 {
+		errs = append(errs, fmt.Errorf("API retry base delay must not be negative, was %s", c.APIRetryBaseDelay))
+	}
+	if c.APITimeout < 0 {
+		errs = append(errs, fmt.Errorf("API timeout must not be negative, was %s", c.APITimeout))
+	}
+	if c.OrphanSweepInterval < 0 {
+		errs = append(errs, fmt.Errorf("orphan sweep interval must not be negative, was %s", c.OrphanSweepInterval))
+	}
+	for _, tag := range c.EIPAdditionalTags {
+		if managedTag(tag) {
+			errs = append(errs, fmt.Errorf("EIP additional tag %s is of a key that the CCM manages", tag))
+		}
+	}
+	pools := map[string]bool{}
+	for _, pool := range c.EIPPoolPriority {
+		if pools[pool] {
+			errs = append(errs, fmt.Errorf("EIP pool priority lists pool %s more than once", pool))
+		}
+		pools[pool] = true
+	}
+	if c.HealthPort < 0 || c.HealthPort > 65535 {
+		errs = append(errs, fmt.Errorf("health port must be between 0 and 65535, was %d", c.HealthPort))
+	}
+	return utilerrors.NewAggregate(errs)
+}
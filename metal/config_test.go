@@ -0,0 +1,125 @@
+package metal
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func testValidConfig() Config {
+	return Config{
+		AuthToken:             "token",
+		ProjectID:             "project",
+		LoadBalancerSetting:   "metallb:///metallb-system/config",
+		Facility:              testFacility,
+		LocalASN:              DefaultLocalASN,
+		BGPNodeSelector:       "role=bgp",
+		ReservationCIDR:       DefaultReservationCIDR,
+		ReservationReuseScope: ReuseScopeService,
+		FacilitySelection:     FacilitySelectionFixed,
+		MetricsGranularity:    MetricsGranularityAggregate,
+		LoadBalancerClass:     DefaultLoadBalancerClass,
+		MetalLBMode:           MetalLBModeConfigMap,
+		ResyncPeriod:          DefaultResyncPeriod,
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *Config)
+		err    string
+	}{
+		{"valid", func(c *Config) {}, ""},
+		{"valid with options", func(c *Config) {
+			c.LoadBalancerSetting = ""
+			c.FacilitySelection = FacilitySelectionRoundRobin
+			c.FacilityCandidates = []string{"ewr1", "ams1"}
+			c.StandbyFacility = "ams1"
+			c.ReservationApprovedCIDR = "147.75.0.0/16"
+			c.PeerCacheTTL = time.Minute
+			c.IPCacheTTL = time.Minute
+			c.DefaultEIPBlockSize = 29
+			c.EIPAdditionalTags = []string{"env=prod", "owner"}
+			c.EIPPoolPriority = []string{"reserved", "fallback"}
+			c.ExcludedNamespaces = []string{"tenant-a", "tenant-b"}
+			c.WithdrawBGPOnCordon = true
+			c.WithdrawBGPTaint = "maintenance.example.com/bgp"
+			c.BGPHoldTime = 30 * time.Second
+			c.BGPKeepalive = 10 * time.Second
+		}, ""},
+		{"desired config on localhost", func(c *Config) { c.DesiredConfigAddress = "127.0.0.1:8080" }, ""},
+		{"desired config with token", func(c *Config) {
+			c.DesiredConfigAddress = "0.0.0.0:8080"
+			c.DesiredConfigToken = "s3cret"
+		}, ""},
+		{"desired config address", func(c *Config) { c.DesiredConfigAddress = "8080" }, "desired config address"},
+		{"desired config without token", func(c *Config) { c.DesiredConfigAddress = "0.0.0.0:8080" }, "requires a desired config token"},
+		{"auth token", func(c *Config) { c.AuthToken = "" }, "auth token is required"},
+		{"project", func(c *Config) { c.ProjectID = "" }, "project ID is required"},
+		{"facility", func(c *Config) { c.Facility = "" }, "facility is required"},
+		{"load balancer", func(c *Config) { c.LoadBalancerSetting = "metallb-system:config" }, "metallb-system:config"},
+		{"local ASN", func(c *Config) { c.LocalASN = 0 }, "local ASN"},
+		{"API server port", func(c *Config) { c.APIServerPort = 70000 }, "API server port"},
+		{"BGP hold time", func(c *Config) { c.BGPHoldTime = time.Second }, "BGP hold time must be at least"},
+		{"BGP keepalive", func(c *Config) { c.BGPKeepalive = -time.Second }, "BGP keepalive must not be negative"},
+		{"BGP timers", func(c *Config) { c.BGPHoldTime, c.BGPKeepalive = 30*time.Second, 15*time.Second }, "at least 3 times the keepalive"},
+		// against the default hold time of metallb
+		{"BGP keepalive of default hold time", func(c *Config) { c.BGPKeepalive = 40 * time.Second }, "at least 3 times the keepalive"},
+		{"BGP node selector", func(c *Config) { c.BGPNodeSelector = "role in (" }, "BGP Node Selector"},
+		{"reservation CIDR", func(c *Config) { c.ReservationCIDR = 33 }, "reservation CIDR"},
+		{"default EIP block size", func(c *Config) { c.DefaultEIPBlockSize = 24 }, "default EIP block size"},
+		{"reuse scope", func(c *Config) { c.ReservationReuseScope = "everywhere" }, "reservation reuse scope"},
+		{"endpoints facility selection", func(c *Config) { c.FacilitySelection = FacilitySelectionEndpoints }, ""},
+		{"facility selection", func(c *Config) { c.FacilitySelection = "random" }, "facility selection must be one of"},
+		{"facility candidates", func(c *Config) { c.FacilitySelection = FacilitySelectionLeastUtilized }, "requires at least one facility candidate"},
+		{"metrics granularity", func(c *Config) { c.MetricsGranularity = "fine" }, "metrics granularity"},
+		{"standby facility", func(c *Config) { c.StandbyFacility = testFacility }, "standby facility"},
+		{"approved CIDR", func(c *Config) { c.ReservationApprovedCIDR = "147.75.0.0" }, "reservation approved CIDR"},
+		{"peer cache TTL", func(c *Config) { c.PeerCacheTTL = -time.Second }, "peer cache TTL"},
+		{"IP cache TTL", func(c *Config) { c.IPCacheTTL = -time.Second }, "IP cache TTL"},
+		{"reconcile timeout", func(c *Config) { c.ReconcileTimeout = -time.Second }, "reconcile timeout"},
+		{"resync period", func(c *Config) { c.ResyncPeriod = 0 }, "resync period"},
+		{"reconcile min interval", func(c *Config) { c.ReconcileMinInterval = -time.Second }, "reconcile min interval"},
+		{"metallb mode", func(c *Config) { c.MetalLBMode = "yaml" }, "metallb mode"},
+		{"load balancer class", func(c *Config) { c.LoadBalancerClass = "" }, "load balancer class"},
+		{"API retry count", func(c *Config) { c.APIRetryCount = -1 }, "API retry count"},
+		{"API retry base delay", func(c *Config) { c.APIRetryBaseDelay = -time.Second }, "API retry base delay"},
+		{"API timeout", func(c *Config) { c.APITimeout = -time.Second }, "API timeout"},
+		{"orphan sweep interval", func(c *Config) { c.OrphanSweepInterval = -time.Second }, "orphan sweep interval"},
+		{"EIP additional tags", func(c *Config) { c.EIPAdditionalTags = []string{"env=prod", "cluster=other"} }, "EIP additional tag cluster=other"},
+		{"EIP pool priority", func(c *Config) { c.EIPPoolPriority = []string{"reserved", "fallback", "reserved"} }, "EIP pool priority"},
+		{"withdraw BGP taint", func(c *Config) { c.WithdrawBGPTaint = "maintenance.example.com/bgp" }, "withdraw BGP taint"},
+		{"API base URL", func(c *Config) { u := "api.equinix.com/metal/v1"; c.BaseURL = &u }, "API base URL"},
+	}
+	for _, tt := range tests {
+		c := testValidConfig()
+		tt.modify(&c)
+		err := c.Validate()
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		case tt.err != "" && err == nil:
+			t.Errorf("%s: expected an error, had none", tt.name)
+		case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+			t.Errorf("%s: mismatched error, actual %q expected to contain %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestConfigValidateAll(t *testing.T) {
+	// every problem is reported, not just the first
+	c := testValidConfig()
+	c.AuthToken = ""
+	c.ReservationCIDR = 8
+	c.MetricsGranularity = "fine"
+	err := c.Validate()
+	if err == nil {
+		t.Fatal("expected an error, had none")
+	}
+	for _, s := range []string{"auth token", "reservation CIDR", "metrics granularity"} {
+		if !strings.Contains(err.Error(), s) {
+			t.Errorf("error %q does not report %s", err, s)
+		}
+	}
+}
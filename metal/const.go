@@ -7,3 +7,15 @@ const (
 	ModeRemove
 	ModeSync
 )
+
+func (m UpdateMode) String() string {
+	switch m {
+	case ModeAdd:
+		return "add"
+	case ModeRemove:
+		return "remove"
+	case ModeSync:
+		return "sync"
+	}
+	return "unknown"
+}
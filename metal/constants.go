@@ -5,13 +5,45 @@ const (
 	hostnameKey                         = "kubernetes.io/hostname"
 	emIdentifier                        = "cloud-provider-equinix-metal-auto"
 	emTag                               = "usage=" + emIdentifier
+	emRetainedIdentifier                = "cloud-provider-equinix-metal-retained"
+	emRetainedTag                       = "usage=" + emRetainedIdentifier
 	ccmIPDescription                    = "Equinix Metal Kubernetes CCM auto-generated for Load Balancer"
+	annotationPrefix                    = "metal.equinix.com/"
 	DefaultAnnotationNodeASN            = "metal.equinix.com/node-asn"
 	DefaultAnnotationPeerASNs           = "metal.equinix.com/peer-asn"
 	DefaultAnnotationPeerIPs            = "metal.equinix.com/peer-ip"
 	DefaultAnnotationSrcIP              = "metal.equinix.com/src-ip"
 	DefaultAnnotationBGPPass            = "metal.equinix.com/bgp-pass"
+	DefaultAnnotationBGPHoldTime        = "metal.equinix.com/bgp-hold-time"
+	DefaultAnnotationBGPKeepalive       = "metal.equinix.com/bgp-keepalive"
 	DefaultAnnotationNetworkIPv4Private = "metal.equinix.com/network/4/private"
+	annotationEIPRetain                 = "metal.equinix.com/eip-retain"
+	annotationEIPDualStack              = "metal.equinix.com/eip-dual-stack"
+	annotationEIPAllocateOnly           = "metal.equinix.com/eip-allocate-only"
+	annotationEIPAdvertisePrefix        = "metal.equinix.com/eip-advertise-prefix"
+	annotationLoadBalancerClass         = "metal.equinix.com/load-balancer-class"
+	annotationDisableLoadBalancer       = "metal.equinix.com/disable-load-balancer"
+	annotationEIPTags                   = "metal.equinix.com/eip-tags"
+	annotationEIPHostname               = "metal.equinix.com/eip-hostname"
+	annotationEIPWaitForApproval        = "metal.equinix.com/eip-wait-for-approval"
+	annotationEIPReservationID          = "metal.equinix.com/eip-reservation-id"
+	annotationNodeInternalIP            = "metal.equinix.com/node-internal-ip"
+	annotationNodeExternalIP            = "metal.equinix.com/node-external-ip"
+	ipv4FamilyTag                       = "family=ipv4"
+	ipv6FamilyTag                       = "family=ipv6"
+	labelTagPrefix                      = "label:"
 	DefaultLocalASN                     = 65000
 	DefaultPeerASN                      = 65530
+	DefaultReservationCIDR              = 32
+	ReuseScopeService                   = "service"
+	ReuseScopeCluster                   = "cluster"
+	ReuseScopeProject                   = "project"
+	LoadBalancerKubeVIP                 = "kube-vip"
+	LoadBalancerMetalLB                 = "metallb"
+	LoadBalancerEmpty                   = "empty"
+	DefaultLoadBalancerClass            = "metal.equinix.com/metallb"
+	MetalLBModeConfigMap                = "configmap"
+	MetalLBModeCRD                      = "crd"
+	// MinReservationCIDR the largest block, i.e. smallest prefix, that can be reserved without approval
+	MinReservationCIDR = 28
 )
@@ -0,0 +1,89 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// cacheReservations keep the reservations as listed, for a degraded reconcile when they cannot be listed
+func (l *loadBalancers) cacheReservations(ips []packngo.IPAddressReservation) {
+	l.cachedIPsLock.Lock()
+	defer l.cachedIPsLock.Unlock()
+	l.cachedIPs = append([]packngo.IPAddressReservation{}, ips...)
+}
+
+// cachedReservations get the reservations as last listed, and whether they ever were
+func (l *loadBalancers) cachedReservations() ([]packngo.IPAddressReservation, bool) {
+	l.cachedIPsLock.Lock()
+	defer l.cachedIPsLock.Unlock()
+	if l.cachedIPs == nil {
+		return nil, false
+	}
+	return append([]packngo.IPAddressReservation{}, l.cachedIPs...), true
+}
+
+// degradedReconcileServices reconcile services against the last known reservations, when the API
+// cannot list them. Only the implementation is changed, so that what is advertised stays correct:
+// known addresses are mapped, and those of removed services withdrawn. Nothing is reserved or
+// released; a service without an address waits, and the reservations of removed services are
+// released by the first sync once the API is back. The cause is returned, wrapped, once done,
+// so that the reconcile still counts as failed.
+func (l *loadBalancers) degradedReconcileServices(ctx context.Context, svcs []*v1.Service, ips []packngo.IPAddressReservation, mode UpdateMode, cause error) error {
+	klog.Warningf("loadbalancer.reconcileServices(): %v: degraded, using cached IP reservations: %v", mode, cause)
+	switch mode {
+	case ModeAdd, ModeSync:
+		validIPs := map[string]bool{}
+		for _, svc := range svcs {
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("degraded reconcile of services stopped, remaining services deferred to next pass: %w", err)
+			}
+			if err := l.degradedAddService(ctx, svc, ips, validIPs); err != nil {
+				return err
+			}
+		}
+		if mode == ModeSync {
+			if err := l.implementor.SyncServices(ctx, validIPs); err != nil {
+				return err
+			}
+		}
+	case ModeRemove:
+		for _, svc := range svcs {
+			if err := l.degradedRemoveService(ctx, svc, ips); err != nil {
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("reconciled from cached IP reservations, reservation changes deferred: %w", cause)
+}
+
+// degradedAddService map the known addresses of a single service, adding each to validIPs
+func (l *loadBalancers) degradedAddService(ctx context.Context, svc *v1.Service, ips []packngo.IPAddressReservation, validIPs map[string]bool) error {
+	defer l.serviceLocks.lock(serviceIdentity(svc))()
+	addrs := l.serviceAddresses([]*v1.Service{svc}, ips)
+	if len(addrs) == 0 && !allocateOnly(svc) {
+		klog.V(2).Infof("loadbalancer.reconcileServices(): degraded: no known address for %s, deferred", serviceRep(svc))
+	}
+	for cidr, name := range addrs {
+		if err := l.implementor.AddService(ctx, name, cidr, l.serviceOptions(ctx, svc)); err != nil {
+			return err
+		}
+		validIPs[cidr] = true
+	}
+	return nil
+}
+
+// degradedRemoveService withdraw the known addresses of a single service, keeping its reservations
+func (l *loadBalancers) degradedRemoveService(ctx context.Context, svc *v1.Service, ips []packngo.IPAddressReservation) error {
+	defer l.serviceLocks.lock(serviceIdentity(svc))()
+	for cidr := range l.serviceAddresses([]*v1.Service{svc}, ips) {
+		klog.V(2).Infof("loadbalancer.reconcileServices(): degraded: remove: for %s entry %s, reservation release deferred", serviceRep(svc), cidr)
+		if err := l.implementor.RemoveService(ctx, cidr); err != nil {
+			return fmt.Errorf("error removing IP from configmap for %s: %v", serviceRep(svc), err)
+		}
+	}
+	return nil
+}
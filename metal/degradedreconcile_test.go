@@ -0,0 +1,85 @@
+package metal
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDegradedReconcileServices(t *testing.T) {
+	web := testLoadBalancerService("default", "web", nil)
+	added := testLoadBalancerService("default", "added", nil)
+	ips := &fakeProjectIPs{}
+	l, lb := testGetLoadBalancers(ips, web, added)
+	l.degradedReconcile = true
+	outage := errors.New("service unavailable")
+
+	// with nothing cached, there is nothing to fall back on
+	ips.listErr = outage
+	if err := l.reconcileServices(context.Background(), []*v1.Service{web}, ModeAdd); err == nil {
+		t.Fatal("expected an error with no cached reservations")
+	}
+	if len(lb.services) != 0 || len(ips.requests) != 0 {
+		t.Fatalf("reconciled with no cached reservations: %d requests, load balancer %v", len(ips.requests), lb.services)
+	}
+
+	ips.listErr = nil
+	if err := l.reconcileServices(context.Background(), []*v1.Service{web}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	web, _ = l.k8sclient.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+	// the reservations are cached as listed, so it is known as of the next pass
+	if err := l.reconcileServices(context.Background(), []*v1.Service{web}, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]string{"147.75.100.1/32": "default/web"}
+
+	// in an outage, a sync restores the known mapping, but reserves nothing for a new service
+	ips.listErr = outage
+	lb.services = map[string]string{"147.75.200.1/32": "default/stale"}
+	err := l.reconcileServices(context.Background(), []*v1.Service{web, added}, ModeSync)
+	if !errors.Is(err, outage) {
+		t.Errorf("expected the outage reported, received %v", err)
+	}
+	if !reflect.DeepEqual(lb.services, expected) {
+		t.Errorf("mismatched degraded sync, actual %v expected %v", lb.services, expected)
+	}
+	if len(ips.requests) != 1 {
+		t.Errorf("degraded sync requested a reservation, %d requests", len(ips.requests))
+	}
+
+	// removal withdraws the address, but releases nothing
+	if err := l.reconcileServices(context.Background(), []*v1.Service{web}, ModeRemove); !errors.Is(err, outage) {
+		t.Errorf("expected the outage reported, received %v", err)
+	}
+	if len(lb.services) != 0 {
+		t.Errorf("expected address withdrawn, have %v", lb.services)
+	}
+	if len(ips.removed) != 0 {
+		t.Errorf("degraded removal released reservations %v", ips.removed)
+	}
+
+	// once the API is back, the first sync catches up
+	ips.listErr = nil
+	if err := l.reconcileServices(context.Background(), []*v1.Service{}, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.removed) != 1 {
+		t.Errorf("expected the reservation of the removed service released, removed %v", ips.removed)
+	}
+
+	// without degraded reconciles, an outage changes nothing
+	l.degradedReconcile = false
+	ips.listErr = outage
+	lb.services = map[string]string{}
+	if err := l.reconcileServices(context.Background(), []*v1.Service{web}, ModeAdd); err == nil {
+		t.Error("expected an error")
+	}
+	if len(lb.services) != 0 {
+		t.Errorf("mapped without degraded reconciles, have %v", lb.services)
+	}
+}
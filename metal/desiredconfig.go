@@ -0,0 +1,158 @@
+package metal
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers"
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers/metallb"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	desiredMetalLBConfigPath = "/metallb/desired"
+)
+
+var errNotMetalLB = errors.New("loadbalancer implementation is not metallb")
+
+// desiredMetalLBConfig get the full metallb config that the CCM would write, given the nodes and
+// services of the informers and the reservations of the project, without applying it. The peers
+// and reservations are those last looked up, see peerCache.last and reservationCache.last, so
+// that a request asks the API only for what was never looked up.
+func (l *loadBalancers) desiredMetalLBConfig(ctx context.Context, nodeLister corelisters.NodeLister, serviceLister corelisters.ServiceLister) (*metallb.ConfigFile, error) {
+	impl, ok := l.implementor.(*metallb.LB)
+	if !ok {
+		return nil, errNotMetalLB
+	}
+
+	nodeList, err := nodeLister.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("unable to list nodes: %v", err)
+	}
+	nodes := map[string]loadbalancers.Node{}
+	for _, node := range nodeList {
+		if node.Spec.ProviderID == "" {
+			klog.V(2).Infof("desiredMetalLBConfig(): no provider ID given for node %s, skipping", node.Name)
+			continue
+		}
+		peer, ok := l.peers.last(node)
+		if !ok {
+			peer, err = l.peers.get(node)
+		}
+		if err != nil || peer == nil {
+			klog.Errorf("desiredMetalLBConfig(): could not get node peer address for node %s: %v", node.Name, err)
+			continue
+		}
+		nodes[node.Name] = l.bgpNode(node, peer)
+	}
+
+	svcs, err := serviceLister.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("unable to list services: %v", err)
+	}
+	ips, err := l.lastReservations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve IP reservations for project %s: %v", l.project, err)
+	}
+
+	svcs = loadBalancerServices(svcs, l.class, l.excludedNS)
+	ips, _ = withCurrentServiceTags(svcs, ips)
+	return impl.DesiredConfig(ctx, nodes, l.serviceAddresses(svcs, ips))
+}
+
+// desiredMetalLBConfigHandler serve the desired metallb config as yaml, in the same format as
+// the configmap, so that it can be diffed against what is committed. The passwords of the peers
+// are redacted, see metallb.RedactedPassword.
+func desiredMetalLBConfigHandler(l *loadBalancers, nodeLister corelisters.NodeLister, serviceLister corelisters.ServiceLister) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		config, err := l.desiredMetalLBConfig(r.Context(), nodeLister, serviceLister)
+		switch {
+		case err == errNotMetalLB:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			klog.Errorf("desiredMetalLBConfigHandler(): %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b, err := config.Redacted().Bytes()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("unable to convert config to yaml: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		_, _ = w.Write(b)
+	}
+}
+
+// requireBearerToken wrap a handler so that it serves only the requests that have the token as
+// their bearer token. Without a token, every request is served, as then it listens only on
+// localhost, see desiredConfigListenAddress.
+func requireBearerToken(token string, h http.Handler) http.Handler {
+	if token == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// desiredConfigListenAddress get the address to serve the desired config on. Without a token, an
+// address without a host, e.g. :8080, is on localhost only, as whatever reaches it can read the
+// config; one with a host that is not localhost then is rejected, see Config.Validate.
+func desiredConfigListenAddress(addr, token string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host != "" || token != "" {
+		return addr
+	}
+	return net.JoinHostPort("localhost", port)
+}
+
+// isLoopbackHost report if the host of an address is localhost, by name or loopback IP
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// serveDesiredMetalLBConfig serve the desired metallb config, and the mapping of reservations to
+// services, on the given address until the context is done, listing the nodes and services from
+// the informers. With a token, each request must have it as its bearer token.
+func serveDesiredMetalLBConfig(ctx context.Context, addr, token string, l *loadBalancers, informer informers.SharedInformerFactory) {
+	nodeLister := informer.Core().V1().Nodes().Lister()
+	serviceLister := informer.Core().V1().Services().Lister()
+	addr = desiredConfigListenAddress(addr, token)
+	mux := http.NewServeMux()
+	mux.Handle(desiredMetalLBConfigPath, requireBearerToken(token, desiredMetalLBConfigHandler(l, nodeLister, serviceLister)))
+	mux.Handle(eipMappingPath, requireBearerToken(token, eipMappingHandler(l, serviceLister)))
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	klog.Infof("serving desired metallb config on %s%s, and EIP mapping on %s%s", addr, desiredMetalLBConfigPath, addr, eipMappingPath)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		klog.Errorf("desired metallb config server failed: %v", err)
+	}
+}
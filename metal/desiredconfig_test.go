@@ -0,0 +1,144 @@
+package metal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers/metallb"
+	"github.com/packethost/packngo"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// testListers the node and service listers of informers of the cluster of the loadbalancers,
+// synced, and stopped at the end of the test
+func testListers(t *testing.T, l *loadBalancers) (corelisters.NodeLister, corelisters.ServiceLister) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	factory := informers.NewSharedInformerFactory(l.k8sclient, 0)
+	nodeLister := factory.Core().V1().Nodes().Lister()
+	serviceLister := factory.Core().V1().Services().Lister()
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+	return nodeLister, serviceLister
+}
+
+func TestDesiredMetalLBConfigHandler(t *testing.T) {
+	web := testLoadBalancerService("default", "web", nil)
+	web.Spec.LoadBalancerIP = "147.75.100.1"
+	unmanaged := testLoadBalancerService("default", "unmanaged", nil)
+	unmanaged.Spec.LoadBalancerIP = "147.75.200.1"
+	ips := &fakeProjectIPs{
+		reservations: []packngo.IPAddressReservation{
+			{IpAddressCommon: packngo.IpAddressCommon{ID: "web", Address: "147.75.100.1", CIDR: 32, Tags: []string{emTag, serviceTag(web), clusterTag(testClusterID)}}},
+		},
+	}
+	nodes := []*v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-a"}, Spec: v1.NodeSpec{ProviderID: "equinixmetal://device-a"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "no-provider"}},
+	}
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "metallb-system"},
+		Data:       map[string]string{"config": ""},
+	}
+	l, _ := testGetLoadBalancers(ips, web, unmanaged, nodes[0], nodes[1], cm)
+	devices := &fakeDevices{neighbors: map[string][]packngo.BGPNeighbor{
+		"device-a": {{AddressFamily: 4, CustomerAs: 65000, CustomerIP: "10.0.0.1", PeerAs: 65530, PeerIps: []string{"169.254.255.1", "169.254.255.2"}, Md5Password: "md5-secret"}},
+	}}
+	l.client.Devices = devices
+	nodeLister, serviceLister := testListers(t, l)
+	handler := desiredMetalLBConfigHandler(l, nodeLister, serviceLister)
+
+	// not metallb
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, desiredMetalLBConfigPath, nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("mismatched status for non-metallb implementation, actual %d expected %d", rec.Code, http.StatusNotFound)
+	}
+
+	l.implementor = metallb.NewLB(l.k8sclient, "")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, desiredMetalLBConfigPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("mismatched status, actual %d expected %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	body := rec.Body.String()
+	for _, s := range []string{"147.75.100.1/32", "default/web", "169.254.255.1", "169.254.255.2", "node-a", metallb.RedactedPassword} {
+		if !strings.Contains(body, s) {
+			t.Errorf("desired config missing %s: %s", s, body)
+		}
+	}
+	for _, s := range []string{"147.75.200.1", "no-provider", "md5-secret"} {
+		if strings.Contains(body, s) {
+			t.Errorf("desired config unexpectedly has %s: %s", s, body)
+		}
+	}
+
+	// served again from what was looked up, without asking the API
+	lists, neighborCalls := ips.lists, devices.neighborCalls
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, desiredMetalLBConfigPath, nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != body {
+		t.Errorf("mismatched second config, status %d: %s", rec.Code, rec.Body.String())
+	}
+	if ips.lists != lists || devices.neighborCalls != neighborCalls {
+		t.Errorf("expected no API calls for the second request, had %d lists and %d neighbour lookups", ips.lists-lists, devices.neighborCalls-neighborCalls)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, desiredMetalLBConfigPath, nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("mismatched status for POST, actual %d expected %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
+
+func TestRequireBearerToken(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		token  string
+		header string
+		status int
+	}{
+		{"", "", http.StatusOK},
+		{"s3cret", "Bearer s3cret", http.StatusOK},
+		{"s3cret", "", http.StatusUnauthorized},
+		{"s3cret", "Bearer other", http.StatusUnauthorized},
+		{"s3cret", "s3cret", http.StatusUnauthorized},
+		{"s3cret", "Basic s3cret", http.StatusUnauthorized},
+	}
+	for i, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, desiredMetalLBConfigPath, nil)
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		rec := httptest.NewRecorder()
+		requireBearerToken(tt.token, ok).ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%d: mismatched status for token %q and header %q, actual %d expected %d", i, tt.token, tt.header, rec.Code, tt.status)
+		}
+	}
+}
+
+func TestDesiredConfigListenAddress(t *testing.T) {
+	tests := []struct {
+		addr     string
+		token    string
+		expected string
+	}{
+		{":8080", "", "localhost:8080"},
+		{":8080", "s3cret", ":8080"},
+		{"127.0.0.1:8080", "", "127.0.0.1:8080"},
+		{"10.0.0.1:8080", "s3cret", "10.0.0.1:8080"},
+	}
+	for _, tt := range tests {
+		if addr := desiredConfigListenAddress(tt.addr, tt.token); addr != tt.expected {
+			t.Errorf("%s with token %q: mismatched address, actual %s expected %s", tt.addr, tt.token, addr, tt.expected)
+		}
+	}
+}
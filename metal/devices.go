@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"strings"
 
 	"github.com/packethost/packngo"
@@ -11,6 +12,7 @@ import (
 	"github.com/pkg/errors"
 
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	cloudprovider "k8s.io/cloud-provider"
@@ -46,14 +48,14 @@ func (i *instances) serviceReconciler() serviceReconciler {
 // cloudprovider.Instances interface implementation
 
 // NodeAddresses returns the addresses of the specified instance.
-func (i *instances) NodeAddresses(_ context.Context, name types.NodeName) ([]v1.NodeAddress, error) {
+func (i *instances) NodeAddresses(ctx context.Context, name types.NodeName) ([]v1.NodeAddress, error) {
 	klog.V(2).Infof("called NodeAddresses with node name %s", name)
 	device, err := deviceByName(i.client, i.project, name)
 	if err != nil {
 		return nil, err
 	}
 
-	return nodeAddresses(device)
+	return nodeAddresses(device, i.nodeByName(ctx, string(name)))
 }
 
 // NodeAddressesByProviderID returns the addresses of the specified instance.
@@ -68,27 +70,55 @@ func (i *instances) NodeAddressesByProviderID(_ context.Context, providerID stri
 		return nil, err
 	}
 
-	return nodeAddresses(device)
+	// the node is not known by its provider ID, so has no overrides
+	return nodeAddresses(device, nil)
 }
 
-func nodeAddresses(device *packngo.Device) ([]v1.NodeAddress, error) {
+// nodeAddresses get the addresses of the device: its hostname, and all of its IPv4 and IPv6
+// addresses, the private ones, e.g. of the 10.x management network, as InternalIP and the public
+// ones as ExternalIP. Management addresses come first, so that those of the device itself are
+// preferred over any elastic IP assigned to it. If the node has an override annotation for either
+// type, its address is reported instead of those of the device, e.g. for a node that is managed
+// through an address that Equinix Metal does not know of.
+func nodeAddresses(device *packngo.Device, node *v1.Node) ([]v1.NodeAddress, error) {
 	var addresses []v1.NodeAddress
 	addresses = append(addresses, v1.NodeAddress{Type: v1.NodeHostName, Address: device.Hostname})
 
+	internalIP := nodeAddressOverride(node, annotationNodeInternalIP)
+	externalIP := nodeAddressOverride(node, annotationNodeExternalIP)
 	var privateIP, publicIP string
-	for _, address := range device.Network {
-		if address.AddressFamily == int(metadata.IPv4) {
+	for _, management := range []bool{true, false} {
+		for _, address := range device.Network {
+			if address.Management != management {
+				continue
+			}
+			if address.AddressFamily != int(metadata.IPv4) && address.AddressFamily != int(metadata.IPv6) {
+				continue
+			}
 			var addrType v1.NodeAddressType
-			if address.Public {
+			switch {
+			case address.Public && externalIP != "":
+				continue
+			case address.Public:
 				publicIP = address.Address
 				addrType = v1.NodeExternalIP
-			} else {
+			case internalIP != "":
+				continue
+			default:
 				privateIP = address.Address
 				addrType = v1.NodeInternalIP
 			}
 			addresses = append(addresses, v1.NodeAddress{Type: addrType, Address: address.Address})
 		}
 	}
+	if internalIP != "" {
+		privateIP = internalIP
+		addresses = append(addresses, v1.NodeAddress{Type: v1.NodeInternalIP, Address: internalIP})
+	}
+	if externalIP != "" {
+		publicIP = externalIP
+		addresses = append(addresses, v1.NodeAddress{Type: v1.NodeExternalIP, Address: externalIP})
+	}
 
 	if privateIP == "" {
 		return nil, errors.New("could not get at least one private ip")
@@ -101,6 +131,38 @@ func nodeAddresses(device *packngo.Device) ([]v1.NodeAddress, error) {
 	return addresses, nil
 }
 
+// nodeAddressOverride get the address that the annotation of the node gives, or "" if the node has
+// none, or if it is not an IP address
+func nodeAddressOverride(node *v1.Node, annotation string) string {
+	if node == nil {
+		return ""
+	}
+	value, ok := node.Annotations[annotation]
+	if !ok {
+		return ""
+	}
+	ip := net.ParseIP(strings.TrimSpace(value))
+	if ip == nil {
+		klog.Warningf("invalid %s %q on node %s, not an IP address, using the addresses of the device", annotation, value, node.Name)
+		return ""
+	}
+	return ip.String()
+}
+
+// nodeByName get the node of the given name, for its annotations, or nil if it cannot be had, e.g.
+// before the CCM is initialized, or as the node is not registered yet
+func (i *instances) nodeByName(ctx context.Context, name string) *v1.Node {
+	if i.k8sclient == nil {
+		return nil
+	}
+	node, err := i.k8sclient.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		klog.V(2).Infof("unable to get node %s for its address overrides: %v", name, err)
+		return nil
+	}
+	return node
+}
+
 // InstanceID returns the cloud provider ID of the node with the specified NodeName.
 // Note that if the instance does not exist or is no longer running, we must return ("", cloudprovider.InstanceNotFound)
 func (i *instances) InstanceID(_ context.Context, nodeName types.NodeName) (string, error) {
@@ -134,7 +196,7 @@ func (i *instances) InstanceType(_ context.Context, nodeName types.NodeName) (st
 		return "", err
 	}
 
-	return device.Plan.Name, nil
+	return instanceType(device), nil
 }
 
 // InstanceTypeByProviderID returns the type of the specified instance.
@@ -145,7 +207,17 @@ func (i *instances) InstanceTypeByProviderID(_ context.Context, providerID strin
 		return "", err
 	}
 
-	return device.Plan.Name, nil
+	return instanceType(device), nil
+}
+
+// instanceType get the instance type of the device, for the node.kubernetes.io/instance-type
+// label: the slug of its plan, e.g. c3.small.x86, or "" if it has no plan yet, e.g. as it still
+// is provisioning
+func instanceType(device *packngo.Device) string {
+	if device.Plan == nil {
+		return ""
+	}
+	return device.Plan.Slug
 }
 
 // AddSSHKeyToAllInstances adds an SSH public key as a legal identity for all instances
@@ -185,7 +257,76 @@ func (i *instances) InstanceShutdownByProviderID(_ context.Context, providerID s
 		return false, err
 	}
 
-	return device.State == "inactive", nil
+	return deviceShutdown(device), nil
+}
+
+// cloudprovider.InstancesV2 interface implementation
+
+// InstanceExists returns true if the device of the node still exists. If false is returned with
+// no error, the node is deleted by the cloud controller manager.
+func (i *instances) InstanceExists(_ context.Context, node *v1.Node) (bool, error) {
+	klog.V(2).Infof("called InstanceExists with node %s", node.Name)
+	_, err := i.deviceFromNode(node)
+	switch {
+	case err == cloudprovider.InstanceNotFound:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	return true, nil
+}
+
+// InstanceShutdown returns true if the device of the node is shut down, or shutting down, so that
+// workloads are moved off it. A device that no longer exists is an error, which leaves it to
+// InstanceExists.
+func (i *instances) InstanceShutdown(_ context.Context, node *v1.Node) (bool, error) {
+	klog.V(2).Infof("called InstanceShutdown with node %s", node.Name)
+	device, err := i.deviceFromNode(node)
+	if err != nil {
+		return false, err
+	}
+
+	return deviceShutdown(device), nil
+}
+
+// deviceShutdown report if the device is powered off, or powering off, e.g. for maintenance
+func deviceShutdown(device *packngo.Device) bool {
+	switch device.State {
+	case "inactive", "powering_off":
+		return true
+	}
+	return false
+}
+
+// InstanceMetadata returns the provider ID, type and addresses of the device of the node, with one
+// lookup of the device. The zone and region are not part of the metadata in this version of the
+// interface; Zones provides them, from the facility of the device.
+func (i *instances) InstanceMetadata(_ context.Context, node *v1.Node) (*cloudprovider.InstanceMetadata, error) {
+	klog.V(2).Infof("called InstanceMetadata with node %s", node.Name)
+	device, err := i.deviceFromNode(node)
+	if err != nil {
+		return nil, err
+	}
+	addresses, err := nodeAddresses(device, node)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cloudprovider.InstanceMetadata{
+		ProviderID:    fmt.Sprintf("%s://%s", providerName, device.ID),
+		InstanceType:  instanceType(device),
+		NodeAddresses: addresses,
+	}, nil
+}
+
+// deviceFromNode get the device of a node, by its provider ID, or by its name if a node that just
+// registered has none yet
+func (i *instances) deviceFromNode(node *v1.Node) (*packngo.Device, error) {
+	if node.Spec.ProviderID != "" {
+		return i.deviceFromProviderID(node.Spec.ProviderID)
+	}
+	return deviceByName(i.client, i.project, types.NodeName(node.Name))
 }
 
 func deviceByID(client *packngo.Client, id string) (*packngo.Device, error) {
@@ -269,10 +410,11 @@ func (i *instances) reconcileNodes(ctx context.Context, nodes []*v1.Node, mode U
 	case ModeAdd, ModeSync:
 		for _, node := range nodes {
 			klog.V(2).Infof("instances.reconcileNodes(): add node %s", node.Name)
-			// get the node provider ID
+			// get the node provider ID; a node that just joined may not have it yet
 			id := node.Spec.ProviderID
 			if id == "" {
-				return fmt.Errorf("no provider ID given")
+				klog.Warningf("instances.reconcileNodes(): no provider ID given for node %s, skipping until next sync", node.Name)
+				continue
 			}
 
 			// add annotations
@@ -7,6 +7,7 @@ import (
 
 	"github.com/packethost/packngo"
 	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	cloudprovider "k8s.io/cloud-provider"
 )
@@ -34,6 +35,7 @@ func TestNodeAddresses(t *testing.T) {
 		{Type: v1.NodeHostName, Address: devName},
 		{Type: v1.NodeInternalIP, Address: networks[0].Address},
 		{Type: v1.NodeExternalIP, Address: networks[1].Address},
+		{Type: v1.NodeExternalIP, Address: networks[2].Address},
 	}
 
 	tests := []struct {
@@ -79,6 +81,7 @@ func TestNodeAddressesByProviderID(t *testing.T) {
 		{Type: v1.NodeHostName, Address: devName},
 		{Type: v1.NodeInternalIP, Address: networks[0].Address},
 		{Type: v1.NodeExternalIP, Address: networks[1].Address},
+		{Type: v1.NodeExternalIP, Address: networks[2].Address},
 	}
 
 	tests := []struct {
@@ -141,7 +144,8 @@ func TestInstanceType(t *testing.T) {
 	devName := testGetNewDevName()
 	facility, _ := testGetOrCreateValidRegion(validRegionName, validRegionCode, backend)
 	plan, _ := testGetOrCreateValidPlan(validPlanName, validPlanSlug, backend)
-	dev, _ := backend.CreateDevice(projectID, devName, plan, facility)
+	backend.CreateDevice(projectID, devName, plan, facility)
+	noPlan := testNoPlanDevice(t)
 
 	tests := []struct {
 		name string
@@ -150,7 +154,8 @@ func TestInstanceType(t *testing.T) {
 	}{
 		{"", "", fmt.Errorf("node name cannot be empty")},          // empty name
 		{"thisdoesnotexist", "", fmt.Errorf("instance not found")}, // unknown name
-		{devName, dev.Plan.Name, nil},                              // valid
+		{devName, validPlanSlug, nil},                              // valid
+		{noPlan.Hostname, "", nil},                                 // still provisioning
 	}
 
 	for i, tt := range tests {
@@ -171,6 +176,7 @@ func TestInstanceTypeByProviderID(t *testing.T) {
 	facility, _ := testGetOrCreateValidRegion(validRegionName, validRegionCode, backend)
 	plan, _ := testGetOrCreateValidPlan(validPlanName, validPlanSlug, backend)
 	dev, _ := backend.CreateDevice(projectID, devName, plan, facility)
+	noPlan := testNoPlanDevice(t)
 
 	tests := []struct {
 		id   string
@@ -181,8 +187,9 @@ func TestInstanceTypeByProviderID(t *testing.T) {
 		{"foo-bar-abcdefg", "", fmt.Errorf("instance not found")},                                    // invalid format
 		{"aws://abcdef5667", "", fmt.Errorf("provider name from providerID should be equinixmetal")}, // not equinixmetalk
 		{"equinixmetal://acbdef-56788", "", fmt.Errorf("instance not found")},                        // unknown ID
-		{fmt.Sprintf("equinixmetal://%s", dev.ID), dev.Plan.Name, nil},                               // valid
-		{fmt.Sprintf("packet://%s", dev.ID), dev.Plan.Name, nil},                                     // valid
+		{fmt.Sprintf("equinixmetal://%s", dev.ID), validPlanSlug, nil},                               // valid
+		{fmt.Sprintf("packet://%s", dev.ID), validPlanSlug, nil},                                     // valid
+		{fmt.Sprintf("equinixmetal://%s", noPlan.ID), "", nil},                                       // still provisioning
 	}
 
 	for i, tt := range tests {
@@ -196,6 +203,23 @@ func TestInstanceTypeByProviderID(t *testing.T) {
 	}
 }
 
+// testNoPlanDevice create a device without a plan, as one may be while it is provisioning, named
+// after the test so that it does not collide with the devices of others
+func testNoPlanDevice(t *testing.T) *packngo.Device {
+	_, backend := testGetValidCloud(t)
+	facility, _ := testGetOrCreateValidRegion(validRegionName, validRegionCode, backend)
+	plan, _ := testGetOrCreateValidPlan(validPlanName, validPlanSlug, backend)
+	dev, err := backend.CreateDevice(projectID, "noplan-"+strings.ToLower(t.Name()), plan, facility)
+	if err != nil {
+		t.Fatalf("unable to create device: %v", err)
+	}
+	dev.Plan = nil
+	if err := backend.UpdateDevice(dev.ID, dev); err != nil {
+		t.Fatalf("unable to update device: %v", err)
+	}
+	return dev
+}
+
 func TestAddSSHKeyToAllInstances(t *testing.T) {
 	vc, _ := testGetValidCloud(t)
 	inst, _ := vc.Instances()
@@ -297,6 +321,236 @@ func TestInstanceShutdownByProviderID(t *testing.T) {
 	}
 }
 
+func TestInstanceShutdown(t *testing.T) {
+	vc, backend := testGetValidCloud(t)
+	inst, _ := vc.InstancesV2()
+	facility, _ := testGetOrCreateValidRegion(validRegionName, validRegionCode, backend)
+	plan, _ := testGetOrCreateValidPlan(validPlanName, validPlanSlug, backend)
+	device := func(state string) string {
+		dev, _ := backend.CreateDevice(projectID, testGetNewDevName(), plan, facility)
+		if state != "" {
+			dev.State = state
+			if err := backend.UpdateDevice(dev.ID, dev); err != nil {
+				t.Fatalf("unable to update %s device: %v", state, err)
+			}
+		}
+		return dev.ID
+	}
+
+	tests := []struct {
+		description string
+		id          string
+		down        bool
+		err         bool
+	}{
+		{"active", device("active"), false, false},
+		{"inactive", device("inactive"), true, false},
+		{"powering off", device("powering_off"), true, false},
+		{"provisioning", device("provisioning"), false, false},
+		{"missing", "acbdef-56788", false, true},
+	}
+
+	for _, tt := range tests {
+		node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: tt.description}, Spec: v1.NodeSpec{ProviderID: fmt.Sprintf("equinixmetal://%s", tt.id)}}
+		down, err := inst.InstanceShutdown(nil, node)
+		switch {
+		case (err != nil) != tt.err:
+			t.Errorf("%s: mismatched error, actual %v expected %t", tt.description, err, tt.err)
+		case down != tt.down:
+			t.Errorf("%s: mismatched down, actual %v expected %v", tt.description, down, tt.down)
+		}
+	}
+}
+
+func TestInstancesV2Node(t *testing.T) {
+	vc, backend := testGetValidCloud(t)
+	inst, _ := vc.InstancesV2()
+	devName := testGetNewDevName()
+	facility, _ := testGetOrCreateValidRegion(validRegionName, validRegionCode, backend)
+	plan, _ := testGetOrCreateValidPlan(validPlanName, validPlanSlug, backend)
+	devActive, _ := backend.CreateDevice(projectID, devName, plan, facility)
+	devActive.Network = []*packngo.IPAddressAssignment{
+		testCreateAddress(false, false), // private ipv4
+		testCreateAddress(false, true),  // public ipv4
+	}
+	if err := backend.UpdateDevice(devActive.ID, devActive); err != nil {
+		t.Fatalf("unable to update active device: %v", err)
+	}
+	devInactive, _ := backend.CreateDevice(projectID, testGetNewDevName(), plan, facility)
+	devInactive.State = "inactive"
+	if err := backend.UpdateDevice(devInactive.ID, devInactive); err != nil {
+		t.Fatalf("unable to update inactive device: %v", err)
+	}
+	node := func(name, providerID string) *v1.Node {
+		return &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: v1.NodeSpec{ProviderID: providerID}}
+	}
+
+	tests := []struct {
+		node     *v1.Node
+		exists   bool
+		down     bool
+		metadata *cloudprovider.InstanceMetadata
+		err      error
+	}{
+		// deleted device, by provider ID or by name
+		{node(devName, "equinixmetal://acbdef-56788"), false, false, nil, fmt.Errorf("instance not found")},
+		{node("thisdoesnotexist", ""), false, false, nil, fmt.Errorf("instance not found")},
+		// not ours
+		{node(devName, "aws://abcdef5667"), false, false, nil, fmt.Errorf("provider name from providerID should be equinixmetal")},
+		// powered off
+		{node("", fmt.Sprintf("equinixmetal://%s", devInactive.ID)), true, true, nil, fmt.Errorf("could not get at least one private ip")},
+		// running, by provider ID or by name
+		{node(devName, fmt.Sprintf("equinixmetal://%s", devActive.ID)), true, false, &cloudprovider.InstanceMetadata{
+			ProviderID:   fmt.Sprintf("equinixmetal://%s", devActive.ID),
+			InstanceType: validPlanSlug,
+			NodeAddresses: []v1.NodeAddress{
+				{Type: v1.NodeHostName, Address: devName},
+				{Type: v1.NodeInternalIP, Address: devActive.Network[0].Address},
+				{Type: v1.NodeExternalIP, Address: devActive.Network[1].Address},
+			},
+		}, nil},
+		{node(devName, ""), true, false, &cloudprovider.InstanceMetadata{
+			ProviderID:   fmt.Sprintf("equinixmetal://%s", devActive.ID),
+			InstanceType: validPlanSlug,
+			NodeAddresses: []v1.NodeAddress{
+				{Type: v1.NodeHostName, Address: devName},
+				{Type: v1.NodeInternalIP, Address: devActive.Network[0].Address},
+				{Type: v1.NodeExternalIP, Address: devActive.Network[1].Address},
+			},
+		}, nil},
+	}
+
+	for i, tt := range tests {
+		// a missing device is not an error for exists, only a malformed provider ID is
+		exists, err := inst.InstanceExists(nil, tt.node)
+		switch {
+		case (err != nil) != strings.HasPrefix(tt.node.Spec.ProviderID, "aws://"):
+			t.Errorf("%d: mismatched exists errors, actual %v", i, err)
+		case exists != tt.exists:
+			t.Errorf("%d: mismatched exists, actual %v expected %v", i, exists, tt.exists)
+		}
+		down, err := inst.InstanceShutdown(nil, tt.node)
+		switch {
+		case tt.exists && err != nil:
+			t.Errorf("%d: unexpected shutdown error: %v", i, err)
+		case !tt.exists && err == nil:
+			t.Errorf("%d: expected a shutdown error, had none", i)
+		case down != tt.down:
+			t.Errorf("%d: mismatched down, actual %v expected %v", i, down, tt.down)
+		}
+		metadata, err := inst.InstanceMetadata(nil, tt.node)
+		switch {
+		case (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())):
+			t.Errorf("%d: mismatched metadata errors, actual %v expected %v", i, err, tt.err)
+		case tt.metadata == nil && metadata != nil:
+			t.Errorf("%d: unexpected metadata %v", i, metadata)
+		case tt.metadata != nil && (metadata.ProviderID != tt.metadata.ProviderID || metadata.InstanceType != tt.metadata.InstanceType || !compareAddresses(metadata.NodeAddresses, tt.metadata.NodeAddresses)):
+			t.Errorf("%d: mismatched metadata, actual %v expected %v", i, metadata, tt.metadata)
+		}
+	}
+
+	// a device without a plan yet has no instance type
+	noPlan := testNoPlanDevice(t)
+	noPlan.Network = devActive.Network
+	if err := backend.UpdateDevice(noPlan.ID, noPlan); err != nil {
+		t.Fatalf("unable to update device without plan: %v", err)
+	}
+	metadata, err := inst.InstanceMetadata(nil, node(noPlan.Hostname, fmt.Sprintf("equinixmetal://%s", noPlan.ID)))
+	if err != nil || metadata.InstanceType != "" {
+		t.Errorf("mismatched metadata of device without plan %v, error %v", metadata, err)
+	}
+}
+
+func TestNodeAddressesOverride(t *testing.T) {
+	private, public := testCreateAddress(false, false), testCreateAddress(false, true)
+	device := &packngo.Device{Hostname: "node-a", Network: []*packngo.IPAddressAssignment{private, public}}
+	publicOnly := &packngo.Device{Hostname: "node-a", Network: []*packngo.IPAddressAssignment{public}}
+	node := func(annotations map[string]string) *v1.Node {
+		return &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-a", Annotations: annotations}}
+	}
+	hostname := v1.NodeAddress{Type: v1.NodeHostName, Address: "node-a"}
+	internal := func(addr string) v1.NodeAddress { return v1.NodeAddress{Type: v1.NodeInternalIP, Address: addr} }
+	external := func(addr string) v1.NodeAddress { return v1.NodeAddress{Type: v1.NodeExternalIP, Address: addr} }
+
+	tests := []struct {
+		device    *packngo.Device
+		node      *v1.Node
+		addresses []v1.NodeAddress
+		err       error
+	}{
+		// absent
+		{device, nil, []v1.NodeAddress{hostname, internal(private.Address), external(public.Address)}, nil},
+		{device, node(nil), []v1.NodeAddress{hostname, internal(private.Address), external(public.Address)}, nil},
+		// present, for either type or both
+		{device, node(map[string]string{annotationNodeInternalIP: "192.168.10.5"}), []v1.NodeAddress{hostname, external(public.Address), internal("192.168.10.5")}, nil},
+		{device, node(map[string]string{annotationNodeExternalIP: " 203.0.113.7 "}), []v1.NodeAddress{hostname, internal(private.Address), external("203.0.113.7")}, nil},
+		{device, node(map[string]string{annotationNodeInternalIP: "192.168.10.5", annotationNodeExternalIP: "203.0.113.7"}), []v1.NodeAddress{hostname, internal("192.168.10.5"), external("203.0.113.7")}, nil},
+		// an override stands in for an address the device lacks
+		{publicOnly, nil, nil, fmt.Errorf("could not get at least one private ip")},
+		{publicOnly, node(map[string]string{annotationNodeInternalIP: "192.168.10.5"}), []v1.NodeAddress{hostname, external(public.Address), internal("192.168.10.5")}, nil},
+		// invalid, so the addresses of the device
+		{device, node(map[string]string{annotationNodeInternalIP: "node-a.internal"}), []v1.NodeAddress{hostname, internal(private.Address), external(public.Address)}, nil},
+		{publicOnly, node(map[string]string{annotationNodeInternalIP: ""}), nil, fmt.Errorf("could not get at least one private ip")},
+	}
+
+	for i, tt := range tests {
+		addresses, err := nodeAddresses(tt.device, tt.node)
+		switch {
+		case (err == nil && tt.err != nil) || (err != nil && tt.err == nil) || (err != nil && tt.err != nil && !strings.HasPrefix(err.Error(), tt.err.Error())):
+			t.Errorf("%d: mismatched errors, actual %v expected %v", i, err, tt.err)
+		case !compareAddresses(addresses, tt.addresses):
+			t.Errorf("%d: mismatched addresses, actual %v expected %v", i, addresses, tt.addresses)
+		}
+	}
+}
+
+func TestNodeAddressesMultiHomed(t *testing.T) {
+	address := func(addr string, family int, public, management bool) *packngo.IPAddressAssignment {
+		return &packngo.IPAddressAssignment{IpAddressCommon: packngo.IpAddressCommon{Address: addr, AddressFamily: family, Public: public, Management: management}}
+	}
+	device := &packngo.Device{Hostname: "node-a", Network: []*packngo.IPAddressAssignment{
+		// an elastic IP assigned to the device, listed before its own addresses
+		address("147.75.200.9", 4, true, false),
+		address("147.75.100.3", 4, true, true),
+		address("2604:1380:1000::1", 6, true, true),
+		address("10.66.4.3", 4, false, true),
+		// a private block assigned to the device, e.g. for pods
+		address("10.70.8.1", 4, false, false),
+		address("147.75.200.10", 4, true, false),
+	}}
+	expected := []v1.NodeAddress{
+		{Type: v1.NodeHostName, Address: "node-a"},
+		{Type: v1.NodeExternalIP, Address: "147.75.100.3"},
+		{Type: v1.NodeExternalIP, Address: "2604:1380:1000::1"},
+		{Type: v1.NodeInternalIP, Address: "10.66.4.3"},
+		{Type: v1.NodeExternalIP, Address: "147.75.200.9"},
+		{Type: v1.NodeInternalIP, Address: "10.70.8.1"},
+		{Type: v1.NodeExternalIP, Address: "147.75.200.10"},
+	}
+	addresses, err := nodeAddresses(device, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !compareAddresses(addresses, expected) {
+		t.Errorf("mismatched addresses, actual %v expected %v", addresses, expected)
+	}
+
+	// an override of the external IP replaces all the public ones, of either family
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-a", Annotations: map[string]string{annotationNodeExternalIP: "203.0.113.7"}}}
+	expected = []v1.NodeAddress{
+		{Type: v1.NodeHostName, Address: "node-a"},
+		{Type: v1.NodeInternalIP, Address: "10.66.4.3"},
+		{Type: v1.NodeInternalIP, Address: "10.70.8.1"},
+		{Type: v1.NodeExternalIP, Address: "203.0.113.7"},
+	}
+	if addresses, err = nodeAddresses(device, node); err != nil {
+		t.Fatalf("unexpected error with override: %v", err)
+	}
+	if !compareAddresses(addresses, expected) {
+		t.Errorf("mismatched addresses with override, actual %v expected %v", addresses, expected)
+	}
+}
+
 func compareAddresses(a1, a2 []v1.NodeAddress) bool {
 	switch {
 	case (a1 == nil && a2 != nil) || (a1 != nil && a2 == nil):
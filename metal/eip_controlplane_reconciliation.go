@@ -54,6 +54,8 @@ type controlPlaneEndpointManager struct {
 	projectID         string
 	httpClient        *http.Client
 	k8sclient         kubernetes.Interface
+	events            reservationEventSink
+	dryRun            bool
 }
 
 func (m *controlPlaneEndpointManager) name() string {
@@ -181,6 +183,10 @@ func (m *controlPlaneEndpointManager) reassign(ctx context.Context, nodes []*v1.
 				if err != nil {
 					return err
 				}
+				if m.dryRun {
+					klog.InfoS("dry run: would assign control plane endpoint", "address", ip.Address, "node", node.Name)
+					return nil
+				}
 				if len(ip.Assignments) == 1 {
 					if _, err := m.deviceIPSrv.Unassign(ip.Assignments[0].ID); err != nil {
 						return err
@@ -192,6 +198,13 @@ func (m *controlPlaneEndpointManager) reassign(ctx context.Context, nodes []*v1.
 					return err
 				}
 				klog.Infof("control plane endpoint assigned to new device %s", node.Name)
+				if m.events != nil {
+					m.events.emit(reservationEvent{
+						Type:          reservationEventReassigned,
+						ReservationID: ip.ID,
+						Address:       ip.Address,
+					})
+				}
 				return nil
 			}
 			klog.Infof("will not assign control plane endpoint to new device %s: returned http code %d", node.Name, resp.StatusCode)
@@ -200,7 +213,7 @@ func (m *controlPlaneEndpointManager) reassign(ctx context.Context, nodes []*v1.
 	return errors.New("ccm didn't find a good candidate for IP allocation. Cluster is unhealthy")
 }
 
-func newControlPlaneEndpointManager(eipTag, projectID string, deviceIPSrv packngo.DeviceIPService, ipResSvr packngo.ProjectIPService, i cloudInstances, apiServerPort int32) *controlPlaneEndpointManager {
+func newControlPlaneEndpointManager(eipTag, projectID string, deviceIPSrv packngo.DeviceIPService, ipResSvr packngo.ProjectIPService, i cloudInstances, apiServerPort int32, dryRun bool, events reservationEventSink) *controlPlaneEndpointManager {
 	return &controlPlaneEndpointManager{
 		httpClient: &http.Client{
 			Timeout: time.Second * 5,
@@ -213,6 +226,8 @@ func newControlPlaneEndpointManager(eipTag, projectID string, deviceIPSrv packng
 		ipResSvr:      ipResSvr,
 		deviceIPSrv:   deviceIPSrv,
 		apiServerPort: apiServerPort,
+		events:        events,
+		dryRun:        dryRun,
 	}
 }
 
@@ -293,6 +308,11 @@ func (m *controlPlaneEndpointManager) reconcileServices(ctx context.Context, svc
 			myep.Subsets = append(myep.Subsets, *copiedSubset)
 		}
 
+		if m.dryRun {
+			klog.InfoS("dry run: would update control plane endpoint service", "service", externalServiceNamespace+"/"+externalServiceName, "address", eip, "port", m.apiServerPort)
+			return nil
+		}
+
 		// save the endpoints
 		if epExisted {
 			if _, err := myeps.Update(ctx, myep, metav1.UpdateOptions{}); err != nil {
@@ -0,0 +1,281 @@
+package metal
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	annotationEIPBlockSize = "metal.equinix.com/eip-block-size"
+	sharedBlockTag         = "block=shared"
+	allocationTagPrefix    = "allocation="
+	sharedBlockDescription = "Equinix Metal Kubernetes CCM auto-generated shared block for Load Balancers"
+)
+
+// eipBlockSize get the prefix length of the shared block that the service draws its address from,
+// from its annotation, else the default, or 0 if it has a reservation of its own. A dual-stack
+// service, or one that draws from a pool, always has its own.
+func (l *loadBalancers) eipBlockSize(svc *v1.Service) int {
+	if dualStack(svc) || reservationPool(svc) != "" {
+		return 0
+	}
+	size := l.defaultBlockSize
+	if v, ok := svc.Annotations[annotationEIPBlockSize]; ok {
+		n, err := strconv.Atoi(strings.TrimPrefix(v, "/"))
+		if err != nil || n < MinReservationCIDR || n > 32 {
+			klog.Errorf("invalid %s %q for service %s, must be between %d and 32, using the default", annotationEIPBlockSize, v, serviceRep(svc), MinReservationCIDR)
+		} else {
+			size = n
+		}
+	}
+	// a single address has nothing to share
+	if size >= 32 {
+		return 0
+	}
+	return size
+}
+
+// isSharedBlock report if the reservation is a block shared by several services, each of which
+// holds a single address of it, rather than the reservation of a single service
+func isSharedBlock(ipr *packngo.IPAddressReservation) bool {
+	for _, tag := range ipr.Tags {
+		if tag == sharedBlockTag {
+			return true
+		}
+	}
+	return false
+}
+
+// allocationTag the tag of a shared block that records the address held by a service in it
+func allocationTag(addr string, svc *v1.Service) string {
+	return allocationTagPrefix + addr + "," + strings.TrimPrefix(serviceTag(svc), "service=")
+}
+
+// blockAllocations get the addresses held in a shared block, each mapped to the service tag of
+// the service that holds it
+func blockAllocations(ipr *packngo.IPAddressReservation) map[string]string {
+	allocations := map[string]string{}
+	for _, tag := range ipr.Tags {
+		if !strings.HasPrefix(tag, allocationTagPrefix) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(tag, allocationTagPrefix), ",", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		allocations[parts[0]] = "service=" + parts[1]
+	}
+	return allocations
+}
+
+// blockAllocation get the address the service holds in the shared block, or "" if none
+func blockAllocation(ipr *packngo.IPAddressReservation, svc *v1.Service) string {
+	svcTag := serviceTag(svc)
+	for addr, tag := range blockAllocations(ipr) {
+		if tag == svcTag {
+			return addr
+		}
+	}
+	return ""
+}
+
+// blockAddresses get every address of an IPv4 block, in order. Elastic IPs are routed to the
+// project, so every address of a block is usable, the first and last included.
+func blockAddresses(ipr *packngo.IPAddressReservation) []string {
+	_, block, err := net.ParseCIDR(fmt.Sprintf("%s/%d", ipr.Address, ipr.CIDR))
+	if err != nil || block.IP.To4() == nil {
+		return nil
+	}
+	first := binary.BigEndian.Uint32(block.IP.To4())
+	addrs := []string{}
+	for i := 0; i < reservationQuantity(ipr.CIDR); i++ {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, first+uint32(i))
+		addrs = append(addrs, ip.String())
+	}
+	return addrs
+}
+
+// freeBlockAddress get the first address of the shared block that no service holds, or "" if
+// all are held
+func freeBlockAddress(ipr *packngo.IPAddressReservation) string {
+	allocations := blockAllocations(ipr)
+	for _, addr := range blockAddresses(ipr) {
+		if _, ok := allocations[addr]; !ok {
+			return addr
+		}
+	}
+	return ""
+}
+
+// drawFromBlock get a shared block of the size the service asks for, with an address for it: one
+// with an address free, else a new one. The service is tagged on the block, so it is found by its
+// tags as its own reservation would be, and so that the block is kept while the service exists.
+// Its address is recorded in an allocation tag as well; the block may not have its addresses
+// yet, in which case the service is allocated one later, by allocateInBlock.
+//
+// The reservations are listed again, rather than taken from the start of the reconcile, as a
+// block may have been requested for another service since.
+func (l *loadBalancers) drawFromBlock(ctx context.Context, svc *v1.Service) (*packngo.IPAddressReservation, error) {
+	l.blockLock.Lock()
+	defer l.blockLock.Unlock()
+	size := l.eipBlockSize(svc)
+	svcName, svcTag, clsTag := serviceRep(svc), serviceTag(svc), clusterTag(l.clusterID)
+	ips, err := l.listReservations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve IP reservations for project %s: %w", l.project, err)
+	}
+	for _, ipr := range ipReservationsByAllTags([]string{emTag, clsTag, sharedBlockTag}, l.withinApproved(ips)) {
+		if ipr.CIDR != size || ipr.Address == "" {
+			continue
+		}
+		// the tags must be current, as another service may have taken an address since the list
+		current, err := l.currentReservation(ctx, ipr.ID)
+		if err != nil {
+			return nil, err
+		}
+		if current == nil {
+			continue
+		}
+		addr := freeBlockAddress(current)
+		if addr == "" {
+			continue
+		}
+		klog.V(2).Infof("drawing %s from shared block %s/%d for %s", addr, current.Address, current.CIDR, svcName)
+		updated, _, err := l.updateTags(ctx, current.ID, append(append([]string{}, current.Tags...), svcTag, allocationTag(addr, svc)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to allocate %s of shared block %s to %s: %v", addr, current.ID, svcName, err)
+		}
+		return updated, nil
+	}
+
+	klog.V(2).Infof("no shared block of /%d with a free address for %s, requesting", size, svcName)
+	facility, err := l.facilitySelector.selectFacility()
+	if err != nil {
+		return nil, fmt.Errorf("failed to select a facility for the shared block: %v", err)
+	}
+	description := fmt.Sprintf("%s (%s)", sharedBlockDescription, clsTag)
+	req := packngo.IPReservationRequest{
+		Type:                   "public_ipv4",
+		Quantity:               reservationQuantity(size),
+		Description:            description,
+		Facility:               &facility,
+		Tags:                   append([]string{emTag, clsTag, sharedBlockTag, svcTag}, l.additionalTags...),
+		FailOnApprovalRequired: l.failOnApprovalRequired(svc),
+	}
+	ipr, err := l.requestReservation(ctx, svc, &req, func(ips []packngo.IPAddressReservation) []*packngo.IPAddressReservation {
+		return ipReservationsByAllTags([]string{emTag, clsTag, sharedBlockTag, svcTag}, ips)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to request a shared block for the load balancer: %w", err)
+	}
+	if ipr.Address == "" {
+		return ipr, nil
+	}
+	return l.allocate(ctx, svc, ipr)
+}
+
+// allocateInBlock get the address the service holds in the shared block, allocating it one if it
+// holds none yet, e.g. as the block did not have its addresses when it was drawn
+func (l *loadBalancers) allocateInBlock(ctx context.Context, svc *v1.Service, ipr *packngo.IPAddressReservation) (string, error) {
+	if addr := blockAllocation(ipr, svc); addr != "" {
+		return addr, nil
+	}
+	l.blockLock.Lock()
+	defer l.blockLock.Unlock()
+	current, err := l.currentReservation(ctx, ipr.ID)
+	if err != nil {
+		return "", err
+	}
+	if current == nil {
+		return "", fmt.Errorf("shared block %s of %s no longer exists", ipr.ID, serviceRep(svc))
+	}
+	updated, err := l.allocate(ctx, svc, current)
+	if err != nil {
+		return "", err
+	}
+	return blockAllocation(updated, svc), nil
+}
+
+// allocate tag the service as holding a free address of the shared block, whose tags must be
+// current; the block lock is held
+func (l *loadBalancers) allocate(ctx context.Context, svc *v1.Service, ipr *packngo.IPAddressReservation) (*packngo.IPAddressReservation, error) {
+	svcName := serviceRep(svc)
+	if blockAllocation(ipr, svc) != "" {
+		return ipr, nil
+	}
+	addr := freeBlockAddress(ipr)
+	if addr == "" {
+		return nil, fmt.Errorf("shared block %s has no free address for %s", ipr.ID, svcName)
+	}
+	tags := append([]string{}, ipr.Tags...)
+	if !hasTag(tags, serviceTag(svc)) {
+		tags = append(tags, serviceTag(svc))
+	}
+	klog.V(2).Infof("allocating %s of shared block %s/%d to %s", addr, ipr.Address, ipr.CIDR, svcName)
+	updated, _, err := l.updateTags(ctx, ipr.ID, append(tags, allocationTag(addr, svc)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate %s of shared block %s to %s: %v", addr, ipr.ID, svcName, err)
+	}
+	return updated, nil
+}
+
+// leaveBlock give up the addresses of the services with the given tags in the shared block, and
+// release the block if no service remains in it; svc is the service leaving, or nil if they are gone
+func (l *loadBalancers) leaveBlock(ctx context.Context, svc *v1.Service, svcTags map[string]bool, ipr *packngo.IPAddressReservation) error {
+	l.blockLock.Lock()
+	defer l.blockLock.Unlock()
+	current, err := l.currentReservation(ctx, ipr.ID)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return nil
+	}
+	allocations := blockAllocations(current)
+	tags := []string{}
+	remaining := 0
+	for _, tag := range current.Tags {
+		switch {
+		case svcTags[tag]:
+			continue
+		case strings.HasPrefix(tag, allocationTagPrefix):
+			addr := strings.SplitN(strings.TrimPrefix(tag, allocationTagPrefix), ",", 2)[0]
+			if svcTags[allocations[addr]] {
+				continue
+			}
+		case strings.HasPrefix(tag, "service="):
+			remaining++
+		}
+		tags = append(tags, tag)
+	}
+	if remaining == 0 {
+		klog.V(2).Infof("no service remains in shared block %s, releasing it", current.ID)
+		return l.removeReservation(ctx, svc, current)
+	}
+	if len(tags) == len(current.Tags) {
+		return nil
+	}
+	klog.V(2).Infof("releasing the addresses of %d services in shared block %s", len(svcTags), current.ID)
+	if _, _, err := l.updateTags(ctx, current.ID, tags); err != nil {
+		return fmt.Errorf("failed to release addresses of shared block %s: %v", current.ID, err)
+	}
+	return nil
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
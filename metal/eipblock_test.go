@@ -0,0 +1,147 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestEIPBlockSize(t *testing.T) {
+	tests := []struct {
+		defaultSize int
+		annotations map[string]string
+		size        int
+	}{
+		{0, nil, 0},
+		{32, nil, 0},
+		{29, nil, 29},
+		{0, map[string]string{annotationEIPBlockSize: "30"}, 30},
+		{0, map[string]string{annotationEIPBlockSize: "/30"}, 30},
+		{29, map[string]string{annotationEIPBlockSize: "32"}, 0},
+		{29, map[string]string{annotationEIPBlockSize: "24"}, 29},
+		{29, map[string]string{annotationEIPBlockSize: "many"}, 29},
+		{29, map[string]string{annotationEIPDualStack: "true"}, 0},
+		{29, map[string]string{annotationEIPPool: "blue"}, 0},
+	}
+	for i, tt := range tests {
+		l := &loadBalancers{defaultBlockSize: tt.defaultSize}
+		if size := l.eipBlockSize(testLoadBalancerService("default", "web", tt.annotations)); size != tt.size {
+			t.Errorf("%d: mismatched size, actual %d expected %d", i, size, tt.size)
+		}
+	}
+}
+
+func TestBlockAddresses(t *testing.T) {
+	ipr := &packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{Address: "147.75.100.1", CIDR: 30}}
+	if addrs := fmt.Sprint(blockAddresses(ipr)); addrs != "[147.75.100.0 147.75.100.1 147.75.100.2 147.75.100.3]" {
+		t.Errorf("mismatched addresses %s", addrs)
+	}
+	svc := testLoadBalancerService("default", "web", nil)
+	ipr.Tags = []string{sharedBlockTag, serviceTag(svc), allocationTag("147.75.100.0", svc)}
+	if addr := blockAllocation(ipr, svc); addr != "147.75.100.0" {
+		t.Errorf("mismatched allocation %s", addr)
+	}
+	if addr := freeBlockAddress(ipr); addr != "147.75.100.1" {
+		t.Errorf("mismatched free address %s", addr)
+	}
+	if !knownTagScheme(append(ipr.Tags, emTag, clusterTag(testClusterID))) {
+		t.Errorf("tags of a shared block not known: %v", ipr.Tags)
+	}
+}
+
+func TestReconcileServicesSharedBlock(t *testing.T) {
+	annotations := map[string]string{annotationEIPBlockSize: "30"}
+	svcs := []*v1.Service{}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		svcs = append(svcs, testLoadBalancerService("default", name, annotations))
+	}
+	objects := []runtime.Object{}
+	for _, svc := range svcs {
+		objects = append(objects, svc)
+	}
+	ips := &fakeProjectIPs{}
+	l, lb := testGetLoadBalancers(ips, objects...)
+	ctx := context.Background()
+	current := func() []*v1.Service {
+		ret := []*v1.Service{}
+		for _, svc := range svcs {
+			updated, err := l.k8sclient.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("unable to get service: %v", err)
+			}
+			ret = append(ret, updated)
+		}
+		return ret
+	}
+
+	// four services share the one /30 block, requested once
+	if err := l.reconcileServices(ctx, svcs[:4], ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.requests) != 1 || ips.requests[0].Quantity != 4 {
+		t.Fatalf("expected a single request for a /30, had %v", ips.requests)
+	}
+	_, block, _ := net.ParseCIDR(fmt.Sprintf("%s/%d", ips.reservations[0].Address, ips.reservations[0].CIDR))
+	seen := map[string]bool{}
+	for _, svc := range current()[:4] {
+		addr := svc.Spec.LoadBalancerIP
+		if ip := net.ParseIP(addr); ip == nil || !block.Contains(ip) || seen[addr] {
+			t.Errorf("service %s has address %q, not a distinct one of %s", svc.Name, addr, block)
+		}
+		seen[addr] = true
+		if lb.services[addr+"/32"] != serviceRep(svc) {
+			t.Errorf("service %s not advertised as %s/32, have %v", svc.Name, addr, lb.services)
+		}
+	}
+
+	// the fifth does not fit, so a second block is requested
+	if err := l.reconcileServices(ctx, current()[4:], ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.requests) != 2 || len(ips.reservations) != 2 {
+		t.Fatalf("expected a second block, have requests %v", ips.requests)
+	}
+
+	// removing one frees its address, without releasing the block
+	updated := current()
+	if err := l.reconcileServices(ctx, updated[:1], ModeRemove); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	freed := updated[0].Spec.LoadBalancerIP
+	if len(ips.removed) != 0 {
+		t.Errorf("expected no reservation removed, removed %v", ips.removed)
+	}
+	if _, ok := lb.services[freed+"/32"]; ok {
+		t.Errorf("removed service still advertised as %s", freed)
+	}
+	if blockAllocations(&ips.reservations[0])[freed] != "" {
+		t.Errorf("address %s of removed service still allocated", freed)
+	}
+
+	// a sync without the fifth releases its block, in which no other service holds an address
+	if err := l.reconcileServices(ctx, updated[1:4], ModeSync); err != nil {
+		t.Fatalf("unexpected error on sync: %v", err)
+	}
+	if len(ips.removed) != 1 || ips.removed[0] != "reservation-2" {
+		t.Errorf("expected the second block removed, removed %v", ips.removed)
+	}
+
+	// and a new service takes the freed address, without a request
+	svc := testLoadBalancerService("default", "f", annotations)
+	if _, err := l.k8sclient.CoreV1().Services("default").Create(ctx, svc, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("unable to create service: %v", err)
+	}
+	if err := l.reconcileServices(ctx, []*v1.Service{svc}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	created, _ := l.k8sclient.CoreV1().Services("default").Get(ctx, "f", metav1.GetOptions{})
+	if created.Spec.LoadBalancerIP != freed || len(ips.requests) != 2 {
+		t.Errorf("expected the freed %s without a request, had %s after %d requests", freed, created.Spec.LoadBalancerIP, len(ips.requests))
+	}
+}
@@ -0,0 +1,91 @@
+package metal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	eipMappingPath = "/eips"
+)
+
+// eipMapping a reservation of this cluster and the service that holds it by its service tag, or
+// none if it is orphaned, see orphanedReservations
+type eipMapping struct {
+	Namespace     string `json:"namespace,omitempty"`
+	Name          string `json:"name,omitempty"`
+	IP            string `json:"ip"`
+	ReservationID string `json:"reservationID"`
+	Orphaned      bool   `json:"orphaned,omitempty"`
+}
+
+// eipMappings get the reservations of each of the services, in the order of the services, then
+// the orphaned reservations, by ID. A reservation that is neither, e.g. of a tag scheme that is
+// not known, is left out, as it is not the CCM's to map or release.
+func (l *loadBalancers) eipMappings(svcs []*v1.Service, ips []packngo.IPAddressReservation) []eipMapping {
+	sorted := append([]*v1.Service{}, svcs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return serviceRep(sorted[i]) < serviceRep(sorted[j])
+	})
+	mappings := []eipMapping{}
+	for _, svc := range sorted {
+		for _, ipr := range ipReservationsByAllTags([]string{emTag, serviceTag(svc), clusterTag(l.clusterID)}, ips) {
+			mappings = append(mappings, eipMapping{Namespace: svc.Namespace, Name: svc.Name, IP: ipr.Address, ReservationID: ipr.ID})
+		}
+	}
+	orphans := l.orphanedReservations(svcs, ips)
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].ID < orphans[j].ID
+	})
+	for _, ipr := range orphans {
+		mappings = append(mappings, eipMapping{IP: ipr.Address, ReservationID: ipr.ID, Orphaned: true})
+	}
+	return mappings
+}
+
+// currentEIPMappings get the mapping of the services of the informer and the reservations of the
+// project as last listed, see lastReservations, of the services that hold them as for
+// releaseOrphans, see holdingServices. The reservations of the legacy tags are mapped as their services hold
+// them, but are not migrated.
+func (l *loadBalancers) currentEIPMappings(ctx context.Context, serviceLister corelisters.ServiceLister) ([]eipMapping, error) {
+	ips, err := l.lastReservations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve IP reservations for project %s: %v", l.project, err)
+	}
+	svcs, err := serviceLister.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("unable to list services: %v", err)
+	}
+	svcs = holdingServices(svcs)
+	ips, _ = withCurrentServiceTags(svcs, ips)
+	return l.eipMappings(svcs, ips), nil
+}
+
+// eipMappingHandler serve the mapping of reservations to services as a JSON array
+func eipMappingHandler(l *loadBalancers, serviceLister corelisters.ServiceLister) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		mappings, err := l.currentEIPMappings(r.Context(), serviceLister)
+		if err != nil {
+			klog.Errorf("eipMappingHandler(): %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(mappings); err != nil {
+			klog.Errorf("eipMappingHandler(): unable to write mapping: %v", err)
+		}
+	}
+}
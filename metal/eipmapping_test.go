@@ -0,0 +1,68 @@
+package metal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/packethost/packngo"
+)
+
+func TestEIPMappingHandler(t *testing.T) {
+	web := testLoadBalancerService("default", "web", nil)
+	api := testLoadBalancerService("default", "api", nil)
+	gone := testLoadBalancerService("default", "gone", nil)
+	reservation := func(id string, tags ...string) packngo.IPAddressReservation {
+		return packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{
+			ID:      id,
+			Address: "147.75.1." + id,
+			CIDR:    32,
+			Tags:    tags,
+		}}
+	}
+	clsTag := clusterTag(testClusterID)
+	ips := &fakeProjectIPs{reservations: []packngo.IPAddressReservation{
+		reservation("1", emTag, serviceTag(web), clsTag),
+		reservation("2", emTag, serviceTag(gone), clsTag),
+		reservation("3", emTag, serviceTag(api), clsTag),
+		// of another cluster, which is not of this inventory
+		reservation("4", emTag, serviceTag(web), clusterTag("other")),
+	}}
+	l, _ := testGetLoadBalancers(ips, web, api)
+	_, serviceLister := testListers(t, l)
+	handler := eipMappingHandler(l, serviceLister)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, eipMappingPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("mismatched status, actual %d expected %d: %s", rec.Code, http.StatusOK, rec.Body.String())
+	}
+	var mappings []eipMapping
+	if err := json.Unmarshal(rec.Body.Bytes(), &mappings); err != nil {
+		t.Fatalf("unable to parse mapping %s: %v", rec.Body.String(), err)
+	}
+	expected := []eipMapping{
+		{Namespace: "default", Name: "api", IP: "147.75.1.3", ReservationID: "3"},
+		{Namespace: "default", Name: "web", IP: "147.75.1.1", ReservationID: "1"},
+		{IP: "147.75.1.2", ReservationID: "2", Orphaned: true},
+	}
+	if !reflect.DeepEqual(mappings, expected) {
+		t.Errorf("mismatched mapping, actual %+v expected %+v", mappings, expected)
+	}
+
+	// served again from the reservations as listed, without asking the API
+	lists := ips.lists
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, eipMappingPath, nil))
+	if rec.Code != http.StatusOK || ips.lists != lists {
+		t.Errorf("expected the second request served without a list, status %d after %d lists", rec.Code, ips.lists-lists)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, eipMappingPath, nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("mismatched status for POST, actual %d expected %d", rec.Code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,29 @@
+package metal
+
+import (
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const annotationEIPType = "metal.equinix.com/eip-type"
+
+// eipType get the type of the IPv4 reservation to request for the service: a regional one, by
+// default, or a global, i.e. anycast, one. An invalid annotation is logged, and a regional one used.
+func eipType(svc *v1.Service) string {
+	switch t := svc.Annotations[annotationEIPType]; t {
+	case "", packngo.PublicIPv4:
+		return packngo.PublicIPv4
+	case packngo.GlobalIPv4:
+		return packngo.GlobalIPv4
+	default:
+		klog.Errorf("service %s has invalid annotation %s, must be %s or %s, was %s", serviceRep(svc), annotationEIPType, packngo.PublicIPv4, packngo.GlobalIPv4, t)
+		return packngo.PublicIPv4
+	}
+}
+
+// globalEIP report if the service asks for a global IPv4 reservation, which is not of any facility
+// or metro, so is requested without one
+func globalEIP(svc *v1.Service) bool {
+	return eipType(svc) == packngo.GlobalIPv4
+}
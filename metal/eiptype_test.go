@@ -0,0 +1,86 @@
+package metal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestReconcileServicesEIPType(t *testing.T) {
+	tests := []struct {
+		annotation string
+		reqType    string
+		facility   bool
+	}{
+		{"", packngo.PublicIPv4, true},
+		{packngo.PublicIPv4, packngo.PublicIPv4, true},
+		{packngo.GlobalIPv4, packngo.GlobalIPv4, false},
+		// an invalid type is left to the default
+		{"anycast", packngo.PublicIPv4, true},
+	}
+	for _, tt := range tests {
+		var annotations map[string]string
+		if tt.annotation != "" {
+			annotations = map[string]string{annotationEIPType: tt.annotation}
+		}
+		svc := testLoadBalancerService("default", "web", annotations)
+		ips := &fakeProjectIPs{}
+		l, lb := testGetLoadBalancers(ips, svc)
+		// a /30 for regional ones, which a global one cannot be
+		l.reservationCIDR = 30
+		if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.annotation, err)
+		}
+		if len(ips.requests) != 1 {
+			t.Fatalf("%q: expected 1 request, had %v", tt.annotation, ips.requests)
+		}
+		req := ips.requests[0]
+		if req.Type != tt.reqType {
+			t.Errorf("%q: mismatched type, actual %s expected %s", tt.annotation, req.Type, tt.reqType)
+		}
+		if (req.Facility != nil) != tt.facility || req.Metro != nil {
+			t.Errorf("%q: mismatched facility, actual %v metro %v, expected one: %t", tt.annotation, req.Facility, req.Metro, tt.facility)
+		}
+		if tt.reqType == packngo.GlobalIPv4 && req.Quantity != 1 {
+			t.Errorf("%q: expected a single global address, had quantity %d", tt.annotation, req.Quantity)
+		}
+		// mapped as any other
+		if lb.services["147.75.100.1/32"] != "default/web" {
+			t.Errorf("%q: address not mapped, load balancer %v", tt.annotation, lb.services)
+		}
+	}
+}
+
+func TestReusableReservationEIPType(t *testing.T) {
+	retained := func(id string, global bool) packngo.IPAddressReservation {
+		return packngo.IPAddressReservation{
+			IpAddressCommon: packngo.IpAddressCommon{ID: id, Address: "147.75.1.1", CIDR: 32, Public: true, Global: global, Tags: []string{emRetainedTag, clusterTag(testClusterID)}},
+		}
+	}
+	global := testLoadBalancerService("default", "web", map[string]string{annotationEIPType: packngo.GlobalIPv4})
+	regional := testLoadBalancerService("default", "other", nil)
+	tests := []struct {
+		svc      *v1.Service
+		global   bool
+		expected bool
+	}{
+		{global, true, true},
+		{global, false, false},
+		{regional, true, false},
+		{regional, false, true},
+	}
+	for i, tt := range tests {
+		ips := &fakeProjectIPs{reservations: []packngo.IPAddressReservation{retained("retained", tt.global)}}
+		l, _ := testGetLoadBalancers(ips, tt.svc)
+		l.reuseScope = ReuseScopeCluster
+		ipr, err := l.reusableReservation(context.Background(), tt.svc, ips.reservations)
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if (ipr != nil) != tt.expected {
+			t.Errorf("%d: mismatched reuse, actual %v expected %t", i, ipr, tt.expected)
+		}
+	}
+}
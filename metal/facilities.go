@@ -2,6 +2,7 @@ package metal
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/packethost/packngo"
 	"k8s.io/apimachinery/pkg/types"
@@ -10,13 +11,16 @@ import (
 	"k8s.io/klog/v2"
 )
 
+// zones maps the metro of a device to its region, and its facility to its zone
 type zones struct {
 	client  *packngo.Client
 	project string
+	// metadataURL the base URL of the metadata service, or "" for that of Equinix Metal
+	metadataURL string
 }
 
 func newZones(client *packngo.Client, projectID string) zones {
-	return zones{client, projectID}
+	return zones{client: client, project: projectID}
 }
 
 // cloudService implementation
@@ -42,7 +46,16 @@ func (z zones) serviceReconciler() serviceReconciler {
 // can no longer be called from the kubelets.
 func (z zones) GetZone(_ context.Context) (cloudprovider.Zone, error) {
 	klog.V(2).Info("called GetZones")
-	return cloudprovider.Zone{}, cloudprovider.NotImplemented
+	md, err := GetAndParseMetadata(z.metadataURL)
+	if err != nil {
+		return cloudprovider.Zone{}, fmt.Errorf("unable to read device metadata: %v", err)
+	}
+	// the metadata has the facility but not the metro, which only the device has
+	device, err := deviceByID(z.client, md.ID)
+	if err != nil {
+		return cloudprovider.Zone{}, err
+	}
+	return deviceZone(device), nil
 }
 
 // GetZoneByProviderID returns the Zone containing the current zone and locality region of the node specified by providerId
@@ -60,7 +73,7 @@ func (z zones) GetZoneByProviderID(_ context.Context, providerID string) (cloudp
 		return cloudprovider.Zone{}, err
 	}
 
-	return cloudprovider.Zone{Region: device.Facility.Code}, nil
+	return deviceZone(device), nil
 }
 
 // GetZoneByNodeName returns the Zone containing the current zone and locality region of the node specified by node name
@@ -73,5 +86,19 @@ func (z zones) GetZoneByNodeName(_ context.Context, nodeName types.NodeName) (cl
 		return cloudprovider.Zone{}, err
 	}
 
-	return cloudprovider.Zone{Region: device.Facility.Code}, nil
+	return deviceZone(device), nil
+}
+
+// deviceZone get the zone of a device: its metro is the region and its facility the failure
+// domain. A device in a facility that is not part of a metro has its facility as its region too.
+func deviceZone(device *packngo.Device) cloudprovider.Zone {
+	var zone cloudprovider.Zone
+	if device.Facility != nil {
+		zone.Region = device.Facility.Code
+		zone.FailureDomain = device.Facility.Code
+	}
+	if device.Metro != nil && device.Metro.Code != "" {
+		zone.Region = device.Metro.Code
+	}
+	return zone
 }
@@ -2,27 +2,83 @@ package metal
 
 import (
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 
+	"github.com/packethost/packngo"
 	"k8s.io/apimachinery/pkg/types"
 	cloudprovider "k8s.io/cloud-provider"
 )
 
+// testMetroDevice create a device in the da11 facility of the da metro, named for the test, so
+// that it cannot take the name of a device of another test
+func testMetroDevice(t *testing.T) *packngo.Device {
+	_, backend := testGetValidCloud(t)
+	facility, _ := testGetOrCreateValidRegion("Dallas 11", "da11", backend)
+	plan, _ := testGetOrCreateValidPlan(validPlanName, validPlanSlug, backend)
+	dev, err := backend.CreateDevice(projectID, "da11-"+strings.ToLower(t.Name()), plan, facility)
+	if err != nil {
+		t.Fatalf("unable to create device: %v", err)
+	}
+	dev.Metro = &packngo.Metro{Code: "da", Name: "Dallas"}
+	if err := backend.UpdateDevice(dev.ID, dev); err != nil {
+		t.Fatalf("unable to update device: %v", err)
+	}
+	return dev
+}
+
 func TestGetZone(t *testing.T) {
 	vc, _ := testGetValidCloud(t)
-	zones, _ := vc.Zones()
-	zone, err := zones.GetZone(nil)
-	var (
-		expectedZone  = cloudprovider.Zone{}
-		expectedError = cloudprovider.NotImplemented
-	)
-	if err != expectedError {
-		t.Errorf("mismatched error: received %v instead of %v", err, expectedError)
+	dev := testMetroDevice(t)
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metadata" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"id": %q, "hostname": %q, "facility": "da11"}`, dev.ID, dev.Hostname)
+	}))
+	defer metadata.Close()
+
+	z := vc.zones.(zones)
+	z.metadataURL = metadata.URL
+	zone, err := z.GetZone(nil)
+	expectedZone := cloudprovider.Zone{Region: "da", FailureDomain: "da11"}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
 	if zone != expectedZone {
 		t.Errorf("mismatched zone: received %v instead of %v", zone, expectedZone)
 	}
+
+	// without the metadata service, there is no zone
+	metadata.Close()
+	if _, err := z.GetZone(nil); err == nil {
+		t.Errorf("expected an error without the metadata service")
+	}
+}
+
+func TestGetZoneMetro(t *testing.T) {
+	vc, _ := testGetValidCloud(t)
+	dev := testMetroDevice(t)
+	expected := cloudprovider.Zone{Region: "da", FailureDomain: "da11"}
+
+	zones, _ := vc.Zones()
+	zone, err := zones.GetZoneByProviderID(nil, fmt.Sprintf("equinixmetal://%s", dev.ID))
+	if err != nil {
+		t.Fatalf("unexpected error by provider ID: %v", err)
+	}
+	if zone != expected {
+		t.Errorf("mismatched zone by provider ID: received %v instead of %v", zone, expected)
+	}
+	zone, err = zones.GetZoneByNodeName(nil, types.NodeName(dev.Hostname))
+	if err != nil {
+		t.Fatalf("unexpected error by node name: %v", err)
+	}
+	if zone != expected {
+		t.Errorf("mismatched zone by node name: received %v instead of %v", zone, expected)
+	}
 }
 
 func TestGetZoneByProviderID(t *testing.T) {
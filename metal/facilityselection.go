@@ -0,0 +1,195 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// FacilitySelectionFixed request each new EIP in the configured facility
+	FacilitySelectionFixed = "fixed"
+	// FacilitySelectionLeastUtilized request each new EIP in the candidate facility with the fewest managed EIPs
+	FacilitySelectionLeastUtilized = "least-utilized"
+	// FacilitySelectionRoundRobin request each new EIP in the next candidate facility in turn
+	FacilitySelectionRoundRobin = "round-robin"
+	// FacilitySelectionEndpoints request each new EIP in the facility of the nodes of the endpoints
+	// of its service, if they are all in one, else in the configured facility
+	FacilitySelectionEndpoints = "endpoints"
+)
+
+// facilityUtilization reports how used each facility is for EIPs; the lower, the more available
+type facilityUtilization interface {
+	utilization(facilities []string) (map[string]int, error)
+}
+
+// reservationUtilization counts the EIP reservations managed by the CCM that the project holds in
+// each facility. There is no API for the capacity of a facility for EIPs, so this stands in.
+type reservationUtilization struct {
+	client  packngo.ProjectIPService
+	project string
+}
+
+func (r reservationUtilization) utilization(facilities []string) (map[string]int, error) {
+	ips, _, err := r.client.List(r.project, &packngo.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve IP reservations for project %s: %v", r.project, err)
+	}
+	counts := map[string]int{}
+	for _, f := range facilities {
+		counts[f] = 0
+	}
+	for _, ipr := range ipReservationsByAllTags([]string{emTag}, ips) {
+		if ipr.Facility == nil {
+			continue
+		}
+		if _, ok := counts[ipr.Facility.Code]; ok {
+			counts[ipr.Facility.Code]++
+		}
+	}
+	return counts, nil
+}
+
+// facilitySelector picks the facility in which to request a new EIP
+type facilitySelector interface {
+	// selectFacility get the facility for the next request
+	selectFacility() (string, error)
+	// facilities get all of the facilities that selectFacility may return
+	facilities() []string
+}
+
+// newFacilitySelector get the selector for the strategy. The fixed strategy always selects the
+// given facility; the others select among the candidates.
+func newFacilitySelector(strategy, facility string, candidates []string, usage facilityUtilization) facilitySelector {
+	switch strategy {
+	case FacilitySelectionLeastUtilized:
+		return &leastUtilizedFacilities{candidates: candidates, usage: usage}
+	case FacilitySelectionRoundRobin:
+		return &roundRobinFacilities{candidates: candidates}
+	default:
+		return fixedFacility(facility)
+	}
+}
+
+type fixedFacility string
+
+func (f fixedFacility) selectFacility() (string, error) {
+	return string(f), nil
+}
+
+func (f fixedFacility) facilities() []string {
+	return []string{string(f)}
+}
+
+// selectServiceFacility get the facility for the next request for the service: with the endpoints
+// selection, that of the nodes of its endpoints, so that its address is advertised from where its
+// backends are, else that of the selector
+func (l *loadBalancers) selectServiceFacility(ctx context.Context, svc *v1.Service) (string, error) {
+	if l.endpointsAffinity {
+		if facility := l.endpointsFacility(ctx, svc); facility != "" {
+			return facility, nil
+		}
+	}
+	return l.facilitySelector.selectFacility()
+}
+
+// endpointsFacility get the facility of the nodes of the ready endpoints of the service, from
+// their zone label, which the CCM sets to their facility, or "" if it has none, or they are in
+// more than one, or any of them is not known
+func (l *loadBalancers) endpointsFacility(ctx context.Context, svc *v1.Service) string {
+	svcName := serviceRep(svc)
+	endpoints, err := l.serviceEndpoints(ctx, svc)
+	if err != nil {
+		klog.V(2).Infof("no endpoints of %s to select its facility by, using the configured one: %v", svcName, err)
+		return ""
+	}
+	facilities := map[string]bool{}
+	for _, name := range endpointsNodes(endpoints) {
+		node, err := l.k8sclient.CoreV1().Nodes().Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			klog.V(2).Infof("unable to get node %s of the endpoints of %s, using the configured facility: %v", name, svcName, err)
+			return ""
+		}
+		facility := nodeFacility(node)
+		if facility == "" {
+			klog.V(2).Infof("node %s of the endpoints of %s has no zone, using the configured facility", name, svcName)
+			return ""
+		}
+		facilities[facility] = true
+	}
+	switch len(facilities) {
+	case 0:
+		return ""
+	case 1:
+		for facility := range facilities {
+			klog.V(2).Infof("endpoints of %s are all in facility %s, requesting its address there", svcName, facility)
+			return facility
+		}
+	}
+	names := make([]string, 0, len(facilities))
+	for facility := range facilities {
+		names = append(names, facility)
+	}
+	sort.Strings(names)
+	klog.V(2).Infof("endpoints of %s are in facilities %v, using the configured facility", svcName, names)
+	return ""
+}
+
+// nodeFacility get the facility of a node from its zone label, or its older beta one
+func nodeFacility(node *v1.Node) string {
+	if zone := node.Labels[v1.LabelZoneFailureDomainStable]; zone != "" {
+		return zone
+	}
+	return node.Labels[v1.LabelZoneFailureDomain]
+}
+
+// leastUtilizedFacilities selects the candidate with the lowest utilization; of those that are
+// equal, the first in the list of candidates
+type leastUtilizedFacilities struct {
+	candidates []string
+	usage      facilityUtilization
+}
+
+func (l *leastUtilizedFacilities) selectFacility() (string, error) {
+	counts, err := l.usage.utilization(l.candidates)
+	if err != nil {
+		return "", fmt.Errorf("unable to get facility utilization: %v", err)
+	}
+	selected := ""
+	for _, f := range l.candidates {
+		if selected == "" || counts[f] < counts[selected] {
+			selected = f
+		}
+	}
+	return selected, nil
+}
+
+func (l *leastUtilizedFacilities) facilities() []string {
+	return l.candidates
+}
+
+// roundRobinFacilities selects each candidate in turn. The position is not persisted, so it
+// starts again at the first candidate on a restart.
+type roundRobinFacilities struct {
+	candidates []string
+	next       int
+	lock       sync.Mutex
+}
+
+func (r *roundRobinFacilities) selectFacility() (string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	f := r.candidates[r.next%len(r.candidates)]
+	r.next++
+	return f, nil
+}
+
+func (r *roundRobinFacilities) facilities() []string {
+	return r.candidates
+}
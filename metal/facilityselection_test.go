@@ -0,0 +1,162 @@
+package metal
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// fakeUtilization reports fixed utilization for each facility
+type fakeUtilization struct {
+	counts map[string]int
+	err    error
+}
+
+func (f fakeUtilization) utilization(facilities []string) (map[string]int, error) {
+	return f.counts, f.err
+}
+
+func TestLeastUtilizedFacilities(t *testing.T) {
+	candidates := []string{"ewr1", "sjc1", "ams1"}
+	tests := []struct {
+		counts   map[string]int
+		expected string
+	}{
+		{map[string]int{"ewr1": 3, "sjc1": 1, "ams1": 2}, "sjc1"},
+		{map[string]int{"ewr1": 0, "sjc1": 0, "ams1": 0}, "ewr1"},
+		{map[string]int{"ewr1": 5, "sjc1": 2, "ams1": 2}, "sjc1"},
+		// a facility that is not reported has nothing used
+		{map[string]int{"ewr1": 5, "sjc1": 2}, "ams1"},
+	}
+	for i, tt := range tests {
+		s := newFacilitySelector(FacilitySelectionLeastUtilized, testFacility, candidates, fakeUtilization{counts: tt.counts})
+		f, err := s.selectFacility()
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if f != tt.expected {
+			t.Errorf("%d: mismatched facility, actual %s expected %s", i, f, tt.expected)
+		}
+	}
+
+	s := newFacilitySelector(FacilitySelectionLeastUtilized, testFacility, candidates, fakeUtilization{err: errors.New("unavailable")})
+	if _, err := s.selectFacility(); err == nil {
+		t.Errorf("expected an error when utilization is unavailable")
+	}
+}
+
+func TestRoundRobinFacilities(t *testing.T) {
+	s := newFacilitySelector(FacilitySelectionRoundRobin, testFacility, []string{"ewr1", "sjc1", "ams1"}, nil)
+	expected := []string{"ewr1", "sjc1", "ams1", "ewr1", "sjc1"}
+	for i, e := range expected {
+		f, err := s.selectFacility()
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if f != e {
+			t.Errorf("%d: mismatched facility, actual %s expected %s", i, f, e)
+		}
+	}
+}
+
+func TestFixedFacility(t *testing.T) {
+	s := newFacilitySelector(FacilitySelectionFixed, testFacility, []string{"sjc1"}, nil)
+	for i := 0; i < 3; i++ {
+		if f, _ := s.selectFacility(); f != testFacility {
+			t.Errorf("%d: mismatched facility, actual %s expected %s", i, f, testFacility)
+		}
+	}
+}
+
+func TestReservationUtilization(t *testing.T) {
+	facility := func(code string) *packngo.Facility { return &packngo.Facility{Code: code} }
+	ips := &fakeProjectIPs{
+		reservations: []packngo.IPAddressReservation{
+			{IpAddressCommon: packngo.IpAddressCommon{ID: "a", Tags: []string{emTag}}, Facility: facility("ewr1")},
+			{IpAddressCommon: packngo.IpAddressCommon{ID: "b", Tags: []string{emTag}}, Facility: facility("ewr1")},
+			{IpAddressCommon: packngo.IpAddressCommon{ID: "c", Tags: []string{emTag}}, Facility: facility("ams1")},
+			// not managed, or not a candidate
+			{IpAddressCommon: packngo.IpAddressCommon{ID: "d"}, Facility: facility("sjc1")},
+			{IpAddressCommon: packngo.IpAddressCommon{ID: "e", Tags: []string{emTag}}, Facility: facility("dfw2")},
+		},
+	}
+	counts, err := reservationUtilization{client: ips, project: projectID}.utilization([]string{"ewr1", "sjc1", "ams1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]int{"ewr1": 2, "sjc1": 0, "ams1": 1}
+	for f, c := range expected {
+		if counts[f] != c {
+			t.Errorf("mismatched count for %s, actual %d expected %d", f, counts[f], c)
+		}
+	}
+	if len(counts) != len(expected) {
+		t.Errorf("mismatched facilities, actual %v expected %v", counts, expected)
+	}
+}
+
+func TestReconcileServicesEndpointsFacility(t *testing.T) {
+	// nodes in two metros, and one without a zone
+	node := func(name, metro, facility string) *v1.Node {
+		labels := map[string]string{}
+		if facility != "" {
+			labels[v1.LabelZoneRegionStable] = metro
+			labels[v1.LabelZoneFailureDomainStable] = facility
+		}
+		return &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+	}
+	endpoints := func(nodes ...string) *v1.Endpoints {
+		var addrs []v1.EndpointAddress
+		for i := range nodes {
+			addrs = append(addrs, v1.EndpointAddress{IP: "10.0.0.1", NodeName: &nodes[i]})
+		}
+		return &v1.Endpoints{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Subsets:    []v1.EndpointSubset{{Addresses: addrs}},
+		}
+	}
+	tests := []struct {
+		description string
+		selection   string
+		endpoints   *v1.Endpoints
+		facility    string
+	}{
+		{"all in one metro", FacilitySelectionEndpoints, endpoints("da-1", "da-2"), "da11"},
+		{"in both metros", FacilitySelectionEndpoints, endpoints("da-1", "ny-1"), testFacility},
+		{"no endpoints", FacilitySelectionEndpoints, nil, testFacility},
+		{"node without zone", FacilitySelectionEndpoints, endpoints("da-1", "bare"), testFacility},
+		{"unknown node", FacilitySelectionEndpoints, endpoints("da-1", "gone"), testFacility},
+		{"fixed selection", FacilitySelectionFixed, endpoints("da-1", "da-2"), testFacility},
+	}
+	for _, tt := range tests {
+		svc := testLoadBalancerService("default", "web", nil)
+		objs := []runtime.Object{
+			svc,
+			node("da-1", "da", "da11"),
+			node("da-2", "da", "da11"),
+			node("ny-1", "ny", "ny5"),
+			node("bare", "", ""),
+		}
+		if tt.endpoints != nil {
+			objs = append(objs, tt.endpoints)
+		}
+		ips := &fakeProjectIPs{}
+		l, _ := testGetLoadBalancers(ips, objs...)
+		l.endpointsAffinity = tt.selection == FacilitySelectionEndpoints
+
+		if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.description, err)
+		}
+		if len(ips.requests) != 1 {
+			t.Fatalf("%s: expected 1 request, had %d", tt.description, len(ips.requests))
+		}
+		if f := ips.requests[0].Facility; f == nil || *f != tt.facility {
+			t.Errorf("%s: mismatched facility, actual %v expected %s", tt.description, f, tt.facility)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/packethost/packngo"
+	"k8s.io/klog/v2"
+)
+
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+	// healthCacheTTL how long the result of a check of the API is reused for, so that frequent
+	// probes, or several of them, do not each call it
+	healthCacheTTL = 5 * time.Second
+	// healthCheckTimeout how long a probe waits for a check of the API before reporting not ready
+	healthCheckTimeout = 10 * time.Second
+)
+
+// apiHealth report if the Equinix Metal API can be reached with the auth token, by getting the
+// project. Probes share a single check in flight, and its result for the cache TTL.
+type apiHealth struct {
+	project  string
+	check    func() error
+	ttl      time.Duration
+	timeout  time.Duration
+	now      func() time.Time
+	lock     sync.Mutex
+	checked  time.Time
+	err      error
+	inflight chan struct{}
+}
+
+func newAPIHealth(client *packngo.Client, project string) *apiHealth {
+	return &apiHealth{
+		project: project,
+		check: func() error {
+			_, _, err := client.Projects.Get(project, nil)
+			return err
+		},
+		ttl:     healthCacheTTL,
+		timeout: healthCheckTimeout,
+		now:     time.Now,
+	}
+}
+
+// ready get the error of the last check of the API, checking it again if the result is older than
+// the cache TTL, or nil if it was reachable
+func (h *apiHealth) ready() error {
+	h.lock.Lock()
+	if !h.checked.IsZero() && h.now().Sub(h.checked) < h.ttl {
+		err := h.err
+		h.lock.Unlock()
+		return err
+	}
+	if h.inflight == nil {
+		done := make(chan struct{})
+		h.inflight = done
+		go func() {
+			err := h.describe(h.check())
+			h.lock.Lock()
+			h.err, h.checked, h.inflight = err, h.now(), nil
+			h.lock.Unlock()
+			close(done)
+		}()
+	}
+	done := h.inflight
+	h.lock.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(h.timeout):
+		return fmt.Errorf("the Equinix Metal API did not answer within %s", h.timeout)
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.err
+}
+
+// describe the error of a check, telling a token that is not allowed the project apart from an API
+// that could not be reached, as the one needs a new token and the other does not
+func (h *apiHealth) describe(err error) error {
+	if err == nil {
+		return nil
+	}
+	if perr, ok := err.(*packngo.ErrorResponse); ok && perr.Response != nil {
+		switch perr.Response.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return fmt.Errorf("the Equinix Metal API rejected the auth token for project %s: %v", h.project, err)
+		}
+	}
+	return fmt.Errorf("unable to reach the Equinix Metal API: %v", err)
+}
+
+// readyzHandler report ready if the Equinix Metal API can be reached, else not ready, with the
+// error of the last check in the body
+func readyzHandler(h *apiHealth) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := h.ready(); err != nil {
+			klog.V(2).Infof("readyzHandler(): not ready: %v", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}
+}
+
+// healthzHandler report healthy for as long as the CCM serves at all; the API is left to readiness,
+// so that losing it does not restart the CCM
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	_, _ = w.Write([]byte("ok"))
+}
+
+// serveHealth serve the health and readiness probes on the given address until the context is done
+func serveHealth(ctx context.Context, addr string, h *apiHealth) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(healthzPath, healthzHandler)
+	mux.Handle(readyzPath, readyzHandler(h))
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+	klog.Infof("serving health on %s%s and readiness on %s%s", addr, healthzPath, addr, readyzPath)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		klog.Errorf("health server failed: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package metal
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/packethost/packngo"
+)
+
+func TestReadyzHandler(t *testing.T) {
+	var status int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/projects/"+projectID {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			_, _ = w.Write([]byte(`{"id": "` + projectID + `"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"errors": ["You are not authorized to view this project"]}`))
+	}))
+	defer ts.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		url    string
+		status int
+		code   int
+		body   string
+	}{
+		// reachable
+		{ts.URL, http.StatusOK, http.StatusOK, "ok"},
+		// forbidden
+		{ts.URL, http.StatusForbidden, http.StatusServiceUnavailable, "rejected the auth token for project " + projectID},
+		{ts.URL, http.StatusUnauthorized, http.StatusServiceUnavailable, "rejected the auth token for project " + projectID},
+		// unreachable
+		{ts.URL, http.StatusBadGateway, http.StatusServiceUnavailable, "unable to reach the Equinix Metal API"},
+		{closed.URL, 0, http.StatusServiceUnavailable, "unable to reach the Equinix Metal API"},
+	}
+	for i, tt := range tests {
+		status = tt.status
+		client, err := packngo.NewClientWithBaseURL("", token, nil, tt.url)
+		if err != nil {
+			t.Fatalf("%d: unable to create client: %v", i, err)
+		}
+		rec := httptest.NewRecorder()
+		readyzHandler(newAPIHealth(client, projectID)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, readyzPath, nil))
+		if rec.Code != tt.code {
+			t.Errorf("%d: mismatched status, actual %d expected %d", i, rec.Code, tt.code)
+		}
+		if body := rec.Body.String(); !strings.Contains(body, tt.body) {
+			t.Errorf("%d: body %q does not have %q", i, body, tt.body)
+		}
+	}
+}
+
+func TestAPIHealthCache(t *testing.T) {
+	now := time.Now()
+	var checks int
+	checkErr := errors.New("connection refused")
+	h := &apiHealth{
+		project: projectID,
+		check: func() error {
+			checks++
+			return checkErr
+		},
+		ttl:     healthCacheTTL,
+		timeout: healthCheckTimeout,
+		now:     func() time.Time { return now },
+	}
+
+	// the result is reused within the TTL
+	for i := 0; i < 3; i++ {
+		if err := h.ready(); err == nil || !strings.Contains(err.Error(), checkErr.Error()) {
+			t.Errorf("%d: expected the check error, got %v", i, err)
+		}
+	}
+	if checks != 1 {
+		t.Errorf("expected 1 check within the TTL, had %d", checks)
+	}
+
+	// and checked again once it passed
+	checkErr = nil
+	now = now.Add(healthCacheTTL)
+	if err := h.ready(); err != nil {
+		t.Errorf("unexpected error after recovery: %v", err)
+	}
+	if checks != 2 {
+		t.Errorf("expected 2 checks after the TTL, had %d", checks)
+	}
+}
+
+func TestAPIHealthTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	h := &apiHealth{
+		project: projectID,
+		check: func() error {
+			<-release
+			return nil
+		},
+		ttl:     healthCacheTTL,
+		timeout: 10 * time.Millisecond,
+		now:     time.Now,
+	}
+	if err := h.ready(); err == nil || !strings.Contains(err.Error(), "did not answer") {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+}
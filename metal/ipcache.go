@@ -0,0 +1,84 @@
+package metal
+
+import (
+	"sync"
+	"time"
+
+	"github.com/packethost/packngo"
+)
+
+// DefaultIPCacheTTL how long a list of the reservations of the project is used before listing again
+const DefaultIPCacheTTL = 30 * time.Second
+
+// reservationCache the reservations of each project, as last listed, so that the reconciles of
+// many services, each starting with a list of every reservation, do not each ask the API again.
+// Whatever changes the reservations here, a request, a removal or a change of tags, invalidates
+// the project, so that the next list sees the change; one made by anything else is seen once the
+// entry expires. A TTL of 0 disables it, but for last, which gets the last list whatever the TTL.
+type reservationCache struct {
+	ttl     time.Duration
+	now     func() time.Time
+	lock    sync.Mutex
+	entries map[string]reservationCacheEntry
+	// generations counts the invalidations of each project, so that a list that started before one
+	// is not cached after it
+	generations map[string]uint64
+}
+
+type reservationCacheEntry struct {
+	ips     []packngo.IPAddressReservation
+	expires time.Time
+}
+
+func newReservationCache(ttl time.Duration) *reservationCache {
+	return &reservationCache{
+		ttl:         ttl,
+		now:         time.Now,
+		entries:     map[string]reservationCacheEntry{},
+		generations: map[string]uint64{},
+	}
+}
+
+// get the reservations of the project, from the cache if they have not expired, else from list
+func (c *reservationCache) get(project string, list func() ([]packngo.IPAddressReservation, error)) ([]packngo.IPAddressReservation, error) {
+	now := c.now()
+	c.lock.Lock()
+	entry, ok := c.entries[project]
+	generation := c.generations[project]
+	c.lock.Unlock()
+	if c.ttl > 0 && ok && now.Before(entry.expires) {
+		// callers may change the slice, so each has its own
+		return append([]packngo.IPAddressReservation{}, entry.ips...), nil
+	}
+
+	ips, err := list()
+	if err != nil {
+		return ips, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.generations[project] == generation {
+		c.entries[project] = reservationCacheEntry{ips: append([]packngo.IPAddressReservation{}, ips...), expires: now.Add(c.ttl)}
+	}
+	return ips, nil
+}
+
+// last get the reservations of the project as last listed, whether or not they have expired, for
+// what only shows them, e.g. the desired config; changes made through the cache still invalidate
+func (c *reservationCache) last(project string) ([]packngo.IPAddressReservation, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[project]
+	if !ok {
+		return nil, false
+	}
+	return append([]packngo.IPAddressReservation{}, entry.ips...), true
+}
+
+// invalidate forget the reservations of the project, e.g. when one was requested or removed
+func (c *reservationCache) invalidate(project string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.entries, project)
+	c.generations[project]++
+}
@@ -0,0 +1,142 @@
+package metal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestReservationCache(t *testing.T) {
+	var (
+		lists int
+		fail  bool
+	)
+	list := func() ([]packngo.IPAddressReservation, error) {
+		lists++
+		if fail {
+			return nil, errors.New("unavailable")
+		}
+		return []packngo.IPAddressReservation{{IpAddressCommon: packngo.IpAddressCommon{ID: "ip"}}}, nil
+	}
+	cache := newReservationCache(time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	get := func(step, project string, expectedLists int) []packngo.IPAddressReservation {
+		ips, err := cache.get(project, list)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", step, err)
+		}
+		if lists != expectedLists {
+			t.Errorf("%s: mismatched lists, actual %d expected %d", step, lists, expectedLists)
+		}
+		return ips
+	}
+
+	// the first is listed, the next are hits until the TTL
+	get("first", "project", 1)
+	now = now.Add(59 * time.Second)
+	ips := get("hit", "project", 1)
+	// which the caller may change without changing the cache
+	ips[0].ID = "changed"
+	if ips := get("hit after change", "project", 1); ips[0].ID != "ip" {
+		t.Errorf("cached reservations changed by the caller, ID %s", ips[0].ID)
+	}
+	get("other project", "other", 2)
+	now = now.Add(2 * time.Second)
+	get("expired", "project", 3)
+
+	// invalidated, it is listed again, only for that project
+	cache.invalidate("project")
+	get("invalidated", "project", 4)
+	get("other project not invalidated", "other", 4)
+
+	// an error is not cached
+	cache.invalidate("project")
+	fail = true
+	if _, err := cache.get("project", list); err == nil {
+		t.Error("expected an error")
+	}
+	fail = false
+	get("after error", "project", 6)
+
+	// a list that was under way when invalidated is not cached
+	cache.invalidate("project")
+	if _, err := cache.get("project", func() ([]packngo.IPAddressReservation, error) {
+		cache.invalidate("project")
+		return list()
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	get("after invalidated list", "project", 8)
+
+	// disabled, every get lists
+	cache = newReservationCache(0)
+	get("disabled", "project", 9)
+	get("disabled again", "project", 10)
+
+	// but the last list is kept, until invalidated
+	if ips, ok := cache.last("project"); !ok || len(ips) != 1 || lists != 10 {
+		t.Errorf("expected the last list without listing, had %v after %d lists", ips, lists)
+	}
+	cache.invalidate("project")
+	if _, ok := cache.last("project"); ok {
+		t.Error("expected no last list after invalidation")
+	}
+}
+
+func TestReservationCacheConcurrent(t *testing.T) {
+	cache := newReservationCache(time.Minute)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.get("project", func() ([]packngo.IPAddressReservation, error) { return nil, nil }); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			cache.invalidate("project")
+		}()
+	}
+	wg.Wait()
+}
+
+func TestReconcileServicesIPCache(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", nil)
+	ips := &fakeProjectIPs{}
+	l, _ := testGetLoadBalancers(ips, svc)
+	l.ipCache = newReservationCache(time.Minute)
+	ctx := context.Background()
+	reconcile := func(step string, mode UpdateMode, expectedLists int, svcs ...*v1.Service) {
+		if err := l.reconcileServices(ctx, svcs, mode); err != nil {
+			t.Fatalf("%s: unexpected error: %v", step, err)
+		}
+		if ips.lists != expectedLists {
+			t.Errorf("%s: mismatched lists, actual %d expected %d", step, ips.lists, expectedLists)
+		}
+	}
+
+	// the add lists, and lists again after its request
+	reconcile("add", ModeAdd, 2, svc)
+	if len(ips.requests) != 1 {
+		t.Fatalf("expected 1 request, had %d", len(ips.requests))
+	}
+	// nothing changed, so the syncs, which list twice each, do not list at all
+	reconcile("sync", ModeSync, 2, svc)
+	reconcile("sync again", ModeSync, 2, svc)
+
+	// removal removes the reservation, after which it is listed again
+	reconcile("remove", ModeRemove, 2, svc)
+	if len(ips.removed) != 1 {
+		t.Fatalf("expected 1 removal, had %d", len(ips.removed))
+	}
+	reconcile("sync after remove", ModeSync, 3)
+	reconcile("sync after remove again", ModeSync, 3)
+}
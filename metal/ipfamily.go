@@ -0,0 +1,128 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	annotationEIPFamily = "metal.equinix.com/eip-family"
+
+	eipFamilyIPv4 = "ipv4"
+	eipFamilyIPv6 = "ipv6"
+)
+
+// ipv6Only report if the service asks for an IPv6 address only, rather than an IPv4 one, or one of
+// each. The annotation takes precedence over the IP family of the service.
+func ipv6Only(svc *v1.Service) bool {
+	if dualStack(svc) {
+		return false
+	}
+	if family, ok := svc.Annotations[annotationEIPFamily]; ok {
+		return family == eipFamilyIPv6
+	}
+	return svc.Spec.IPFamily != nil && *svc.Spec.IPFamily == v1.IPv6Protocol
+}
+
+// isIPv6 report if the address is an IPv6 one
+func isIPv6(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && ip.To4() == nil
+}
+
+// addServiceIPv6Only add a service that has only an IPv6 address. It is found by the same tags as
+// the IPv6 half of a dual-stack service, but is written to spec.loadBalancerIP, as an IPv4 one is.
+// A service that had an IPv4 address stops advertising it; the sync releases its reservation.
+func (l *loadBalancers) addServiceIPv6Only(ctx context.Context, svc *v1.Service, ips []packngo.IPAddressReservation) error {
+	var err error
+	svcName := serviceRep(svc)
+	svcIP := l.assignedIP(svc)
+	tags := []string{emTag, serviceTag(svc), clusterTag(l.clusterID), ipv6FamilyTag}
+	ipReservation := ipReservationByAllTags(tags, ips)
+
+	if svcIP != "" && !isIPv6(svcIP) {
+		klog.V(2).Infof("service %s now is IPv6 only, replacing IPv4 address %s", svcName, svcIP)
+		if err := l.unadvertise(ctx, svc, svcIP, ips); err != nil {
+			return err
+		}
+		svcIP = ""
+	}
+	if svcIP != "" && l.rejectUnapproved(svc, svcIP, ipReservationByAddress(svcIP, ips)) {
+		return nil
+	}
+	if svcIP != "" {
+		if rejected, err := l.rejectUnowned(ctx, svc, svcIP, ips); err != nil || rejected {
+			return err
+		}
+	}
+	if svcIP == "" {
+		// the list of reservations may be stale, see addService
+		if ipReservation != nil {
+			if ipReservation, err = l.currentReservation(ctx, ipReservation.ID); err != nil {
+				return err
+			}
+		}
+		if ipReservation == nil {
+			if ipReservation, err = l.pendingReservation(ctx, svcName); err != nil {
+				return err
+			}
+		}
+		if ipReservation == nil {
+			klog.V(2).Infof("no IPv6 assignment found for %s, requesting", svcName)
+			facility, err := l.selectServiceFacility(ctx, svc)
+			if err != nil {
+				return fmt.Errorf("failed to select a facility for the load balancer IPv6 address: %v", err)
+			}
+			req := packngo.IPReservationRequest{
+				Type:                   "public_ipv6",
+				Quantity:               1,
+				Description:            l.describeReservation(svc),
+				Facility:               &facility,
+				Tags:                   append(append(tags, l.serviceLabelTags(svc)...), l.serviceAdditionalTags(svc)...),
+				FailOnApprovalRequired: l.failOnApprovalRequired(svc),
+			}
+			ipReservation, err = l.requestReservation(ctx, svc, &req, func(ips []packngo.IPAddressReservation) []*packngo.IPAddressReservation {
+				return ipReservationsByAllTags(tags, ips)
+			})
+			if err != nil {
+				return fmt.Errorf("failed to request an IPv6 address for the load balancer: %w", err)
+			}
+		}
+		if !l.hasAddress(svcName, ipReservation) {
+			return nil
+		}
+		if l.rejectUnapproved(svc, ipReservation.Address, ipReservation) {
+			return nil
+		}
+		svcIP = ipReservation.Address
+		klog.V(2).Infof("assigning IPv6 address %s to %s", svcIP, svcName)
+		if err := l.writeServiceIP(ctx, svc, svcIP); err != nil {
+			klog.Warningf("failed to assign IPv6 address %s to service %s, will try again on next reconcile: %v", svcIP, svcName, err)
+			l.recordPending(svcName, ipReservation.ID)
+			return nil
+		}
+	}
+	if ipReservation != nil {
+		l.updateLabelTags(ctx, svc, ipReservation)
+	}
+	if allocateOnly(svc) {
+		return l.setIngressIPs(ctx, svc, svcIP)
+	}
+	if err := l.implementor.AddService(ctx, poolName(svc), hostCIDR(svcIP), l.serviceOptions(ctx, svc)); err != nil {
+		return err
+	}
+	for _, ip := range l.advertisedExternalIPs(svc, svcIP, ips) {
+		if err := l.implementor.AddService(ctx, svcName+"/"+ip, hostCIDR(ip), l.serviceOptions(ctx, svc)); err != nil {
+			return err
+		}
+	}
+	if !l.writeSpecIP {
+		return l.setIngressIPs(ctx, svc, svcIP)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package metal
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIPv6Only(t *testing.T) {
+	ipv4, ipv6 := v1.IPv4Protocol, v1.IPv6Protocol
+	tests := []struct {
+		annotations map[string]string
+		family      *v1.IPFamily
+		only        bool
+	}{
+		{nil, nil, false},
+		{nil, &ipv4, false},
+		{nil, &ipv6, true},
+		{map[string]string{annotationEIPFamily: eipFamilyIPv6}, nil, true},
+		{map[string]string{annotationEIPFamily: eipFamilyIPv4}, nil, false},
+		// the annotation wins
+		{map[string]string{annotationEIPFamily: eipFamilyIPv4}, &ipv6, false},
+		{map[string]string{annotationEIPFamily: eipFamilyIPv6}, &ipv4, true},
+		// dual-stack is both
+		{map[string]string{annotationEIPFamily: eipFamilyIPv6, annotationEIPDualStack: "true"}, &ipv6, false},
+	}
+	for i, tt := range tests {
+		svc := testLoadBalancerService("default", "web", tt.annotations)
+		svc.Spec.IPFamily = tt.family
+		if only := ipv6Only(svc); only != tt.only {
+			t.Errorf("%d: mismatched IPv6 only, actual %v expected %v", i, only, tt.only)
+		}
+	}
+}
+
+func TestReconcileServicesIPv6Only(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", map[string]string{annotationEIPFamily: eipFamilyIPv6})
+	ips := &fakeProjectIPs{}
+	l, lb := testGetLoadBalancers(ips, svc)
+	current := func() *v1.Service {
+		existing, err := l.k8sclient.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unable to get service: %v", err)
+		}
+		return existing
+	}
+
+	// creation reserves only an IPv6 address, and writes it as the loadBalancerIP
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.requests) != 1 || ips.requests[0].Type != "public_ipv6" {
+		t.Fatalf("expected a single IPv6 request, had %v", ips.requests)
+	}
+	expectedTags := []string{emTag, serviceTag(svc), clusterTag(testClusterID), ipv6FamilyTag}
+	if strings.Join(ips.requests[0].Tags, ",") != strings.Join(expectedTags, ",") {
+		t.Errorf("mismatched tags, actual %v expected %v", ips.requests[0].Tags, expectedTags)
+	}
+	ipv6 := "2604:1380:100::1"
+	updated := current()
+	if updated.Spec.LoadBalancerIP != ipv6 {
+		t.Errorf("mismatched loadBalancerIP, actual %s expected %s", updated.Spec.LoadBalancerIP, ipv6)
+	}
+	if len(lb.services) != 1 || lb.services[ipv6+"/128"] != "default/web" {
+		t.Errorf("expected only %s/128 mapped, have %v", ipv6, lb.services)
+	}
+
+	// another pass does not reserve or release anything
+	if err := l.reconcileServices(context.Background(), []*v1.Service{updated}, ModeSync); err != nil {
+		t.Fatalf("unexpected error on sync: %v", err)
+	}
+	if len(ips.requests) != 1 || len(ips.removed) != 0 || len(lb.services) != 1 {
+		t.Errorf("sync changed an IPv6 only service: %d requests, removed %v, load balancer %v", len(ips.requests), ips.removed, lb.services)
+	}
+
+	// cleanup releases it
+	if err := l.reconcileServices(context.Background(), []*v1.Service{updated}, ModeRemove); err != nil {
+		t.Fatalf("unexpected error on remove: %v", err)
+	}
+	if len(ips.removed) != 1 || len(ips.reservations) != 0 || len(lb.services) != 0 {
+		t.Errorf("expected the reservation released and unmapped, removed %v, remaining %v, load balancer %v", ips.removed, ips.reservations, lb.services)
+	}
+}
+
+func TestReconcileServicesSwitchFamily(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", nil)
+	ips := &fakeProjectIPs{}
+	l, lb := testGetLoadBalancers(ips, svc)
+	reconcile := func(step, family string) *v1.Service {
+		existing, err := l.k8sclient.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("%s: unable to get service: %v", step, err)
+		}
+		if family != "" {
+			existing.Annotations = map[string]string{annotationEIPFamily: family}
+			if existing, err = l.k8sclient.CoreV1().Services("default").Update(context.Background(), existing, metav1.UpdateOptions{}); err != nil {
+				t.Fatalf("%s: unable to update service: %v", step, err)
+			}
+		}
+		for _, mode := range []UpdateMode{ModeAdd, ModeSync} {
+			if err := l.reconcileServices(context.Background(), []*v1.Service{existing}, mode); err != nil {
+				t.Fatalf("%s: unexpected error on %v: %v", step, mode, err)
+			}
+			if existing, err = l.k8sclient.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{}); err != nil {
+				t.Fatalf("%s: unable to get service: %v", step, err)
+			}
+		}
+		return existing
+	}
+	check := func(step string, svc *v1.Service, v6 bool) {
+		addr := svc.Spec.LoadBalancerIP
+		if addr == "" || isIPv6(addr) != v6 {
+			t.Fatalf("%s: mismatched loadBalancerIP %q, expected IPv6 %v", step, addr, v6)
+		}
+		if len(lb.services) != 1 || lb.services[hostCIDR(addr)] != "default/web" {
+			t.Errorf("%s: expected only %s mapped, have %v", step, addr, lb.services)
+		}
+		// the reservation of the other family is released, and the lookup by tags finds this one
+		if len(ips.reservations) != 1 || ips.reservations[0].Address != addr {
+			t.Errorf("%s: expected only the reservation of %s, have %v", step, addr, ips.reservations)
+		}
+	}
+
+	check("ipv4", reconcile("ipv4", ""), false)
+	check("to ipv6", reconcile("to ipv6", eipFamilyIPv6), true)
+	check("back to ipv4", reconcile("back to ipv4", eipFamilyIPv4), false)
+}
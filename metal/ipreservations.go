@@ -1,9 +1,46 @@
 package metal
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+
 	"github.com/packethost/packngo"
 )
 
+const (
+	ipBasePath = "/ips"
+)
+
+// ipReservationTagger updates the tags on an existing IP reservation. packngo's
+// ProjectIPService does not expose an update call, so the default implementation
+// goes to the API directly.
+type ipReservationTagger interface {
+	UpdateTags(reservationID string, tags []string) (*packngo.IPAddressReservation, *packngo.Response, error)
+}
+
+type ipReservationTaggerOp struct {
+	client *packngo.Client
+}
+
+// UpdateTags replace the tags on the reservation with the given ID
+func (i ipReservationTaggerOp) UpdateTags(reservationID string, tags []string) (*packngo.IPAddressReservation, *packngo.Response, error) {
+	apiPath := path.Join(ipBasePath, reservationID)
+	body := map[string]interface{}{
+		"tags": tags,
+	}
+	ipr := new(packngo.IPAddressReservation)
+	resp, err := i.client.DoRequest("PATCH", apiPath, body, ipr)
+	if err != nil {
+		return nil, resp, err
+	}
+	return ipr, resp, nil
+}
+
 // ipReservationByAllTags given a set of packngo.IPAddressReservation and a set of tags, find
 // the first reservation that has all of those tags
 func ipReservationByAllTags(targetTags []string, ips []packngo.IPAddressReservation) *packngo.IPAddressReservation {
@@ -43,6 +80,61 @@ ips:
 	return ret
 }
 
+// ipReservationsWithoutTag given a set of packngo.IPAddressReservation and a tag, get
+// the reservations that do not have that tag
+func ipReservationsWithoutTag(tag string, ips []packngo.IPAddressReservation) []packngo.IPAddressReservation {
+	ret := []packngo.IPAddressReservation{}
+ips:
+	for _, ip := range ips {
+		for _, t := range ip.Tags {
+			if t == tag {
+				continue ips
+			}
+		}
+		ret = append(ret, ip)
+	}
+	return ret
+}
+
+// ipReservationByAddress given a set of packngo.IPAddressReservation and an address, find
+// the reservation whose block includes that address
+func ipReservationByAddress(addr string, ips []packngo.IPAddressReservation) *packngo.IPAddressReservation {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil
+	}
+	for i, ipr := range ips {
+		_, block, err := net.ParseCIDR(fmt.Sprintf("%s/%d", ipr.Address, ipr.CIDR))
+		if err != nil {
+			continue
+		}
+		if block.Contains(ip) {
+			return &ips[i]
+		}
+	}
+	return nil
+}
+
+// errAmbiguousDescription more than one reservation has the description being searched for
+var errAmbiguousDescription = errors.New("multiple reservations share the description")
+
+// ipReservationByDescription given a set of packngo.IPAddressReservation and a description, find
+// the reservation with exactly that description. If more than one matches, we cannot know which
+// is correct, so return errAmbiguousDescription rather than guessing.
+func ipReservationByDescription(description string, ips []packngo.IPAddressReservation) (*packngo.IPAddressReservation, error) {
+	var ret *packngo.IPAddressReservation
+	for i, ip := range ips {
+		if ip.Description == nil || *ip.Description != description {
+			continue
+		}
+		if ret != nil {
+			return nil, errAmbiguousDescription
+		}
+		ret = &ips[i]
+	}
+	return ret, nil
+}
+
 // ipReservationByAnyTags given a set of packngo.IPAddressReservation and a set of tags, find
 // the first reservation that has any of those tags
 func ipReservationByAnyTags(targetTags []string, ips []packngo.IPAddressReservation) *packngo.IPAddressReservation {
@@ -77,3 +169,69 @@ func ipReservationsByAnyTags(targetTags []string, ips []packngo.IPAddressReserva
 	// if we made it here, nothing matched
 	return ret
 }
+
+// managedTag report if the tag is of a key that the CCM sets and reads, or a label tag, so may not
+// be set by the user, as it could change which reservations are found or released
+func managedTag(tag string) bool {
+	if strings.HasPrefix(tag, labelTagPrefix) {
+		return true
+	}
+	switch strings.SplitN(tag, "=", 2)[0] {
+	case "usage", "cluster", "service", "family", "role", "block", "allocation":
+		return true
+	}
+	return false
+}
+
+// knownTagScheme report if the tags of a reservation are all of the forms that the CCM sets, so
+// that it can tell whether the reservation is of a service that still exists. A reservation with
+// a tag of a key the CCM uses, but a value it does not know the form of, most likely was tagged
+// by another version of the CCM, e.g. a newer one before a rollback, and must not be taken for
+// an orphan. It needs a service tag too. Tags of other keys, e.g. set by hand, do not matter.
+func knownTagScheme(tags []string) bool {
+	var service bool
+	for _, tag := range tags {
+		i := strings.Index(tag, "=")
+		if i < 0 || strings.HasPrefix(tag, labelTagPrefix) {
+			continue
+		}
+		key, value := tag[:i], tag[i+1:]
+		switch key {
+		case "usage":
+			if tag != emTag && tag != emRetainedTag {
+				return false
+			}
+		case "cluster":
+			if value == "" {
+				return false
+			}
+		case "service":
+			// the base64url of a sha256, or the standard base64 of before
+			b, err := base64.RawURLEncoding.DecodeString(value)
+			if err != nil {
+				b, err = base64.StdEncoding.DecodeString(value)
+			}
+			if err != nil || len(b) != sha256.Size {
+				return false
+			}
+			service = true
+		case "family":
+			if tag != ipv4FamilyTag && tag != ipv6FamilyTag {
+				return false
+			}
+		case "role":
+			if tag != standbyTag {
+				return false
+			}
+		case "block":
+			if tag != sharedBlockTag {
+				return false
+			}
+		case "allocation":
+			if parts := strings.SplitN(value, ",", 2); len(parts) != 2 || net.ParseIP(parts[0]) == nil {
+				return false
+			}
+		}
+	}
+	return service
+}
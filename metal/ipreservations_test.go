@@ -76,3 +76,103 @@ func TestIPReservationByAnyTags(t *testing.T) {
 		}
 	}
 }
+
+func TestIPReservationByDescription(t *testing.T) {
+	desc := func(s string) *string { return &s }
+	ips := []packngo.IPAddressReservation{
+		{Description: nil},
+		{Description: desc("a")},
+		{Description: desc("b")},
+		{Description: desc("b")},
+	}
+	tests := []struct {
+		description string
+		match       int
+		err         error
+	}{
+		{"a", 1, nil},
+		{"b", -1, errAmbiguousDescription},
+		{"c", -1, nil},
+		{"", -1, nil},
+	}
+
+	for i, tt := range tests {
+		matched, err := ipReservationByDescription(tt.description, ips)
+		switch {
+		case err != tt.err:
+			t.Errorf("%d: mismatched error, actual %v expected %v", i, err, tt.err)
+		case matched == nil && tt.match >= 0:
+			t.Errorf("%d: found no match but expected index %d", i, tt.match)
+		case matched != nil && tt.match < 0:
+			t.Errorf("%d: found a match but expected none", i)
+		case matched == nil && tt.match < 0:
+			// this is good
+		case matched != &ips[tt.match]:
+			t.Errorf("%d: match did not find index %d", i, tt.match)
+		}
+	}
+}
+
+func TestIPReservationByAddress(t *testing.T) {
+	ips := []packngo.IPAddressReservation{
+		{IpAddressCommon: packngo.IpAddressCommon{Address: "147.75.1.1", CIDR: 32}},
+		{IpAddressCommon: packngo.IpAddressCommon{Address: "147.75.200.0", CIDR: 30}},
+		{IpAddressCommon: packngo.IpAddressCommon{Address: "2604:1380:100::", CIDR: 64}},
+		{IpAddressCommon: packngo.IpAddressCommon{Address: "", CIDR: 32}},
+	}
+	tests := []struct {
+		addr  string
+		match int
+	}{
+		{"147.75.1.1", 0},
+		{"147.75.1.2", -1},
+		{"147.75.200.0", 1},
+		{"147.75.200.3", 1},
+		{"147.75.200.4", -1},
+		{"2604:1380:100::5", 2},
+		{"not-an-ip", -1},
+		{"", -1},
+	}
+
+	for i, tt := range tests {
+		matched := ipReservationByAddress(tt.addr, ips)
+		switch {
+		case matched == nil && tt.match >= 0:
+			t.Errorf("%d: found no match but expected index %d", i, tt.match)
+		case matched != nil && tt.match < 0:
+			t.Errorf("%d: found a match but expected none", i)
+		case matched == nil && tt.match < 0:
+			// this is good
+		case matched != &ips[tt.match]:
+			t.Errorf("%d: match did not find index %d", i, tt.match)
+		}
+	}
+}
+
+func TestKnownTagScheme(t *testing.T) {
+	svc := serviceTag(testLoadBalancerService("default", "web", nil))
+	cls := clusterTag(testClusterID)
+	tests := []struct {
+		tags  []string
+		known bool
+	}{
+		{[]string{emTag, svc, cls}, true},
+		{[]string{emRetainedTag, svc, cls}, true},
+		{[]string{emTag, svc, cls, ipv6FamilyTag, standbyTag, labelTagPrefix + "team=web"}, true},
+		// tags of other keys do not matter
+		{[]string{emTag, svc, cls, "owner=ops", "manual"}, true},
+		// no service tag
+		{[]string{emTag, cls}, false},
+		// values of another form
+		{[]string{emTag, "service=v2:default/web", cls}, false},
+		{[]string{emTag, "service=abc", cls}, false},
+		{[]string{emTag, svc, cls, "family=dual"}, false},
+		{[]string{emTag, svc, cls, "role=canary"}, false},
+		{[]string{"usage=cloud-provider-equinix-metal-v2", svc, cls}, false},
+	}
+	for i, tt := range tests {
+		if known := knownTagScheme(tt.tags); known != tt.known {
+			t.Errorf("%d: %v: mismatched known, actual %v expected %v", i, tt.tags, known, tt.known)
+		}
+	}
+}
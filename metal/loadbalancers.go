@@ -5,7 +5,13 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"net"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers"
 	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers/empty"
@@ -15,31 +21,221 @@ import (
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 )
 
 const (
 	bufferSize = 4096
+	// nodeSyncProgressInterval how many node lookups between progress logs
+	nodeSyncProgressInterval = 50
+	// peerLookupConcurrency how many BGP neighbour lookups of nodes are in flight at once, so that
+	// many nodes joining at once are not looked up one after the other, nor all at once
+	peerLookupConcurrency = 10
 )
 
 type loadBalancers struct {
 	client            *packngo.Client
 	k8sclient         kubernetes.Interface
 	project           string
-	facility          string
+	facilitySelector  facilitySelector
+	endpointsAffinity bool
 	clusterID         string
 	implementor       loadbalancers.LB
 	implementorConfig string
+	reservationCIDR   int
+	defaultBlockSize  int
+	reuseScope        string
+	manageExternalIPs bool
+	labelTags         []string
+	additionalTags    []string
+	poolPriority      []string
+	excludedNS        map[string]bool
+	descriptionTmpl   string
+	warnDuplicates    bool
+	checkManageable   bool
+	degradedReconcile bool
+	waitForApproval   bool
+	standbyFacility   string
+	approvedCIDR      *net.IPNet
+	nodeSelector      labels.Selector
+	bgpPass           string
+	bgpAnnotations    bgpAnnotations
+	bgpHoldTime       time.Duration
+	bgpKeepalive      time.Duration
+	holdNoReadyNodes  bool
+	withdrawOnCordon  bool
+	withdrawTaint     string
+	peers             *peerCache
+	ipCache           *reservationCache
+	metrics           reconcileMetrics
+	ipTagger          ipReservationTagger
+	events            reservationEventSink
+	serviceLocks      *serviceLocks
+	logSummary        func(*reconcileSummary)
+	retry             apiRetry
+	class             string
+	metallbMode       string
+	createConfigMap   bool
+	dryRun            bool
+	writeSpecIP       bool
+	dynamicClient     dynamic.Interface
+	recorder          record.EventRecorder
+	// endpointsLister the endpoints of the informer, if it is started, else they are got live
+	endpointsLister corelisters.EndpointsLister
+	// pending reservations not yet written to their service, by service: those that were created
+	// without an address, and those for which the service could not be updated
+	pending     map[string]string
+	pendingLock sync.Mutex
+	// cachedIPs the reservations as last listed, for degraded reconciles
+	cachedIPs     []packngo.IPAddressReservation
+	cachedIPsLock sync.Mutex
+	// blockLock serializes the allocation of the addresses of shared blocks, and the claim of free
+	// reservations, see stillFree
+	blockLock sync.Mutex
+	// warnedDuplicates the groups of services of the same selector last warned about, by their names
+	warnedDuplicates     map[string]bool
+	warnedDuplicatesLock sync.Mutex
 }
 
-func newLoadBalancers(client *packngo.Client, projectID, facility string, config string) *loadBalancers {
-	return &loadBalancers{client, nil, projectID, facility, "", nil, config}
+// newLoadBalancers get the loadbalancers of the config, which is validated, see Config.Validate
+func newLoadBalancers(client *packngo.Client, metalConfig Config, events reservationEventSink) *loadBalancers {
+	// these are validated with the rest of the config, so an empty one is the only one that does not parse
+	_, approved, _ := net.ParseCIDR(metalConfig.ReservationApprovedCIDR)
+	selector := labels.Everything()
+	if metalConfig.BGPNodeSelector != "" {
+		selector, _ = labels.Parse(metalConfig.BGPNodeSelector)
+	}
+	excluded := map[string]bool{}
+	for _, ns := range metalConfig.ExcludedNamespaces {
+		excluded[ns] = true
+	}
+	lookupPeer := func(providerID string) (*packngo.BGPNeighbor, error) {
+		defer observePackngoRequest("get_bgp_neighbors", time.Now())
+		return getNodeBGPConfig(providerID, client)
+	}
+	projectID := metalConfig.ProjectID
+	return &loadBalancers{
+		client:            client,
+		project:           projectID,
+		facilitySelector:  newFacilitySelector(metalConfig.FacilitySelection, metalConfig.Facility, metalConfig.FacilityCandidates, reservationUtilization{client: client.ProjectIPs, project: projectID}),
+		endpointsAffinity: metalConfig.FacilitySelection == FacilitySelectionEndpoints,
+		implementorConfig: metalConfig.LoadBalancerSetting,
+		reservationCIDR:   metalConfig.ReservationCIDR,
+		defaultBlockSize:  metalConfig.DefaultEIPBlockSize,
+		reuseScope:        metalConfig.ReservationReuseScope,
+		manageExternalIPs: metalConfig.ManageExternalIPs,
+		labelTags:         metalConfig.ReservationLabelTags,
+		additionalTags:    metalConfig.EIPAdditionalTags,
+		poolPriority:      metalConfig.EIPPoolPriority,
+		excludedNS:        excluded,
+		descriptionTmpl:   metalConfig.EIPDescriptionTemplate,
+		warnDuplicates:    metalConfig.WarnDuplicateSelectors,
+		checkManageable:   metalConfig.CheckManageable,
+		degradedReconcile: metalConfig.DegradedReconcile,
+		waitForApproval:   metalConfig.WaitForIPApproval,
+		standbyFacility:   metalConfig.StandbyFacility,
+		approvedCIDR:      approved,
+		nodeSelector:      selector,
+		bgpPass:           metalConfig.BGPPass,
+		bgpAnnotations: bgpAnnotations{
+			localASN:  metalConfig.AnnotationLocalASN,
+			peerASNs:  metalConfig.AnnotationPeerASNs,
+			peerIPs:   metalConfig.AnnotationPeerIPs,
+			bgpPass:   metalConfig.AnnotationBGPPass,
+			holdTime:  metalConfig.AnnotationBGPHoldTime,
+			keepalive: metalConfig.AnnotationBGPKeepalive,
+		},
+		bgpHoldTime:      metalConfig.BGPHoldTime,
+		bgpKeepalive:     metalConfig.BGPKeepalive,
+		holdNoReadyNodes: metalConfig.HoldWithoutReadyNodes,
+		withdrawOnCordon: metalConfig.WithdrawBGPOnCordon,
+		withdrawTaint:    metalConfig.WithdrawBGPTaint,
+		peers:            newPeerCache(metalConfig.PeerCacheTTL, lookupPeer),
+		ipCache:          newReservationCache(metalConfig.IPCacheTTL),
+		metrics:          newReconcileMetrics(metalConfig.MetricsGranularity),
+		ipTagger:         ipReservationTaggerOp{client: client},
+		events:           events,
+		serviceLocks:     newServiceLocks(),
+		logSummary:       (*reconcileSummary).log,
+		retry:            apiRetry{count: metalConfig.APIRetryCount, baseDelay: metalConfig.APIRetryBaseDelay},
+		class:            metalConfig.LoadBalancerClass,
+		metallbMode:      metalConfig.MetalLBMode,
+		createConfigMap:  metalConfig.CreateMetalLBConfigMap,
+		dryRun:           metalConfig.DryRun,
+		writeSpecIP:      metalConfig.WriteServiceLoadBalancerIP,
+		pending:          map[string]string{},
+	}
 }
 
 func (l *loadBalancers) name() string {
 	return "loadbalancer"
 }
+
+// ParseLoadBalancerSetting parse the loadbalancer setting, of the form <type>://<detail>, into the
+// type of implementation and the detail that is passed to it, i.e. the path and any query. This is
+// the only place the setting is parsed; the implementation applies its own defaults to an empty
+// detail, e.g. the metallb configmap. An empty setting disables load balancing, and reports an
+// empty type. Anything else that is not of that form, or not of a known type, or for metallb a
+// detail that is not /<namespace>/<name>, is an error, rather than disabling load balancing, or
+// using another configmap, without a word.
+func ParseLoadBalancerSetting(setting string) (string, string, error) {
+	if setting == "" {
+		return "", "", nil
+	}
+	if !strings.Contains(setting, "://") {
+		return "", "", fmt.Errorf("invalid loadbalancer setting %q, must be <type>://<detail>, e.g. %s:///metallb-system/config", setting, LoadBalancerMetalLB)
+	}
+	u, err := url.Parse(setting)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid loadbalancer setting %q: %v", setting, err)
+	}
+	switch u.Scheme {
+	case LoadBalancerKubeVIP, LoadBalancerMetalLB, LoadBalancerEmpty:
+	default:
+		return "", "", fmt.Errorf("invalid loadbalancer setting %q, unknown type %q, must be one of: %s, %s, %s", setting, u.Scheme, LoadBalancerKubeVIP, LoadBalancerMetalLB, LoadBalancerEmpty)
+	}
+	if u.Scheme == LoadBalancerMetalLB {
+		if err := validateMetalLBPath(u.Path); err != nil {
+			return "", "", fmt.Errorf("invalid loadbalancer setting %q, must be %s:///<namespace>/<name>, e.g. %s:///metallb-system/config: %v", setting, LoadBalancerMetalLB, LoadBalancerMetalLB, err)
+		}
+	}
+	// the implementation may take options as a query, e.g. the configmap key for metallb
+	config := u.Path
+	if u.RawQuery != "" {
+		config += "?" + u.RawQuery
+	}
+	return u.Scheme, config, nil
+}
+
+// validateMetalLBPath check the path of a metallb setting: empty for the defaults, or the
+// namespace, optionally followed by the name of the configmap, each of which must be valid names
+func validateMetalLBPath(path string) error {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	parts := strings.Split(path, "/")
+	if len(parts) > 2 {
+		return fmt.Errorf("%q has more than a namespace and a name", path)
+	}
+	if errs := validation.IsDNS1123Label(parts[0]); len(errs) > 0 {
+		return fmt.Errorf("invalid namespace %q: %s", parts[0], strings.Join(errs, "; "))
+	}
+	if len(parts) == 2 {
+		if errs := validation.IsDNS1123Subdomain(parts[1]); len(errs) > 0 {
+			return fmt.Errorf("invalid name %q: %s", parts[1], strings.Join(errs, "; "))
+		}
+	}
+	return nil
+}
+
 func (l *loadBalancers) init(k8sclient kubernetes.Interface) error {
 	klog.V(2).Info("loadBalancers.init(): started")
 	// parse the implementor config and see what kind it is - allow for no config
@@ -49,6 +245,7 @@ func (l *loadBalancers) init(k8sclient kubernetes.Interface) error {
 	}
 
 	l.k8sclient = k8sclient
+	l.recorder = newEventRecorder(k8sclient)
 	// get the UID of the kube-system namespace
 	systemNamespace, err := k8sclient.CoreV1().Namespaces().Get(context.Background(), "kube-system", metav1.GetOptions{})
 	if err != nil {
@@ -58,25 +255,34 @@ func (l *loadBalancers) init(k8sclient kubernetes.Interface) error {
 		return fmt.Errorf("kube-system namespace is missing unexplainably")
 	}
 
-	u, err := url.Parse(l.implementorConfig)
+	implType, config, err := ParseLoadBalancerSetting(l.implementorConfig)
 	if err != nil {
-		return fmt.Errorf("invalid config: %v", err)
+		return err
 	}
-	config := u.Path
 	var impl loadbalancers.LB
-	switch u.Scheme {
-	case "kube-vip":
+	switch implType {
+	case LoadBalancerKubeVIP:
 		klog.Info("loadbalancer implementation enabled: kube-vip")
 		impl = kubevip.NewLB(k8sclient, config)
-	case "metallb":
+	case LoadBalancerMetalLB:
+		// metallb 0.13 and later is configured with custom resources, earlier versions with a configmap
+		if l.metallbMode == MetalLBModeCRD {
+			klog.Info("loadbalancer implementation enabled: metallb, custom resources")
+			impl = metallb.NewCRDLB(l.dynamicClient, config)
+			break
+		}
 		klog.Info("loadbalancer implementation enabled: metallb")
-		impl = metallb.NewLB(k8sclient, config)
-	case "empty":
+		lb := metallb.NewLB(k8sclient, config)
+		lb.SetCreateIfMissing(l.createConfigMap)
+		impl = lb
+	case LoadBalancerEmpty:
 		klog.Info("loadbalancer implementation enabled: empty, bgp only")
 		impl = empty.NewLB(k8sclient, config)
-	default:
-		klog.Info("loadbalancer implementation disabled")
-		impl = nil
+	}
+
+	if d, ok := impl.(loadbalancers.DryRunner); ok && l.dryRun {
+		klog.Info("loadbalancer dry run: changes to the loadbalancer config are logged, not saved")
+		d.SetDryRun(true)
 	}
 
 	l.clusterID = string(systemNamespace.UID)
@@ -86,22 +292,76 @@ func (l *loadBalancers) init(k8sclient kubernetes.Interface) error {
 }
 
 // implementation of cloudprovider.LoadBalancer
-// we do this via metallb, not directly, so none of this works... for now.
+// the reconcilers reserve and map the EIPs, through the loadbalancer implementation, so these
+// only report them, and release them on delete
 
+// GetLoadBalancer report whether the service has an EIP reserved, and the status with its
+// addresses if it does
 func (l *loadBalancers) GetLoadBalancer(ctx context.Context, clusterName string, service *v1.Service) (status *v1.LoadBalancerStatus, exists bool, err error) {
-	return nil, false, nil
+	ips, err := l.listReservations(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to retrieve IP reservations for project %s: %w", l.project, err)
+	}
+	// the reconciler migrates them, a get only looks past the legacy tags
+	ips, _ = withCurrentServiceTags([]*v1.Service{service}, ips)
+	status = l.loadBalancerStatus(service, ips)
+	return status, status != nil, nil
 }
 func (l *loadBalancers) GetLoadBalancerName(ctx context.Context, clusterName string, service *v1.Service) string {
 	return ""
 }
+
+// EnsureLoadBalancer get the status with the addresses of the EIPs reserved for the service,
+// which is empty until the reconciler has reserved them. A service that we do not manage, see
+// loadBalancerServices, e.g. of another class or namespace or that opted out, keeps the status it
+// has, as whoever manages its address writes it.
 func (l *loadBalancers) EnsureLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) (*v1.LoadBalancerStatus, error) {
-	return nil, nil
+	if len(loadBalancerServices([]*v1.Service{service}, l.class, l.excludedNS)) == 0 {
+		return service.Status.LoadBalancer.DeepCopy(), nil
+	}
+	status, _, err := l.GetLoadBalancer(ctx, clusterName, service)
+	if err != nil {
+		return nil, err
+	}
+	if status == nil {
+		status = &v1.LoadBalancerStatus{}
+	}
+	return status, nil
 }
 func (l *loadBalancers) UpdateLoadBalancer(ctx context.Context, clusterName string, service *v1.Service, nodes []*v1.Node) error {
 	return nil
 }
+
+// EnsureLoadBalancerDeleted release the reservations of a deleted service, whether or not a load
+// balancer implementation is enabled; with one, it first stops advertising them, see
+// withdrawService, as the reconciler, which finds none left, may not. A service that has none,
+// e.g. because they already were released, is not an error, so it may be called again.
 func (l *loadBalancers) EnsureLoadBalancerDeleted(ctx context.Context, clusterName string, service *v1.Service) error {
-	return nil
+	svcName := serviceRep(service)
+	defer l.serviceLocks.lock(serviceIdentity(service))()
+	ips, err := l.listReservations(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to retrieve IP reservations for project %s: %w", l.project, err)
+	}
+	if ips, err = l.migrateServiceTags(ctx, []*v1.Service{service}, ips); err != nil {
+		return err
+	}
+	ipReservations := ipReservationsByAllTags([]string{serviceTag(service), emTag, clusterTag(l.clusterID)}, ips)
+	sharing, err := l.sharingServices(ctx, service)
+	if err != nil {
+		return err
+	}
+	if len(sharing) > 0 {
+		klog.V(2).Infof("EnsureLoadBalancerDeleted(): EIP of %s still is shared by %s, keeping it", svcName, strings.Join(sharing, ", "))
+		return nil
+	}
+	if l.implementor != nil {
+		if err := l.withdrawService(ctx, service, ipReservations); err != nil {
+			return err
+		}
+	}
+	klog.V(2).Infof("EnsureLoadBalancerDeleted(): releasing %d IP reservations of %s", len(ipReservations), svcName)
+	return l.releaseReservations(ctx, service, ipReservations)
 }
 
 // utility funcs
@@ -124,140 +384,277 @@ func (l *loadBalancers) serviceReconciler() serviceReconciler {
 
 // reconcileNodes given a node, update the metallb load balancer by
 // by adding it to or removing it from the known metallb configmap
-func (l *loadBalancers) reconcileNodes(ctx context.Context, nodes []*v1.Node, mode UpdateMode) error {
-	var (
-		peer *packngo.BGPNeighbor
-		err  error
-	)
+func (l *loadBalancers) reconcileNodes(ctx context.Context, nodes []*v1.Node, mode UpdateMode) (err error) {
+	var peer *packngo.BGPNeighbor
 	klog.V(2).Infof("loadbalancers.reconcileNodes(): called for nodes %v", nodes)
+	defer func() { observeReconcile("node", mode, err) }()
+	ctx, summary := newReconcileSummary(ctx, "loadbalancers.reconcileNodes()", mode, l.implementor)
+	defer func() { l.logSummary(summary) }()
 
 	// are we adding, removing or syncing the node?
 	switch mode {
 	case ModeRemove:
+		// the node is gone already, so these are the ones that remain
+		hold, err := l.holdWithoutReadyNodes(ctx)
+		if err != nil {
+			return err
+		}
+		if hold {
+			klog.Warningf("loadbalancers.reconcileNodes(): no ready nodes, keeping the peers of removed nodes %v until there are", nodeNames(nodes))
+			return nil
+		}
 		for _, node := range nodes {
 			klog.V(2).Infof("loadbalancers.reconcileNodes(): reconciling remove node %s", node.Name)
-			if err := l.implementor.RemoveNode(ctx, node.Name); err != nil {
+			l.peers.invalidate(node)
+			err := l.implementor.RemoveNode(ctx, node.Name)
+			l.metrics.observe("node", node.Name, "remove", err == nil)
+			if err != nil {
 				klog.V(2).Infof("loadbalancers.reconcileNodes(): error removing node %s: %v", node.Name, err)
+				summary.failed++
 				continue
 			}
+			summary.removed++
 		}
 	case ModeAdd:
-		for _, node := range nodes {
+		// a node that stopped matching is removed by the next sync
+		add := []*v1.Node{}
+		for _, node := range l.selectedNodes(nodes) {
 			klog.V(2).Infof("loadbalancers.reconcileNodes(): reconciling add node %s", node.Name)
-			// get the node provider ID
-			id := node.Spec.ProviderID
-			if id == "" {
-				return fmt.Errorf("no provider ID given for node %s", node.Name)
+			// get the node provider ID; a node that just joined may not have it yet
+			if node.Spec.ProviderID == "" {
+				klog.Warningf("loadbalancers.reconcileNodes(): no provider ID given for node %s, skipping until next sync", node.Name)
+				summary.unchanged++
+				continue
 			}
-			if peer, err = getNodeBGPConfig(id, l.client); err != nil || peer == nil {
+			add = append(add, node)
+		}
+		// in the order of their names, so that the config is the same however the nodes came
+		sort.Slice(add, func(i, j int) bool { return add[i].Name < add[j].Name })
+		looked := l.lookupPeers(ctx, add)
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("reconcile of nodes stopped, remaining nodes deferred to next pass: %w", err)
+		}
+		bgpNodes := []loadbalancers.Node{}
+		for i, node := range add {
+			if peer, err = looked[i].peer, looked[i].err; err != nil || peer == nil {
 				klog.Errorf("loadbalancers.reconcileNodes(): could not add metallb node peer address for node %s: %v", node.Name, err)
+				l.metrics.observe("node", node.Name, "add", false)
+				summary.failed++
 				continue
 			}
-			if err := l.implementor.AddNode(ctx, node.Name, peer.CustomerAs, peer.PeerAs, peer.Md5Password, peer.CustomerIP, peer.PeerIps...); err != nil {
-				klog.V(2).Infof("loadbalancers.reconcileNodes(): error adding node %s: %v", node.Name, err)
+			bgpNodes = append(bgpNodes, l.bgpNode(node, peer))
+		}
+		// all at once if the implementation can, so that it saves its config once
+		if adder, ok := l.implementor.(loadbalancers.NodesAdder); ok && len(bgpNodes) > 0 {
+			before := summary.activity()
+			err := adder.AddNodes(ctx, bgpNodes)
+			if err != nil {
+				klog.V(2).Infof("loadbalancers.reconcileNodes(): error adding nodes %v: %v", bgpNodeNames(bgpNodes), err)
+			}
+			for _, n := range bgpNodes {
+				l.metrics.observe("node", n.Name, "add", err == nil)
+				summary.item(before, err)
+			}
+			break
+		}
+		for _, n := range bgpNodes {
+			before := summary.activity()
+			err := l.implementor.AddNode(ctx, n.Name, n.LocalASN, n.PeerASN, n.Password, n.SourceIP, n.Peers...)
+			l.metrics.observe("node", n.Name, "add", err == nil)
+			summary.item(before, err)
+			if err != nil {
+				klog.V(2).Infof("loadbalancers.reconcileNodes(): error adding node %s: %v", n.Name, err)
 				continue
 			}
 		}
 	case ModeSync:
-		// make sure the list of nodes exactly matches between the provided nodes and the ones in the configmap
+		if l.holdNoReadyNodes && l.readyNodes(nodes) == 0 {
+			klog.Warningf("loadbalancers.reconcileNodes(): sync: none of %d nodes is ready, keeping the current peers until one is", len(nodes))
+			return nil
+		}
+		// make sure the list of nodes exactly matches between the provided nodes and the ones in the configmap;
+		// only those that match the selector peer, so any other is removed
+		nodes = l.selectedNodes(nodes)
 		goodMap := map[string]loadbalancers.Node{}
+
+		// there is no call to get the peers of many devices at once, so rather than one call for each
+		// node, only look up those that the implementation does not have already
+		known := map[string]loadbalancers.Node{}
+		if lister, ok := l.implementor.(loadbalancers.NodeLister); ok {
+			if known, err = lister.Nodes(ctx); err != nil {
+				klog.Errorf("loadbalancers.reconcileNodes(): could not get configured nodes, looking up all: %v", err)
+				known = map[string]loadbalancers.Node{}
+			}
+		}
+		missing := []*v1.Node{}
 		for _, node := range nodes {
-			// get the node provider ID
-			id := node.Spec.ProviderID
-			if id == "" {
-				return fmt.Errorf("no provider ID given for node %s", node.Name)
+			if n, ok := known[node.Name]; ok {
+				// the node is not looked up, so changed annotations still are synced
+				goodMap[node.Name] = l.nodeOverrides(node, n)
+				continue
 			}
-			if peer, err = getNodeBGPConfig(id, l.client); err != nil || peer == nil {
-				klog.Errorf("loadbalancers.reconcileNodes(): could not get node peer address for node %s: %v", node.Name, err)
+			missing = append(missing, node)
+		}
+		klog.V(2).Infof("loadbalancers.reconcileNodes(): sync: %d nodes configured already, %d to look up", len(goodMap), len(missing))
+
+		lookup := []*v1.Node{}
+		for _, node := range missing {
+			// get the node provider ID; a node that just joined may not have it yet, so do not let
+			// it hold up the others, and look at it again on the next sync
+			if node.Spec.ProviderID == "" {
+				klog.Warningf("loadbalancers.reconcileNodes(): sync: no provider ID given for node %s, skipping until next sync", node.Name)
 				continue
 			}
-			goodMap[node.Name] = loadbalancers.Node{
-				Name:     node.Name,
-				LocalASN: peer.CustomerAs,
-				PeerASN:  peer.PeerAs,
-				SourceIP: peer.CustomerIP,
-				Peers:    peer.PeerIps,
-				Password: peer.Md5Password,
+			lookup = append(lookup, node)
+		}
+		looked := l.lookupPeers(ctx, lookup)
+		// an incomplete map would remove good nodes, so do not sync at all
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("reconcile of nodes stopped before sync while looking up %d nodes, deferred to next pass: %w", len(lookup), err)
+		}
+		for i, node := range lookup {
+			if peer, err = looked[i].peer, looked[i].err; err != nil || peer == nil {
+				klog.Errorf("loadbalancers.reconcileNodes(): could not get node peer address for node %s: %v", node.Name, err)
+				summary.failed++
+				continue
 			}
+			goodMap[node.Name] = l.bgpNode(node, peer)
 		}
 		if err := l.implementor.SyncNodes(ctx, goodMap); err != nil {
 			return fmt.Errorf("error syncing nodes: %v", err)
 		}
+		for name := range goodMap {
+			if _, ok := known[name]; ok {
+				summary.unchanged++
+			} else {
+				summary.added++
+			}
+		}
+		for name := range known {
+			if _, ok := goodMap[name]; !ok {
+				summary.removed++
+			}
+		}
 	}
 	klog.V(2).Infof("loadbalancers.reconcileNodes(): config changed, done")
 	return nil
 }
 
+// peerLookup the BGP neighbour of the device of a node, or the error looking it up
+type peerLookup struct {
+	peer *packngo.BGPNeighbor
+	err  error
+}
+
+// lookupPeers look up the BGP neighbours of the devices of the nodes, at most
+// peerLookupConcurrency at once, each result at the index of its node. Once the context is done,
+// the nodes not yet looked up have its error.
+func (l *loadBalancers) lookupPeers(ctx context.Context, nodes []*v1.Node) []peerLookup {
+	results := make([]peerLookup, len(nodes))
+	workers := peerLookupConcurrency
+	if len(nodes) < workers {
+		workers = len(nodes)
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := ctx.Err(); err != nil {
+					results[i].err = err
+					continue
+				}
+				var peer *packngo.BGPNeighbor
+				results[i].err = callWithContext(ctx, func() error {
+					var err error
+					peer, err = l.peers.get(nodes[i])
+					return err
+				})
+				if results[i].err == nil {
+					results[i].peer = peer
+				}
+			}
+		}()
+	}
+	for i := range nodes {
+		if i > 0 && i%nodeSyncProgressInterval == 0 {
+			klog.V(2).Infof("loadbalancers.lookupPeers(): looking up node %d of %d", i+1, len(nodes))
+		}
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return results
+}
+
+// bgpNodeNames the names of the nodes, for logs
+func bgpNodeNames(nodes []loadbalancers.Node) []string {
+	names := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		names = append(names, n.Name)
+	}
+	return names
+}
+
 // reconcileServices add or remove services to have loadbalancers. If it adds a
 // service, then it requests a new IP reservation, with "fast-fail", i.e. if it
 // cannot create the IP reservation immediately, then it fails, rather than
 // waiting for human support. It tags the IP reservation so it can find it later.
 // Before trying to create one, it tries to find an IP reservation with the right tags.
-func (l *loadBalancers) reconcileServices(ctx context.Context, svcs []*v1.Service, mode UpdateMode) error {
+// A service that fails does not stop the others, see addServices.
+func (l *loadBalancers) reconcileServices(ctx context.Context, svcs []*v1.Service, mode UpdateMode) (err error) {
 	klog.V(2).Infof("loadbalancer.reconcileServices(): %v starting", mode)
 	klog.V(5).Infof("loadbalancer.reconcileServices(): services %#v", svcs)
+	ctx, summary := newReconcileSummary(ctx, "loadbalancer.reconcileServices()", mode, l.implementor)
+	defer func() { l.logSummary(summary) }()
+	defer func() { observeReconcile("service", mode, err) }()
 
-	var err error
-	// get IP address reservations and check if they any exists for this svc
-	ips, _, err := l.client.ProjectIPs.List(l.project, &packngo.ListOptions{})
-	if err != nil {
-		return fmt.Errorf("unable to retrieve IP reservations for project %s: %v", l.project, err)
-	}
+	validSvcs := loadBalancerServices(svcs, l.class, l.excludedNS)
+	klog.V(5).Infof("loadbalancer.reconcileServices(): valid services %#v", validSvcs)
 
-	validSvcs := []*v1.Service{}
-	for _, svc := range svcs {
-		// filter on type: only take those that are of type=LoadBalancer
-		if svc.Spec.Type != v1.ServiceTypeLoadBalancer {
-			continue
+	// removal only withdraws, so it goes ahead; the sync catches up on the rest once a node is ready
+	if mode != ModeRemove {
+		hold, err := l.holdWithoutReadyNodes(ctx)
+		if err != nil {
+			return err
 		}
-		// filter on name: do not try to manage the the service we created for EIP load balancer
-		if svc.ObjectMeta.Name == externalServiceName && svc.ObjectMeta.Namespace == externalServiceNamespace {
-			continue
+		if hold {
+			klog.Warningf("loadbalancer.reconcileServices(): %v: no ready nodes to advertise, deferring service changes until there are", mode)
+			return nil
 		}
-		validSvcs = append(validSvcs, svc)
 	}
-	klog.V(5).Infof("loadbalancer.reconcileServices(): valid services %#v", validSvcs)
 
+	// get IP address reservations and check if they any exists for this svc
+	ips, err := l.listReservations(ctx)
+	if err != nil {
+		err = fmt.Errorf("unable to retrieve IP reservations for project %s: %w", l.project, err)
+		if cached, ok := l.cachedReservations(); ok && l.degradedReconcile {
+			return l.degradedReconcileServices(ctx, validSvcs, cached, mode, err)
+		}
+		return err
+	}
+	if ips, err = l.migrateServiceTags(ctx, validSvcs, ips); err != nil {
+		return err
+	}
+	l.cacheReservations(ips)
+	eipReservations.Set(float64(len(ipReservationsByAllTags([]string{emTag, clusterTag(l.clusterID)}, ips))))
+
+	// the failures of services added in a sync, returned once it is done
+	var addErr error
 	switch mode {
 	case ModeAdd:
 		// ADDITION
-		for _, svc := range validSvcs {
-			klog.V(2).Infof("loadbalancer.reconcileServices(): add: service %s", svc.Name)
-			if err := l.addService(ctx, svc, ips); err != nil {
-				return err
-			}
-		}
+		return l.addServices(ctx, summary, validSvcs, ips, mode)
 	case ModeRemove:
 		// REMOVAL
 		for _, svc := range validSvcs {
-			svcName := serviceRep(svc)
-			svcTag := serviceTag(svc)
-			clsTag := clusterTag(l.clusterID)
-			svcIP := svc.Spec.LoadBalancerIP
-
-			var svcIPCidr string
-			ipReservation := ipReservationByAllTags([]string{svcTag, emTag, clsTag}, ips)
-
-			klog.V(2).Infof("loadbalancer.reconcileServices(): remove: %s with existing IP assignment %s", svcName, svcIP)
-
-			// get the IPs and see if there is anything to clean up
-			if ipReservation == nil {
-				klog.V(2).Infof("loadbalancer.reconcileServices(): remove: no IP reservation found for %s, nothing to delete", svcName)
-				continue
-			}
-			// delete the reservation
-			klog.V(2).Infof("loadbalancer.reconcileServices(): remove: for %s EIP ID %s", svcName, ipReservation.ID)
-			_, err = l.client.ProjectIPs.Remove(ipReservation.ID)
-			if err != nil {
-				return fmt.Errorf("failed to remove IP address reservation %s from project: %v", ipReservation.String(), err)
-			}
-			// remove it from the configmap
-			svcIPCidr = fmt.Sprintf("%s/%d", ipReservation.Address, ipReservation.CIDR)
-			klog.V(2).Infof("loadbalancer.reconcileServices(): remove: for %s entry %s", svcName, svcIPCidr)
-			if err := l.implementor.RemoveService(ctx, svcIPCidr); err != nil {
-				return fmt.Errorf("error removing IP from configmap for %s: %v", svcName, err)
+			if err := l.lockedRemoveService(ctx, svc, ips); err != nil {
+				summary.failed++
+				return err
 			}
-			klog.V(2).Infof("loadbalancer.reconcileServices(): remove: removed service %s from implementation", svcName)
+			summary.removed++
 		}
 	case ModeSync:
 		// what we have to do:
@@ -266,41 +663,67 @@ func (l *loadBalancers) reconcileServices(ctx context.Context, svcs []*v1.Servic
 		// 3. for each EIP, ensure it exists in the configmap
 		// 4. get each EIP in the configmap, check if it is in our list; if not, delete
 
-		// add each service that is in the known list
-		for _, svc := range validSvcs {
-			klog.V(2).Infof("loadbalancer.reconcileServices(): sync: service %s", svc.Name)
-			if err := l.addService(ctx, svc, ips); err != nil {
-				return err
-			}
+		// add each service that is in the known list; a failed one still holds its reservations,
+		// so the removal goes ahead, and the failures are returned once it is done
+		addErr = l.addServices(ctx, summary, validSvcs, ips, mode)
+
+		// advisory only: several addresses for the same endpoints may be a mistake
+		if l.warnDuplicates {
+			l.warnDuplicateSelectors(validSvcs)
 		}
 
 		// remove any service that is not in the known list
 
+		// each service added above already is saved, but do not start removing if we ran out of time
+		if err := ctx.Err(); err != nil {
+			return utilerrors.NewAggregate([]error{addErr, fmt.Errorf("reconcile of services stopped before removal, deferred to next pass: %w", err)})
+		}
 		// we need to get the addresses again, because we might have changed them
 		klog.V(5).Info("loadbalancer.reconcileServices(): sync: getting all IP reservations")
-		ips, _, err = l.client.ProjectIPs.List(l.project, &packngo.ListOptions{})
+		// a failure from here on is returned with those of the services added above
+		ips, err = l.listReservations(ctx)
 		if err != nil {
-			return fmt.Errorf("unable to retrieve IP reservations for project %s: %v", l.project, err)
+			return utilerrors.NewAggregate([]error{addErr, fmt.Errorf("unable to retrieve IP reservations for project %s: %v", l.project, err)})
 		}
+		// those of a service added above, e.g. adopted, may have had the legacy tags
+		if ips, err = l.migrateServiceTags(ctx, validSvcs, ips); err != nil {
+			return utilerrors.NewAggregate([]error{addErr, err})
+		}
+		l.cacheReservations(ips)
+		eipReservations.Set(float64(len(ipReservationsByAllTags([]string{emTag, clusterTag(l.clusterID)}, ips))))
 		// get all EIP that have the equinix metal tag and are allocated to this cluster
 		ipReservations := ipReservationsByAllTags([]string{emTag, clusterTag(l.clusterID)}, ips)
-		// create a map of EIP to svcIP so we can get the CIDR
-		ipCidr := map[string]int{}
-		for _, ipr := range ipReservations {
-			ipCidr[ipr.Address] = ipr.CIDR
-		}
-
 		// create a map of all valid IPs
 		validTags := map[string]bool{}
+		validDualStackTags := map[string]bool{}
+		validIPv6OnlyTags := map[string]bool{}
+		validStandbyTags := map[string]bool{}
 		validIPs := map[string]bool{}
+		// a standby in use stays until the service moves off it, even if it no longer asks for one
+		svcIPs := map[string]bool{}
 
 		for _, svc := range validSvcs {
 			validTags[serviceTag(svc)] = true
-			svcIP := svc.Spec.LoadBalancerIP
-			if svcIP != "" {
-				if cidr, ok := ipCidr[svcIP]; ok {
-					validIPs[fmt.Sprintf("%s/%d", svcIP, cidr)] = true
-				}
+			if dualStack(svc) {
+				validDualStackTags[serviceTag(svc)] = true
+			}
+			if ipv6Only(svc) {
+				validIPv6OnlyTags[serviceTag(svc)] = true
+			}
+			if l.standby(svc) {
+				validStandbyTags[serviceTag(svc)] = true
+			}
+			svcIPs[l.assignedIP(svc)] = true
+		}
+		for addr := range l.serviceAddresses(validSvcs, ips) {
+			validIPs[addr] = true
+		}
+		// a service that opted out keeps the reservations it had, e.g. to manage their address
+		// itself, though they are no longer advertised, see loadBalancerDisabled
+		optedOutTags := map[string]bool{}
+		for _, svc := range svcs {
+			if svc.Spec.Type == v1.ServiceTypeLoadBalancer && loadBalancerDisabled(svc) {
+				optedOutTags[serviceTag(svc)] = true
 			}
 		}
 
@@ -308,125 +731,1577 @@ func (l *loadBalancers) reconcileServices(ctx context.Context, svcs []*v1.Servic
 		klog.V(2).Infof("loadbalancer.reconcileServices(): sync: valid svc IPs %v", validIPs)
 
 		if err := l.implementor.SyncServices(ctx, validIPs); err != nil {
-			return err
+			return utilerrors.NewAggregate([]error{addErr, err})
 		}
 
 		// remove any EIPs that do not have a reservation
 
 		klog.V(5).Infof("loadbalancer.reconcileServices(): sync: all reservations with emTag %#v", ipReservations)
 		for _, ipReservation := range ipReservations {
-			var foundTag bool
+			// rather than an orphan, it may be of a version of the CCM with another tag scheme
+			if !knownTagScheme(ipReservation.Tags) {
+				klog.V(2).Infof("loadbalancer.reconcileServices(): sync: leaving reservation %s with unrecognized tags %v", ipReservation.ID, ipReservation.Tags)
+				continue
+			}
+			// a shared block stays as long as any service in it does
+			if isSharedBlock(ipReservation) {
+				stale := map[string]bool{}
+				for _, tag := range ipReservation.Tags {
+					if strings.HasPrefix(tag, "service=") && !validTags[tag] && !optedOutTags[tag] {
+						stale[tag] = true
+					}
+				}
+				if len(stale) == 0 {
+					continue
+				}
+				klog.V(2).Infof("loadbalancer.reconcileServices(): sync: releasing the addresses of %d services no longer in shared block %s", len(stale), ipReservation.ID)
+				if err := l.leaveBlock(ctx, nil, stale, ipReservation); err != nil {
+					summary.failed++
+					return utilerrors.NewAggregate([]error{addErr, err})
+				}
+				summary.removed++
+				continue
+			}
+			var foundTag, ipv6, standby bool
+			for _, tag := range ipReservation.Tags {
+				switch tag {
+				case ipv6FamilyTag:
+					ipv6 = true
+				case standbyTag:
+					standby = true
+				}
+			}
 			for _, tag := range ipReservation.Tags {
-				if _, ok := validTags[tag]; ok {
+				// the IPv6 address is valid only as long as its service still is dual-stack or IPv6
+				// only, the IPv4 one as long as it is not IPv6 only, and the standby as long as its
+				// service still asks for one, or uses it
+				validFamily := validDualStackTags[tag] || validIPv6OnlyTags[tag]
+				if !ipv6 {
+					validFamily = standby || !validIPv6OnlyTags[tag]
+				}
+				if _, ok := validTags[tag]; ok && validFamily && (!standby || validStandbyTags[tag] || svcIPs[ipReservation.Address]) {
 					foundTag = true
 				}
+				foundTag = foundTag || optedOutTags[tag]
 			}
 			// did we find a valid tag?
 			if !foundTag {
 				klog.V(2).Infof("loadbalancer.reconcileServices(): sync: removing reservation with service= tag but not in validTags list %#v", ipReservation)
-				// delete the reservation
-				_, err = l.client.ProjectIPs.Remove(ipReservation.ID)
+				// return it to its pool, or delete the reservation
+				if isPoolReservation(ipReservation) {
+					err = l.returnToPool(ctx, "", ipReservation)
+				} else {
+					err = l.removeReservation(ctx, nil, ipReservation)
+				}
 				if err != nil {
-					return fmt.Errorf("failed to remove IP address reservation %s from project: %v", ipReservation.String(), err)
+					summary.failed++
+					return utilerrors.NewAggregate([]error{addErr, err})
 				}
+				summary.removed++
 			}
 		}
 	}
-	return nil
+	return addErr
 }
 
-// addService add a single service; wraps the implementation
-func (l *loadBalancers) addService(ctx context.Context, svc *v1.Service, ips []packngo.IPAddressReservation) error {
+// lockedRemoveService remove a single service, serialized with any other work on the same service
+func (l *loadBalancers) lockedRemoveService(ctx context.Context, svc *v1.Service, ips []packngo.IPAddressReservation) error {
+	defer l.serviceLocks.lock(serviceIdentity(svc))()
+	err := l.removeService(ctx, svc, ips)
+	l.metrics.observe("service", serviceRep(svc), "remove", err == nil)
+	return err
+}
+
+// removeService remove a single service; releases or retains each of its reservations, both
+// families for a dual-stack service, and wraps the implementation
+func (l *loadBalancers) removeService(ctx context.Context, svc *v1.Service, ips []packngo.IPAddressReservation) error {
 	svcName := serviceRep(svc)
 	svcTag := serviceTag(svc)
 	clsTag := clusterTag(l.clusterID)
-	svcIP := svc.Spec.LoadBalancerIP
+	svcIP := l.assignedIP(svc)
 
-	var (
-		svcIPCidr string
-		err       error
-	)
-	ipReservation := ipReservationByAllTags([]string{svcTag, emTag, clsTag}, ips)
+	ipReservations := ipReservationsByAllTags([]string{svcTag, emTag, clsTag}, ips)
 
-	klog.V(2).Infof("processing %s with existing IP assignment %s", svcName, svcIP)
-	// if it already has an IP, no need to get it one
-	if svcIP == "" {
-		klog.V(2).Infof("no IP assigned for service %s; searching reservations", svcName)
+	klog.V(2).Infof("loadbalancer.reconcileServices(): remove: %s with existing IP assignment %s", svcName, svcIP)
 
-		// if no IP found, request a new one
-		if ipReservation == nil {
+	// external IPs are not ours to release, only to stop advertising
+	for _, ip := range l.advertisedExternalIPs(svc, svcIP, ips) {
+		klog.V(2).Infof("loadbalancer.reconcileServices(): remove: for %s external IP %s", svcName, ip)
+		if err := l.implementor.RemoveService(ctx, hostCIDR(ip)); err != nil {
+			return fmt.Errorf("error removing external IP %s from configmap for %s: %v", ip, svcName, err)
+		}
+	}
 
-			// if we did not find an IP reserved, create a request
-			klog.V(2).Infof("no IP assignment found for %s, requesting", svcName)
-			// create a request
-			facility := l.facility
-			req := packngo.IPReservationRequest{
-				Type:        "public_ipv4",
-				Quantity:    1,
-				Description: ccmIPDescription,
-				Facility:    &facility,
-				Tags: []string{
-					emTag,
-					svcTag,
-					clsTag,
-				},
-				FailOnApprovalRequired: true,
-			}
-
-			ipReservation, _, err = l.client.ProjectIPs.Request(l.project, &req)
-			if err != nil {
-				return fmt.Errorf("failed to request an IP for the load balancer: %v", err)
+	// the others that share the EIP still advertise and hold it
+	sharing, err := l.sharingServices(ctx, svc)
+	if err != nil {
+		return err
+	}
+	if len(sharing) > 0 {
+		klog.V(2).Infof("loadbalancer.reconcileServices(): remove: EIP of %s still is shared by %s, keeping it", svcName, strings.Join(sharing, ", "))
+		return nil
+	}
+	// stop advertising each before it is released
+	if err := l.withdrawService(ctx, svc, ipReservations); err != nil {
+		return err
+	}
+	// get the IPs and see if there is anything to clean up
+	if len(ipReservations) == 0 {
+		klog.V(2).Infof("loadbalancer.reconcileServices(): remove: no IP reservation found for %s, nothing to delete", svcName)
+		return nil
+	}
+	if err := l.releaseReservations(ctx, svc, ipReservations); err != nil {
+		return err
+	}
+	klog.V(2).Infof("loadbalancer.reconcileServices(): remove: removed service %s from implementation", svcName)
+	return nil
+}
+
+// withdrawService stop advertising the addresses of a removed service: that of each of its
+// reservations, or if none is left, e.g. EnsureLoadBalancerDeleted released them already, the
+// address assigned to it
+func (l *loadBalancers) withdrawService(ctx context.Context, svc *v1.Service, ipReservations []*packngo.IPAddressReservation) error {
+	if allocateOnly(svc) {
+		return nil
+	}
+	svcName := serviceRep(svc)
+	if len(ipReservations) == 0 {
+		if svcIP := l.assignedIP(svc); svcIP != "" {
+			klog.V(2).Infof("loadbalancer.reconcileServices(): remove: for %s without reservation entry %s", svcName, hostCIDR(svcIP))
+			if err := l.implementor.RemoveService(ctx, hostCIDR(svcIP)); err != nil {
+				return fmt.Errorf("error removing IP from configmap for %s: %v", svcName, err)
 			}
 		}
-
-		// if we have no IP from existing or a new reservation, log it and return
-		if ipReservation == nil {
-			klog.V(2).Infof("no IP to assign to service %s, will need to wait until it is allocated", svcName)
-			return nil
+		return nil
+	}
+	for _, ipReservation := range ipReservations {
+		addr := ipReservation.Address
+		if isSharedBlock(ipReservation) {
+			if addr = blockAllocation(ipReservation, svc); addr == "" {
+				continue
+			}
 		}
+		svcIPCidr := advertisedCIDR(svc, addr, ipReservation)
+		klog.V(2).Infof("loadbalancer.reconcileServices(): remove: for %s entry %s", svcName, svcIPCidr)
+		if err := l.implementor.RemoveService(ctx, svcIPCidr); err != nil {
+			return fmt.Errorf("error removing IP from configmap for %s: %v", svcName, err)
+		}
+	}
+	return nil
+}
 
-		// we have an IP, either found from existing reservations or a new reservation.
-		// map and assign it
-		svcIP = ipReservation.Address
-
-		// assign the IP and save it
-		klog.V(2).Infof("assigning IP %s to %s", svcIP, svcName)
-		intf := l.k8sclient.CoreV1().Services(svc.Namespace)
-		existing, err := intf.Get(ctx, svc.Name, metav1.GetOptions{})
-		if err != nil || existing == nil {
-			klog.V(2).Infof("failed to get latest for service %s: %v", svcName, err)
-			return fmt.Errorf("failed to get latest for service %s: %v", svcName, err)
+// releaseReservations release each of the reservations of a removed service: return it to its
+// pool, retain it, or delete it. This does not depend on the implementation.
+func (l *loadBalancers) releaseReservations(ctx context.Context, svc *v1.Service, ipReservations []*packngo.IPAddressReservation) error {
+	svcName := serviceRep(svc)
+	retain := l.retainReservation(ctx, svc)
+	for _, ipReservation := range ipReservations {
+		if isSharedBlock(ipReservation) {
+			// the address goes back to the block, which others may hold addresses in still
+			if err := l.leaveBlock(ctx, svc, map[string]bool{serviceTag(svc): true}, ipReservation); err != nil {
+				return err
+			}
+		} else if isPoolReservation(ipReservation) {
+			if err := l.returnToPool(ctx, svcName, ipReservation); err != nil {
+				return err
+			}
+		} else if retain {
+			// keep the reservation, but move it out of the managed set so that sync does not release it
+			klog.V(2).Infof("loadbalancer.reconcileServices(): remove: retaining EIP ID %s for %s", ipReservation.ID, svcName)
+			if _, _, err := l.updateTags(ctx, ipReservation.ID, retainedTags(ipReservation.Tags)); err != nil {
+				return fmt.Errorf("failed to retain IP address reservation %s: %v", ipReservation.String(), err)
+			}
+			l.emitReservationEvent(ctx, reservationEventRetained, svcName, ipReservation)
+		} else {
+			// delete the reservation
+			klog.V(2).Infof("loadbalancer.reconcileServices(): remove: for %s EIP ID %s", svcName, ipReservation.ID)
+			if err := l.removeReservation(ctx, svc, ipReservation); err != nil {
+				return err
+			}
 		}
-		existing.Spec.LoadBalancerIP = svcIP
+	}
+	return nil
+}
 
-		_, err = intf.Update(ctx, existing, metav1.UpdateOptions{})
-		if err != nil {
-			klog.V(2).Infof("failed to update service %s: %v", svcName, err)
-			return fmt.Errorf("failed to update service %s: %v", svcName, err)
+// duplicateSelectorServices get the groups of services, by name, that have the same non-empty
+// selector in the same namespace, and so the same endpoints, but distinct addresses. Services
+// without an address yet are left out. Each group, and the list of groups, is sorted.
+func duplicateSelectorServices(svcs []*v1.Service) [][]string {
+	groups := map[string][]*v1.Service{}
+	for _, svc := range svcs {
+		if len(svc.Spec.Selector) == 0 || svc.Spec.LoadBalancerIP == "" {
+			continue
 		}
-		klog.V(2).Infof("successfully assigned %s update service %s", svcIP, svcName)
+		key := svc.Namespace + "/" + labels.SelectorFromSet(svc.Spec.Selector).String()
+		groups[key] = append(groups[key], svc)
 	}
-	// our default CIDR for each address is 32
-	cidr := 32
-	if ipReservation != nil {
-		cidr = ipReservation.CIDR
+	ret := [][]string{}
+	for _, group := range groups {
+		addrs := map[string]bool{}
+		names := []string{}
+		for _, svc := range group {
+			addrs[svc.Spec.LoadBalancerIP] = true
+			names = append(names, serviceRep(svc))
+		}
+		if len(addrs) < 2 {
+			continue
+		}
+		sort.Strings(names)
+		ret = append(ret, names)
 	}
-	svcIPCidr = fmt.Sprintf("%s/%d", svcIP, cidr)
-	return l.implementor.AddService(ctx, svcName, svcIPCidr)
+	sort.Slice(ret, func(i, j int) bool { return ret[i][0] < ret[j][0] })
+	return ret
 }
 
-func serviceRep(svc *v1.Service) string {
-	if svc == nil {
-		return ""
+// warnDuplicateSelectors warn about each group of services that have the same selector, see
+// duplicateSelectorServices, that was not in the groups of the last sync, so that each is warned
+// about once rather than on every sync; get the groups warned about
+func (l *loadBalancers) warnDuplicateSelectors(svcs []*v1.Service) [][]string {
+	l.warnedDuplicatesLock.Lock()
+	defer l.warnedDuplicatesLock.Unlock()
+	warned := [][]string{}
+	current := map[string]bool{}
+	for _, names := range duplicateSelectorServices(svcs) {
+		group := strings.Join(names, ", ")
+		current[group] = true
+		if l.warnedDuplicates[group] {
+			continue
+		}
+		klog.Warningf("loadbalancer.reconcileServices(): sync: services %s have the same selector but each has its own EIP; if they are duplicates, delete all but one to release their addresses", group)
+		warned = append(warned, names)
 	}
-	return fmt.Sprintf("%s/%s", svc.Namespace, svc.Name)
+	// a group resolved and then back is warned about again
+	l.warnedDuplicates = current
+	return warned
 }
 
-func serviceTag(svc *v1.Service) string {
+// removeReservation delete a reservation from the project, of the given service, or nil if it is
+// gone. If the manageable check is enabled, and the reservation fails it, it is left in place with
+// a warning; deleting it would fail, or take with it addresses in use elsewhere.
+func (l *loadBalancers) removeReservation(ctx context.Context, svc *v1.Service, ipReservation *packngo.IPAddressReservation) error {
+	var svcName string
+	if svc != nil {
+		svcName = serviceRep(svc)
+	}
+	if l.checkManageable {
+		if reason := unremovableReason(ipReservation); reason != "" {
+			klog.Warningf("not removing IP address reservation %s: %s", ipReservation.String(), reason)
+			return nil
+		}
+	}
+	if err := l.deleteReservation(ctx, ipReservation.ID); err != nil {
+		// e.g. removed by a concurrent delete; either way it is gone
+		if isNotFound(err) {
+			klog.V(2).Infof("IP address reservation %s already removed", ipReservation.String())
+			return nil
+		}
+		return fmt.Errorf("failed to remove IP address reservation %s from project: %v", ipReservation.String(), err)
+	}
+	l.emitReservationEvent(ctx, reservationEventDeleted, svcName, ipReservation)
+	l.serviceEvent(svc, v1.EventTypeNormal, eventReasonEIPReleased, "released EIP reservation %s of %s", ipReservation.ID, ipReservation.Address)
+	return nil
+}
+
+// unremovableReason get why the reservation is not safe to delete, or "" if it is. It must be
+// manageable, and not have anything assigned from it, neither the whole to a device nor part
+// of the block.
+func unremovableReason(ipReservation *packngo.IPAddressReservation) string {
+	switch {
+	case !ipReservation.Manageable:
+		return "it is not manageable"
+	case ipReservation.Management:
+		return "it is a management address"
+	case len(ipReservation.Assignments) > 0:
+		return fmt.Sprintf("it has %d assignments", len(ipReservation.Assignments))
+	}
+	return ""
+}
+
+// addServices add each of the services, going on past any that fails, so that a single bad service
+// does not hold up the others. Each failure is recorded as an event on its service, and all of them
+// are returned together, each of which errors.Is still tells apart.
+func (l *loadBalancers) addServices(ctx context.Context, summary *reconcileSummary, svcs []*v1.Service, ips []packngo.IPAddressReservation, mode UpdateMode) error {
+	errs := []error{}
+	for _, svc := range svcs {
+		if err := ctx.Err(); err != nil {
+			errs = append(errs, fmt.Errorf("reconcile of services stopped, remaining services deferred to next pass: %w", err))
+			break
+		}
+		klog.V(2).Infof("loadbalancer.reconcileServices(): %v: service %s", mode, svc.Name)
+		before := summary.activity()
+		err := l.lockedAddService(ctx, svc, ips)
+		summary.item(before, err)
+		if err != nil {
+			klog.Errorf("loadbalancer.reconcileServices(): %v: failed to reconcile service %s, going on with the others: %v", mode, serviceRep(svc), err)
+			l.serviceEvent(svc, v1.EventTypeWarning, eventReasonSyncFailed, "failed to reconcile load balancer: %v", err)
+			errs = append(errs, fmt.Errorf("service %s: %w", serviceRep(svc), err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// lockedAddService add a single service, serialized with any other work on the same service
+func (l *loadBalancers) lockedAddService(ctx context.Context, svc *v1.Service, ips []packngo.IPAddressReservation) error {
+	defer l.serviceLocks.lock(serviceIdentity(svc))()
+	err := l.addService(ctx, svc, ips)
+	l.metrics.observe("service", serviceRep(svc), "add", err == nil)
+	return err
+}
+
+// loadBalancerServices get the services that we manage: those of type LoadBalancer, either without
+// a class or of the given class, not in any of the excluded namespaces, and not opted out
+func loadBalancerServices(svcs []*v1.Service, class string, excludedNamespaces map[string]bool) []*v1.Service {
+	validSvcs := []*v1.Service{}
+	for _, svc := range svcs {
+		// filter on type: only take those that are of type=LoadBalancer
+		if svc.Spec.Type != v1.ServiceTypeLoadBalancer {
+			continue
+		}
+		// filter on class: another load balancer controller manages those of other classes
+		if c, ok := loadBalancerClass(svc); ok && c != class {
+			klog.V(5).Infof("skipping service %s of load balancer class %s", serviceRep(svc), c)
+			continue
+		}
+		// filter on namespace: another controller manages those of the excluded namespaces
+		if excludedNamespaces[svc.Namespace] {
+			klog.V(5).Infof("skipping service %s of excluded namespace", serviceRep(svc))
+			continue
+		}
+		// filter on opt-out: the user manages the address of the service themselves
+		if loadBalancerDisabled(svc) {
+			klog.V(5).Infof("skipping service %s with load balancer disabled", serviceRep(svc))
+			continue
+		}
+		// filter on name: do not try to manage the the service we created for EIP load balancer
+		if svc.ObjectMeta.Name == externalServiceName && svc.ObjectMeta.Namespace == externalServiceNamespace {
+			continue
+		}
+		validSvcs = append(validSvcs, svc)
+	}
+	return validSvcs
+}
+
+// addService add a single service; wraps the implementation
+func (l *loadBalancers) addService(ctx context.Context, svc *v1.Service, ips []packngo.IPAddressReservation) error {
+	svcName := serviceRep(svc)
+	svcTag := serviceTag(svc)
+	clsTag := clusterTag(l.clusterID)
+	svcIP := l.assignedIP(svc)
+
+	var (
+		svcIPCidr string
+		err       error
+	)
+	// the IPv6 half of a dual-stack service, and a standby, carry the same service tag, so leave them out here
+	ipv4s := withoutStandby(ipReservationsWithoutTag(ipv6FamilyTag, ips))
+	ipReservation := ipReservationByAllTags([]string{svcTag, emTag, clsTag}, ipv4s)
+
+	klog.V(2).Infof("processing %s with existing IP assignment %s", svcName, svcIP)
+	// e.g. a hostname; it would make a broken entry, so skip the service, but not the rest of the reconcile
+	if svcIP != "" && net.ParseIP(svcIP) == nil {
+		klog.Errorf("service %s has spec.loadBalancerIP %q, which is not an IP address, not mapping it; set an IP address, or remove it to have one assigned", svcName, svcIP)
+		return nil
+	}
+	if ipv6Only(svc) {
+		return l.addServiceIPv6Only(ctx, svc, ips)
+	}
+	// it was IPv6 only, and no longer is, so it needs an IPv4 address; the IPv6 one is dropped below
+	if ipr := ipReservationByAllTags([]string{svcTag, emTag, clsTag, ipv6FamilyTag}, ips); ipr != nil && svcIP != "" && ipr.Address == svcIP {
+		klog.V(2).Infof("service %s no longer is IPv6 only, replacing IPv6 address %s", svcName, svcIP)
+		svcIP = ""
+	}
+	// the standby address may be the one to use instead
+	if svcIP, ips, err = l.reconcileStandby(ctx, svc, ips, svcIP); err != nil {
+		return err
+	}
+	// a service pinned to a reservation gets exactly that one, whatever its address or tags
+	if id := svc.Annotations[annotationEIPReservationID]; id != "" {
+		pinned, err := l.pinnedReservation(ctx, svc, id)
+		if err != nil || pinned == nil {
+			return err
+		}
+		if svcIP, err = l.replaceWithPinned(ctx, svc, svcIP, ipReservation, pinned, ips); err != nil {
+			return err
+		}
+		ipReservation = pinned
+	}
+	// e.g. set by the user, or assigned before the approved CIDR was
+	if svcIP != "" && l.rejectUnapproved(svc, svcIP, ipReservationByAddress(svcIP, ips)) {
+		return nil
+	}
+	// e.g. set by the user to an address of another project, or none at all
+	if svcIP != "" {
+		if rejected, err := l.rejectUnowned(ctx, svc, svcIP, ips); err != nil || rejected {
+			return err
+		}
+	}
+	// e.g. reserved by hand for the address set by the user, so it is managed from now on
+	if svcIP != "" && ipReservation == nil {
+		ipReservation = l.adoptByAddress(ctx, svc, svcIP, ipv4s)
+	}
+	// if it already has an IP, no need to get it one
+	if svcIP == "" {
+		klog.V(2).Infof("no IP assigned for service %s; searching reservations", svcName)
+
+		// the list of reservations may predate a removal for the same service identity that we
+		// waited on, e.g. delete and recreate, so make sure it still exists before reusing it
+		if ipReservation != nil {
+			ipReservation, err = l.currentReservation(ctx, ipReservation.ID)
+			if err != nil {
+				return err
+			}
+		}
+
+		// a reservation we created earlier without an address may not be listed yet
+		if ipReservation == nil {
+			if ipReservation, err = l.pendingReservation(ctx, svcName); err != nil {
+				return err
+			}
+		}
+
+		// another service may have got the EIP it shares since the list
+		if ipReservation == nil && shareKey(svc) != "" {
+			if ipReservation, err = l.sharedReservation(ctx, svc); err != nil {
+				return err
+			}
+		}
+
+		// a service that draws from a pool gets its address only from there
+		if ipReservation == nil && reservationPool(svc) != "" {
+			if ipReservation, err = l.drawFromPool(ctx, svc, l.withinApproved(ipv4s)); err != nil {
+				return err
+			}
+		}
+
+		// a service that shares a block gets one of its addresses
+		if ipReservation == nil && l.eipBlockSize(svc) > 0 {
+			if ipReservation, err = l.drawFromBlock(ctx, svc); err != nil {
+				return err
+			}
+		}
+
+		// the tags may have been lost, e.g. removed by hand, so look for the description we would have set
+		if ipReservation == nil {
+			ipReservation = l.adoptByDescription(ctx, svc, l.withinApproved(ipv4s))
+		}
+
+		// depending on the reuse scope, a reservation that no other service holds may do
+		if ipReservation == nil {
+			if ipReservation, err = l.reusableReservation(ctx, svc, l.withinApproved(ipv4s)); err != nil {
+				return err
+			}
+		}
+
+		// if no IP found, request a new one
+		if ipReservation == nil {
+
+			// if we did not find an IP reserved, create a request
+			klog.V(2).Infof("no IP assignment found for %s, requesting", svcName)
+			// create a request
+			tags := []string{
+				emTag,
+				svcTag,
+				clsTag,
+			}
+			if dualStack(svc) {
+				tags = append(tags, ipv4FamilyTag)
+			}
+			tags = append(append(tags, l.serviceLabelTags(svc)...), l.serviceAdditionalTags(svc)...)
+			req := packngo.IPReservationRequest{
+				Type:                   packngo.PublicIPv4,
+				Quantity:               reservationQuantity(l.reservationCIDR),
+				Description:            l.describeReservation(svc),
+				Tags:                   tags,
+				FailOnApprovalRequired: l.failOnApprovalRequired(svc),
+			}
+			// a global address is anycast, so of no facility, and only ever a single one
+			if globalEIP(svc) {
+				req.Type = packngo.GlobalIPv4
+				req.Quantity = 1
+			} else {
+				facility, err := l.selectServiceFacility(ctx, svc)
+				if err != nil {
+					return fmt.Errorf("failed to select a facility for the load balancer IP: %v", err)
+				}
+				req.Facility = &facility
+			}
+
+			ipReservation, err = l.requestReservation(ctx, svc, &req, func(ips []packngo.IPAddressReservation) []*packngo.IPAddressReservation {
+				return ipReservationsByAllTags([]string{svcTag, emTag, clsTag}, withoutStandby(ipReservationsWithoutTag(ipv6FamilyTag, ips)))
+			})
+			if err != nil {
+				return fmt.Errorf("failed to request an IP for the load balancer: %w", err)
+			}
+			// the list predates it, but the IPv6 half must find it, to be in the same facility
+			ips = append(append([]packngo.IPAddressReservation{}, ips...), *ipReservation)
+		}
+
+		// if we have no IP from existing or a new reservation, log it and return
+		if ipReservation == nil {
+			klog.V(2).Infof("no IP to assign to service %s, will need to wait until it is allocated", svcName)
+			return nil
+		}
+		if !l.hasAddress(svcName, ipReservation) {
+			return nil
+		}
+		// the API cannot be asked for an address within a block, so a new one may be outside it
+		if l.rejectUnapproved(svc, ipReservation.Address, ipReservation) {
+			return l.releaseRejected(ctx, svc, ipReservation)
+		}
+
+		// we have an IP, either found from existing reservations or a new reservation.
+		// map and assign it
+		svcIP = ipReservation.Address
+		// in a shared block, the service holds only one of the addresses
+		if isSharedBlock(ipReservation) {
+			if svcIP, err = l.allocateInBlock(ctx, svc, ipReservation); err != nil {
+				return err
+			}
+		}
+
+		// assign the IP and save it. The reservation is made already, so if the service cannot be
+		// updated, e.g. the apiserver is briefly unavailable, do not fail the whole reconcile; record
+		// it, so the next reconcile writes it without reserving another, and move on
+		klog.V(2).Infof("assigning IP %s to %s", svcIP, svcName)
+		if err := l.writeServiceIP(ctx, svc, svcIP); err != nil {
+			klog.Warningf("failed to assign IP %s to service %s, will try again on next reconcile: %v", svcIP, svcName, err)
+			l.recordPending(svcName, ipReservation.ID)
+			return nil
+		}
+		klog.V(2).Infof("successfully assigned %s update service %s", svcIP, svcName)
+	}
+	// the labels of one service do not apply to a block, or an EIP, shared by others
+	if ipReservation != nil && !isSharedBlock(ipReservation) && shareKey(svc) == "" {
+		l.updateLabelTags(ctx, svc, ipReservation)
+	}
+	// the reservation may be a larger block, held for the service, but unless the service asks for
+	// more of it, only the address itself is advertised
+	if !allocateOnly(svc) {
+		ipr := ipReservationByAddress(svcIP, ips)
+		if ipr == nil {
+			ipr = ipReservation
+		}
+		svcIPCidr = advertisedCIDR(svc, svcIP, ipr)
+		if err := l.implementor.AddService(ctx, poolName(svc), svcIPCidr, l.serviceOptions(ctx, svc)); err != nil {
+			return err
+		}
+	}
+	for _, ip := range l.advertisedExternalIPs(svc, svcIP, ips) {
+		// pool names must be unique, and an address cannot collide with any other service name
+		if err := l.implementor.AddService(ctx, svcName+"/"+ip, hostCIDR(ip), l.serviceOptions(ctx, svc)); err != nil {
+			return err
+		}
+	}
+	if dualStack(svc) {
+		return l.addServiceIPv6(ctx, svc, ips, svcIP)
+	}
+	if err := l.dropServiceIPv6(ctx, svc, ips, svcIP); err != nil {
+		return err
+	}
+	// nothing will announce the address, or it is not in the spec, so the status is for us to write
+	if allocateOnly(svc) || !l.writeSpecIP {
+		return l.setIngressIPs(ctx, svc, svcIP)
+	}
+	return nil
+}
+
+// addServiceIPv6 add the IPv6 half of a dual-stack service. The reservation is found by the same
+// tags as the IPv4 one plus the family tag. As spec.loadBalancerIP can hold only one address,
+// both addresses are written to the service status.
+func (l *loadBalancers) addServiceIPv6(ctx context.Context, svc *v1.Service, ips []packngo.IPAddressReservation, ipv4 string) error {
+	var err error
+	svcName := serviceRep(svc)
+	tags := []string{emTag, serviceTag(svc), clusterTag(l.clusterID), ipv6FamilyTag}
+	ipReservation := ipReservationByAllTags(tags, ips)
+
+	// the list of reservations may be stale, see addService; once it is in the status, we know it is ours
+	if ipReservation != nil && !hasIngressIP(svc, ipReservation.Address) {
+		ipReservation, err = l.currentReservation(ctx, ipReservation.ID)
+		if err != nil {
+			return err
+		}
+	}
+	if ipReservation == nil {
+		if ipReservation, err = l.pendingReservation(ctx, svcName+"/ipv6"); err != nil {
+			return err
+		}
+	}
+	if ipReservation == nil {
+		klog.V(2).Infof("no IPv6 assignment found for %s, requesting", svcName)
+		// keep both halves in the same facility
+		var facility string
+		if ipr := ipReservationByAddress(ipv4, ips); ipr != nil && ipr.Facility != nil {
+			facility = ipr.Facility.Code
+		} else if facility, err = l.selectServiceFacility(ctx, svc); err != nil {
+			return fmt.Errorf("failed to select a facility for the load balancer IPv6 address: %v", err)
+		}
+		req := packngo.IPReservationRequest{
+			Type:                   "public_ipv6",
+			Quantity:               1,
+			Description:            fmt.Sprintf("%s (%s)", l.describeReservation(svc), ipv6FamilyTag),
+			Facility:               &facility,
+			Tags:                   append(append(tags, l.serviceLabelTags(svc)...), l.serviceAdditionalTags(svc)...),
+			FailOnApprovalRequired: l.failOnApprovalRequired(svc),
+		}
+		ipReservation, err = l.requestReservation(ctx, svc, &req, func(ips []packngo.IPAddressReservation) []*packngo.IPAddressReservation {
+			return ipReservationsByAllTags(tags, ips)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to request an IPv6 address for the load balancer: %w", err)
+		}
+	}
+	if !l.hasAddress(svcName+"/ipv6", ipReservation) {
+		return nil
+	}
+	if l.rejectUnapproved(svc, ipReservation.Address, ipReservation) {
+		if hasIngressIP(svc, ipReservation.Address) {
+			return nil
+		}
+		return l.releaseRejected(ctx, svc, ipReservation)
+	}
+	l.updateLabelTags(ctx, svc, ipReservation)
+
+	// each address is its own pool, and pool names must be unique, so the IPv6 one gets a suffix
+	// that cannot collide with any other service name
+	if !allocateOnly(svc) {
+		svcIPCidr := hostCIDR(ipReservation.Address)
+		if err := l.implementor.AddService(ctx, svcName+"/ipv6", svcIPCidr, l.serviceOptions(ctx, svc)); err != nil {
+			return err
+		}
+	}
+	return l.setIngressIPs(ctx, svc, ipv4, ipReservation.Address)
+}
+
+// dropServiceIPv6 remove the IPv6 half of a service that no longer is dual-stack: stop advertising
+// it, release its reservation, and leave only the IPv4 address in the status. The sync would
+// release the reservation too, but not fix the status.
+func (l *loadBalancers) dropServiceIPv6(ctx context.Context, svc *v1.Service, ips []packngo.IPAddressReservation, ipv4 string) error {
+	svcName := serviceRep(svc)
+	ipReservation := ipReservationByAllTags([]string{emTag, serviceTag(svc), clusterTag(l.clusterID), ipv6FamilyTag}, ips)
+	if ipReservation == nil {
+		return nil
+	}
+	klog.V(2).Infof("service %s no longer is dual-stack, removing IPv6 address %s", svcName, ipReservation.Address)
+	if !allocateOnly(svc) {
+		if err := l.implementor.RemoveService(ctx, hostCIDR(ipReservation.Address)); err != nil {
+			return fmt.Errorf("error removing IPv6 address from configmap for %s: %v", svcName, err)
+		}
+	}
+	if err := l.removeReservation(ctx, svc, ipReservation); err != nil {
+		return err
+	}
+	if !hasIngressIP(svc, ipReservation.Address) {
+		return nil
+	}
+	return l.setIngressIPs(ctx, svc, ipv4)
+}
+
+// loadBalancerStatus get the status of the service with the addresses of its reservations, as the
+// CCM sets them: the assigned address, else its IPv4 one, and for a dual-stack service, its IPv6
+// one as well; or nil if it has none of its own
+func (l *loadBalancers) loadBalancerStatus(svc *v1.Service, ips []packngo.IPAddressReservation) *v1.LoadBalancerStatus {
+	tags := []string{serviceTag(svc), emTag, clusterTag(l.clusterID)}
+	ipv6 := ipReservationByAllTags(append(tags, ipv6FamilyTag), ips)
+	addrs := []string{}
+	if ipv6Only(svc) {
+		if ipv6 != nil && ipv6.Address != "" {
+			addrs = append(addrs, ipv6.Address)
+		}
+	} else {
+		// e.g. the standby, when it is the active one
+		addr := l.assignedIP(svc)
+		if addr != "" && ipReservationByAddress(addr, ips) == nil {
+			addr = ""
+		}
+		if ipv4 := ipReservationByAllTags(tags, withoutStandby(ipReservationsWithoutTag(ipv6FamilyTag, ips))); addr == "" && ipv4 != nil {
+			addr = ipv4.Address
+			if isSharedBlock(ipv4) {
+				addr = blockAllocation(ipv4, svc)
+			}
+		}
+		if addr != "" {
+			addrs = append(addrs, addr)
+		}
+		if dualStack(svc) && ipv6 != nil && ipv6.Address != "" {
+			addrs = append(addrs, ipv6.Address)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil
+	}
+	return &v1.LoadBalancerStatus{Ingress: serviceIngress(svc, addrs)}
+}
+
+// serviceIngress get the ingress of the status of the service for its addresses, each with the
+// hostname of its annotation, if it has one, e.g. for external-dns
+func serviceIngress(svc *v1.Service, addrs []string) []v1.LoadBalancerIngress {
+	hostname := eipHostname(svc)
+	ingress := []v1.LoadBalancerIngress{}
+	for _, addr := range addrs {
+		ingress = append(ingress, v1.LoadBalancerIngress{IP: addr, Hostname: hostname})
+	}
+	return ingress
+}
+
+// eipHostname get the hostname of the annotation of the service, or "" if it has none; one that
+// is not a DNS name is logged, and ignored
+func eipHostname(svc *v1.Service) string {
+	hostname := strings.TrimSpace(svc.Annotations[annotationEIPHostname])
+	if hostname == "" {
+		return ""
+	}
+	if errs := validation.IsDNS1123Subdomain(hostname); len(errs) > 0 {
+		klog.Errorf("ignoring hostname %q of %s for service %s, it is not a DNS name: %s", hostname, annotationEIPHostname, serviceRep(svc), strings.Join(errs, "; "))
+		return ""
+	}
+	return hostname
+}
+
+// assignedIP get the address assigned to the service: its spec.loadBalancerIP, or if the CCM does
+// not write that and it is not set, the first address of its status, IPv4 for a dual-stack service
+func (l *loadBalancers) assignedIP(svc *v1.Service) string {
+	if svc.Spec.LoadBalancerIP != "" || l.writeSpecIP || len(svc.Status.LoadBalancer.Ingress) == 0 {
+		return svc.Spec.LoadBalancerIP
+	}
+	return svc.Status.LoadBalancer.Ingress[0].IP
+}
+
+// setIngressIPs set the status of the service to the given addresses, unless it has exactly those already
+func (l *loadBalancers) setIngressIPs(ctx context.Context, svc *v1.Service, addrs ...string) error {
+	svcName := serviceRep(svc)
+	ingress := serviceIngress(svc, addrs)
+	current := len(svc.Status.LoadBalancer.Ingress) == len(ingress)
+	for _, want := range ingress {
+		current = current && hasIngress(svc, want)
+	}
+	if current {
+		return nil
+	}
+	if l.dryRun {
+		klog.InfoS("dry run: would set service status", "service", svcName, "addresses", addrs)
+		return nil
+	}
+	klog.V(2).Infof("setting status of %s to addresses %v", svcName, addrs)
+	intf := l.k8sclient.CoreV1().Services(svc.Namespace)
+	existing, err := intf.Get(ctx, svc.Name, metav1.GetOptions{})
+	if err != nil || existing == nil {
+		return fmt.Errorf("failed to get latest for service %s: %v", svcName, err)
+	}
+	existing.Status.LoadBalancer.Ingress = ingress
+	if _, err := intf.UpdateStatus(ctx, existing, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update status of service %s: %v", svcName, err)
+	}
+	return nil
+}
+
+// writeServiceIP set the spec.loadBalancerIP of the latest version of the service, or if that is
+// not to be written, its status
+func (l *loadBalancers) writeServiceIP(ctx context.Context, svc *v1.Service, svcIP string) error {
+	svcName := serviceRep(svc)
+	// the spec is left as declared, and the address kept in the status only
+	if !l.writeSpecIP {
+		if err := l.setIngressIPs(ctx, svc, svcIP); err != nil {
+			return err
+		}
+		l.serviceEvent(svc, v1.EventTypeNormal, eventReasonEIPAssigned, "assigned EIP %s", svcIP)
+		return nil
+	}
+	if l.dryRun {
+		klog.InfoS("dry run: would set service loadBalancerIP", "service", svcName, "loadBalancerIP", svcIP)
+		return nil
+	}
+	intf := l.k8sclient.CoreV1().Services(svc.Namespace)
+	existing, err := intf.Get(ctx, svc.Name, metav1.GetOptions{})
+	if err != nil || existing == nil {
+		return fmt.Errorf("failed to get latest for service %s: %v", svcName, err)
+	}
+	existing.Spec.LoadBalancerIP = svcIP
+	if _, err := intf.Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("failed to update service %s: %v", svcName, err)
+	}
+	l.serviceEvent(svc, v1.EventTypeNormal, eventReasonEIPAssigned, "assigned EIP %s", svcIP)
+	return nil
+}
+
+// requestReservation request a reservation for a service, for which match finds all of its
+// reservations. The API has no idempotency keys, so if a request is retried, e.g. by the client
+// after the response was lost, it may have created more than one, or one may exist although the
+// request failed. So list again straight after: keep the one returned, or the first, and release
+// the rest. The same goes for a request retried here after a transient error.
+//
+// In a dry run, nothing is requested; the reservation returned has no address, so the service
+// waits for one as it would for a reservation that has none yet.
+func (l *loadBalancers) requestReservation(ctx context.Context, svc *v1.Service, req *packngo.IPReservationRequest, match func([]packngo.IPAddressReservation) []*packngo.IPAddressReservation) (*packngo.IPAddressReservation, error) {
+	svcName := serviceRep(svc)
+	if l.dryRun {
+		var facility string
+		if req.Facility != nil {
+			facility = *req.Facility
+		}
+		klog.InfoS("dry run: would request IP reservation", "service", svcName, "type", req.Type, "quantity", req.Quantity, "facility", facility, "tags", req.Tags)
+		return &packngo.IPAddressReservation{}, nil
+	}
+	var ipReservation *packngo.IPAddressReservation
+	reqErr := l.retry.retryMutationOnTransient(ctx, "request of IP reservation for "+svcName, func() error {
+		var err error
+		defer observePackngoRequest("request_ip_reservation", time.Now())
+		ipReservation, _, err = l.client.ProjectIPs.Request(l.project, req)
+		// even a failed request may have created one
+		l.ipCache.invalidate(l.project)
+		return err
+	})
+	if reqErr != nil {
+		reqErr = mapReservationRequestError(reqErr)
+	}
+	ips, err := l.listReservations(ctx)
+	if err != nil {
+		if reqErr != nil {
+			l.serviceEvent(svc, v1.EventTypeWarning, reservationRequestFailedReason(reqErr), "failed to request an EIP: %v", reqErr)
+			return nil, reqErr
+		}
+		klog.Warningf("unable to check for duplicate IP reservations for %s: %v", svcName, err)
+		l.emitReservationEvent(ctx, reservationEventCreated, svcName, ipReservation)
+		l.serviceEvent(svc, v1.EventTypeNormal, eventReasonEIPRequested, "requested EIP reservation %s", ipReservation.ID)
+		return ipReservation, nil
+	}
+	found := match(ips)
+	var keep *packngo.IPAddressReservation
+	for _, ipr := range found {
+		if ipReservation != nil && reqErr == nil && ipr.ID == ipReservation.ID {
+			keep = ipr
+		}
+	}
+	if keep == nil && len(found) > 0 {
+		keep = found[0]
+	}
+	if keep == nil {
+		if reqErr != nil {
+			l.serviceEvent(svc, v1.EventTypeWarning, reservationRequestFailedReason(reqErr), "failed to request an EIP: %v", reqErr)
+			return nil, reqErr
+		}
+		// it may not be listed yet
+		l.emitReservationEvent(ctx, reservationEventCreated, svcName, ipReservation)
+		l.serviceEvent(svc, v1.EventTypeNormal, eventReasonEIPRequested, "requested EIP reservation %s", ipReservation.ID)
+		return ipReservation, nil
+	}
+	if reqErr != nil {
+		klog.Warningf("request of IP reservation for %s failed, but reservation %s was created, using it: %v", svcName, keep.ID, reqErr)
+	}
+	l.emitReservationEvent(ctx, reservationEventCreated, svcName, keep)
+	l.serviceEvent(svc, v1.EventTypeNormal, eventReasonEIPRequested, "requested EIP reservation %s", keep.ID)
+	for _, ipr := range found {
+		if ipr == keep {
+			continue
+		}
+		klog.Warningf("removing duplicate IP reservation %s for %s", ipr.ID, svcName)
+		if err := l.deleteReservation(ctx, ipr.ID); err != nil {
+			klog.Errorf("failed to remove duplicate IP reservation %s for %s, sync will retry: %v", ipr.ID, svcName, err)
+			continue
+		}
+		l.emitReservationEvent(ctx, reservationEventDeleted, svcName, ipr)
+	}
+	return keep, nil
+}
+
+// listReservations list the reservations of the project, retrying transient errors; a list made
+// since the last change here, and within the IP cache TTL, is used rather than listing again
+func (l *loadBalancers) listReservations(ctx context.Context) ([]packngo.IPAddressReservation, error) {
+	return l.ipCache.get(l.project, func() ([]packngo.IPAddressReservation, error) {
+		var ips []packngo.IPAddressReservation
+		err := l.retry.retryOnTransient(ctx, "list of IP reservations", func() error {
+			var err error
+			defer observePackngoRequest("list_ip_reservations", time.Now())
+			ips, _, err = l.client.ProjectIPs.List(l.project, &packngo.ListOptions{})
+			return err
+		})
+		return ips, err
+	})
+}
+
+// lastReservations get the reservations of the project as last listed, if any were, else list
+// them, for what only shows them and so need not ask the API on every request
+func (l *loadBalancers) lastReservations(ctx context.Context) ([]packngo.IPAddressReservation, error) {
+	if ips, ok := l.ipCache.last(l.project); ok {
+		return ips, nil
+	}
+	return l.listReservations(ctx)
+}
+
+// deleteReservation delete a reservation from the project, retrying transient errors
+func (l *loadBalancers) deleteReservation(ctx context.Context, id string) error {
+	if l.dryRun {
+		klog.InfoS("dry run: would remove IP reservation", "reservation", id)
+		return nil
+	}
+	return l.retry.retryMutationOnTransient(ctx, "removal of IP reservation "+id, func() error {
+		defer observePackngoRequest("remove_ip_reservation", time.Now())
+		_, err := l.client.ProjectIPs.Remove(id)
+		l.ipCache.invalidate(l.project)
+		return err
+	})
+}
+
+// updateTags replace the tags of a reservation, so that the next list of them sees the change. In
+// a dry run, the reservation is returned as it would be, with the tags replaced.
+func (l *loadBalancers) updateTags(ctx context.Context, id string, tags []string) (*packngo.IPAddressReservation, *packngo.Response, error) {
+	if l.dryRun {
+		klog.InfoS("dry run: would update tags of IP reservation", "reservation", id, "tags", tags)
+		ipr, err := l.currentReservation(ctx, id)
+		if err == nil && ipr == nil {
+			err = fmt.Errorf("IP reservation %s no longer exists", id)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		ipr.Tags = tags
+		return ipr, nil, nil
+	}
+	defer l.ipCache.invalidate(l.project)
+	var (
+		ipr  *packngo.IPAddressReservation
+		resp *packngo.Response
+	)
+	err := callToEnd(ctx, func() error {
+		var err error
+		ipr, resp, err = l.ipTagger.UpdateTags(id, tags)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return ipr, resp, nil
+}
+
+// currentReservation get the reservation as it is now, or nil if it no longer exists
+func (l *loadBalancers) currentReservation(ctx context.Context, id string) (*packngo.IPAddressReservation, error) {
+	var ipr *packngo.IPAddressReservation
+	err := callWithContext(ctx, func() error {
+		defer observePackngoRequest("get_ip_reservation", time.Now())
+		var err error
+		ipr, _, err = l.client.ProjectIPs.Get(id, &packngo.GetOptions{})
+		return err
+	})
+	if err != nil {
+		if isNotFound(err) {
+			klog.V(2).Infof("IP reservation %s no longer exists", id)
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unable to retrieve IP reservation %s: %v", id, err)
+	}
+	return ipr, nil
+}
+
+// stillFree get the current reservation, if it still is free by the given check, rather than as
+// it was in a list that may be stale, so that one another service claimed since is not claimed
+// twice. It is nil if it no longer is free, or no longer exists. The claims are serialized by
+// blockLock, which the caller holds until it has tagged the reservation.
+func (l *loadBalancers) stillFree(ctx context.Context, ipr *packngo.IPAddressReservation, free func(*packngo.IPAddressReservation) bool) (*packngo.IPAddressReservation, error) {
+	current, err := l.currentReservation(ctx, ipr.ID)
+	if err != nil || current == nil {
+		return nil, err
+	}
+	if !free(current) {
+		klog.V(2).Infof("reservation %s was claimed since it was listed, has tags %v, skipping", ipr.ID, current.Tags)
+		return nil, nil
+	}
+	return current, nil
+}
+
+// hasAddress report if the reservation has its address. On rare occasions, the API returns a
+// reservation without one; that cannot be mapped, so record it, by the given key, to check
+// again on the next reconcile, rather than requesting another.
+func (l *loadBalancers) hasAddress(key string, ipr *packngo.IPAddressReservation) bool {
+	l.pendingLock.Lock()
+	defer l.pendingLock.Unlock()
+	// a dry run requested nothing, so there is nothing to check again
+	if ipr.Address == "" && l.dryRun {
+		return false
+	}
+	if ipr.Address == "" {
+		klog.V(2).Infof("IP reservation %s for %s has no address yet, will check again on next reconcile", ipr.ID, key)
+		l.pending[key] = ipr.ID
+		return false
+	}
+	delete(l.pending, key)
+	return true
+}
+
+// recordPending record a reservation by the given key, to look up again on the next reconcile
+func (l *loadBalancers) recordPending(key, id string) {
+	l.pendingLock.Lock()
+	defer l.pendingLock.Unlock()
+	l.pending[key] = id
+}
+
+// pendingReservation get the current state of a reservation recorded by hasAddress or recordPending,
+// or nil if there is none
+func (l *loadBalancers) pendingReservation(ctx context.Context, key string) (*packngo.IPAddressReservation, error) {
+	l.pendingLock.Lock()
+	id, ok := l.pending[key]
+	l.pendingLock.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	ipr, err := l.currentReservation(ctx, id)
+	if ipr == nil && err == nil {
+		l.pendingLock.Lock()
+		delete(l.pending, key)
+		l.pendingLock.Unlock()
+	}
+	return ipr, err
+}
+
+// emitReservationEvent publish an operation on a reservation to the events sink
+func (l *loadBalancers) emitReservationEvent(ctx context.Context, eventType, svcName string, ipr *packngo.IPAddressReservation) {
+	if ipr == nil {
+		return
+	}
+	summaryFrom(ctx).reservation(eventType)
+	// in a dry run, nothing happened to publish
+	if l.events == nil || l.dryRun {
+		return
+	}
+	l.events.emit(reservationEvent{
+		Type:          eventType,
+		Service:       svcName,
+		ReservationID: ipr.ID,
+		Address:       ipr.Address,
+	})
+}
+
+// retainReservation report if the reservation for a service should be kept rather
+// than released when the service is removed. The retain annotation can be set
+// either on the service itself, or on its namespace, so that deleting an entire
+// namespace does not give up its addresses.
+func (l *loadBalancers) retainReservation(ctx context.Context, svc *v1.Service) bool {
+	if svc.Annotations[annotationEIPRetain] == "true" {
+		return true
+	}
+	ns, err := l.k8sclient.CoreV1().Namespaces().Get(ctx, svc.Namespace, metav1.GetOptions{})
+	if err != nil || ns == nil {
+		klog.V(2).Infof("could not get namespace %s to check for %s, releasing: %v", svc.Namespace, annotationEIPRetain, err)
+		return false
+	}
+	return ns.Annotations[annotationEIPRetain] == "true"
+}
+
+// retainedTags convert the tags of a managed reservation to those of a retained one.
+// The usage tag is swapped, so that the reservation no longer is considered
+// managed, and thus is neither reused nor released, while the service and cluster tags
+// are kept so that an operator can find it again.
+func retainedTags(tags []string) []string {
+	ret := []string{}
+	for _, tag := range tags {
+		if tag == emTag {
+			tag = emRetainedTag
+		}
+		ret = append(ret, tag)
+	}
+	return ret
+}
+
+// adoptByAddress find the reservation of exactly the address of the service, e.g. one reserved in
+// the portal and set as spec.loadBalancerIP by the user, and if it is not tagged by the CCM, tag it
+// for the service, as if it had been requested for it; it is reused, and released, as one would
+// be. A reservation of a larger block, one of a device, or one with a tag of another service or
+// cluster, is left untouched. Returns nil if there is none to adopt.
+func (l *loadBalancers) adoptByAddress(ctx context.Context, svc *v1.Service, addr string, ips []packngo.IPAddressReservation) *packngo.IPAddressReservation {
+	svcName := serviceRep(svc)
+	ipReservation := ipReservationByAddress(addr, ips)
+	if ipReservation == nil || ipReservation.Address != addr || ipReservation.CIDR != 32 || ipReservation.Management || !ipReservation.Public {
+		return nil
+	}
+	for _, tag := range ipReservation.Tags {
+		if strings.HasPrefix(tag, "usage=") || strings.HasPrefix(tag, "service=") || strings.HasPrefix(tag, "cluster=") {
+			return nil
+		}
+	}
+	tags := append(append([]string{}, ipReservation.Tags...), emTag, serviceTag(svc), clusterTag(l.clusterID))
+	klog.V(2).Infof("adopting untagged reservation %s of %s for %s", ipReservation.ID, addr, svcName)
+	updated, _, err := l.updateTags(ctx, ipReservation.ID, tags)
+	if err != nil {
+		klog.Errorf("failed to tag reservation %s of %s for %s, will try again on next reconcile: %v", ipReservation.ID, addr, svcName, err)
+		return nil
+	}
+	return updated
+}
+
+// adoptByDescription find a reservation for the service by its description, and if
+// one is found, restore its tags so it is found normally from now on, replacing any usage tag,
+// e.g. that of a retained one, see reassignedTags. Returns nil if there is no match, if the
+// description is ambiguous, or if the reservation has a cluster or service tag of another, e.g.
+// as the description template does not have the cluster.
+func (l *loadBalancers) adoptByDescription(ctx context.Context, svc *v1.Service, ips []packngo.IPAddressReservation) *packngo.IPAddressReservation {
+	svcName := serviceRep(svc)
+	ipReservation, err := ipReservationByDescription(l.describeReservation(svc), ips)
+	switch {
+	case err != nil:
+		klog.Warningf("not adopting reservation by description for %s: %v", svcName, err)
+		return nil
+	case ipReservation == nil:
+		return nil
+	}
+	svcTag, clsTag := serviceTag(svc), clusterTag(l.clusterID)
+	_, cluster, service := reservationTagValues(ipReservation.Tags)
+	if (cluster != "" && cluster != clsTag) || (service != "" && service != svcTag && service != legacyServiceTag(svc)) {
+		klog.Warningf("not adopting reservation %s by description for %s, it has the tags %s %s of another", ipReservation.ID, svcName, cluster, service)
+		return nil
+	}
+	tags := reassignedTags(ipReservation.Tags, svcTag, clsTag)
+	klog.V(2).Infof("adopting reservation %s for %s by description", ipReservation.ID, svcName)
+	updated, _, err := l.updateTags(ctx, ipReservation.ID, tags)
+	if err != nil {
+		klog.Errorf("failed to restore tags on reservation %s for %s: %v", ipReservation.ID, svcName, err)
+		return nil
+	}
+	return updated
+}
+
+// serviceAddresses get every address that should be advertised for the given services, as a map
+// to the name under which it is advertised: the loadBalancerIP if it is in a reservation we manage,
+// the IPv6 address of a dual-stack service, and any valid external IPs.
+func (l *loadBalancers) serviceAddresses(svcs []*v1.Service, ips []packngo.IPAddressReservation) map[string]string {
+	// create a set of reserved addresses, so we only keep service IPs that we manage
+	reserved := map[string]bool{}
+	for _, ipr := range ipReservationsByAllTags([]string{emTag, clusterTag(l.clusterID)}, ips) {
+		reserved[ipr.Address] = true
+		if isSharedBlock(ipr) {
+			for addr := range blockAllocations(ipr) {
+				reserved[addr] = true
+			}
+		}
+	}
+
+	addrs := map[string]string{}
+	for _, svc := range svcs {
+		// none of its addresses are advertised
+		if allocateOnly(svc) {
+			continue
+		}
+		svcName := serviceRep(svc)
+		svcIP := l.assignedIP(svc)
+		if svcIP != "" && reserved[svcIP] {
+			addrs[advertisedCIDR(svc, svcIP, ipReservationByAddress(svcIP, ips))] = poolName(svc)
+		}
+		for _, ip := range l.validExternalIPs(svc, svcIP, ips) {
+			addrs[hostCIDR(ip)] = svcName + "/" + ip
+		}
+		if dualStack(svc) {
+			if ipr := ipReservationByAllTags([]string{serviceTag(svc), emTag, clusterTag(l.clusterID), ipv6FamilyTag}, ips); ipr != nil {
+				addrs[hostCIDR(ipr.Address)] = svcName + "/ipv6"
+			}
+		}
+	}
+	return addrs
+}
+
+// advertisedExternalIPs get the valid external IPs of the service that are advertised; none are for
+// a service that only is allocated addresses
+func (l *loadBalancers) advertisedExternalIPs(svc *v1.Service, svcIP string, ips []packngo.IPAddressReservation) []string {
+	if allocateOnly(svc) {
+		return nil
+	}
+	return l.validExternalIPs(svc, svcIP, ips)
+}
+
+// validExternalIPs get the spec.externalIPs of the service to advertise as additional addresses,
+// if managing them is enabled. These are not requested, as an address of our choosing cannot be;
+// each must be in a reservation of the project already, and not one that is managed for another
+// service. The loadBalancerIP takes precedence, so an external IP that is the same is left out.
+func (l *loadBalancers) validExternalIPs(svc *v1.Service, svcIP string, ips []packngo.IPAddressReservation) []string {
+	if !l.manageExternalIPs {
+		return nil
+	}
+	svcName := serviceRep(svc)
+	svcTag := serviceTag(svc)
+	ret := []string{}
+	for _, ip := range svc.Spec.ExternalIPs {
+		if ip == svcIP {
+			continue
+		}
+		ipr := ipReservationByAddress(ip, ips)
+		if ipr == nil {
+			klog.Warningf("external IP %s of service %s is not in any reservation of project %s, not advertising it", ip, svcName, l.project)
+			continue
+		}
+		if usage, _, service := reservationTagValues(ipr.Tags); usage == emTag && service != svcTag {
+			klog.Warningf("external IP %s of service %s is in reservation %s of another service, not advertising it", ip, svcName, ipr.ID)
+			continue
+		}
+		ret = append(ret, ip)
+	}
+	return ret
+}
+
+// reusableReservation find a reservation that no service holds, to reuse for the given service,
+// as allowed by the reuse scope:
+//
+//   - service: none; only the reservation tagged for the service itself is reused
+//   - cluster: a reservation of this cluster, either retained, or whose service no longer exists
+//   - project: as cluster, and also a reservation retained by any cluster in the project
+//
+// Reservations in use by a service of another cluster cannot be known, so are never reused.
+// The reservation is re-tagged for the service.
+func (l *loadBalancers) reusableReservation(ctx context.Context, svc *v1.Service, ips []packngo.IPAddressReservation) (*packngo.IPAddressReservation, error) {
+	if l.reuseScope != ReuseScopeCluster && l.reuseScope != ReuseScopeProject {
+		return nil, nil
+	}
+	svcName := serviceRep(svc)
+	clsTag := clusterTag(l.clusterID)
+
+	svcs, err := l.k8sclient.CoreV1().Services("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list services to find a reusable reservation for %s: %v", svcName, err)
+	}
+	inUse := map[string]bool{}
+	for i := range svcs.Items {
+		inUse[serviceTag(&svcs.Items[i])] = true
+	}
+
+	facilities := map[string]bool{}
+	for _, f := range l.facilitySelector.facilities() {
+		facilities[f] = true
+	}
+	reusable := func(ipr *packngo.IPAddressReservation) bool {
+		// those of a pool go back to it, for the services that draw from it
+		if ipr.Address == "" || isPoolReservation(ipr) || (ipr.Facility != nil && !facilities[ipr.Facility.Code]) || ipr.Global != globalEIP(svc) {
+			return false
+		}
+		usage, cluster, service := reservationTagValues(ipr.Tags)
+		switch {
+		case usage == emRetainedTag && cluster == clsTag:
+		case usage == emRetainedTag && l.reuseScope == ReuseScopeProject:
+		case usage == emTag && cluster == clsTag && service != "" && !inUse[service]:
+		default:
+			return false
+		}
+		return true
+	}
+	l.blockLock.Lock()
+	defer l.blockLock.Unlock()
+	for i := range ips {
+		if !reusable(&ips[i]) {
+			continue
+		}
+		ipr, err := l.stillFree(ctx, &ips[i], reusable)
+		if err != nil {
+			return nil, err
+		}
+		if ipr == nil {
+			continue
+		}
+		klog.V(2).Infof("reusing reservation %s with tags %v for %s, scope %s", ipr.ID, ipr.Tags, svcName, l.reuseScope)
+		updated, _, err := l.updateTags(ctx, ipr.ID, reassignedTags(ipr.Tags, serviceTag(svc), clsTag))
+		if err != nil {
+			return nil, fmt.Errorf("failed to re-tag reservation %s for %s: %v", ipr.ID, svcName, err)
+		}
+		l.emitReservationEvent(ctx, reservationEventReassigned, svcName, updated)
+		return updated, nil
+	}
+	return nil, nil
+}
+
+// reservationTagValues get the usage, cluster and service tags from a set of tags
+func reservationTagValues(tags []string) (usage, cluster, service string) {
+	for _, tag := range tags {
+		switch {
+		case strings.HasPrefix(tag, "usage="):
+			usage = tag
+		case strings.HasPrefix(tag, "cluster="):
+			cluster = tag
+		case strings.HasPrefix(tag, "service="):
+			service = tag
+		}
+	}
+	return usage, cluster, service
+}
+
+// reassignedTags replace the usage, cluster and service tags with the managed ones of the given
+// service in the given cluster, keeping any others
+func reassignedTags(tags []string, svcTag, clsTag string) []string {
+	ret := []string{}
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, "usage=") || strings.HasPrefix(tag, "cluster=") || strings.HasPrefix(tag, "service=") {
+			continue
+		}
+		ret = append(ret, tag)
+	}
+	return append(ret, emTag, svcTag, clsTag)
+}
+
+// serviceLabelTags get the tags for the configured labels of the service that it has, in the
+// configured order. The prefix keeps them apart from the managed tags, so no label can affect
+// which reservations are found or released.
+func (l *loadBalancers) serviceLabelTags(svc *v1.Service) []string {
+	tags := []string{}
+	for _, key := range l.labelTags {
+		if value, ok := svc.Labels[key]; ok {
+			tags = append(tags, fmt.Sprintf("%s%s=%s", labelTagPrefix, key, value))
+		}
+	}
+	return tags
+}
+
+// serviceAdditionalTags get the extra tags for a new reservation of the service: those of the
+// config, then those of its annotation that it does not have already. They are set once, when the
+// reservation is created, and never used to find or release it; one of a key that the CCM manages
+// could change which reservations are found, so is ignored, with an error.
+func (l *loadBalancers) serviceAdditionalTags(svc *v1.Service) []string {
+	tags := append([]string{}, l.additionalTags...)
+	value, ok := svc.Annotations[annotationEIPTags]
+	if !ok {
+		return tags
+	}
+	for _, tag := range strings.Split(value, ",") {
+		tag = strings.TrimSpace(tag)
+		switch {
+		case tag == "" || hasTag(tags, tag):
+			continue
+		case managedTag(tag):
+			klog.Errorf("ignoring tag %s of %s for service %s, the CCM manages tags of its key", tag, annotationEIPTags, serviceRep(svc))
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// updateLabelTags make the label tags of the reservation match the labels of the service, e.g.
+// after a label changed or the reservation was reused for another service. These are for
+// accounting only, so a failure is logged, and tried again on the next reconcile.
+func (l *loadBalancers) updateLabelTags(ctx context.Context, svc *v1.Service, ipReservation *packngo.IPAddressReservation) {
+	tags := []string{}
+	current := []string{}
+	for _, tag := range ipReservation.Tags {
+		if strings.HasPrefix(tag, labelTagPrefix) {
+			current = append(current, tag)
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	desired := l.serviceLabelTags(svc)
+	if strings.Join(current, ",") == strings.Join(desired, ",") {
+		return
+	}
+	klog.V(2).Infof("updating label tags of IP reservation %s for %s to %v", ipReservation.ID, serviceRep(svc), desired)
+	if _, _, err := l.updateTags(ctx, ipReservation.ID, append(tags, desired...)); err != nil {
+		klog.Warningf("failed to update label tags of IP reservation %s: %v", ipReservation.String(), err)
+	}
+}
+
+// reservationDescription get the description for the reservation of a service. It is
+// unique per cluster and service, but uses the service hash rather than its name, for
+// the same reason as the tags.
+func reservationDescription(clusterID string, svc *v1.Service) string {
+	return fmt.Sprintf("%s (%s, %s)", ccmIPDescription, clusterTag(clusterID), legacyServiceTag(svc))
+}
+
+// describeReservation get the description for the reservation of a service, from the configured
+// template if there is one, else the default one. A template that does not render, e.g. of an
+// unknown placeholder, is logged, and the default description is used.
+func (l *loadBalancers) describeReservation(svc *v1.Service) string {
+	if l.descriptionTmpl == "" {
+		return reservationDescription(l.clusterID, svc)
+	}
+	description, err := renderDescription(l.descriptionTmpl, l.clusterID, svc)
+	if err != nil {
+		klog.Warningf("invalid EIP description template %q, using the default description for %s: %v", l.descriptionTmpl, serviceRep(svc), err)
+		return reservationDescription(l.clusterID, svc)
+	}
+	return description
+}
+
+// renderDescription render a template of a reservation description for a service, replacing each
+// of the placeholders {namespace}, {name} and {cluster} with the namespace and name of the
+// service, and the ID of the cluster. Any other placeholder, or a brace that is not closed, is an
+// error.
+func renderDescription(template, clusterID string, svc *v1.Service) (string, error) {
+	values := map[string]string{
+		"namespace": svc.Namespace,
+		"name":      svc.Name,
+		"cluster":   clusterID,
+	}
+	var b strings.Builder
+	rest := template
+	for {
+		start := strings.IndexAny(rest, "{}")
+		if start < 0 {
+			b.WriteString(rest)
+			break
+		}
+		if rest[start] == '}' {
+			return "", fmt.Errorf("unopened brace at position %d", len(template)-len(rest)+start)
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unclosed brace at position %d", len(template)-len(rest)+start)
+		}
+		key := rest[start+1 : start+end]
+		value, ok := values[key]
+		if !ok {
+			return "", fmt.Errorf("unknown placeholder {%s}, must be one of {namespace}, {name}, {cluster}", key)
+		}
+		b.WriteString(rest[:start])
+		b.WriteString(value)
+		rest = rest[start+end+1:]
+	}
+	return b.String(), nil
+}
+
+// reservationQuantity get the number of addresses in an IPv4 block of the given CIDR
+func reservationQuantity(cidr int) int {
+	if cidr <= 0 || cidr > 32 {
+		return 1
+	}
+	return 1 << (32 - cidr)
+}
+
+// hostCIDR get the single address CIDR for an address, /32 for IPv4 and /128 for IPv6
+func hostCIDR(addr string) string {
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+		return fmt.Sprintf("%s/128", addr)
+	}
+	return fmt.Sprintf("%s/32", addr)
+}
+
+// advertisedCIDR get the CIDR to advertise for the IPv4 address of a service, held by the given
+// reservation. It is the single address, unless the service sets a prefix length, which must be
+// within the reservation; if it is not, that is logged, and the single address is advertised.
+func advertisedCIDR(svc *v1.Service, addr string, ipr *packngo.IPAddressReservation) string {
+	prefix, ok := svc.Annotations[annotationEIPAdvertisePrefix]
+	if !ok {
+		return hostCIDR(addr)
+	}
+	if ip := net.ParseIP(addr); ip == nil || ip.To4() == nil {
+		return hostCIDR(addr)
+	}
+	// the rest of a shared block is held by other services
+	if ipr != nil && isSharedBlock(ipr) {
+		klog.Errorf("%s of service %s is in a shared block, advertising only %s", annotationEIPAdvertisePrefix, serviceRep(svc), addr)
+		return hostCIDR(addr)
+	}
+	cidr, err := prefixCIDR(addr, prefix, ipr)
+	if err != nil {
+		klog.Errorf("invalid %s for service %s, advertising only %s: %v", annotationEIPAdvertisePrefix, serviceRep(svc), addr, err)
+		return hostCIDR(addr)
+	}
+	return cidr
+}
+
+// prefixCIDR get the network of the given prefix length that holds the IPv4 address, if it is
+// within the reservation
+func prefixCIDR(addr, prefix string, ipr *packngo.IPAddressReservation) (string, error) {
+	n, err := strconv.Atoi(prefix)
+	if err != nil || n < 0 || n > 32 {
+		return "", fmt.Errorf("prefix length must be between 0 and 32, was %q", prefix)
+	}
+	if ipr == nil {
+		return "", fmt.Errorf("no reservation holds %s", addr)
+	}
+	if n < ipr.CIDR {
+		return "", fmt.Errorf("/%d is wider than the reservation %s/%d", n, ipr.Address, ipr.CIDR)
+	}
+	_, network, err := net.ParseCIDR(fmt.Sprintf("%s/%d", addr, n))
+	if err != nil {
+		return "", err
+	}
+	return network.String(), nil
+}
+
+// loadBalancerClass get the load balancer class of the service, if it has one. spec.loadBalancerClass
+// is not available in the Kubernetes API this is built against, so the class is set by annotation.
+func loadBalancerClass(svc *v1.Service) (string, bool) {
+	class, ok := svc.Annotations[annotationLoadBalancerClass]
+	return class, ok
+}
+
+// loadBalancerDisabled report if the service opted out of management by the CCM, to manage its
+// address itself. An annotation that is not a boolean does not opt out, with an error.
+func loadBalancerDisabled(svc *v1.Service) bool {
+	v, ok := svc.Annotations[annotationDisableLoadBalancer]
+	if !ok {
+		return false
+	}
+	disabled, err := strconv.ParseBool(v)
+	if err != nil {
+		klog.Errorf("service %s has invalid annotation %s, must be a boolean, was %s", serviceRep(svc), annotationDisableLoadBalancer, v)
+		return false
+	}
+	return disabled
+}
+
+// dualStack report if the service asks for a pair of IPv4 and IPv6 addresses
+func dualStack(svc *v1.Service) bool {
+	return svc.Annotations[annotationEIPDualStack] == "true"
+}
+
+// allocateOnly report if the service only wants its addresses reserved and written to it, e.g. for
+// an external-dns controller, but not advertised by the implementation at all
+func allocateOnly(svc *v1.Service) bool {
+	return svc.Annotations[annotationEIPAllocateOnly] == "true"
+}
+
+// hasIngressIP report if the address already is in the status of the service
+func hasIngressIP(svc *v1.Service, ip string) bool {
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		if ingress.IP == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// hasIngress report if the ingress, of both its address and hostname, already is in the status of
+// the service
+func hasIngress(svc *v1.Service, want v1.LoadBalancerIngress) bool {
+	for _, ingress := range svc.Status.LoadBalancer.Ingress {
+		if ingress.IP == want.IP && ingress.Hostname == want.Hostname {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceOptions get the settings from a service that are passed on to the implementation
+func serviceOptions(svc *v1.Service) loadbalancers.ServiceOptions {
+	return loadbalancers.ServiceOptions{
+		SessionAffinity: svc.Spec.SessionAffinity == v1.ServiceAffinityClientIP,
+	}
+}
+
+// serviceOptions get the options of the service for the implementation, with the nodes from which
+// to advertise its address if it is of externalTrafficPolicy: Local, see advertiseFrom
+func (l *loadBalancers) serviceOptions(ctx context.Context, svc *v1.Service) loadbalancers.ServiceOptions {
+	opts := serviceOptions(svc)
+	opts.AdvertiseFrom = l.advertiseFrom(ctx, svc)
+	return opts
+}
+
+func serviceRep(svc *v1.Service) string {
+	if svc == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s", svc.Namespace, svc.Name)
+}
+
+// serviceTag get the tag of the reservations of a service: the sha256 of its identity, base64url
+// encoded without padding, as the `/` and `+` of standard base64 are awkward in tags
+func serviceTag(svc *v1.Service) string {
+	if svc == nil {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(serviceIdentity(svc)))
+	return fmt.Sprintf("service=%s", base64.RawURLEncoding.EncodeToString(hash[:]))
+}
+
+// legacyServiceTag get the tag of the reservations of a service of before base64url: the same
+// hash, standard base64 encoded. Reservations of this tag are migrated to that of serviceTag, see
+// migrateServiceTags; descriptions keep it, so that reservations of either are found by them.
+func legacyServiceTag(svc *v1.Service) string {
 	if svc == nil {
 		return ""
 	}
-	hash := sha256.Sum256([]byte(serviceRep(svc)))
+	hash := sha256.Sum256([]byte(serviceIdentity(svc)))
 	return fmt.Sprintf("service=%s", base64.StdEncoding.EncodeToString(hash[:]))
 }
 func clusterTag(clusterID string) string {
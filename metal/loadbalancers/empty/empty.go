@@ -15,7 +15,7 @@ func NewLB(k8sclient kubernetes.Interface, config string) *LB {
 	return &LB{}
 }
 
-func (l *LB) AddService(ctx context.Context, svc, ip string) error {
+func (l *LB) AddService(ctx context.Context, svc, ip string, opts loadbalancers.ServiceOptions) error {
 	return nil
 }
 
@@ -0,0 +1,20 @@
+package loadbalancers
+
+import "fmt"
+
+// RejectedError a change to the configuration of the implementation was refused by the admission
+// control of the cluster, e.g. a validating webhook on configmaps. Unlike a transient error, the
+// same change will be refused again until the policy or the change is fixed.
+type RejectedError struct {
+	// Resource what was to be changed, e.g. "configmap metallb-system/config"
+	Resource string
+	Err      error
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("change to %s rejected by admission: %v", e.Resource, e.Err)
+}
+
+func (e *RejectedError) Unwrap() error {
+	return e.Err
+}
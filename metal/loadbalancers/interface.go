@@ -12,9 +12,37 @@ type LB interface {
 	// SyncNodes ensure that the list of nodes is only those with the matched names
 	SyncNodes(ctx context.Context, nodes map[string]Node) error
 	// AddService add a service with the provided name and IP
-	AddService(ctx context.Context, svc, ip string) error
+	AddService(ctx context.Context, svc, ip string, opts ServiceOptions) error
 	// RemoveService remove service with the given IP
 	RemoveService(ctx context.Context, ip string) error
 	// SyncServices ensure that the list of services is only those with the matched IPs
 	SyncServices(ctx context.Context, ips map[string]bool) error
 }
+
+// NodeLister optionally implemented by an LB that can report the nodes it already has, so that
+// a sync need not look those up again
+type NodeLister interface {
+	// Nodes get the nodes currently configured, by name
+	Nodes(ctx context.Context) (map[string]Node, error)
+}
+
+// NodesAdder optionally implemented by an LB that can add many nodes with a single change to its
+// config, so that many nodes joining at once do not each save it
+type NodesAdder interface {
+	// AddNodes add the nodes, in the order given
+	AddNodes(ctx context.Context, nodes []Node) error
+}
+
+// ChangeCounter optionally implemented by an LB that can report how many times it has changed
+// its config, so that a reconcile can tell whether it changed anything
+type ChangeCounter interface {
+	// Changes get the number of changes saved since the LB was created
+	Changes() uint64
+}
+
+// DryRunner optionally implemented by an LB that can log the changes it would save, rather than
+// saving them, so that a dry run shows what would change
+type DryRunner interface {
+	// SetDryRun log changes rather than saving them, if dryRun is true
+	SetDryRun(dryRun bool)
+}
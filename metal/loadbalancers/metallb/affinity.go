@@ -0,0 +1,36 @@
+package metallb
+
+import (
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+// affinityWarnings tracks the services warned that their session affinity is not guaranteed, so
+// that each is warned once when it requests it, rather than on every sync. The zero value is ready.
+type affinityWarnings struct {
+	lock   sync.Mutex
+	warned map[string]bool
+}
+
+// check warn if the service requests session affinity and was not warned already, and get whether it was
+func (a *affinityWarnings) check(svc string, affinity bool) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if !affinity {
+		// warn again should it request it later
+		delete(a.warned, svc)
+		return false
+	}
+	if a.warned[svc] {
+		return false
+	}
+	if a.warned == nil {
+		a.warned = map[string]bool{}
+	}
+	a.warned[svc] = true
+	// metallb advertises over BGP to every peer, and the upstream routers balance with ECMP,
+	// so there is nothing we can set to keep a client on a single node
+	klog.Warningf("metallb.AddService(): service %s requests session affinity, which is not guaranteed with BGP ECMP across multiple peers", svc)
+	return true
+}
@@ -0,0 +1,27 @@
+package metallb
+
+import (
+	"testing"
+)
+
+func TestAffinityWarnings(t *testing.T) {
+	var a affinityWarnings
+	tests := []struct {
+		svc      string
+		affinity bool
+		warned   bool
+	}{
+		{"default/a", true, true},
+		{"default/a", true, false},
+		{"default/b", false, false},
+		{"default/b", true, true},
+		{"default/a", false, false},
+		{"default/a", true, true},
+		{"default/b", true, false},
+	}
+	for i, tt := range tests {
+		if warned := a.check(tt.svc, tt.affinity); warned != tt.warned {
+			t.Errorf("%d: %s affinity %v warned %v, expected %v", i, tt.svc, tt.affinity, warned, tt.warned)
+		}
+	}
+}
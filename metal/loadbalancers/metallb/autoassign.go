@@ -0,0 +1,55 @@
+package metallb
+
+import (
+	"k8s.io/klog/v2"
+)
+
+const (
+	// AutoAssignPoolsWarn only warn about auto-assign pools that the CCM did not create
+	AutoAssignPoolsWarn = "warn"
+	// AutoAssignPoolsDisable set auto-assign to false on them, so that metallb only hands out their
+	// addresses when a service asks for one
+	AutoAssignPoolsDisable = "disable"
+	// AutoAssignPoolsRemove remove them from the config
+	AutoAssignPoolsRemove = "remove"
+)
+
+// autoAssign report if metallb assigns from the pool to any service that asks for none; that
+// is its default when the pool does not say
+func (a AddressPool) autoAssign() bool {
+	return a.AutoAssign == nil || *a.AutoAssign
+}
+
+// neutralizeAutoAssignPools handle the pools that metallb auto-assigns from, which some metallb
+// installs ship as a default. The CCM never creates those, each of its pools is the address of a
+// single service and not auto-assigned, so any such pool is foreign, and would give services
+// addresses that the CCM does not manage, or even that it manages for another service. Each is
+// warned about, and, as mode says, disabled or removed. Returns if the config changed.
+func neutralizeAutoAssignPools(cfg *ConfigFile, mode string) bool {
+	var changed bool
+	pools := make([]AddressPool, 0, len(cfg.Pools))
+	for _, pool := range cfg.Pools {
+		if !pool.autoAssign() {
+			pools = append(pools, pool)
+			continue
+		}
+		switch mode {
+		case AutoAssignPoolsDisable:
+			klog.Warningf("metallb pool %q with addresses %v is auto-assigned, and not created by the CCM; disabling auto-assign", pool.Name, pool.Addresses)
+			autoAssign := false
+			pool.AutoAssign = &autoAssign
+			pools = append(pools, pool)
+			changed = true
+		case AutoAssignPoolsRemove:
+			klog.Warningf("metallb pool %q with addresses %v is auto-assigned, and not created by the CCM; removing", pool.Name, pool.Addresses)
+			changed = true
+		default:
+			klog.Warningf("metallb pool %q with addresses %v is auto-assigned, and not created by the CCM; services may be given addresses the CCM does not manage", pool.Name, pool.Addresses)
+			pools = append(pools, pool)
+		}
+	}
+	if changed {
+		cfg.Pools = pools
+	}
+	return changed
+}
@@ -0,0 +1,80 @@
+package metallb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestAddServiceAutoAssignPools(t *testing.T) {
+	autoAssign := true
+	foreign := AddressPool{Protocol: "bgp", Name: "default", Addresses: []string{"147.75.200.0/29"}, AutoAssign: &autoAssign}
+	// metallb auto-assigns when the pool does not say
+	unset := AddressPool{Protocol: "bgp", Name: "unset", Addresses: []string{"147.75.201.0/29"}}
+	ccm := servicePool("kube-system/dns", "147.75.100.1/32")
+
+	tests := []struct {
+		mode    string
+		foreign int
+		kept    int
+	}{
+		// warns only, all pools stay as they are
+		{AutoAssignPoolsWarn, 2, 2},
+		{"", 2, 2},
+		// kept, but no longer auto-assigned
+		{AutoAssignPoolsDisable, 0, 2},
+		// gone
+		{AutoAssignPoolsRemove, 0, 0},
+	}
+	for _, tt := range tests {
+		l, _ := testGetLB(t, &ConfigFile{Pools: []AddressPool{foreign, unset, ccm}})
+		l.autoAssignPools = tt.mode
+		if err := l.AddService(context.Background(), "default/web", "147.75.100.2/32", loadbalancers.ServiceOptions{}); err != nil {
+			t.Fatalf("%q: unexpected error: %v", tt.mode, err)
+		}
+		var foreignAutoAssign, kept int
+		pools := map[string]AddressPool{}
+		for _, pool := range testReadConfig(t, l).Pools {
+			pools[pool.Name] = pool
+			if pool.Name == foreign.Name || pool.Name == unset.Name {
+				kept++
+				if pool.autoAssign() {
+					foreignAutoAssign++
+				}
+			}
+		}
+		if foreignAutoAssign != tt.foreign {
+			t.Errorf("%q: mismatched auto-assign pools, actual %d expected %d", tt.mode, foreignAutoAssign, tt.foreign)
+		}
+		if kept != tt.kept {
+			t.Errorf("%q: mismatched foreign pools, actual %d expected %d", tt.mode, kept, tt.kept)
+		}
+		// the pools of the CCM are left as they are, and the new one added
+		for _, name := range []string{ccm.Name, "default/web"} {
+			if pool, ok := pools[name]; !ok || pool.autoAssign() {
+				t.Errorf("%q: pool %s missing or auto-assigned: %v", tt.mode, name, pools)
+			}
+		}
+	}
+}
+
+func TestNewLBAutoAssignPools(t *testing.T) {
+	tests := []struct {
+		config   string
+		expected string
+	}{
+		{"", AutoAssignPoolsWarn},
+		{"/ns/cm?autoAssignPools=disable", AutoAssignPoolsDisable},
+		{"/ns/cm?autoAssignPools=remove", AutoAssignPoolsRemove},
+		{"/ns/cm?autoAssignPools=delete", AutoAssignPoolsWarn},
+	}
+	for _, tt := range tests {
+		l := NewLB(fake.NewSimpleClientset(), tt.config)
+		if l.autoAssignPools != tt.expected {
+			t.Errorf("%q: mismatched mode, actual %s expected %s", tt.config, l.autoAssignPools, tt.expected)
+		}
+	}
+}
@@ -31,9 +31,10 @@ type Peer struct {
 	Addr          string         `yaml:"peer-address"`
 	Port          uint16         `yaml:"peer-port"`
 	HoldTime      string         `yaml:"hold-time"`
+	KeepaliveTime string         `yaml:"keepalive-time,omitempty"`
 	RouterID      string         `yaml:"router-id"`
 	NodeSelectors []NodeSelector `yaml:"node-selectors"`
-	Password      string         `yaml:"password"`
+	Password      string         `yaml:"password,omitempty"`
 }
 
 type NodeSelector struct {
@@ -25,7 +25,26 @@ func (cfg *ConfigFile) Bytes() ([]byte, error) {
 	return yaml.Marshal(cfg)
 }
 
-// AddPeer adds a peer. If a matching peer already exists, do not change anything
+// RedactedPassword the password of a peer as shown, rather than written, see Redacted
+const RedactedPassword = "<redacted>"
+
+// Redacted get a copy of the config with the password of each peer that has one replaced by
+// RedactedPassword, so that it can be shown or logged without the BGP MD5 secrets
+func (cfg *ConfigFile) Redacted() *ConfigFile {
+	redacted := *cfg
+	redacted.Peers = make([]Peer, 0, len(cfg.Peers))
+	for _, p := range cfg.Peers {
+		p := p.Duplicate()
+		if p.Password != "" {
+			p.Password = RedactedPassword
+		}
+		redacted.Peers = append(redacted.Peers, p)
+	}
+	return &redacted
+}
+
+// AddPeer adds a peer. If a matching peer already exists, do not change anything. A peer of the
+// same address for the same nodes, but that differs otherwise, e.g. in its password, is replaced.
 // Returns if anything changed
 func (cfg *ConfigFile) AddPeer(add *Peer) bool {
 	// ignore empty peer; nothing to add
@@ -50,6 +69,13 @@ func (cfg *ConfigFile) AddPeer(add *Peer) bool {
 	if found {
 		return false
 	}
+	for i, peer := range cfg.Peers {
+		var pns, ans NodeSelectors = peer.NodeSelectors, add.NodeSelectors
+		if peer.Addr == add.Addr && pns.Equal(ans) {
+			cfg.Peers[i] = *add
+			return true
+		}
+	}
 	cfg.Peers = append(cfg.Peers, *add)
 	return true
 }
@@ -108,10 +134,57 @@ func (cfg *ConfigFile) AddAddressPool(add *AddressPool) bool {
 	if found {
 		return false
 	}
+	// a pool of the same addresses, e.g. of a service recreated with a new name before the old
+	// pool was pruned, is replaced, as metallb rejects a config with an address in two pools
+	for i, pool := range cfg.Pools {
+		if sameAddresses(pool.Addresses, add.Addresses) {
+			cfg.Pools[i] = *add
+			cfg.DedupeAddressPools()
+			return true
+		}
+	}
 	cfg.Pools = append(cfg.Pools, *add)
 	return true
 }
 
+// DedupeAddressPools remove every pool that has the same addresses as one before it, keeping the
+// first. Returns if anything changed
+func (cfg *ConfigFile) DedupeAddressPools() bool {
+	pools := make([]AddressPool, 0, len(cfg.Pools))
+	for _, pool := range cfg.Pools {
+		var duplicate bool
+		for _, kept := range pools {
+			if sameAddresses(kept.Addresses, pool.Addresses) {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			pools = append(pools, pool)
+		}
+	}
+	changed := len(pools) != len(cfg.Pools)
+	cfg.Pools = pools
+	return changed
+}
+
+// sameAddresses report if both have the same addresses, in any order
+func sameAddresses(a, b []string) bool {
+	if len(a) != len(b) || len(a) == 0 {
+		return false
+	}
+	set := map[string]bool{}
+	for _, addr := range a {
+		set[addr] = true
+	}
+	for _, addr := range b {
+		if !set[addr] {
+			return false
+		}
+	}
+	return true
+}
+
 // RemoveAddressPool remove a pool. If the matching pool does not exist, do not change anything
 func (cfg *ConfigFile) RemoveAddressPool(remove *AddressPool) {
 	if remove == nil {
@@ -328,7 +401,7 @@ func (p *Peer) Equal(o *Peer) bool {
 	}
 	// not matched if any field is mismatched
 	if p.MyASN != o.MyASN || p.ASN != o.ASN || p.Addr != o.Addr || p.Port != o.Port || p.HoldTime != o.HoldTime ||
-		p.Password != o.Password || p.RouterID != o.RouterID {
+		p.KeepaliveTime != o.KeepaliveTime || p.Password != o.Password || p.RouterID != o.RouterID {
 		return false
 	}
 
@@ -348,6 +421,7 @@ func (p *Peer) Duplicate() Peer {
 		Addr:          p.Addr,
 		Port:          p.Port,
 		HoldTime:      p.HoldTime,
+		KeepaliveTime: p.KeepaliveTime,
 		Password:      p.Password,
 		RouterID:      p.RouterID,
 		NodeSelectors: nodeSelectors,
@@ -32,6 +32,24 @@ func TestConfigFileAddPeer(t *testing.T) {
 	}
 }
 
+func TestConfigFileRedacted(t *testing.T) {
+	withPassword, without := genPeer(), genPeer()
+	withPassword.Password = "secret"
+	without.Password = ""
+	cfg := ConfigFile{Peers: []Peer{withPassword, without}}
+
+	redacted := cfg.Redacted()
+	if redacted.Peers[0].Password != RedactedPassword || redacted.Peers[1].Password != "" {
+		t.Errorf("mismatched redacted passwords %q and %q", redacted.Peers[0].Password, redacted.Peers[1].Password)
+	}
+	if cfg.Peers[0].Password != "secret" {
+		t.Errorf("redacting changed the original password to %q", cfg.Peers[0].Password)
+	}
+	if !redacted.Peers[1].Equal(&without) {
+		t.Errorf("redacting changed a peer without a password: %#v", redacted.Peers[1])
+	}
+}
+
 func TestConfigFileRemovePeer(t *testing.T) {
 	peers := []Peer{
 		genPeer(),
@@ -120,6 +138,37 @@ func TestConfigFileAddAddressPool(t *testing.T) {
 		}
 	}
 }
+func TestConfigFileAddAddressPoolSameAddresses(t *testing.T) {
+	old, other := servicePool("default/old", "147.75.100.1/32"), servicePool("default/other", "147.75.100.2/32")
+	cfg := ConfigFile{Pools: []AddressPool{old, other, old}}
+	renamed := servicePool("default/new", "147.75.100.1/32")
+	if !cfg.AddAddressPool(&renamed) {
+		t.Error("expected a change")
+	}
+	if len(cfg.Pools) != 2 || cfg.Pools[0].Name != "default/new" || cfg.Pools[1].Name != "default/other" {
+		t.Errorf("mismatched pools, actual %v", cfg.Pools)
+	}
+	// added again, it is there already
+	if cfg.AddAddressPool(&renamed) {
+		t.Error("unexpected change adding again")
+	}
+}
+
+func TestConfigFileDedupeAddressPools(t *testing.T) {
+	first, second := servicePool("default/first", "147.75.100.1/32"), servicePool("default/second", "147.75.100.1/32")
+	other := servicePool("default/other", "147.75.100.2/32")
+	cfg := ConfigFile{Pools: []AddressPool{first, other, second}}
+	if !cfg.DedupeAddressPools() {
+		t.Error("expected a change")
+	}
+	if len(cfg.Pools) != 2 || cfg.Pools[0].Name != "default/first" || cfg.Pools[1].Name != "default/other" {
+		t.Errorf("mismatched pools, actual %v", cfg.Pools)
+	}
+	if cfg.DedupeAddressPools() {
+		t.Error("unexpected change without duplicates")
+	}
+}
+
 func TestConfigFileRemoveAddressPool(t *testing.T) {
 	pools := []AddressPool{
 		genPool(),
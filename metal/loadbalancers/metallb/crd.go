@@ -0,0 +1,333 @@
+package metallb
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync/atomic"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog/v2"
+)
+
+const (
+	crdGroup = "metallb.io"
+
+	// managedByLabel marks the custom resources that the CCM created, so that it prunes only those
+	managedByLabel = "app.kubernetes.io/managed-by"
+	managedByValue = "cloud-provider-equinix-metal"
+	// nodeLabel the node of a peer, and serviceAnnotation the service of a pool, by which to find them
+	nodeLabel         = "metal.equinix.com/node"
+	serviceAnnotation = "metal.equinix.com/service"
+)
+
+var (
+	ipAddressPoolResource    = schema.GroupVersionResource{Group: crdGroup, Version: "v1beta1", Resource: "ipaddresspools"}
+	bgpAdvertisementResource = schema.GroupVersionResource{Group: crdGroup, Version: "v1beta1", Resource: "bgpadvertisements"}
+	bgpPeerResource          = schema.GroupVersionResource{Group: crdGroup, Version: "v1beta2", Resource: "bgppeers"}
+)
+
+// CRDLB manages metallb 0.13 and later, which is configured with custom resources rather than a
+// configmap: an IPAddressPool and a BGPAdvertisement for each service address, and a BGPPeer for
+// each peer of each node. It only changes the resources it created itself.
+type CRDLB struct {
+	client    dynamic.Interface
+	namespace string
+	affinity  affinityWarnings
+	// changes the number of custom resources created, updated or deleted
+	changes uint64
+	// dryRun log the changes to the custom resources rather than making them
+	dryRun bool
+}
+
+// NewCRDLB get a metallb implementation for the custom resources in the namespace given by config,
+// "<namespace>"; anything after it, e.g. the name of a configmap, is ignored
+func NewCRDLB(client dynamic.Interface, config string) *CRDLB {
+	if i := strings.Index(config, "?"); i >= 0 {
+		config = config[:i]
+	}
+	namespace := strings.SplitN(strings.TrimPrefix(config, "/"), "/", 2)[0]
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+	return &CRDLB{client: client, namespace: namespace}
+}
+
+// AddService add the pool and advertisement for the address of a service
+func (l *CRDLB) AddService(ctx context.Context, svc, ip string, opts loadbalancers.ServiceOptions) error {
+	l.affinity.check(svc, opts.SessionAffinity)
+	name := addressResourceName(ip)
+	pool := l.object("IPAddressPool", name, nil, map[string]interface{}{
+		"addresses":  []interface{}{ip},
+		"autoAssign": false,
+	})
+	pool.SetAnnotations(map[string]string{serviceAnnotation: svc})
+	if err := l.apply(ctx, ipAddressPoolResource, pool); err != nil {
+		return fmt.Errorf("unable to save metallb address pool for %s: %v", ip, err)
+	}
+	spec := map[string]interface{}{
+		"ipAddressPools": []interface{}{name},
+	}
+	if len(opts.AdvertiseFrom) > 0 {
+		nodes := make([]interface{}, 0, len(opts.AdvertiseFrom))
+		for _, n := range opts.AdvertiseFrom {
+			nodes = append(nodes, n)
+		}
+		spec["nodeSelectors"] = []interface{}{
+			map[string]interface{}{"matchExpressions": []interface{}{
+				map[string]interface{}{"key": hostnameKey, "operator": "In", "values": nodes},
+			}},
+		}
+	}
+	advertisement := l.object("BGPAdvertisement", name, nil, spec)
+	if err := l.apply(ctx, bgpAdvertisementResource, advertisement); err != nil {
+		return fmt.Errorf("unable to save metallb BGP advertisement for %s: %v", ip, err)
+	}
+	return nil
+}
+
+// RemoveService remove the pool and advertisement for the given address
+func (l *CRDLB) RemoveService(ctx context.Context, ip string) error {
+	return l.removeAddress(ctx, addressResourceName(ip))
+}
+
+// SyncServices ensure that the pools and advertisements are only those for the given addresses
+func (l *CRDLB) SyncServices(ctx context.Context, ips map[string]bool) error {
+	valid := map[string]bool{}
+	for ip := range ips {
+		valid[addressResourceName(ip)] = true
+	}
+	for _, resource := range []schema.GroupVersionResource{ipAddressPoolResource, bgpAdvertisementResource} {
+		items, err := l.list(ctx, resource, "")
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if valid[item.GetName()] {
+				continue
+			}
+			klog.V(2).Infof("metallb.SyncServices(): removing %s %s not in valid list", resource.Resource, item.GetName())
+			if err := l.delete(ctx, resource, item.GetName()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// AddNode add a peer for each of the peers of the node
+func (l *CRDLB) AddNode(ctx context.Context, nodeName string, localASN, peerASN int, password, srcIP string, peers ...string) error {
+	return l.addNode(ctx, loadbalancers.Node{Name: nodeName, LocalASN: localASN, PeerASN: peerASN, Password: password, SourceIP: srcIP, Peers: peers})
+}
+
+// AddNodes add a peer for each of the peers of each of the nodes, in the order given
+func (l *CRDLB) AddNodes(ctx context.Context, nodes []loadbalancers.Node) error {
+	for _, node := range nodes {
+		if err := l.addNode(ctx, node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *CRDLB) addNode(ctx context.Context, node loadbalancers.Node) error {
+	nodeName := node.Name
+	for _, p := range nodePeers(node) {
+		spec := map[string]interface{}{
+			"myASN":       int64(p.MyASN),
+			"peerASN":     int64(p.ASN),
+			"peerAddress": p.Addr,
+			"nodeSelectors": []interface{}{
+				map[string]interface{}{"matchLabels": map[string]interface{}{hostnameKey: nodeName}},
+			},
+		}
+		if p.Password != "" {
+			spec["password"] = p.Password
+		}
+		if p.HoldTime != "" {
+			spec["holdTime"] = p.HoldTime
+		}
+		if p.KeepaliveTime != "" {
+			spec["keepaliveTime"] = p.KeepaliveTime
+		}
+		peer := l.object("BGPPeer", peerResourceName(nodeName, p.Addr), map[string]string{nodeLabel: nodeName}, spec)
+		if err := l.apply(ctx, bgpPeerResource, peer); err != nil {
+			return fmt.Errorf("unable to save metallb BGP peer %s for node %s: %v", p.Addr, nodeName, err)
+		}
+	}
+	return nil
+}
+
+// RemoveNode remove the peers of the node
+func (l *CRDLB) RemoveNode(ctx context.Context, nodeName string) error {
+	items, err := l.list(ctx, bgpPeerResource, nodeLabel+"="+nodeName)
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := l.delete(ctx, bgpPeerResource, item.GetName()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SyncNodes ensure that the peers are only those of the given nodes
+func (l *CRDLB) SyncNodes(ctx context.Context, nodes map[string]loadbalancers.Node) error {
+	items, err := l.list(ctx, bgpPeerResource, "")
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		if _, ok := nodes[item.GetLabels()[nodeLabel]]; ok {
+			continue
+		}
+		klog.V(2).Infof("metallb.SyncNodes(): removing peer %s of node %q", item.GetName(), item.GetLabels()[nodeLabel])
+		if err := l.delete(ctx, bgpPeerResource, item.GetName()); err != nil {
+			return err
+		}
+	}
+	for _, node := range nodes {
+		if err := l.addNode(ctx, node); err != nil {
+			klog.V(2).Infof("metallb.SyncNodes(): error adding node %s: %v", node.Name, err)
+		}
+	}
+	return nil
+}
+
+// Changes get the number of custom resources created, updated or deleted
+func (l *CRDLB) Changes() uint64 {
+	return atomic.LoadUint64(&l.changes)
+}
+
+// SetDryRun log the changes to the custom resources rather than making them
+func (l *CRDLB) SetDryRun(dryRun bool) {
+	l.dryRun = dryRun
+}
+
+// removeAddress remove the pool and advertisement of the given name
+func (l *CRDLB) removeAddress(ctx context.Context, name string) error {
+	for _, resource := range []schema.GroupVersionResource{bgpAdvertisementResource, ipAddressPoolResource} {
+		if err := l.delete(ctx, resource, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// object get a custom resource of ours, with the given labels in addition to the managed-by one
+func (l *CRDLB) object(kind, name string, labels map[string]string, spec map[string]interface{}) *unstructured.Unstructured {
+	version := "v1beta1"
+	if kind == "BGPPeer" {
+		version = bgpPeerResource.Version
+	}
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": crdGroup + "/" + version,
+		"kind":       kind,
+		"spec":       spec,
+	}}
+	obj.SetName(name)
+	obj.SetNamespace(l.namespace)
+	all := map[string]string{managedByLabel: managedByValue}
+	for k, v := range labels {
+		all[k] = v
+	}
+	obj.SetLabels(all)
+	return obj
+}
+
+// redactedSpec get a copy of the spec of a resource to log, with its password, as a BGPPeer has,
+// replaced by RedactedPassword
+func redactedSpec(spec interface{}) interface{} {
+	m, ok := spec.(map[string]interface{})
+	if _, has := m["password"]; !ok || !has {
+		return spec
+	}
+	redacted := map[string]interface{}{}
+	for k, v := range m {
+		redacted[k] = v
+	}
+	redacted["password"] = RedactedPassword
+	return redacted
+}
+
+// apply create the resource, or update it if it exists and its spec or metadata differ
+func (l *CRDLB) apply(ctx context.Context, resource schema.GroupVersionResource, obj *unstructured.Unstructured) error {
+	intf := l.client.Resource(resource).Namespace(l.namespace)
+	existing, err := intf.Get(ctx, obj.GetName(), metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err) && l.dryRun:
+		klog.InfoS("dry run: would create metallb resource", "resource", resource.Resource, "name", obj.GetName(), "spec", redactedSpec(obj.Object["spec"]))
+		return nil
+	case apierrors.IsNotFound(err):
+		klog.V(2).Infof("creating metallb %s %s", resource.Resource, obj.GetName())
+		if _, err := intf.Create(ctx, obj, metav1.CreateOptions{}); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case reflect.DeepEqual(existing.Object["spec"], obj.Object["spec"]) && reflect.DeepEqual(existing.GetLabels(), obj.GetLabels()) && reflect.DeepEqual(existing.GetAnnotations(), obj.GetAnnotations()):
+		return nil
+	case l.dryRun:
+		klog.InfoS("dry run: would update metallb resource", "resource", resource.Resource, "name", obj.GetName(), "spec", redactedSpec(obj.Object["spec"]))
+		return nil
+	default:
+		klog.V(2).Infof("updating metallb %s %s", resource.Resource, obj.GetName())
+		obj.SetResourceVersion(existing.GetResourceVersion())
+		if _, err := intf.Update(ctx, obj, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+	atomic.AddUint64(&l.changes, 1)
+	return nil
+}
+
+// delete delete a resource of ours; one that is gone already is not an error
+func (l *CRDLB) delete(ctx context.Context, resource schema.GroupVersionResource, name string) error {
+	if l.dryRun {
+		klog.InfoS("dry run: would delete metallb resource", "resource", resource.Resource, "name", name)
+		return nil
+	}
+	err := l.client.Resource(resource).Namespace(l.namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		return nil
+	case err != nil:
+		return fmt.Errorf("unable to delete metallb %s %s: %v", resource.Resource, name, err)
+	}
+	atomic.AddUint64(&l.changes, 1)
+	return nil
+}
+
+// list get the resources of ours, optionally only those matching a further label selector
+func (l *CRDLB) list(ctx context.Context, resource schema.GroupVersionResource, selector string) ([]unstructured.Unstructured, error) {
+	s := managedByLabel + "=" + managedByValue
+	if selector != "" {
+		s += "," + selector
+	}
+	list, err := l.client.Resource(resource).Namespace(l.namespace).List(ctx, metav1.ListOptions{LabelSelector: s})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list metallb %s: %v", resource.Resource, err)
+	}
+	return list.Items, nil
+}
+
+// addressResourceName get the name of the pool and advertisement for an address, e.g. 147.75.1.2/32
+// gives ccm-147-75-1-2-32. Names must be DNS subdomains, which the colons of IPv6 and the slash are
+// not part of. The name of the service is not used, as it may be given another address.
+func addressResourceName(addr string) string {
+	return "ccm-" + strings.ToLower(resourceNameReplacer.Replace(addr))
+}
+
+// peerResourceName get the name of the peer of a node
+func peerResourceName(nodeName, addr string) string {
+	return "ccm-" + strings.ToLower(nodeName) + "-" + resourceNameReplacer.Replace(addr)
+}
+
+var resourceNameReplacer = strings.NewReplacer(".", "-", ":", "-", "/", "-")
@@ -0,0 +1,263 @@
+package metallb
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func testCRDNames(t *testing.T, lb *CRDLB, resource schema.GroupVersionResource) string {
+	list, err := lb.client.Resource(resource).Namespace(lb.namespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("unable to list %s: %v", resource.Resource, err)
+	}
+	names := []string{}
+	for _, item := range list.Items {
+		names = append(names, item.GetName())
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func TestNewCRDLB(t *testing.T) {
+	tests := []struct {
+		config    string
+		namespace string
+	}{
+		{"", defaultNamespace},
+		{"/", defaultNamespace},
+		{"/metallb", "metallb"},
+		{"/metallb/config", "metallb"},
+		{"/metallb/config?key=other", "metallb"},
+	}
+	for i, tt := range tests {
+		if lb := NewCRDLB(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()), tt.config); lb.namespace != tt.namespace {
+			t.Errorf("%d: mismatched namespace, actual %s expected %s", i, lb.namespace, tt.namespace)
+		}
+	}
+}
+
+func TestCRDServices(t *testing.T) {
+	// a pool that another controller created is left alone
+	foreign := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "metallb.io/v1beta1",
+		"kind":       "IPAddressPool",
+		"metadata":   map[string]interface{}{"name": "foreign", "namespace": defaultNamespace},
+		"spec":       map[string]interface{}{"addresses": []interface{}{"10.0.0.0/24"}},
+	}}
+	lb := NewCRDLB(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), foreign), "")
+	ctx := context.Background()
+
+	for _, s := range []struct{ svc, ip string }{{"default/a", "147.75.1.1/32"}, {"default/b", "2604:1380::1/128"}} {
+		if err := lb.AddService(ctx, s.svc, s.ip, loadbalancers.ServiceOptions{}); err != nil {
+			t.Fatalf("unexpected error adding %s: %v", s.svc, err)
+		}
+	}
+	if names := testCRDNames(t, lb, ipAddressPoolResource); names != "ccm-147-75-1-1-32,ccm-2604-1380--1-128,foreign" {
+		t.Errorf("mismatched pools %s", names)
+	}
+	if names := testCRDNames(t, lb, bgpAdvertisementResource); names != "ccm-147-75-1-1-32,ccm-2604-1380--1-128" {
+		t.Errorf("mismatched advertisements %s", names)
+	}
+	pool, err := lb.client.Resource(ipAddressPoolResource).Namespace(defaultNamespace).Get(ctx, "ccm-147-75-1-1-32", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unable to get pool: %v", err)
+	}
+	addrs, _, _ := unstructured.NestedStringSlice(pool.Object, "spec", "addresses")
+	autoAssign, _, _ := unstructured.NestedBool(pool.Object, "spec", "autoAssign")
+	if len(addrs) != 1 || addrs[0] != "147.75.1.1/32" || autoAssign || pool.GetAnnotations()[serviceAnnotation] != "default/a" {
+		t.Errorf("mismatched pool %v", pool.Object)
+	}
+
+	// adding again changes nothing
+	changes := lb.Changes()
+	if err := lb.AddService(ctx, "default/a", "147.75.1.1/32", loadbalancers.ServiceOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if lb.Changes() != changes {
+		t.Errorf("adding the same service again changed %d resources", lb.Changes()-changes)
+	}
+
+	// sync prunes ours only
+	if err := lb.SyncServices(ctx, map[string]bool{"2604:1380::1/128": true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if names := testCRDNames(t, lb, ipAddressPoolResource); names != "ccm-2604-1380--1-128,foreign" {
+		t.Errorf("mismatched pools after sync %s", names)
+	}
+	if names := testCRDNames(t, lb, bgpAdvertisementResource); names != "ccm-2604-1380--1-128" {
+		t.Errorf("mismatched advertisements after sync %s", names)
+	}
+
+	// remove, twice
+	for i := 0; i < 2; i++ {
+		if err := lb.RemoveService(ctx, "2604:1380::1/128"); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+	if names := testCRDNames(t, lb, ipAddressPoolResource); names != "foreign" {
+		t.Errorf("mismatched pools after remove %s", names)
+	}
+}
+
+func TestCRDServiceAdvertiseFrom(t *testing.T) {
+	lb := NewCRDLB(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()), "")
+	ctx := context.Background()
+	name := "ccm-147-75-1-1-32"
+	selectedNodes := func() []interface{} {
+		adv, err := lb.client.Resource(bgpAdvertisementResource).Namespace(defaultNamespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unable to get advertisement: %v", err)
+		}
+		selectors, _, _ := unstructured.NestedSlice(adv.Object, "spec", "nodeSelectors")
+		if len(selectors) == 0 {
+			return nil
+		}
+		expressions, _, _ := unstructured.NestedSlice(selectors[0].(map[string]interface{}), "matchExpressions")
+		if len(selectors) != 1 || len(expressions) != 1 {
+			t.Fatalf("mismatched node selectors %v", selectors)
+		}
+		expr := expressions[0].(map[string]interface{})
+		if expr["key"] != hostnameKey || expr["operator"] != "In" {
+			t.Fatalf("mismatched node selector expression %v", expr)
+		}
+		values, _, _ := unstructured.NestedSlice(expr, "values")
+		return values
+	}
+
+	tests := []struct {
+		nodes    []string
+		expected []interface{}
+	}{
+		{[]string{"a", "c"}, []interface{}{"a", "c"}},
+		// the endpoints moved, so the advertisement is updated in place
+		{[]string{"b"}, []interface{}{"b"}},
+		// from all nodes once again
+		{nil, nil},
+	}
+	for i, tt := range tests {
+		if err := lb.AddService(ctx, "default/web", "147.75.1.1/32", loadbalancers.ServiceOptions{AdvertiseFrom: tt.nodes}); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if nodes := selectedNodes(); !reflect.DeepEqual(nodes, tt.expected) {
+			t.Errorf("%d: mismatched nodes advertising, actual %v expected %v", i, nodes, tt.expected)
+		}
+	}
+}
+
+func TestCRDNodes(t *testing.T) {
+	lb := NewCRDLB(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()), "")
+	ctx := context.Background()
+	nodes := map[string]loadbalancers.Node{
+		"a": {Name: "a", LocalASN: 65000, PeerASN: 65530, Password: "secret", HoldTime: 30 * time.Second, KeepaliveTime: 10 * time.Second, Peers: []string{"169.254.255.1", "169.254.255.2"}},
+		"b": {Name: "b", LocalASN: 65000, PeerASN: 65530, Peers: []string{"169.254.255.1"}},
+	}
+	if err := lb.SyncNodes(ctx, nodes); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if names := testCRDNames(t, lb, bgpPeerResource); names != "ccm-a-169-254-255-1,ccm-a-169-254-255-2,ccm-b-169-254-255-1" {
+		t.Errorf("mismatched peers %s", names)
+	}
+	peer, err := lb.client.Resource(bgpPeerResource).Namespace(defaultNamespace).Get(ctx, "ccm-a-169-254-255-2", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unable to get peer: %v", err)
+	}
+	myASN, _, _ := unstructured.NestedInt64(peer.Object, "spec", "myASN")
+	peerASN, _, _ := unstructured.NestedInt64(peer.Object, "spec", "peerASN")
+	addr, _, _ := unstructured.NestedString(peer.Object, "spec", "peerAddress")
+	password, _, _ := unstructured.NestedString(peer.Object, "spec", "password")
+	holdTime, _, _ := unstructured.NestedString(peer.Object, "spec", "holdTime")
+	keepaliveTime, _, _ := unstructured.NestedString(peer.Object, "spec", "keepaliveTime")
+	if myASN != 65000 || peerASN != 65530 || addr != "169.254.255.2" || password != "secret" || holdTime != "30s" || keepaliveTime != "10s" {
+		t.Errorf("mismatched peer %v", peer.Object)
+	}
+	// the timers of the load balancer are left to metallb
+	peer, _ = lb.client.Resource(bgpPeerResource).Namespace(defaultNamespace).Get(ctx, "ccm-b-169-254-255-1", metav1.GetOptions{})
+	if _, found, _ := unstructured.NestedString(peer.Object, "spec", "holdTime"); found {
+		t.Errorf("default hold time written %v", peer.Object)
+	}
+
+	// a changed node is updated in place
+	node := nodes["b"]
+	node.PeerASN = 65531
+	nodes["b"] = node
+	if err := lb.AddNode(ctx, node.Name, node.LocalASN, node.PeerASN, node.Password, node.SourceIP, node.Peers...); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	peer, _ = lb.client.Resource(bgpPeerResource).Namespace(defaultNamespace).Get(ctx, "ccm-b-169-254-255-1", metav1.GetOptions{})
+	if peerASN, _, _ := unstructured.NestedInt64(peer.Object, "spec", "peerASN"); peerASN != 65531 {
+		t.Errorf("peer not updated, peer ASN %d", peerASN)
+	}
+
+	// nodes that are gone are pruned
+	delete(nodes, "a")
+	if err := lb.SyncNodes(ctx, nodes); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if names := testCRDNames(t, lb, bgpPeerResource); names != "ccm-b-169-254-255-1" {
+		t.Errorf("mismatched peers after sync %s", names)
+	}
+	if err := lb.RemoveNode(ctx, "b"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if names := testCRDNames(t, lb, bgpPeerResource); names != "" {
+		t.Errorf("mismatched peers after remove %s", names)
+	}
+}
+
+func TestRedactedSpec(t *testing.T) {
+	spec := map[string]interface{}{"peerAddress": "169.254.255.1", "password": "secret"}
+	redacted, ok := redactedSpec(spec).(map[string]interface{})
+	if !ok || redacted["password"] != RedactedPassword || redacted["peerAddress"] != "169.254.255.1" {
+		t.Errorf("mismatched redacted spec %v", redacted)
+	}
+	if spec["password"] != "secret" {
+		t.Errorf("redacting changed the spec, password now %v", spec["password"])
+	}
+	pool := map[string]interface{}{"addresses": []interface{}{"147.75.1.1/32"}}
+	if !reflect.DeepEqual(redactedSpec(pool), pool) {
+		t.Errorf("redacting changed a spec without a password: %v", redactedSpec(pool))
+	}
+}
+
+func TestCRDDryRun(t *testing.T) {
+	stale := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "metallb.io/v1beta1",
+		"kind":       "IPAddressPool",
+		"metadata": map[string]interface{}{
+			"name":      "ccm-147-75-1-9-32",
+			"namespace": defaultNamespace,
+			"labels":    map[string]interface{}{managedByLabel: managedByValue},
+		},
+		"spec": map[string]interface{}{"addresses": []interface{}{"147.75.1.9/32"}},
+	}}
+	lb := NewCRDLB(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), stale), "")
+	lb.SetDryRun(true)
+	ctx := context.Background()
+
+	if err := lb.AddService(ctx, "default/a", "147.75.1.1/32", loadbalancers.ServiceOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := lb.SyncServices(ctx, map[string]bool{"147.75.1.1/32": true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if names := testCRDNames(t, lb, ipAddressPoolResource); names != "ccm-147-75-1-9-32" {
+		t.Errorf("dry run changed pools, now %s", names)
+	}
+	if names := testCRDNames(t, lb, bgpAdvertisementResource); names != "" {
+		t.Errorf("dry run created advertisements %s", names)
+	}
+	if changes := lb.Changes(); changes != 0 {
+		t.Errorf("mismatched changes, actual %d expected 0", changes)
+	}
+}
@@ -0,0 +1,102 @@
+package metallb
+
+import (
+	"sort"
+	"time"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers"
+)
+
+// DesiredConfig compute the config that the CCM would write for the given nodes, and services as
+// a map of advertised address to service name, without reading or writing the configmap. Of the
+// base config, only what the CCM does not manage is kept: the bgp communities, and peers that do
+// not select a single node by hostname. Peers and pools are in a stable order, so that the output
+// can be diffed.
+func DesiredConfig(base *ConfigFile, nodes map[string]loadbalancers.Node, services map[string]string) *ConfigFile {
+	config := &ConfigFile{}
+	if base != nil {
+		config.BGPCommunities = base.BGPCommunities
+	peers:
+		for _, p := range base.Peers {
+			for _, selector := range p.NodeSelectors {
+				if _, ok := selector.MatchLabels[hostnameKey]; ok {
+					continue peers
+				}
+			}
+			config.Peers = append(config.Peers, p)
+		}
+	}
+
+	names := make([]string, 0, len(nodes))
+	for name := range nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, p := range nodePeers(nodes[name]) {
+			p := p
+			config.AddPeer(&p)
+		}
+	}
+
+	addrs := make([]string, 0, len(services))
+	for addr := range services {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		pool := servicePool(services[addr], addr)
+		config.AddAddressPool(&pool)
+	}
+	return config
+}
+
+// nodePeers get the peers for a single node, one for each of its upstream peer addresses
+func nodePeers(node loadbalancers.Node) []Peer {
+	ns := NodeSelector{
+		MatchLabels: map[string]string{
+			hostnameKey: node.Name,
+		},
+	}
+	peers := []Peer{}
+	for i, peer := range node.Peers {
+		peers = append(peers, Peer{
+			MyASN:         uint32(node.LocalASN),
+			ASN:           uint32(node.PeerASNOf(i)),
+			Password:      node.Password,
+			Addr:          peer,
+			HoldTime:      durationString(node.HoldTime),
+			KeepaliveTime: durationString(node.KeepaliveTime),
+			NodeSelectors: []NodeSelector{ns},
+		})
+	}
+	return peers
+}
+
+// durationString get a BGP timer as metallb parses it, or "" for its default
+func durationString(d time.Duration) string {
+	if d == 0 {
+		return ""
+	}
+	return d.String()
+}
+
+// parseDurationString get a BGP timer of metallb, or 0 for its default, or if it does not parse
+func parseDurationString(s string) time.Duration {
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// servicePool get the pool for a single address of a service; it is never auto-assigned
+func servicePool(svcName, addr string) AddressPool {
+	autoAssign := false
+	return AddressPool{
+		Protocol:   "bgp",
+		Name:       svcName,
+		Addresses:  []string{addr},
+		AutoAssign: &autoAssign,
+	}
+}
@@ -0,0 +1,97 @@
+package metallb
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers"
+)
+
+func TestDesiredConfig(t *testing.T) {
+	autoAssign := false
+	hostname := func(name string) []NodeSelector {
+		return []NodeSelector{{MatchLabels: map[string]string{hostnameKey: name}}}
+	}
+	base := &ConfigFile{
+		BGPCommunities: map[string]string{"no-advertise": "65535:65282"},
+		Peers: []Peer{
+			{MyASN: 65000, ASN: 65530, Addr: "169.254.255.9", NodeSelectors: hostname("gone")},
+			{MyASN: 64512, ASN: 64513, Addr: "10.99.0.1"},
+		},
+		Pools: []AddressPool{
+			{Protocol: "bgp", Name: "default/gone", Addresses: []string{"147.75.1.1/32"}, AutoAssign: &autoAssign},
+		},
+	}
+	nodes := map[string]loadbalancers.Node{
+		"node-b": {Name: "node-b", LocalASN: 65000, PeerASN: 65530, Peers: []string{"169.254.255.1"}},
+		"node-a": {Name: "node-a", LocalASN: 65000, PeerASN: 65530, Password: "secret", Peers: []string{"169.254.255.1", "169.254.255.2"}},
+	}
+	services := map[string]string{
+		"147.75.100.2/32": "default/web",
+		"147.75.100.1/32": "kube-system/dns",
+	}
+	expected := &ConfigFile{
+		BGPCommunities: map[string]string{"no-advertise": "65535:65282"},
+		Peers: []Peer{
+			{MyASN: 64512, ASN: 64513, Addr: "10.99.0.1"},
+			{MyASN: 65000, ASN: 65530, Password: "secret", Addr: "169.254.255.1", NodeSelectors: hostname("node-a")},
+			{MyASN: 65000, ASN: 65530, Password: "secret", Addr: "169.254.255.2", NodeSelectors: hostname("node-a")},
+			{MyASN: 65000, ASN: 65530, Addr: "169.254.255.1", NodeSelectors: hostname("node-b")},
+		},
+		Pools: []AddressPool{
+			{Protocol: "bgp", Name: "kube-system/dns", Addresses: []string{"147.75.100.1/32"}, AutoAssign: &autoAssign},
+			{Protocol: "bgp", Name: "default/web", Addresses: []string{"147.75.100.2/32"}, AutoAssign: &autoAssign},
+		},
+	}
+
+	config := DesiredConfig(base, nodes, services)
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("mismatched config, actual %#v expected %#v", config, expected)
+	}
+	// the output must be identical each time, or diffs against it are noise
+	first, err := config.Bytes()
+	if err != nil {
+		t.Fatalf("unable to convert config to bytes: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		b, err := DesiredConfig(base, nodes, services).Bytes()
+		if err != nil {
+			t.Fatalf("unable to convert config to bytes: %v", err)
+		}
+		if string(b) != string(first) {
+			t.Fatalf("%d: unstable output, actual %s expected %s", i, b, first)
+		}
+	}
+}
+
+func TestDesiredConfigMatchesApplied(t *testing.T) {
+	// what is computed must be what adding the nodes and services one by one writes
+	l, _ := testGetLB(t, &ConfigFile{})
+	ctx := context.Background()
+	if err := l.AddNode(ctx, "node-a", 65000, 65530, "secret", "10.0.0.1", "169.254.255.1", "169.254.255.2"); err != nil {
+		t.Fatalf("unexpected error adding node: %v", err)
+	}
+	if err := l.AddService(ctx, "default/web", "147.75.100.1/32", loadbalancers.ServiceOptions{}); err != nil {
+		t.Fatalf("unexpected error adding service: %v", err)
+	}
+	nodes := map[string]loadbalancers.Node{
+		"node-a": {Name: "node-a", LocalASN: 65000, PeerASN: 65530, Password: "secret", Peers: []string{"169.254.255.1", "169.254.255.2"}},
+	}
+	services := map[string]string{"147.75.100.1/32": "default/web"}
+	config, err := l.DesiredConfig(ctx, nodes, services)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, err := config.Bytes()
+	if err != nil {
+		t.Fatalf("unable to convert config to bytes: %v", err)
+	}
+	applied, err := testReadConfig(t, l).Bytes()
+	if err != nil {
+		t.Fatalf("unable to convert config to bytes: %v", err)
+	}
+	if string(b) != string(applied) {
+		t.Errorf("mismatched config, actual %s expected %s", b, applied)
+	}
+}
@@ -2,15 +2,21 @@ package metallb
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"net/url"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	k8stypes "k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/klog/v2"
 )
 
@@ -18,16 +24,58 @@ const (
 	hostnameKey      = "kubernetes.io/hostname"
 	defaultNamespace = "metallb-system"
 	defaultName      = "config"
+	defaultKey       = "config"
 )
 
 type LB struct {
 	configMapInterface typedv1.ConfigMapInterface
 	configMapNamespace string
 	configMapName      string
+	// configMapKey the key in the data of the configmap that holds the metallb config
+	configMapKey string
+	// autoAssignPools what to do with auto-assign pools that the CCM did not create
+	autoAssignPools string
+	rejections      *rejections
+	affinity        affinityWarnings
+	// changes the number of updates of the configmap saved
+	changes uint64
+	// dryRun log the updates rather than saving them
+	dryRun bool
+	// createIfMissing create the configmap, with an empty config, if it does not exist
+	createIfMissing bool
 }
 
+// NewLB get a metallb implementation for the configmap given by config, "<namespace>/<name>", with
+// an optional query: "key=<key>" for the key in its data that holds the metallb config, and
+// "rejectionBackoff=<duration>" for the longest to wait before updating again after admission
+// rejected an update, and "autoAssignPools=<warn|disable|remove>" for what to do with auto-assign
+// pools that the CCM did not create
 func NewLB(k8sclient kubernetes.Interface, config string) *LB {
-	var configmapnamespace, configmapname string
+	var configmapnamespace, configmapname, configmapkey string
+	maxBackoff := DefaultRejectionBackoff
+	autoAssignPools := AutoAssignPoolsWarn
+	if i := strings.Index(config, "?"); i >= 0 {
+		if query, err := url.ParseQuery(config[i+1:]); err == nil {
+			configmapkey = query.Get("key")
+			if v := query.Get("rejectionBackoff"); v != "" {
+				if d, err := time.ParseDuration(v); err == nil && d > 0 {
+					maxBackoff = d
+				} else {
+					klog.Errorf("invalid metallb rejectionBackoff %q, using %s", v, maxBackoff)
+				}
+			}
+			switch v := query.Get("autoAssignPools"); v {
+			case "":
+			case AutoAssignPoolsWarn, AutoAssignPoolsDisable, AutoAssignPoolsRemove:
+				autoAssignPools = v
+			default:
+				klog.Errorf("invalid metallb autoAssignPools %q, using %s", v, autoAssignPools)
+			}
+		} else {
+			klog.Errorf("invalid metallb config query %q, using defaults: %v", config[i+1:], err)
+		}
+		config = config[:i]
+	}
 	// it may have an extra slash at the beginning or end, so get rid of it
 	if strings.HasPrefix(config, "/") {
 		config = config[1:]
@@ -35,9 +83,11 @@ func NewLB(k8sclient kubernetes.Interface, config string) *LB {
 	if strings.HasSuffix(config, "/") {
 		config = config[:len(config)-1]
 	}
+	// a namespace alone takes the default name
 	cmparts := strings.SplitN(config, "/", 2)
+	configmapnamespace = cmparts[0]
 	if len(cmparts) >= 2 {
-		configmapnamespace, configmapname = cmparts[0], cmparts[1]
+		configmapname = cmparts[1]
 	}
 	// defaults
 	if configmapname == "" {
@@ -46,6 +96,9 @@ func NewLB(k8sclient kubernetes.Interface, config string) *LB {
 	if configmapnamespace == "" {
 		configmapnamespace = defaultNamespace
 	}
+	if configmapkey == "" {
+		configmapkey = defaultKey
+	}
 
 	// get the configmap
 	cmInterface := k8sclient.CoreV1().ConfigMaps(configmapnamespace)
@@ -53,204 +106,299 @@ func NewLB(k8sclient kubernetes.Interface, config string) *LB {
 		configMapInterface: cmInterface,
 		configMapNamespace: configmapnamespace,
 		configMapName:      configmapname,
+		configMapKey:       configmapkey,
+		autoAssignPools:    autoAssignPools,
+		rejections:         newRejections(flowcontrol.NewBackOff(rejectionBackoffInitial, maxBackoff), time.Now),
 	}
 }
 
-func (l *LB) AddService(ctx context.Context, svc, ip string) error {
-	config, err := l.getConfigMap(ctx)
-	if err != nil {
-		return fmt.Errorf("unable to retrieve metallb config map %s:%s : %v", l.configMapNamespace, l.configMapName, err)
-	}
-
-	// Update the service and configmap and save them
-	return mapIP(ctx, config, ip, svc, l.configMapName, l.configMapInterface)
+func (l *LB) AddService(ctx context.Context, svc, ip string, opts loadbalancers.ServiceOptions) error {
+	l.affinity.check(svc, opts.SessionAffinity)
+	return l.updateConfig(ctx, func(config *ConfigFile) bool {
+		// a foreign auto-assign pool may give another service the address, so deal with it first
+		changed := neutralizeAutoAssignPools(config, l.autoAssignPools)
+		klog.V(2).Infof("mapping IP %s", ip)
+		pool := servicePool(svc, ip)
+		if !config.AddAddressPool(&pool) {
+			klog.V(2).Info("address already on ConfigMap, unchanged")
+			return changed
+		}
+		return true
+	})
 }
 
 func (l *LB) RemoveService(ctx context.Context, ip string) error {
-	config, err := l.getConfigMap(ctx)
-	if err != nil {
-		return fmt.Errorf("unable to retrieve metallb config map %s:%s : %v", l.configMapNamespace, l.configMapName, err)
-	}
-
-	return unmapIP(ctx, config, ip, l.configMapName, l.configMapInterface)
+	return l.updateConfig(ctx, func(config *ConfigFile) bool {
+		klog.V(2).Infof("unmapping IP %s", ip)
+		pools := len(config.Pools)
+		config.RemoveAddressPoolByAddress(ip)
+		return len(config.Pools) != pools
+	})
 }
 
 func (l *LB) SyncServices(ctx context.Context, ips map[string]bool) error {
-	config, err := l.getConfigMap(ctx)
-	if err != nil {
-		return fmt.Errorf("unable to retrieve metallb config map %s:%s : %v", l.configMapNamespace, l.configMapName, err)
-	}
-
-	// get all IPs registered in the configmap; remove those not in our valid list
-	configIPs := getServiceAddresses(config)
-	klog.V(2).Infof("metallb.SyncServices(): actual configmap IPs %v", configIPs)
-	for _, ip := range configIPs {
-		if _, ok := ips[ip]; !ok {
-			klog.V(2).Infof("metallb.SyncServices(): removing from configmap ip %s not in valid list", ip)
-			if err := unmapIP(ctx, config, ip, l.configMapName, l.configMapInterface); err != nil {
-				return fmt.Errorf("error removing IP from configmap %s: %v", ip, err)
+	return l.updateConfig(ctx, func(config *ConfigFile) bool {
+		// get all IPs registered in the configmap; remove those not in our valid list
+		configIPs := getServiceAddresses(config)
+		klog.V(2).Infof("metallb.SyncServices(): actual configmap IPs %v", configIPs)
+		// pools of the same addresses, e.g. from before they were replaced on add, are merged
+		changed := config.DedupeAddressPools()
+		if changed {
+			klog.V(2).Info("metallb.SyncServices(): removed duplicate address pools from configmap")
+		}
+		for _, ip := range configIPs {
+			if _, ok := ips[ip]; !ok {
+				klog.V(2).Infof("metallb.SyncServices(): removing from configmap ip %s not in valid list", ip)
+				config.RemoveAddressPoolByAddress(ip)
+				changed = true
 			}
 		}
-	}
-	return nil
+		return changed
+	})
 }
 
 // AddNode add a node with the provided name, srcIP, and bgp information
 func (l *LB) AddNode(ctx context.Context, nodeName string, localASN, peerASN int, password, srcIP string, peers ...string) error {
-	config, err := l.getConfigMap(ctx)
-	if err != nil {
-		return fmt.Errorf("unable to retrieve metallb config map %s:%s : %v", l.configMapNamespace, l.configMapName, err)
-	}
+	return l.AddNodes(ctx, []loadbalancers.Node{{Name: nodeName, LocalASN: localASN, PeerASN: peerASN, Password: password, SourceIP: srcIP, Peers: peers}})
+}
 
-	ns := NodeSelector{
-		MatchLabels: map[string]string{
-			hostnameKey: nodeName,
-		},
-	}
-	var changed bool
-	for _, peer := range peers {
-		p := Peer{
-			MyASN:         uint32(localASN),
-			ASN:           uint32(peerASN),
-			Password:      password,
-			Addr:          peer,
-			NodeSelectors: []NodeSelector{ns},
+// AddNodes add the nodes, in the order given, with a single update of the configmap
+func (l *LB) AddNodes(ctx context.Context, nodes []loadbalancers.Node) error {
+	return l.updateConfig(ctx, func(config *ConfigFile) bool {
+		var changed bool
+		for _, node := range nodes {
+			if addNodePeers(config, node) {
+				changed = true
+			}
 		}
+		return changed
+	})
+}
+
+// addNodePeers add the peers of the node to the config, reporting if any was not there already
+func addNodePeers(config *ConfigFile, node loadbalancers.Node) bool {
+	var changed bool
+	for _, p := range nodePeers(node) {
+		p := p
 		if config.AddPeer(&p) {
 			changed = true
 		}
 	}
-	if changed {
-		return saveUpdatedConfigMap(ctx, l.configMapInterface, l.configMapName, config)
-	}
-	return nil
+	return changed
 }
 
 // RemoveNode remove a node with the provided name
 func (l *LB) RemoveNode(ctx context.Context, nodeName string) error {
+	return l.updateConfig(ctx, func(config *ConfigFile) bool {
+		// go through the peers and see if we have one with our hostname.
+		selector := NodeSelector{
+			MatchLabels: map[string]string{
+				hostnameKey: nodeName,
+			},
+		}
+		return config.RemovePeerBySelector(&selector)
+	})
+}
+
+// DesiredConfig get the config that would be written for the given nodes and services, based on
+// the current configmap, without changing it. See the function DesiredConfig.
+func (l *LB) DesiredConfig(ctx context.Context, nodes map[string]loadbalancers.Node, services map[string]string) (*ConfigFile, error) {
 	config, err := l.getConfigMap(ctx)
 	if err != nil {
-		return fmt.Errorf("unable to retrieve metallb config map %s:%s : %v", l.configMapNamespace, l.configMapName, err)
-	}
-	// go through the peers and see if we have one with our hostname.
-	selector := NodeSelector{
-		MatchLabels: map[string]string{
-			hostnameKey: nodeName,
-		},
-	}
-	var changed bool
-	if config.RemovePeerBySelector(&selector) {
-		changed = true
-	}
-	if changed {
-		return saveUpdatedConfigMap(ctx, l.configMapInterface, l.configMapName, config)
+		return nil, fmt.Errorf("unable to retrieve metallb config map %s:%s : %v", l.configMapNamespace, l.configMapName, err)
 	}
-	return nil
+	return DesiredConfig(config, nodes, services), nil
 }
 
-// SyncNodes ensure that the list of nodes is only those with the matched names
-func (l *LB) SyncNodes(ctx context.Context, nodes map[string]loadbalancers.Node) error {
+// Nodes get the nodes that have peers in the configmap. The source IP is not part of the
+// metallb config, so is not set.
+func (l *LB) Nodes(ctx context.Context) (map[string]loadbalancers.Node, error) {
 	config, err := l.getConfigMap(ctx)
 	if err != nil {
-		return fmt.Errorf("unable to retrieve metallb config map %s:%s : %v", l.configMapNamespace, l.configMapName, err)
+		return nil, fmt.Errorf("unable to retrieve metallb config map %s:%s : %v", l.configMapNamespace, l.configMapName, err)
 	}
-
-	// first remove every node from the configmap that is not in the provided nodes
-	configNodes := getNodes(config)
-	for _, node := range configNodes {
-		if _, ok := nodes[node]; !ok {
-			klog.V(2).Infof("metallb.SyncNodes(): removing node from configmap: %s", node)
-			if err := l.RemoveNode(ctx, node); err != nil {
-				klog.V(2).Infof("metallb.SyncNodes(): error removing node %s: %v", node, err)
+	nodes := map[string]loadbalancers.Node{}
+	for _, p := range config.Peers {
+		for _, selector := range p.NodeSelectors {
+			name, ok := selector.MatchLabels[hostnameKey]
+			if !ok {
 				continue
 			}
+			node := nodes[name]
+			node.Name = name
+			node.LocalASN = int(p.MyASN)
+			node.PeerASN = int(p.ASN)
+			node.Password = p.Password
+			node.HoldTime = parseDurationString(p.HoldTime)
+			node.KeepaliveTime = parseDurationString(p.KeepaliveTime)
+			node.Peers = append(node.Peers, p.Addr)
+			node.PeerASNs = append(node.PeerASNs, int(p.ASN))
+			nodes[name] = node
 		}
 	}
-	// now see if any nodes are missing
-	// get the list of nodes afresh
-	configNodes = getNodes(config)
-	configMap := map[string]bool{}
-	for _, node := range configNodes {
-		configMap[node] = true
-	}
-	for _, node := range nodes {
-		if _, ok := configMap[node.Name]; !ok {
-			if err := l.AddNode(ctx, node.Name, node.LocalASN, node.PeerASN, node.Password, node.SourceIP, node.Peers...); err != nil {
-				klog.V(2).Infof("loadbalancers.reconcileNodes(): error adding node %s: %v", node.Name, err)
-				continue
-			}
+	// the peers have their own ASNs only if they differ
+	for name, node := range nodes {
+		if !distinctASNs(node.PeerASNs) {
+			node.PeerASNs = nil
+			nodes[name] = node
 		}
 	}
-	return nil
+	return nodes, nil
 }
 
-func (l *LB) getConfigMap(ctx context.Context) (*ConfigFile, error) {
-	cm, err := l.configMapInterface.Get(ctx, l.configMapName, metav1.GetOptions{})
-	if err != nil {
-		return nil, fmt.Errorf("unable to get metallb configmap %s: %v", l.configMapName, err)
+// SyncNodes ensure that the list of nodes is only those with the matched names, with a single
+// update of the configmap; nodes are added in the order of their names, for stable diffs
+func (l *LB) SyncNodes(ctx context.Context, nodes map[string]loadbalancers.Node) error {
+	names := make([]string, 0, len(nodes))
+	for name := range nodes {
+		names = append(names, name)
 	}
-	// ignore checking if it exists; if not, it gives a blank string, which ParseConfig can handle anyways
-	configData := cm.Data["config"]
-	return ParseConfig([]byte(configData))
+	sort.Strings(names)
+	return l.updateConfig(ctx, func(config *ConfigFile) bool {
+		var changed bool
+		// first remove every node from the configmap that is not in the provided nodes
+		for _, node := range getNodes(config) {
+			if _, ok := nodes[node]; !ok {
+				klog.V(2).Infof("metallb.SyncNodes(): removing node from configmap: %s", node)
+				if config.RemovePeerBySelector(&NodeSelector{MatchLabels: map[string]string{hostnameKey: node}}) {
+					changed = true
+				}
+			}
+		}
+		// now add any nodes that are missing, or whose peers changed, e.g. their password
+		for _, name := range names {
+			if addNodePeers(config, nodes[name]) {
+				changed = true
+			}
+		}
+		return changed
+	})
 }
 
-// mapIP add a given ip address to the metallb configmap
-func mapIP(ctx context.Context, config *ConfigFile, addr, svcName, configmapname string, cmInterface typedv1.ConfigMapInterface) error {
-	klog.V(2).Infof("mapping IP %s", addr)
-	return updateMapIP(ctx, config, addr, svcName, configmapname, cmInterface, true)
+// createConfigMap create the configmap with an empty config under its key. If another, e.g. metallb,
+// created it since it was found missing, that one is used. In a dry run, it is only logged, and the
+// empty configmap returned as if it had been created.
+func (l *LB) createConfigMap(ctx context.Context) (*v1.ConfigMap, error) {
+	name := l.configMapNamespace + "/" + l.configMapName
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: l.configMapName, Namespace: l.configMapNamespace},
+		Data:       map[string]string{l.configMapKey: ""},
+	}
+	if l.dryRun {
+		klog.InfoS("dry run: would create missing metallb configmap", "configmap", name, "key", l.configMapKey)
+		return cm, nil
+	}
+	klog.Infof("metallb configmap %s does not exist, creating it with an empty config", name)
+	created, err := l.configMapInterface.Create(ctx, cm, metav1.CreateOptions{})
+	if apierrors.IsAlreadyExists(err) {
+		return l.configMapInterface.Get(ctx, l.configMapName, metav1.GetOptions{})
+	}
+	return created, err
 }
 
-// unmapIP remove a given IP address from the metalllb config map
-func unmapIP(ctx context.Context, config *ConfigFile, addr, configmapname string, cmInterface typedv1.ConfigMapInterface) error {
-	klog.V(2).Infof("unmapping IP %s", addr)
-	return updateMapIP(ctx, config, addr, "", configmapname, cmInterface, false)
+func (l *LB) getConfigMap(ctx context.Context) (*ConfigFile, error) {
+	_, config, err := l.readConfigMap(ctx)
+	return config, err
 }
 
-func updateMapIP(ctx context.Context, config *ConfigFile, addr, svcName, configmapname string, cmInterface typedv1.ConfigMapInterface, add bool) error {
-	if config == nil {
-		klog.V(2).Info("config unchanged, not updating")
-		return nil
+// readConfigMap get the configmap, at its current resourceVersion, and the config in it
+func (l *LB) readConfigMap(ctx context.Context) (*v1.ConfigMap, *ConfigFile, error) {
+	cm, err := l.configMapInterface.Get(ctx, l.configMapName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) && l.createIfMissing {
+		cm, err = l.createConfigMap(ctx)
 	}
-	// update the configmap and save it
-	if add {
-		autoAssign := false
-		if !config.AddAddressPool(&AddressPool{
-			Protocol:   "bgp",
-			Name:       svcName,
-			Addresses:  []string{addr},
-			AutoAssign: &autoAssign,
-		}) {
-			klog.V(2).Info("address already on ConfigMap, unchanged")
-			return nil
-		}
-	} else {
-		config.RemoveAddressPoolByAddress(addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get metallb configmap %s: %v", l.configMapName, err)
 	}
-	klog.V(2).Info("config changed, updating")
-	if err := saveUpdatedConfigMap(ctx, cmInterface, configmapname, config); err != nil {
-		klog.V(2).Infof("error updating configmap: %v", err)
-		return fmt.Errorf("failed to update configmap: %v", err)
+	// a configmap with no data yet gives a blank string, which ParseConfig can handle anyways; but if
+	// it has other data and not our key, the key most likely is wrong, and we would add a second config
+	configData, ok := cm.Data[l.configMapKey]
+	if !ok && len(cm.Data) > 0 {
+		keys := []string{}
+		for k := range cm.Data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return nil, nil, fmt.Errorf("metallb configmap %s has no key %s, only %s", l.configMapName, l.configMapKey, strings.Join(keys, ", "))
 	}
-	return nil
+	config, err := ParseConfig([]byte(configData))
+	return cm, config, err
 }
 
-func saveUpdatedConfigMap(ctx context.Context, cmi typedv1.ConfigMapInterface, name string, cfg *ConfigFile) error {
+// updateConfig apply a change to the config in the configmap, and save it if the change reports
+// that it changed anything. The configmap is updated at the resourceVersion it was read at, so
+// that when another change was saved since, e.g. by the node and the service reconcilers at
+// once, the update fails with a conflict rather than overwriting it; the configmap then is read,
+// and the change applied to it, again.
+func (l *LB) updateConfig(ctx context.Context, change func(*ConfigFile) bool) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm, config, err := l.readConfigMap(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to retrieve metallb config map %s:%s : %v", l.configMapNamespace, l.configMapName, err)
+		}
+		if !change(config) {
+			klog.V(2).Info("config unchanged, not updating")
+			return nil
+		}
+		klog.V(2).Info("config changed, updating")
+		return l.saveUpdatedConfigMap(ctx, cm, config)
+	})
+}
+
+// saveUpdatedConfigMap save the config under the key of the configmap, as it was read; any other
+// keys are left as they are. If admission rejected the last update, it does not try again until
+// the backoff has passed, as the same update most likely would be rejected again.
+func (l *LB) saveUpdatedConfigMap(ctx context.Context, cm *v1.ConfigMap, cfg *ConfigFile) error {
+	name := l.configMapNamespace + "/" + l.configMapName
+	if err := l.rejections.check(name); err != nil {
+		return err
+	}
 	b, err := cfg.Bytes()
 	if err != nil {
 		return fmt.Errorf("error converting configfile data to bytes: %v", err)
 	}
 
-	mergePatch, _ := json.Marshal(map[string]interface{}{
-		"data": map[string]interface{}{
-			"config": string(b),
-		},
-	})
-
-	klog.V(2).Infof("patching configmap:\n%s", mergePatch)
+	// the config is logged without the passwords of the peers
+	shown, err := cfg.Redacted().Bytes()
+	if err != nil {
+		return fmt.Errorf("error converting configfile data to bytes: %v", err)
+	}
+	if l.dryRun {
+		klog.InfoS("dry run: would update metallb configmap", "configmap", name, "key", l.configMapKey, "config", string(shown))
+		return nil
+	}
+	klog.V(2).Infof("updating configmap %s at resourceVersion %s:\n%s", name, cm.ResourceVersion, shown)
+	updated := cm.DeepCopy()
+	if updated.Data == nil {
+		updated.Data = map[string]string{}
+	}
+	updated.Data[l.configMapKey] = string(b)
 	// save to k8s
-	_, err = cmi.Patch(ctx, name, k8stypes.MergePatchType, mergePatch, metav1.PatchOptions{})
+	_, err = l.configMapInterface.Update(ctx, updated, metav1.UpdateOptions{})
+	if err == nil {
+		atomic.AddUint64(&l.changes, 1)
+	}
+	if apierrors.IsConflict(err) {
+		klog.V(2).Infof("configmap %s changed since it was read, trying again: %v", name, err)
+		return err
+	}
+	return l.rejections.record(name, err)
+}
+
+// Changes get the number of updates of the configmap saved
+func (l *LB) Changes() uint64 {
+	return atomic.LoadUint64(&l.changes)
+}
 
-	return err
+// SetDryRun log the updates of the configmap rather than saving them
+func (l *LB) SetDryRun(dryRun bool) {
+	l.dryRun = dryRun
+}
+
+// SetCreateIfMissing create the configmap, with an empty config, if it does not exist, e.g. on a
+// fresh cluster where metallb has not created it yet, rather than fail every reconcile until it does
+func (l *LB) SetCreateIfMissing(create bool) {
+	l.createIfMissing = create
 }
 
 // getServiceAddresses get the IPs of services in the metallb configmap
@@ -264,6 +412,16 @@ func getServiceAddresses(config *ConfigFile) []string {
 }
 
 // getNodes get the names of nodes in the metallb configmap
+// distinctASNs report if the ASNs are not all the same
+func distinctASNs(asns []int) bool {
+	for _, asn := range asns {
+		if asn != asns[0] {
+			return true
+		}
+	}
+	return false
+}
+
 func getNodes(config *ConfigFile) []string {
 	nodes := []string{}
 	peers := config.Peers
@@ -0,0 +1,432 @@
+package metallb
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+)
+
+// testGetLB get an LB backed by a fake clientset holding a configmap with the given config
+func testGetLB(t *testing.T, cfg *ConfigFile, objects ...runtime.Object) (*LB, *fake.Clientset) {
+	data := ""
+	if cfg != nil {
+		b, err := cfg.Bytes()
+		if err != nil {
+			t.Fatalf("unable to convert config to bytes: %v", err)
+		}
+		data = string(b)
+	}
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      defaultName,
+			Namespace: defaultNamespace,
+		},
+		Data: map[string]string{
+			"config": data,
+		},
+	}
+	client := fake.NewSimpleClientset(append(objects, cm)...)
+	return NewLB(client, ""), client
+}
+
+// testReadConfig get the parsed config as currently saved in the configmap
+func testReadConfig(t *testing.T, l *LB) *ConfigFile {
+	cfg, err := l.getConfigMap(context.Background())
+	if err != nil {
+		t.Fatalf("unable to read configmap: %v", err)
+	}
+	return cfg
+}
+
+func TestAddServiceSessionAffinity(t *testing.T) {
+	tests := []struct {
+		svc      string
+		ip       string
+		affinity bool
+	}{
+		{"default/plain", "147.75.100.1/32", false},
+		{"default/sticky", "147.75.100.2/32", true},
+	}
+	for i, tt := range tests {
+		l, _ := testGetLB(t, &ConfigFile{})
+		if err := l.AddService(context.Background(), tt.svc, tt.ip, loadbalancers.ServiceOptions{SessionAffinity: tt.affinity}); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		// affinity is advisory for BGP; the address still must be advertised
+		addrs := getServiceAddresses(testReadConfig(t, l))
+		if len(addrs) != 1 || addrs[0] != tt.ip {
+			t.Errorf("%d: mismatched addresses, actual %v expected %s", i, addrs, tt.ip)
+		}
+	}
+}
+
+func TestNodes(t *testing.T) {
+	l, _ := testGetLB(t, &ConfigFile{})
+	if err := l.AddNode(context.Background(), "node-a", 65000, 65530, "secret", "10.0.0.1", "169.254.255.1", "169.254.255.2"); err != nil {
+		t.Fatalf("unexpected error adding node: %v", err)
+	}
+	if err := l.AddNode(context.Background(), "node-b", 65000, 65530, "", "10.0.0.2", "169.254.255.1"); err != nil {
+		t.Fatalf("unexpected error adding node: %v", err)
+	}
+	nodes, err := l.Nodes(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]loadbalancers.Node{
+		"node-a": {Name: "node-a", LocalASN: 65000, PeerASN: 65530, Password: "secret", Peers: []string{"169.254.255.1", "169.254.255.2"}},
+		"node-b": {Name: "node-b", LocalASN: 65000, PeerASN: 65530, Peers: []string{"169.254.255.1"}},
+	}
+	if !reflect.DeepEqual(nodes, expected) {
+		t.Errorf("mismatched nodes, actual %#v expected %#v", nodes, expected)
+	}
+}
+
+func TestNodePassword(t *testing.T) {
+	l, client := testGetLB(t, &ConfigFile{})
+	ctx := context.Background()
+	addNode := func(password string) {
+		if err := l.AddNode(ctx, "node-a", 65000, 65530, password, "10.0.0.1", "169.254.255.1", "169.254.255.2"); err != nil {
+			t.Fatalf("unexpected error adding node: %v", err)
+		}
+	}
+	data := func() string {
+		cm, err := client.CoreV1().ConfigMaps(defaultNamespace).Get(ctx, defaultName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unable to get configmap: %v", err)
+		}
+		return cm.Data[defaultKey]
+	}
+
+	// no password is left out, rather than written empty
+	addNode("")
+	if strings.Contains(data(), "password") {
+		t.Errorf("empty password written:\n%s", data())
+	}
+
+	// a changed password replaces the peers, rather than adding more
+	for i, password := range []string{"secret", "secret", "rotated", ""} {
+		before := l.Changes()
+		addNode(password)
+		changed := l.Changes() != before
+		if expected := i != 1; changed != expected {
+			t.Errorf("%d: mismatched changed, actual %t expected %t", i, changed, expected)
+		}
+		nodes, err := l.Nodes(ctx)
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if node := nodes["node-a"]; node.Password != password || len(node.Peers) != 2 {
+			t.Errorf("%d: mismatched node, actual %#v expected password %q and 2 peers", i, node, password)
+		}
+	}
+
+	// a sync picks up a changed password of a node it has already
+	nodes := map[string]loadbalancers.Node{
+		"node-a": {Name: "node-a", LocalASN: 65000, PeerASN: 65530, Password: "synced", Peers: []string{"169.254.255.1", "169.254.255.2"}},
+	}
+	if err := l.SyncNodes(ctx, nodes); err != nil {
+		t.Fatalf("unexpected error syncing: %v", err)
+	}
+	if peers := testReadConfig(t, l).Peers; len(peers) != 2 || peers[0].Password != "synced" || peers[1].Password != "synced" {
+		t.Errorf("mismatched peers after sync %#v", peers)
+	}
+}
+
+func TestNodeBGPTimers(t *testing.T) {
+	l, client := testGetLB(t, &ConfigFile{})
+	ctx := context.Background()
+	node := loadbalancers.Node{Name: "node-a", LocalASN: 65000, PeerASN: 65530, Peers: []string{"169.254.255.1"}}
+	data := func() string {
+		cm, err := client.CoreV1().ConfigMaps(defaultNamespace).Get(ctx, defaultName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unable to get configmap: %v", err)
+		}
+		return cm.Data[defaultKey]
+	}
+
+	// no keepalive is left out, so metallb uses its default
+	if err := l.AddNodes(ctx, []loadbalancers.Node{node}); err != nil {
+		t.Fatalf("unexpected error adding node: %v", err)
+	}
+	if strings.Contains(data(), "keepalive-time") {
+		t.Errorf("empty keepalive written:\n%s", data())
+	}
+
+	// changed timers replace the peers, and are read back
+	node.HoldTime, node.KeepaliveTime = 30*time.Second, 10*time.Second
+	if err := l.SyncNodes(ctx, map[string]loadbalancers.Node{node.Name: node}); err != nil {
+		t.Fatalf("unexpected error syncing: %v", err)
+	}
+	peers := testReadConfig(t, l).Peers
+	if len(peers) != 1 || peers[0].HoldTime != "30s" || peers[0].KeepaliveTime != "10s" {
+		t.Errorf("mismatched peers %#v", peers)
+	}
+	nodes, err := l.Nodes(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := nodes[node.Name]; n.HoldTime != node.HoldTime || n.KeepaliveTime != node.KeepaliveTime {
+		t.Errorf("mismatched node, actual %#v expected timers %s and %s", n, node.HoldTime, node.KeepaliveTime)
+	}
+}
+
+func TestConfigMapKey(t *testing.T) {
+	tests := []struct {
+		config string
+		key    string
+	}{
+		{"", "config"},
+		{"metallb-system/config", "config"},
+		{"metallb-system/config?key=metallb.yaml", "metallb.yaml"},
+		{"/other/cm/?key=custom", "custom"},
+	}
+	for i, tt := range tests {
+		l := NewLB(fake.NewSimpleClientset(), tt.config)
+		if l.configMapKey != tt.key {
+			t.Errorf("%d: mismatched key, actual %s expected %s", i, l.configMapKey, tt.key)
+		}
+	}
+}
+
+func TestCustomConfigMapKeyPreservesSiblings(t *testing.T) {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      defaultName,
+			Namespace: defaultNamespace,
+		},
+		Data: map[string]string{
+			"metallb.yaml": "",
+			"other":        "keep me",
+		},
+	}
+	client := fake.NewSimpleClientset(cm)
+	l := NewLB(client, "metallb-system/config?key=metallb.yaml")
+	if err := l.AddService(context.Background(), "default/web", "147.75.100.1/32", loadbalancers.ServiceOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	saved, err := client.CoreV1().ConfigMaps(defaultNamespace).Get(context.Background(), defaultName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unable to get configmap: %v", err)
+	}
+	if saved.Data["other"] != "keep me" {
+		t.Errorf("sibling key changed, actual %q expected %q", saved.Data["other"], "keep me")
+	}
+	if _, ok := saved.Data["config"]; ok {
+		t.Errorf("config written to the default key rather than the custom one")
+	}
+	cfg, err := ParseConfig([]byte(saved.Data["metallb.yaml"]))
+	if err != nil {
+		t.Fatalf("unable to parse saved config: %v", err)
+	}
+	if addrs := getServiceAddresses(cfg); len(addrs) != 1 || addrs[0] != "147.75.100.1/32" {
+		t.Errorf("mismatched addresses, actual %v expected [147.75.100.1/32]", addrs)
+	}
+}
+
+func TestConfigMapMissingKey(t *testing.T) {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      defaultName,
+			Namespace: defaultNamespace,
+		},
+		Data: map[string]string{
+			"other": "keep me",
+		},
+	}
+	l := NewLB(fake.NewSimpleClientset(cm), "")
+	if err := l.AddService(context.Background(), "default/web", "147.75.100.1/32", loadbalancers.ServiceOptions{}); err == nil {
+		t.Errorf("no error for a configmap without the key")
+	}
+}
+
+func TestAddServiceRenamed(t *testing.T) {
+	l, _ := testGetLB(t, &ConfigFile{})
+	ctx := context.Background()
+	// recreated with a new name before the pool of the old one was pruned
+	for _, svc := range []string{"default/web", "default/web-v2"} {
+		if err := l.AddService(ctx, svc, "147.75.100.1/32", loadbalancers.ServiceOptions{}); err != nil {
+			t.Fatalf("%s: unexpected error: %v", svc, err)
+		}
+	}
+	cfg := testReadConfig(t, l)
+	if len(cfg.Pools) != 1 || cfg.Pools[0].Name != "default/web-v2" {
+		t.Errorf("expected the single pool of default/web-v2, have %v", cfg.Pools)
+	}
+}
+
+func TestSyncServicesDuplicatePools(t *testing.T) {
+	l, _ := testGetLB(t, &ConfigFile{Pools: []AddressPool{
+		servicePool("default/web", "147.75.100.1/32"),
+		servicePool("default/web-v2", "147.75.100.1/32"),
+	}})
+	if err := l.SyncServices(context.Background(), map[string]bool{"147.75.100.1/32": true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cfg := testReadConfig(t, l)
+	if len(cfg.Pools) != 1 {
+		t.Errorf("expected the duplicate pools merged, have %v", cfg.Pools)
+	}
+}
+
+func TestChanges(t *testing.T) {
+	l, _ := testGetLB(t, &ConfigFile{})
+	for i, ip := range []string{"147.75.100.1/32", "147.75.100.1/32", "147.75.100.2/32"} {
+		if err := l.AddService(context.Background(), "default/web", ip, loadbalancers.ServiceOptions{}); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+	// the second is on the configmap already, so is not saved
+	if changes := l.Changes(); changes != 2 {
+		t.Errorf("mismatched changes, actual %d expected 2", changes)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	l, client := testGetLB(t, &ConfigFile{})
+	l.SetDryRun(true)
+	ctx := context.Background()
+	if err := l.AddService(ctx, "default/web", "147.75.100.1/32", loadbalancers.ServiceOptions{}); err != nil {
+		t.Fatalf("unexpected error adding service: %v", err)
+	}
+	if err := l.AddNode(ctx, "node-a", 65000, 65530, "", "10.0.0.1", "169.254.255.1"); err != nil {
+		t.Fatalf("unexpected error adding node: %v", err)
+	}
+	for _, action := range client.Actions() {
+		if action.GetVerb() != "get" {
+			t.Errorf("unexpected %s of %s in dry run", action.GetVerb(), action.GetResource().Resource)
+		}
+	}
+	if addrs := getServiceAddresses(testReadConfig(t, l)); len(addrs) != 0 {
+		t.Errorf("dry run saved addresses %v", addrs)
+	}
+	if changes := l.Changes(); changes != 0 {
+		t.Errorf("mismatched changes, actual %d expected 0", changes)
+	}
+}
+
+func TestCreateIfMissing(t *testing.T) {
+	ctx := context.Background()
+	for _, create := range []bool{false, true} {
+		client := fake.NewSimpleClientset()
+		l := NewLB(client, "")
+		l.SetCreateIfMissing(create)
+		err := l.AddService(ctx, "default/web", "147.75.100.1/32", loadbalancers.ServiceOptions{})
+		if !create {
+			if err == nil {
+				t.Errorf("expected an error for the missing configmap")
+			}
+			if _, err := client.CoreV1().ConfigMaps(defaultNamespace).Get(ctx, defaultName, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+				t.Errorf("expected the configmap not created, had %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if addrs := getServiceAddresses(testReadConfig(t, l)); !reflect.DeepEqual(addrs, []string{"147.75.100.1/32"}) {
+			t.Errorf("mismatched addresses in the created configmap, actual %v", addrs)
+		}
+	}
+}
+
+func TestCreateIfMissingEmptyConfig(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	l := NewLB(client, "metallb-system/config?key=metallb.yaml")
+	l.SetCreateIfMissing(true)
+	// a read alone creates it, as a config with nothing in it
+	nodes, err := l.Nodes(ctx)
+	if err != nil || len(nodes) != 0 {
+		t.Fatalf("expected no nodes and no error, had %v, %v", nodes, err)
+	}
+	cm, err := client.CoreV1().ConfigMaps(defaultNamespace).Get(ctx, defaultName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("configmap not created: %v", err)
+	}
+	data, ok := cm.Data["metallb.yaml"]
+	if !ok {
+		t.Fatalf("configmap created without its key, data %v", cm.Data)
+	}
+	cfg, err := ParseConfig([]byte(data))
+	if err != nil {
+		t.Fatalf("created config does not parse: %v", err)
+	}
+	if len(cfg.Peers) != 0 || len(cfg.Pools) != 0 {
+		t.Errorf("expected an empty config, had %v", cfg)
+	}
+
+	// in a dry run, it is not created
+	client = fake.NewSimpleClientset()
+	l = NewLB(client, "")
+	l.SetCreateIfMissing(true)
+	l.SetDryRun(true)
+	if err := l.AddService(ctx, "default/web", "147.75.100.1/32", loadbalancers.ServiceOptions{}); err != nil {
+		t.Fatalf("unexpected error in dry run: %v", err)
+	}
+	for _, action := range client.Actions() {
+		if action.GetVerb() != "get" {
+			t.Errorf("unexpected %s of %s in dry run", action.GetVerb(), action.GetResource().Resource)
+		}
+	}
+}
+
+func TestUpdateConflict(t *testing.T) {
+	l, client := testGetLB(t, &ConfigFile{})
+	ctx := context.Background()
+	var updates int
+	client.PrependReactor("update", "configmaps", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		updates++
+		if updates > 1 {
+			return false, nil, nil
+		}
+		// another writer saves a peer between our read and our update
+		cm, err := client.Tracker().Get(action.GetResource(), defaultNamespace, defaultName)
+		if err != nil {
+			return true, nil, err
+		}
+		concurrent := cm.(*v1.ConfigMap).DeepCopy()
+		cfg, err := ParseConfig([]byte(concurrent.Data["config"]))
+		if err != nil {
+			return true, nil, err
+		}
+		cfg.AddPeer(&Peer{MyASN: 65000, ASN: 65530, Addr: "169.254.255.1", NodeSelectors: []NodeSelector{{MatchLabels: map[string]string{hostnameKey: "node-a"}}}})
+		b, err := cfg.Bytes()
+		if err != nil {
+			return true, nil, err
+		}
+		concurrent.Data["config"] = string(b)
+		if err := client.Tracker().Update(action.GetResource(), concurrent, defaultNamespace); err != nil {
+			return true, nil, err
+		}
+		return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "configmaps"}, defaultName, errors.New("the object has been modified"))
+	})
+	if err := l.AddService(ctx, "default/web", "147.75.100.1/32", loadbalancers.ServiceOptions{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if updates != 2 {
+		t.Errorf("expected the conflicting update to be retried once, had %d updates", updates)
+	}
+	cfg := testReadConfig(t, l)
+	if addrs := getServiceAddresses(cfg); len(addrs) != 1 || addrs[0] != "147.75.100.1/32" {
+		t.Errorf("mismatched addresses, actual %v expected [147.75.100.1/32]", addrs)
+	}
+	if len(cfg.Peers) != 1 || cfg.Peers[0].Addr != "169.254.255.1" {
+		t.Errorf("concurrent peer lost, have peers %v", cfg.Peers)
+	}
+	if changes := l.Changes(); changes != 1 {
+		t.Errorf("mismatched changes, actual %d expected 1", changes)
+	}
+}
@@ -0,0 +1,78 @@
+package metallb
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/klog/v2"
+)
+
+const (
+	rejectionBackoffInitial = 10 * time.Second
+	// DefaultRejectionBackoff the longest to wait before trying a rejected update again
+	DefaultRejectionBackoff = 5 * time.Minute
+)
+
+// rejections tracks updates of configmaps that admission rejected, and backs off from trying
+// again; each further rejection doubles the wait, up to the maximum, and a successful update
+// resets it. Other errors may be transient, so are returned as they are, without backoff.
+type rejections struct {
+	backoff *flowcontrol.Backoff
+	now     func() time.Time
+	lock    sync.Mutex
+	last    map[string]error
+}
+
+func newRejections(backoff *flowcontrol.Backoff, now func() time.Time) *rejections {
+	return &rejections{backoff: backoff, last: map[string]error{}, now: now}
+}
+
+// check get the last rejection of an update of the named configmap, if still backing off from it
+func (r *rejections) check(name string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err, ok := r.last[name]; ok && r.backoff.IsInBackOffSinceUpdate(name, r.now()) {
+		klog.V(2).Infof("not updating configmap %s, backing off for %s after it was rejected", name, r.backoff.Get(name))
+		return err
+	}
+	return nil
+}
+
+// record the result of an update of the named configmap, and get the error to return for it
+func (r *rejections) record(name string, err error) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err == nil {
+		if _, ok := r.last[name]; ok {
+			klog.Infof("update of configmap %s accepted again", name)
+			delete(r.last, name)
+			r.backoff.Reset(name)
+		}
+		return nil
+	}
+	if !isAdmissionRejection(err) {
+		return err
+	}
+	r.backoff.Next(name, r.now())
+	rejected := &loadbalancers.RejectedError{Resource: "configmap " + name, Err: err}
+	r.last[name] = rejected
+	klog.Errorf("update of configmap %s was rejected by an admission webhook, not trying again for %s; change the policy to allow the CCM to update it: %v", name, r.backoff.Get(name), err)
+	return rejected
+}
+
+// isAdmissionRejection report if the error is a validating or mutating admission webhook denying
+// the request. The apiserver reports these with the code and reason the webhook chose, so they
+// are recognized by the message it prefixes.
+func isAdmissionRejection(err error) bool {
+	var status apierrors.APIStatus
+	if !errors.As(err, &status) {
+		return false
+	}
+	msg := status.Status().Message
+	return strings.Contains(msg, "admission webhook") && strings.Contains(msg, "denied the request")
+}
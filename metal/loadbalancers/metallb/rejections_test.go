@@ -0,0 +1,137 @@
+package metallb
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/clock"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// webhookDenied the error the apiserver gives when a validating webhook denies a request
+func webhookDenied() error {
+	return &apierrors.StatusError{ErrStatus: metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusForbidden,
+		Message: `admission webhook "policy.example.com" denied the request: configmaps in metallb-system are locked`,
+	}}
+}
+
+func TestIsAdmissionRejection(t *testing.T) {
+	tests := []struct {
+		err      error
+		rejected bool
+	}{
+		{webhookDenied(), true},
+		{apierrors.NewServiceUnavailable("try again"), false},
+		{apierrors.NewForbidden(schema.GroupResource{Resource: "configmaps"}, "config", errors.New("no rbac")), false},
+		{errors.New("connection refused"), false},
+	}
+	for i, tt := range tests {
+		if rejected := isAdmissionRejection(tt.err); rejected != tt.rejected {
+			t.Errorf("%d: mismatched rejection for %v, actual %t expected %t", i, tt.err, rejected, tt.rejected)
+		}
+	}
+}
+
+func TestSaveUpdatedConfigMapRejected(t *testing.T) {
+	l, client := testGetLB(t, &ConfigFile{})
+	fakeClock := clock.NewFakeClock(time.Now())
+	l.rejections = newRejections(flowcontrol.NewFakeBackOff(10*time.Second, time.Minute, fakeClock), fakeClock.Now)
+	var (
+		updates int
+		deny    = true
+	)
+	client.PrependReactor("update", "configmaps", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		updates++
+		if deny {
+			return true, nil, webhookDenied()
+		}
+		return false, nil, nil
+	})
+	add := func() error {
+		return l.AddService(context.Background(), "default/web", "147.75.100.1/32", loadbalancers.ServiceOptions{})
+	}
+
+	// the rejection is classified, and wraps the original
+	err := add()
+	var rejected *loadbalancers.RejectedError
+	if !errors.As(err, &rejected) {
+		t.Fatalf("expected a rejected error, got %v", err)
+	}
+	var status *apierrors.StatusError
+	if !errors.As(err, &status) {
+		t.Errorf("rejected error does not wrap the apiserver error: %v", err)
+	}
+	if updates != 1 {
+		t.Fatalf("expected 1 update, had %d", updates)
+	}
+
+	// within the backoff, nothing is sent, but it still fails with the rejection
+	fakeClock.Step(5 * time.Second)
+	if err := add(); !errors.As(err, &rejected) {
+		t.Errorf("expected a rejected error while backing off, got %v", err)
+	}
+	if updates != 1 {
+		t.Errorf("updated while backing off, %d updates", updates)
+	}
+
+	// after it, it tries again, and another rejection doubles the backoff
+	fakeClock.Step(6 * time.Second)
+	if err := add(); !errors.As(err, &rejected) {
+		t.Errorf("expected a rejected error, got %v", err)
+	}
+	if updates != 2 {
+		t.Errorf("expected 2 updates, had %d", updates)
+	}
+	fakeClock.Step(15 * time.Second)
+	if err := add(); !errors.As(err, &rejected) || updates != 2 {
+		t.Errorf("expected still backing off after 15s of 20s, got %v with %d updates", err, updates)
+	}
+
+	// once the policy allows it, it succeeds, and the backoff is reset
+	deny = false
+	fakeClock.Step(6 * time.Second)
+	if err := add(); err != nil {
+		t.Fatalf("unexpected error once allowed: %v", err)
+	}
+	if updates != 3 {
+		t.Errorf("expected 3 updates, had %d", updates)
+	}
+	if addrs := getServiceAddresses(testReadConfig(t, l)); len(addrs) != 1 || addrs[0] != "147.75.100.1/32" {
+		t.Errorf("mismatched addresses, actual %v expected [147.75.100.1/32]", addrs)
+	}
+	if err := l.RemoveService(context.Background(), "147.75.100.1/32"); err != nil || updates != 4 {
+		t.Errorf("expected update right away after reset, got %v with %d updates", err, updates)
+	}
+}
+
+func TestSaveUpdatedConfigMapTransientError(t *testing.T) {
+	// other errors may clear up on their own, so are tried again right away
+	l, client := testGetLB(t, &ConfigFile{})
+	var updates int
+	client.PrependReactor("update", "configmaps", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		updates++
+		return true, nil, apierrors.NewServiceUnavailable("try again")
+	})
+	for i := 0; i < 2; i++ {
+		err := l.AddService(context.Background(), "default/web", "147.75.100.1/32", loadbalancers.ServiceOptions{})
+		var rejected *loadbalancers.RejectedError
+		if err == nil || errors.As(err, &rejected) {
+			t.Errorf("%d: expected an unclassified error, got %v", i, err)
+		}
+	}
+	if updates != 2 {
+		t.Errorf("expected 2 updates, had %d", updates)
+	}
+}
@@ -1,10 +1,27 @@
 package loadbalancers
 
+import "time"
+
 type Node struct {
 	Name     string
 	SourceIP string
 	LocalASN int
 	PeerASN  int
+	// PeerASNs the ASN of each of the peers, in the order of Peers, if they have their own; else
+	// every peer has PeerASN
+	PeerASNs []int
 	Password string
 	Peers    []string
+	// HoldTime and KeepaliveTime the BGP timers of the sessions with its peers; 0 for the defaults
+	// of the load balancer
+	HoldTime      time.Duration
+	KeepaliveTime time.Duration
+}
+
+// PeerASNOf get the ASN of the peer at the given index of Peers
+func (n Node) PeerASNOf(i int) int {
+	if len(n.PeerASNs) == len(n.Peers) && i < len(n.PeerASNs) {
+		return n.PeerASNs[i]
+	}
+	return n.PeerASN
 }
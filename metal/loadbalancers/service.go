@@ -0,0 +1,12 @@
+package loadbalancers
+
+// ServiceOptions per-service settings that an implementation may honour when
+// advertising a service's address
+type ServiceOptions struct {
+	// SessionAffinity the service requires that traffic from a single client
+	// always reaches the same backend, i.e. sessionAffinity: ClientIP
+	SessionAffinity bool
+	// AdvertiseFrom the names of the only nodes from which to advertise the address, e.g. those of
+	// the ready endpoints of a service of externalTrafficPolicy: Local; from all nodes if empty
+	AdvertiseFrom []string
+}
@@ -0,0 +1,2677 @@
+package metal
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers"
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers/metallb"
+	"github.com/packethost/packngo"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	testClusterID = "abc-123-cluster"
+	testFacility  = "ewr1"
+)
+
+// fakeProjectIPs in-memory implementation of packngo.ProjectIPService, which also
+// implements ipReservationTagger. It is safe for concurrent use.
+type fakeProjectIPs struct {
+	mu           sync.Mutex
+	reservations []packngo.IPAddressReservation
+	requests     []packngo.IPReservationRequest
+	removed      []string
+	next         int
+	// onRequest if set, is called after each successful Request
+	onRequest func()
+	// beforeRemove if set, is called at the start of each Remove
+	beforeRemove func()
+	// withholdAddress if set, Request creates reservations without an address
+	withholdAddress bool
+	// listErr if set, List fails with it
+	listErr error
+	// lostResponses the number of Requests whose response is lost: the client retries, so each
+	// creates an extra reservation
+	lostResponses int
+	// requestErr if set, Request creates the reservation but fails with it
+	requestErr error
+	// failures each call to List, Request or Remove first takes the next of these, if any, and
+	// fails with it without doing anything, unless it is nil
+	failures []error
+	// lists the number of calls to List
+	lists int
+}
+
+// failure get the next failure, if any; the lock is held
+func (f *fakeProjectIPs) failure() error {
+	if len(f.failures) == 0 {
+		return nil
+	}
+	err := f.failures[0]
+	f.failures = f.failures[1:]
+	return err
+}
+
+func (f *fakeProjectIPs) notFound() error {
+	return &packngo.ErrorResponse{Response: &http.Response{StatusCode: http.StatusNotFound}}
+}
+
+func (f *fakeProjectIPs) Get(reservationID string, getOpt *packngo.GetOptions) (*packngo.IPAddressReservation, *packngo.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.reservations {
+		if f.reservations[i].ID == reservationID {
+			ipr := f.reservations[i]
+			return &ipr, nil, nil
+		}
+	}
+	return nil, nil, f.notFound()
+}
+
+func (f *fakeProjectIPs) List(projectID string, opts *packngo.ListOptions) ([]packngo.IPAddressReservation, *packngo.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.lists++
+	if f.listErr != nil {
+		return nil, nil, f.listErr
+	}
+	if err := f.failure(); err != nil {
+		return nil, nil, err
+	}
+	ret := make([]packngo.IPAddressReservation, len(f.reservations))
+	copy(ret, f.reservations)
+	return ret, nil, nil
+}
+
+func (f *fakeProjectIPs) Request(projectID string, req *packngo.IPReservationRequest) (*packngo.IPAddressReservation, *packngo.Response, error) {
+	f.mu.Lock()
+	if err := f.failure(); err != nil {
+		f.mu.Unlock()
+		return nil, nil, err
+	}
+	f.requests = append(f.requests, *req)
+	for ; f.lostResponses > 0; f.lostResponses-- {
+		f.next++
+		f.reservations = append(f.reservations, packngo.IPAddressReservation{
+			IpAddressCommon: packngo.IpAddressCommon{
+				ID:      fmt.Sprintf("reservation-%d", f.next),
+				Address: fmt.Sprintf("147.75.100.%d", f.next),
+				CIDR:    32,
+				Public:  true,
+				Tags:    append([]string{}, req.Tags...),
+			},
+		})
+	}
+	f.next++
+	description := req.Description
+	address, cidr, family := fmt.Sprintf("147.75.100.%d", f.next), 33-bits.Len(uint(req.Quantity)), 4
+	if req.Type == "public_ipv6" {
+		address, cidr, family = fmt.Sprintf("2604:1380:100::%d", f.next), 128, 6
+	}
+	if f.withholdAddress {
+		address = ""
+	}
+	ipr := packngo.IPAddressReservation{
+		Description: &description,
+		IpAddressCommon: packngo.IpAddressCommon{
+			ID:            fmt.Sprintf("reservation-%d", f.next),
+			Address:       address,
+			CIDR:          cidr,
+			AddressFamily: family,
+			Public:        true,
+			Global:        req.Type == packngo.GlobalIPv4,
+			Tags:          append([]string{}, req.Tags...),
+		},
+	}
+	if req.Facility != nil {
+		ipr.Facility = &packngo.Facility{Code: *req.Facility}
+	}
+	f.reservations = append(f.reservations, ipr)
+	f.mu.Unlock()
+	if f.requestErr != nil {
+		return nil, nil, f.requestErr
+	}
+	if f.onRequest != nil {
+		f.onRequest()
+	}
+	return &ipr, nil, nil
+}
+
+func (f *fakeProjectIPs) Remove(ipReservationID string) (*packngo.Response, error) {
+	if f.beforeRemove != nil {
+		f.beforeRemove()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.failure(); err != nil {
+		return nil, err
+	}
+	for i := range f.reservations {
+		if f.reservations[i].ID == ipReservationID {
+			f.reservations = append(f.reservations[:i], f.reservations[i+1:]...)
+			f.removed = append(f.removed, ipReservationID)
+			return nil, nil
+		}
+	}
+	return nil, f.notFound()
+}
+
+func (f *fakeProjectIPs) AvailableAddresses(ipReservationID string, r *packngo.AvailableRequest) ([]string, *packngo.Response, error) {
+	return nil, nil, nil
+}
+
+func (f *fakeProjectIPs) UpdateTags(reservationID string, tags []string) (*packngo.IPAddressReservation, *packngo.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.reservations {
+		if f.reservations[i].ID == reservationID {
+			f.reservations[i].Tags = append([]string{}, tags...)
+			ipr := f.reservations[i]
+			return &ipr, nil, nil
+		}
+	}
+	return nil, nil, f.notFound()
+}
+
+// fakeLB records what the load balancer implementation was asked to do
+type fakeLB struct {
+	services map[string]string
+	options  map[string]loadbalancers.ServiceOptions
+	nodes    map[string]loadbalancers.Node
+	// changes the number of calls that changed anything
+	changes uint64
+}
+
+func newFakeLB() *fakeLB {
+	return &fakeLB{services: map[string]string{}, options: map[string]loadbalancers.ServiceOptions{}, nodes: map[string]loadbalancers.Node{}}
+}
+
+func (f *fakeLB) AddNode(ctx context.Context, nodeName string, localASN, peerASN int, pass string, srcIP string, peers ...string) error {
+	f.nodes[nodeName] = loadbalancers.Node{Name: nodeName, LocalASN: localASN, PeerASN: peerASN, Password: pass, SourceIP: srcIP, Peers: peers}
+	return nil
+}
+func (f *fakeLB) AddNodes(ctx context.Context, nodes []loadbalancers.Node) error {
+	for _, n := range nodes {
+		f.nodes[n.Name] = n
+	}
+	return nil
+}
+func (f *fakeLB) RemoveNode(ctx context.Context, nodeName string) error {
+	delete(f.nodes, nodeName)
+	return nil
+}
+func (f *fakeLB) SyncNodes(ctx context.Context, nodes map[string]loadbalancers.Node) error {
+	if !reflect.DeepEqual(f.nodes, nodes) {
+		f.changes++
+	}
+	f.nodes = map[string]loadbalancers.Node{}
+	for k, v := range nodes {
+		f.nodes[k] = v
+	}
+	return nil
+}
+func (f *fakeLB) AddService(ctx context.Context, svc, ip string, opts loadbalancers.ServiceOptions) error {
+	if f.services[ip] != svc {
+		f.changes++
+	}
+	f.services[ip] = svc
+	f.options[svc] = opts
+	return nil
+}
+func (f *fakeLB) RemoveService(ctx context.Context, ip string) error {
+	if _, ok := f.services[ip]; ok {
+		f.changes++
+	}
+	delete(f.services, ip)
+	return nil
+}
+func (f *fakeLB) Nodes(ctx context.Context) (map[string]loadbalancers.Node, error) {
+	nodes := map[string]loadbalancers.Node{}
+	for k, v := range f.nodes {
+		nodes[k] = v
+	}
+	return nodes, nil
+}
+func (f *fakeLB) SyncServices(ctx context.Context, ips map[string]bool) error {
+	for ip := range f.services {
+		if !ips[ip] {
+			f.changes++
+			delete(f.services, ip)
+		}
+	}
+	return nil
+}
+func (f *fakeLB) Changes() uint64 {
+	return f.changes
+}
+
+// testLoadBalancersConfig get the config of the loadBalancers of the tests, with the given
+// loadbalancer setting
+func testLoadBalancersConfig(setting string) Config {
+	return Config{
+		ProjectID:                  projectID,
+		Facility:                   testFacility,
+		FacilitySelection:          FacilitySelectionFixed,
+		LoadBalancerSetting:        setting,
+		ReservationCIDR:            DefaultReservationCIDR,
+		ReservationReuseScope:      ReuseScopeService,
+		MetricsGranularity:         MetricsGranularityAggregate,
+		LoadBalancerClass:          DefaultLoadBalancerClass,
+		MetalLBMode:                MetalLBModeConfigMap,
+		WriteServiceLoadBalancerIP: true,
+	}
+}
+
+// testGetLoadBalancers get a loadBalancers backed by fakes, with the given kubernetes objects
+func testGetLoadBalancers(ips *fakeProjectIPs, objects ...runtime.Object) (*loadBalancers, *fakeLB) {
+	lb := newFakeLB()
+	client := &packngo.Client{ProjectIPs: ips}
+	l := newLoadBalancers(client, testLoadBalancersConfig(""), nil)
+	l.k8sclient = fake.NewSimpleClientset(objects...)
+	l.clusterID = testClusterID
+	l.implementor = lb
+	l.ipTagger = ips
+	return l, lb
+}
+
+func testLoadBalancerService(namespace, name string, annotations map[string]string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   namespace,
+			Annotations: annotations,
+		},
+		Spec: v1.ServiceSpec{
+			Type: v1.ServiceTypeLoadBalancer,
+		},
+	}
+}
+
+func testNamespace(name string, annotations map[string]string) *v1.Namespace {
+	return &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Annotations: annotations,
+		},
+	}
+}
+
+func TestReconcileServicesRemoveRetain(t *testing.T) {
+	retain := map[string]string{annotationEIPRetain: "true"}
+	tests := []struct {
+		name        string
+		svcAnnots   map[string]string
+		nsAnnots    map[string]string
+		nsExists    bool
+		retained    bool
+		description string
+	}{
+		{"default", nil, nil, true, false, "no annotation releases the reservation"},
+		{"missing-namespace", nil, nil, false, false, "namespace already gone releases the reservation"},
+		{"service", retain, nil, true, true, "annotation on service retains"},
+		{"namespace", nil, retain, true, true, "annotation on namespace retains"},
+		{"false", map[string]string{annotationEIPRetain: "false"}, nil, true, false, "annotation set false releases"},
+	}
+
+	for i, tt := range tests {
+		ips := &fakeProjectIPs{}
+		objs := []runtime.Object{}
+		if tt.nsExists {
+			objs = append(objs, testNamespace(tt.name, tt.nsAnnots))
+		}
+		svc := testLoadBalancerService(tt.name, "web", tt.svcAnnots)
+		objs = append(objs, svc)
+		l, lb := testGetLoadBalancers(ips, objs...)
+		ctx := context.Background()
+
+		if err := l.reconcileServices(ctx, []*v1.Service{svc}, ModeAdd); err != nil {
+			t.Fatalf("%d: unexpected error adding service: %v", i, err)
+		}
+		if len(ips.reservations) != 1 {
+			t.Fatalf("%d: expected 1 reservation after add, got %d", i, len(ips.reservations))
+		}
+		id := ips.reservations[0].ID
+
+		if err := l.reconcileServices(ctx, []*v1.Service{svc}, ModeRemove); err != nil {
+			t.Fatalf("%d: unexpected error removing service: %v", i, err)
+		}
+		if len(lb.services) != 0 {
+			t.Errorf("%d: expected service to be removed from load balancer, still have %v", i, lb.services)
+		}
+		switch {
+		case tt.retained && len(ips.reservations) != 1:
+			t.Errorf("%d: %s: expected reservation to be retained, but was removed", i, tt.description)
+		case tt.retained:
+			ipr := ips.reservations[0]
+			if ipReservationByAllTags([]string{emTag}, ips.reservations) != nil {
+				t.Errorf("%d: %s: retained reservation still has managed tag: %v", i, tt.description, ipr.Tags)
+			}
+			if ipReservationByAllTags([]string{emRetainedTag, serviceTag(svc), clusterTag(testClusterID)}, ips.reservations) == nil {
+				t.Errorf("%d: %s: retained reservation missing retained tags: %v", i, tt.description, ipr.Tags)
+			}
+		case len(ips.reservations) != 0 || len(ips.removed) != 1 || ips.removed[0] != id:
+			t.Errorf("%d: %s: expected reservation %s to be released, remaining %v", i, tt.description, id, ips.reservations)
+		}
+	}
+}
+
+func TestReconcileServicesSyncIgnoresRetained(t *testing.T) {
+	ips := &fakeProjectIPs{
+		reservations: []packngo.IPAddressReservation{
+			{IpAddressCommon: packngo.IpAddressCommon{
+				ID:      "retained",
+				Address: "147.75.1.1",
+				CIDR:    32,
+				Tags:    []string{emRetainedTag, "service=abc", clusterTag(testClusterID)},
+			}},
+		},
+	}
+	l, _ := testGetLoadBalancers(ips)
+	if err := l.reconcileServices(context.Background(), []*v1.Service{}, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.removed) != 0 {
+		t.Errorf("sync removed retained reservations %v", ips.removed)
+	}
+}
+
+func TestReconcileServicesSyncIgnoresUnknownTagScheme(t *testing.T) {
+	cls := clusterTag(testClusterID)
+	orphan := serviceTag(testLoadBalancerService("default", "gone", nil))
+	reservation := func(id string, tags ...string) packngo.IPAddressReservation {
+		return packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{ID: id, Address: "147.75.1." + id[len(id)-1:], CIDR: 32, Tags: tags}}
+	}
+	ips := &fakeProjectIPs{
+		reservations: []packngo.IPAddressReservation{
+			reservation("orphan-1", emTag, orphan, cls),
+			// e.g. of a newer version of the CCM, before a rollback
+			reservation("newer-2", emTag, "service=v2:default/gone", cls),
+			reservation("newer-3", emTag, orphan, cls, "family=dual"),
+			reservation("newer-4", emTag, cls),
+		},
+	}
+	l, _ := testGetLoadBalancers(ips)
+	if err := l.reconcileServices(context.Background(), []*v1.Service{}, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.removed) != 1 || ips.removed[0] != "orphan-1" {
+		t.Errorf("mismatched removed, actual %v expected [orphan-1]", ips.removed)
+	}
+	if len(ips.reservations) != 3 {
+		t.Fatalf("expected 3 reservations left, have %v", ips.reservations)
+	}
+	for _, ipr := range ips.reservations {
+		if ipr.ID == "newer-3" && len(ipr.Tags) != 4 {
+			t.Errorf("tags of %s changed: %v", ipr.ID, ipr.Tags)
+		}
+	}
+}
+
+func TestReconcileServicesReservationEvents(t *testing.T) {
+	ips := &fakeProjectIPs{}
+	keep := testLoadBalancerService("default", "keep", map[string]string{annotationEIPRetain: "true"})
+	drop := testLoadBalancerService("default", "drop", nil)
+	l, _ := testGetLoadBalancers(ips, testNamespace("default", nil), keep, drop)
+	sink := &recordingEventSink{}
+	l.events = sink
+	ctx := context.Background()
+
+	if err := l.reconcileServices(ctx, []*v1.Service{keep, drop}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error adding services: %v", err)
+	}
+	if err := l.reconcileServices(ctx, []*v1.Service{keep, drop}, ModeRemove); err != nil {
+		t.Fatalf("unexpected error removing services: %v", err)
+	}
+
+	expected := []struct {
+		eventType string
+		service   string
+	}{
+		{reservationEventCreated, "default/keep"},
+		{reservationEventCreated, "default/drop"},
+		{reservationEventRetained, "default/keep"},
+		{reservationEventDeleted, "default/drop"},
+	}
+	if len(sink.events) != len(expected) {
+		t.Fatalf("expected %d events, received %d: %#v", len(expected), len(sink.events), sink.events)
+	}
+	for i, e := range expected {
+		actual := sink.events[i]
+		if actual.Type != e.eventType || actual.Service != e.service || actual.ReservationID == "" || actual.Address == "" {
+			t.Errorf("%d: expected %s event for %s, received %#v", i, e.eventType, e.service, actual)
+		}
+	}
+}
+
+func TestReconcileServicesSessionAffinity(t *testing.T) {
+	ips := &fakeProjectIPs{}
+	sticky := testLoadBalancerService("default", "sticky", nil)
+	sticky.Spec.SessionAffinity = v1.ServiceAffinityClientIP
+	plain := testLoadBalancerService("default", "plain", nil)
+	plain.Spec.SessionAffinity = v1.ServiceAffinityNone
+	l, lb := testGetLoadBalancers(ips, sticky, plain)
+
+	if err := l.reconcileServices(context.Background(), []*v1.Service{sticky, plain}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tests := []struct {
+		svc      string
+		affinity bool
+	}{
+		{"default/sticky", true},
+		{"default/plain", false},
+	}
+	for i, tt := range tests {
+		opts, ok := lb.options[tt.svc]
+		switch {
+		case !ok:
+			t.Errorf("%d: service %s not passed to implementation", i, tt.svc)
+		case opts.SessionAffinity != tt.affinity:
+			t.Errorf("%d: service %s affinity actual %v expected %v", i, tt.svc, opts.SessionAffinity, tt.affinity)
+		}
+	}
+}
+
+func TestReservationDescriptionUnique(t *testing.T) {
+	a := testLoadBalancerService("default", "a", nil)
+	b := testLoadBalancerService("default", "b", nil)
+	descriptions := map[string]bool{
+		reservationDescription("cluster1", a): true,
+		reservationDescription("cluster1", b): true,
+		reservationDescription("cluster2", a): true,
+	}
+	if len(descriptions) != 3 {
+		t.Errorf("descriptions are not unique per cluster and service: %v", descriptions)
+	}
+	if strings.Contains(reservationDescription("cluster1", a), "default/a") {
+		t.Errorf("description leaks the service name: %s", reservationDescription("cluster1", a))
+	}
+}
+
+func TestRenderDescription(t *testing.T) {
+	svc := testLoadBalancerService("shop", "web", nil)
+	tests := []struct {
+		template    string
+		description string
+		err         bool
+	}{
+		{"k8s {cluster} {namespace}/{name}", "k8s cluster1 shop/web", false},
+		{"{name}{name}", "webweb", false},
+		{"no placeholders", "no placeholders", false},
+		{"{service}", "", true},
+		{"{name", "", true},
+		{"name}", "", true},
+		{"{}", "", true},
+	}
+	for i, tt := range tests {
+		description, err := renderDescription(tt.template, "cluster1", svc)
+		switch {
+		case (err != nil) != tt.err:
+			t.Errorf("%d: %q mismatched error, actual %v expected %t", i, tt.template, err, tt.err)
+		case description != tt.description:
+			t.Errorf("%d: %q mismatched description, actual %q expected %q", i, tt.template, description, tt.description)
+		}
+	}
+}
+
+func TestAddServiceDescriptionTemplate(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", nil)
+	tests := []struct {
+		template    string
+		description string
+	}{
+		{"", reservationDescription(testClusterID, svc)},
+		{"k8s {cluster} {namespace}/{name}", "k8s " + testClusterID + " default/web"},
+		// a template that does not render falls back to the default
+		{"k8s {service}", reservationDescription(testClusterID, svc)},
+	}
+	for i, tt := range tests {
+		ips := &fakeProjectIPs{}
+		l, _ := testGetLoadBalancers(ips, svc)
+		l.descriptionTmpl = tt.template
+		if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if len(ips.requests) != 1 {
+			t.Fatalf("%d: expected 1 request, had %d", i, len(ips.requests))
+		}
+		if ips.requests[0].Description != tt.description {
+			t.Errorf("%d: mismatched description, actual %q expected %q", i, ips.requests[0].Description, tt.description)
+		}
+	}
+}
+
+func TestAddServiceAdoptByDescription(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", nil)
+	desc := reservationDescription(testClusterID, svc)
+	untagged := func(id string, tags ...string) packngo.IPAddressReservation {
+		d := desc
+		return packngo.IPAddressReservation{
+			IpAddressCommon: packngo.IpAddressCommon{ID: id, Address: "147.75.1." + id, CIDR: 32, Tags: tags},
+			Description:     &d,
+		}
+	}
+	foreign := untagged("1", emTag, serviceTag(svc), clusterTag("other"))
+	tests := []struct {
+		reservations []packngo.IPAddressReservation
+		adopted      string
+		requests     int
+		description  string
+	}{
+		{[]packngo.IPAddressReservation{untagged("1")}, "1", 0, "single match is adopted"},
+		{[]packngo.IPAddressReservation{untagged("1"), untagged("2")}, "", 1, "ambiguous match is skipped"},
+		{nil, "", 1, "no match requests a new one"},
+		{[]packngo.IPAddressReservation{untagged("1", emRetainedTag, serviceTag(svc), clusterTag(testClusterID), "env=prod")}, "1", 0, "retained is adopted with a single usage tag"},
+		// e.g. of a description template without the cluster
+		{[]packngo.IPAddressReservation{foreign}, "", 1, "of another cluster is skipped"},
+		{[]packngo.IPAddressReservation{untagged("1", emTag, "service=other", clusterTag(testClusterID))}, "", 1, "of another service is skipped"},
+	}
+	for i, tt := range tests {
+		ips := &fakeProjectIPs{reservations: tt.reservations}
+		l, _ := testGetLoadBalancers(ips, svc)
+		list, _, _ := ips.List(projectID, nil)
+		if err := l.addService(context.Background(), svc, list); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if len(ips.requests) != tt.requests {
+			t.Errorf("%d: %s: expected %d requests, had %d", i, tt.description, tt.requests, len(ips.requests))
+		}
+		if tt.adopted == "" {
+			// left as it was
+			for _, ipr := range ips.reservations {
+				if ipr.ID == "1" && len(tt.reservations) == 1 && !reflect.DeepEqual(ipr.Tags, tt.reservations[0].Tags) {
+					t.Errorf("%d: %s: skipped reservation retagged, tags %v", i, tt.description, ipr.Tags)
+				}
+			}
+			continue
+		}
+		ipr := ipReservationByAllTags([]string{emTag, serviceTag(svc), clusterTag(testClusterID)}, ips.reservations)
+		if ipr == nil || ipr.ID != tt.adopted {
+			t.Errorf("%d: %s: expected reservation %s to be tagged for the service, found %v", i, tt.description, tt.adopted, ipr)
+			continue
+		}
+		// a single usage tag, that of a managed reservation, and any others kept
+		if expected := reassignedTags(tt.reservations[0].Tags, serviceTag(svc), clusterTag(testClusterID)); !reflect.DeepEqual(ipr.Tags, expected) {
+			t.Errorf("%d: %s: mismatched tags of the adopted reservation, actual %v expected %v", i, tt.description, ipr.Tags, expected)
+		}
+	}
+}
+
+func TestAddServiceAdoptByAddress(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", nil)
+	svc.Spec.LoadBalancerIP = "147.75.1.1"
+	managed := []string{emTag, serviceTag(svc), clusterTag(testClusterID)}
+	reservation := func(address string, cidr int, public bool, tags ...string) packngo.IPAddressReservation {
+		return packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{ID: "user", Address: address, CIDR: cidr, Public: public, Tags: tags}}
+	}
+	tests := []struct {
+		reservation packngo.IPAddressReservation
+		tags        []string
+		description string
+	}{
+		{reservation("147.75.1.1", 32, true), managed, "untagged is adopted"},
+		{reservation("147.75.1.1", 32, true, "env=prod"), append([]string{"env=prod"}, managed...), "other tags are kept"},
+		{reservation("147.75.1.0", 30, true), nil, "block is left"},
+		{reservation("147.75.1.1", 32, false), nil, "private is left"},
+		{reservation("147.75.1.1", 32, true, emRetainedTag, "service=other", clusterTag(testClusterID)), []string{emRetainedTag, "service=other", clusterTag(testClusterID)}, "retained by another is left"},
+	}
+	for i, tt := range tests {
+		ips := &fakeProjectIPs{reservations: []packngo.IPAddressReservation{tt.reservation}}
+		l, lb := testGetLoadBalancers(ips, svc)
+		// adopted once, and found by its tags on each reconcile after
+		for j := 0; j < 2; j++ {
+			list, _, _ := ips.List(projectID, nil)
+			if err := l.addService(context.Background(), svc, list); err != nil {
+				t.Fatalf("%d: %s: unexpected error: %v", i, tt.description, err)
+			}
+		}
+		if len(ips.requests) != 0 {
+			t.Errorf("%d: %s: unexpected requests %v", i, tt.description, ips.requests)
+		}
+		if tags := ips.reservations[0].Tags; !reflect.DeepEqual(tags, tt.tags) {
+			t.Errorf("%d: %s: mismatched tags, actual %v expected %v", i, tt.description, tags, tt.tags)
+		}
+		if lb.services["147.75.1.1/32"] != "default/web" {
+			t.Errorf("%d: %s: expected 147.75.1.1/32 advertised, have %v", i, tt.description, lb.services)
+		}
+	}
+}
+
+func TestReconcileServicesSyncTimeout(t *testing.T) {
+	svcs := []*v1.Service{
+		testLoadBalancerService("default", "a", nil),
+		testLoadBalancerService("default", "b", nil),
+		testLoadBalancerService("default", "c", nil),
+	}
+	// a reservation for a deleted service, which sync would remove if it got that far
+	orphan := packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{
+		ID:      "orphan",
+		Address: "147.75.1.1",
+		CIDR:    32,
+		Tags:    []string{emTag, "service=deleted", clusterTag(testClusterID)},
+	}}
+	ips := &fakeProjectIPs{reservations: []packngo.IPAddressReservation{orphan}}
+	objs := []runtime.Object{}
+	for _, svc := range svcs {
+		objs = append(objs, svc)
+	}
+	l, lb := testGetLoadBalancers(ips, objs...)
+
+	// the pass runs out of time in the middle of the request for the second service, which still
+	// runs to its end, as it would take effect anyway
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var requested int
+	ips.onRequest = func() {
+		if requested++; requested == 2 {
+			cancel()
+		}
+	}
+
+	err := l.reconcileServices(ctx, svcs, ModeSync)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancelled error, received %v", err)
+	}
+	// the first two services were processed and saved, the second with the reservation its
+	// request got after the pass ran out of time, and the third was not started
+	if len(ips.requests) != 2 || len(lb.services) != 2 {
+		t.Errorf("expected exactly two services processed, had %d requests and %d services", len(ips.requests), len(lb.services))
+	}
+	for _, name := range []string{"a", "b"} {
+		existing, _ := l.k8sclient.CoreV1().Services("default").Get(context.Background(), name, metav1.GetOptions{})
+		if existing.Spec.LoadBalancerIP == "" {
+			t.Errorf("service %s did not have its IP saved", name)
+		}
+	}
+	// the destructive part of sync did not run
+	if len(ips.removed) != 0 {
+		t.Errorf("sync removed reservations %v after running out of time", ips.removed)
+	}
+
+	// the next pass picks up the rest, with the services as they now are
+	list, _ := l.k8sclient.CoreV1().Services("").List(context.Background(), metav1.ListOptions{})
+	svcs = nil
+	for i := range list.Items {
+		svcs = append(svcs, &list.Items[i])
+	}
+	if err := l.reconcileServices(context.Background(), svcs, ModeSync); err != nil {
+		t.Fatalf("unexpected error on next pass: %v", err)
+	}
+	if len(ips.requests) != 3 {
+		t.Errorf("expected all services processed on next pass, had %d requests", len(ips.requests))
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		existing, _ := l.k8sclient.CoreV1().Services("default").Get(context.Background(), name, metav1.GetOptions{})
+		if existing.Spec.LoadBalancerIP == "" {
+			t.Errorf("service %s did not have its IP saved on next pass", name)
+		}
+	}
+}
+
+func TestReconcileServicesDeleteRecreate(t *testing.T) {
+	old := packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{
+		ID:      "old",
+		Address: "147.75.1.1",
+		CIDR:    32,
+		Tags:    []string{emTag, serviceTag(testLoadBalancerService("default", "web", nil)), clusterTag(testClusterID)},
+	}}
+	ips := &fakeProjectIPs{reservations: []packngo.IPAddressReservation{old}}
+
+	// the deleted service had the old address; the recreated one with the same name has none yet
+	oldSvc := testLoadBalancerService("default", "web", nil)
+	oldSvc.Spec.LoadBalancerIP = old.Address
+	newSvc := testLoadBalancerService("default", "web", nil)
+	l, lb := testGetLoadBalancers(ips, newSvc)
+	lb.services["147.75.1.1/32"] = "default/web"
+
+	// hold the removal of the old reservation in flight until we let it go
+	removeStarted := make(chan struct{})
+	releaseRemove := make(chan struct{})
+	ips.beforeRemove = func() {
+		close(removeStarted)
+		<-releaseRemove
+	}
+
+	removeErr := make(chan error, 1)
+	go func() {
+		removeErr <- l.reconcileServices(context.Background(), []*v1.Service{oldSvc}, ModeRemove)
+	}()
+	<-removeStarted
+
+	addErr := make(chan error, 1)
+	go func() {
+		addErr <- l.reconcileServices(context.Background(), []*v1.Service{newSvc}, ModeAdd)
+	}()
+
+	// the add must wait for the in-flight removal of the same service
+	select {
+	case err := <-addErr:
+		t.Fatalf("add completed while removal of the same service was in flight: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(releaseRemove)
+
+	if err := <-removeErr; err != nil {
+		t.Fatalf("unexpected error on remove: %v", err)
+	}
+	if err := <-addErr; err != nil {
+		t.Fatalf("unexpected error on add: %v", err)
+	}
+
+	if len(ips.removed) != 1 || ips.removed[0] != "old" {
+		t.Errorf("mismatched removed reservations, actual %v expected [old]", ips.removed)
+	}
+	if len(ips.requests) != 1 {
+		t.Fatalf("expected a new reservation for the recreated service, had %d requests", len(ips.requests))
+	}
+	existing, _ := l.k8sclient.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+	if existing.Spec.LoadBalancerIP == old.Address {
+		t.Errorf("recreated service was assigned the address of the removed reservation")
+	}
+	if _, ok := lb.services["147.75.1.1/32"]; ok {
+		t.Errorf("removed address still in load balancer")
+	}
+	if svc := lb.services[existing.Spec.LoadBalancerIP+"/32"]; svc != "default/web" {
+		t.Errorf("new address %s not in load balancer, have %v", existing.Spec.LoadBalancerIP, lb.services)
+	}
+}
+
+func TestReconcileServicesDualStack(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", map[string]string{annotationEIPDualStack: "true"})
+	ips := &fakeProjectIPs{}
+	l, lb := testGetLoadBalancers(ips, svc)
+	current := func() *v1.Service {
+		existing, err := l.k8sclient.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unable to get service: %v", err)
+		}
+		return existing
+	}
+
+	// creation reserves one of each family
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.requests) != 2 {
+		t.Fatalf("expected 2 requests, had %d", len(ips.requests))
+	}
+	for i, tt := range []struct {
+		family string
+		tag    string
+	}{
+		{"public_ipv4", ipv4FamilyTag},
+		{"public_ipv6", ipv6FamilyTag},
+	} {
+		req := ips.requests[i]
+		if req.Type != tt.family {
+			t.Errorf("%d: mismatched type, actual %s expected %s", i, req.Type, tt.family)
+		}
+		expectedTags := []string{emTag, serviceTag(svc), clusterTag(testClusterID), tt.tag}
+		if strings.Join(req.Tags, ",") != strings.Join(expectedTags, ",") {
+			t.Errorf("%d: mismatched tags, actual %v expected %v", i, req.Tags, expectedTags)
+		}
+	}
+	if ips.requests[0].Description == ips.requests[1].Description {
+		t.Errorf("both families have the same description %s", ips.requests[0].Description)
+	}
+	ipv4, ipv6 := "147.75.100.1", "2604:1380:100::2"
+	if lb.services[ipv4+"/32"] != "default/web" || lb.services[ipv6+"/128"] != "default/web/ipv6" {
+		t.Errorf("both addresses not mapped to the load balancer, have %v", lb.services)
+	}
+
+	// status has both
+	updated := current()
+	if updated.Spec.LoadBalancerIP != ipv4 {
+		t.Errorf("mismatched loadBalancerIP, actual %s expected %s", updated.Spec.LoadBalancerIP, ipv4)
+	}
+	ingress := updated.Status.LoadBalancer.Ingress
+	if len(ingress) != 2 || ingress[0].IP != ipv4 || ingress[1].IP != ipv6 {
+		t.Errorf("mismatched status ingress, actual %v expected [%s %s]", ingress, ipv4, ipv6)
+	}
+
+	// another pass does not reserve anything new
+	if err := l.reconcileServices(context.Background(), []*v1.Service{updated}, ModeSync); err != nil {
+		t.Fatalf("unexpected error on sync: %v", err)
+	}
+	if len(ips.requests) != 2 || len(ips.removed) != 0 || len(lb.services) != 2 {
+		t.Errorf("sync changed a dual-stack service: %d requests, removed %v, load balancer %v", len(ips.requests), ips.removed, lb.services)
+	}
+
+	// cleanup releases both
+	if err := l.reconcileServices(context.Background(), []*v1.Service{updated}, ModeRemove); err != nil {
+		t.Fatalf("unexpected error on remove: %v", err)
+	}
+	if len(ips.removed) != 2 || len(ips.reservations) != 0 {
+		t.Errorf("expected both reservations removed, removed %v, remaining %v", ips.removed, ips.reservations)
+	}
+	if len(lb.services) != 0 {
+		t.Errorf("expected both addresses removed from load balancer, have %v", lb.services)
+	}
+}
+
+func TestReconcileServicesSyncNoLongerDualStack(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", map[string]string{annotationEIPDualStack: "true"})
+	ips := &fakeProjectIPs{}
+	l, _ := testGetLoadBalancers(ips, svc)
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	updated, _ := l.k8sclient.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+	delete(updated.Annotations, annotationEIPDualStack)
+	if err := l.reconcileServices(context.Background(), []*v1.Service{updated}, ModeSync); err != nil {
+		t.Fatalf("unexpected error on sync: %v", err)
+	}
+	// the IPv6 half goes, the IPv4 one stays
+	if len(ips.removed) != 1 || ips.removed[0] != "reservation-2" {
+		t.Errorf("mismatched removed, actual %v expected [reservation-2]", ips.removed)
+	}
+}
+
+func TestServiceAddressesIPv6OfOtherCluster(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", map[string]string{annotationEIPDualStack: "true"})
+	ipv6 := func(id, addr, cluster string) packngo.IPAddressReservation {
+		return packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{ID: id, Address: addr, CIDR: 128, Tags: []string{emTag, serviceTag(svc), clusterTag(cluster), ipv6FamilyTag}}}
+	}
+	l, _ := testGetLoadBalancers(&fakeProjectIPs{})
+
+	// the IPv6 reservation of a service of the same name in another cluster is not this one's
+	addrs := l.serviceAddresses([]*v1.Service{svc}, []packngo.IPAddressReservation{ipv6("other", "2604:1380::1", "other")})
+	if len(addrs) != 0 {
+		t.Errorf("expected no addresses of another cluster, had %v", addrs)
+	}
+	addrs = l.serviceAddresses([]*v1.Service{svc}, []packngo.IPAddressReservation{ipv6("other", "2604:1380::1", "other"), ipv6("own", "2604:1380::2", testClusterID)})
+	if _, ok := addrs["2604:1380::2/128"]; !ok || len(addrs) != 1 {
+		t.Errorf("mismatched addresses, actual %v expected 2604:1380::2/128 only", addrs)
+	}
+}
+
+func TestReconcileServicesIPFamilyTransitions(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", nil)
+	ips := &fakeProjectIPs{}
+	l, lb := testGetLoadBalancers(ips, svc)
+	current := func() *v1.Service {
+		existing, err := l.k8sclient.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unable to get service: %v", err)
+		}
+		return existing
+	}
+	ingressIPs := func(svc *v1.Service) []string {
+		addrs := []string{}
+		for _, ingress := range svc.Status.LoadBalancer.Ingress {
+			addrs = append(addrs, ingress.IP)
+		}
+		return addrs
+	}
+	svcTags := []string{emTag, serviceTag(svc), clusterTag(testClusterID)}
+
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ipv4 := "147.75.100.1"
+
+	// single to dual: the IPv4 reservation is kept, and an IPv6 one is added under the same service tag
+	updated := current()
+	updated.Annotations = map[string]string{annotationEIPDualStack: "true"}
+	if err := l.reconcileServices(context.Background(), []*v1.Service{updated}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error to dual-stack: %v", err)
+	}
+	if len(ips.requests) != 2 || ips.requests[1].Type != "public_ipv6" || len(ips.removed) != 0 {
+		t.Fatalf("expected only an IPv6 request, had %v, removed %v", ips.requests, ips.removed)
+	}
+	if tagged := ipReservationsByAllTags(svcTags, ips.reservations); len(tagged) != 2 {
+		t.Errorf("expected 2 reservations with the service tags, have %d", len(tagged))
+	}
+	ipv6 := "2604:1380:100::2"
+	if len(lb.services) != 2 || lb.services[ipv4+"/32"] != "default/web" || lb.services[ipv6+"/128"] != "default/web/ipv6" {
+		t.Errorf("mismatched load balancer for dual-stack, have %v", lb.services)
+	}
+	updated = current()
+	if addrs := ingressIPs(updated); strings.Join(addrs, ",") != ipv4+","+ipv6 {
+		t.Errorf("mismatched status for dual-stack, actual %v expected [%s %s]", addrs, ipv4, ipv6)
+	}
+
+	// dual to single: the IPv6 half is released and no longer advertised, without waiting for a sync
+	delete(updated.Annotations, annotationEIPDualStack)
+	if err := l.reconcileServices(context.Background(), []*v1.Service{updated}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error to single-stack: %v", err)
+	}
+	if len(ips.removed) != 1 || ips.removed[0] != "reservation-2" {
+		t.Errorf("mismatched removed, actual %v expected [reservation-2]", ips.removed)
+	}
+	if tagged := ipReservationsByAllTags(svcTags, ips.reservations); len(tagged) != 1 || tagged[0].Address != ipv4 {
+		t.Errorf("expected only the IPv4 reservation with the service tags, have %v", tagged)
+	}
+	if len(lb.services) != 1 || lb.services[ipv4+"/32"] != "default/web" {
+		t.Errorf("mismatched load balancer for single-stack, have %v", lb.services)
+	}
+	updated = current()
+	if addrs := ingressIPs(updated); strings.Join(addrs, ",") != ipv4 {
+		t.Errorf("mismatched status for single-stack, actual %v expected [%s]", addrs, ipv4)
+	}
+
+	// and a sync then leaves it be
+	if err := l.reconcileServices(context.Background(), []*v1.Service{updated}, ModeSync); err != nil {
+		t.Fatalf("unexpected error on sync: %v", err)
+	}
+	if len(ips.requests) != 2 || len(ips.removed) != 1 || len(lb.services) != 1 {
+		t.Errorf("sync changed a single-stack service: %d requests, removed %v, load balancer %v", len(ips.requests), ips.removed, lb.services)
+	}
+}
+
+func TestReconcileServicesReservationBlock(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", nil)
+	ips := &fakeProjectIPs{}
+	l, lb := testGetLoadBalancers(ips, svc)
+	l.reservationCIDR = 30
+
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.requests) != 1 || ips.requests[0].Quantity != 4 {
+		t.Fatalf("expected a single request for a block of 4, had %v", ips.requests)
+	}
+	if ips.reservations[0].CIDR != 30 {
+		t.Errorf("mismatched reservation CIDR, actual %d expected 30", ips.reservations[0].CIDR)
+	}
+	// only the first address is used and advertised, the block stays under the service tag
+	updated, _ := l.k8sclient.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+	if updated.Spec.LoadBalancerIP != "147.75.100.1" {
+		t.Errorf("mismatched loadBalancerIP, actual %s expected 147.75.100.1", updated.Spec.LoadBalancerIP)
+	}
+	if len(lb.services) != 1 || lb.services["147.75.100.1/32"] != "default/web" {
+		t.Errorf("mismatched advertised addresses, actual %v expected 147.75.100.1/32", lb.services)
+	}
+
+	// sync keeps the single address
+	if err := l.reconcileServices(context.Background(), []*v1.Service{updated}, ModeSync); err != nil {
+		t.Fatalf("unexpected error on sync: %v", err)
+	}
+	if len(ips.requests) != 1 || len(ips.removed) != 0 || len(lb.services) != 1 {
+		t.Errorf("sync changed the block: %d requests, removed %v, load balancer %v", len(ips.requests), ips.removed, lb.services)
+	}
+
+	// cleanup releases the whole block and withdraws the address
+	if err := l.reconcileServices(context.Background(), []*v1.Service{updated}, ModeRemove); err != nil {
+		t.Fatalf("unexpected error on remove: %v", err)
+	}
+	if len(ips.removed) != 1 || len(ips.reservations) != 0 {
+		t.Errorf("expected the block removed, removed %v, remaining %v", ips.removed, ips.reservations)
+	}
+	if len(lb.services) != 0 {
+		t.Errorf("expected address withdrawn from load balancer, have %v", lb.services)
+	}
+}
+
+func TestReservationQuantity(t *testing.T) {
+	tests := []struct {
+		cidr     int
+		quantity int
+	}{
+		{0, 1},
+		{32, 1},
+		{31, 2},
+		{30, 4},
+		{28, 16},
+		{33, 1},
+	}
+	for i, tt := range tests {
+		if q := reservationQuantity(tt.cidr); q != tt.quantity {
+			t.Errorf("%d: mismatched quantity for /%d, actual %d expected %d", i, tt.cidr, q, tt.quantity)
+		}
+	}
+}
+
+func TestHostCIDR(t *testing.T) {
+	tests := []struct {
+		addr string
+		cidr string
+	}{
+		{"147.75.100.1", "147.75.100.1/32"},
+		{"2604:1380:100::2", "2604:1380:100::2/128"},
+	}
+	for i, tt := range tests {
+		if c := hostCIDR(tt.addr); c != tt.cidr {
+			t.Errorf("%d: mismatched CIDR, actual %s expected %s", i, c, tt.cidr)
+		}
+	}
+}
+
+func TestAddServiceReservationWithoutAddress(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", nil)
+	ips := &fakeProjectIPs{withholdAddress: true}
+	l, lb := testGetLoadBalancers(ips, svc)
+
+	// the reservation comes back without an address, so nothing can be mapped yet
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.requests) != 1 {
+		t.Fatalf("expected 1 request, had %d", len(ips.requests))
+	}
+	if len(lb.services) != 0 {
+		t.Errorf("mapped a reservation without an address: %v", lb.services)
+	}
+	updated, _ := l.k8sclient.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+	if updated.Spec.LoadBalancerIP != "" {
+		t.Errorf("assigned loadBalancerIP %q from a reservation without an address", updated.Spec.LoadBalancerIP)
+	}
+	if id := l.pending["default/web"]; id != "reservation-1" {
+		t.Errorf("mismatched pending reservation, actual %q expected reservation-1", id)
+	}
+
+	// still no address on the next pass; wait rather than request another
+	if err := l.reconcileServices(context.Background(), []*v1.Service{updated}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.requests) != 1 || len(lb.services) != 0 {
+		t.Errorf("mismatched second pass, %d requests and load balancer %v", len(ips.requests), lb.services)
+	}
+
+	// the address appears
+	ips.reservations[0].Address = "147.75.100.1"
+	if err := l.reconcileServices(context.Background(), []*v1.Service{updated}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.requests) != 1 {
+		t.Errorf("requested another reservation, had %d requests", len(ips.requests))
+	}
+	if lb.services["147.75.100.1/32"] != "default/web" {
+		t.Errorf("address not mapped once available, load balancer %v", lb.services)
+	}
+	updated, _ = l.k8sclient.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+	if updated.Spec.LoadBalancerIP != "147.75.100.1" {
+		t.Errorf("mismatched loadBalancerIP, actual %q expected 147.75.100.1", updated.Spec.LoadBalancerIP)
+	}
+	if _, ok := l.pending["default/web"]; ok {
+		t.Errorf("pending reservation not cleared once it had an address")
+	}
+}
+
+func TestReusableReservationStaleList(t *testing.T) {
+	web := testLoadBalancerService("default", "web", nil)
+	api := testLoadBalancerService("default", "api", nil)
+	ips := &fakeProjectIPs{reservations: []packngo.IPAddressReservation{
+		{IpAddressCommon: packngo.IpAddressCommon{ID: "retained", Address: "147.75.1.1", CIDR: 32, Public: true, Tags: []string{emRetainedTag, clusterTag(testClusterID)}}},
+	}}
+	l, _ := testGetLoadBalancers(ips, web, api)
+	l.reuseScope = ReuseScopeCluster
+	// both services were reconciled from the same list, taken before either claimed it
+	stale := append([]packngo.IPAddressReservation{}, ips.reservations...)
+
+	ipr, err := l.reusableReservation(context.Background(), web, stale)
+	if err != nil || ipr == nil {
+		t.Fatalf("expected the retained reservation reused, had %v, error %v", ipr, err)
+	}
+	ipr, err = l.reusableReservation(context.Background(), api, stale)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ipr != nil {
+		t.Errorf("reservation claimed twice, by %s and then %s: %v", serviceRep(web), serviceRep(api), ipr.Tags)
+	}
+	if !hasTag(ips.reservations[0].Tags, serviceTag(web)) {
+		t.Errorf("reservation no longer of the first service, has tags %v", ips.reservations[0].Tags)
+	}
+}
+
+func TestAddServiceReuseScope(t *testing.T) {
+	other := testLoadBalancerService("default", "other", nil)
+	gone := testLoadBalancerService("default", "gone", nil)
+	otherCluster := clusterTag("other-cluster")
+	candidates := map[string][]string{
+		"retained":              {emRetainedTag, serviceTag(gone), clusterTag(testClusterID)},
+		"retained-other":        {emRetainedTag, serviceTag(gone), otherCluster},
+		"orphaned":              {emTag, serviceTag(gone), clusterTag(testClusterID)},
+		"in-use":                {emTag, serviceTag(other), clusterTag(testClusterID)},
+		"other-cluster":         {emTag, serviceTag(gone), otherCluster},
+		"not-managed":           {"usage=something-else"},
+		"retained-extra-tagged": {emRetainedTag, serviceTag(gone), clusterTag(testClusterID), "owner=team-a"},
+	}
+	tests := []struct {
+		scope     string
+		candidate string
+		reuse     bool
+	}{
+		{ReuseScopeService, "retained", false},
+		{ReuseScopeService, "orphaned", false},
+		{ReuseScopeService, "retained-other", false},
+		{ReuseScopeCluster, "retained", true},
+		{ReuseScopeCluster, "orphaned", true},
+		{ReuseScopeCluster, "retained-other", false},
+		{ReuseScopeCluster, "in-use", false},
+		{ReuseScopeCluster, "other-cluster", false},
+		{ReuseScopeCluster, "not-managed", false},
+		{ReuseScopeProject, "retained", true},
+		{ReuseScopeProject, "orphaned", true},
+		{ReuseScopeProject, "retained-other", true},
+		{ReuseScopeProject, "in-use", false},
+		{ReuseScopeProject, "other-cluster", false},
+		{ReuseScopeProject, "retained-extra-tagged", true},
+	}
+	for i, tt := range tests {
+		ips := &fakeProjectIPs{reservations: []packngo.IPAddressReservation{
+			{IpAddressCommon: packngo.IpAddressCommon{
+				ID:      tt.candidate,
+				Address: "147.75.1.1",
+				CIDR:    32,
+				Tags:    candidates[tt.candidate],
+			}},
+		}}
+		svc := testLoadBalancerService("default", "web", nil)
+		l, lb := testGetLoadBalancers(ips, svc, other)
+		l.reuseScope = tt.scope
+
+		if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		reused := len(ips.requests) == 0
+		if reused != tt.reuse {
+			t.Errorf("%d: scope %s candidate %s: mismatched reuse, actual %v expected %v", i, tt.scope, tt.candidate, reused, tt.reuse)
+			continue
+		}
+		if !reused {
+			continue
+		}
+		if lb.services["147.75.1.1/32"] != "default/web" {
+			t.Errorf("%d: reused address not mapped, load balancer %v", i, lb.services)
+		}
+		// the reused reservation now is managed for this service, keeping any other tags
+		tags := ips.reservations[0].Tags
+		if ipReservationByAllTags([]string{emTag, serviceTag(svc), clusterTag(testClusterID)}, ips.reservations) == nil {
+			t.Errorf("%d: reused reservation not re-tagged for the service, tags %v", i, tags)
+		}
+		if ipReservationByAnyTags([]string{emRetainedTag, serviceTag(gone), otherCluster}, ips.reservations) != nil {
+			t.Errorf("%d: reused reservation kept previous tags %v", i, tags)
+		}
+		if tt.candidate == "retained-extra-tagged" && ipReservationByAllTags([]string{"owner=team-a"}, ips.reservations) == nil {
+			t.Errorf("%d: reused reservation lost unrelated tags %v", i, tags)
+		}
+	}
+}
+
+func TestReconcileServicesExternalIPs(t *testing.T) {
+	other := testLoadBalancerService("default", "other", nil)
+	web := testLoadBalancerService("default", "web", nil)
+	testReservations := func() []packngo.IPAddressReservation {
+		return []packngo.IPAddressReservation{
+			// the service's own
+			{IpAddressCommon: packngo.IpAddressCommon{ID: "own", Address: "147.75.50.1", CIDR: 32, Tags: []string{emTag, serviceTag(web), clusterTag(testClusterID)}}},
+			// reserved by the user, not by the CCM
+			{IpAddressCommon: packngo.IpAddressCommon{ID: "user-block", Address: "147.75.200.0", CIDR: 30}},
+			// managed for another service
+			{IpAddressCommon: packngo.IpAddressCommon{ID: "other", Address: "147.75.1.1", CIDR: 32, Tags: []string{emTag, serviceTag(other), clusterTag(testClusterID)}}},
+		}
+	}
+
+	tests := []struct {
+		manage         bool
+		loadBalancerIP string
+		externalIPs    []string
+		expected       map[string]string
+	}{
+		// disabled, only the VIP
+		{false, "", []string{"147.75.200.1"}, map[string]string{"147.75.50.1/32": "default/web"}},
+		// the VIP and each external IP in a reservation, but not those unreserved or of another service
+		{true, "", []string{"147.75.200.1", "147.75.200.2", "10.0.0.1", "147.75.1.1"}, map[string]string{
+			"147.75.50.1/32":  "default/web",
+			"147.75.200.1/32": "default/web/147.75.200.1",
+			"147.75.200.2/32": "default/web/147.75.200.2",
+		}},
+		// loadBalancerIP takes precedence over the same external IP
+		{true, "147.75.50.1", []string{"147.75.50.1", "147.75.200.2"}, map[string]string{
+			"147.75.50.1/32":  "default/web",
+			"147.75.200.2/32": "default/web/147.75.200.2",
+		}},
+	}
+	for i, tt := range tests {
+		svc := testLoadBalancerService("default", "web", nil)
+		svc.Spec.LoadBalancerIP = tt.loadBalancerIP
+		svc.Spec.ExternalIPs = tt.externalIPs
+		ips := &fakeProjectIPs{reservations: testReservations()}
+		l, lb := testGetLoadBalancers(ips, svc, other)
+		l.manageExternalIPs = tt.manage
+
+		if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if !reflect.DeepEqual(lb.services, tt.expected) {
+			t.Errorf("%d: mismatched addresses, actual %v expected %v", i, lb.services, tt.expected)
+		}
+
+		// sync keeps them all
+		updated, _ := l.k8sclient.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+		if err := l.reconcileServices(context.Background(), []*v1.Service{updated, other}, ModeSync); err != nil {
+			t.Fatalf("%d: unexpected error on sync: %v", i, err)
+		}
+		if !reflect.DeepEqual(lb.services, tt.expected) {
+			t.Errorf("%d: mismatched addresses after sync, actual %v expected %v", i, lb.services, tt.expected)
+		}
+
+		// removal stops advertising the external IPs, but releases only the reservation of the service itself
+		if err := l.reconcileServices(context.Background(), []*v1.Service{updated}, ModeRemove); err != nil {
+			t.Fatalf("%d: unexpected error on remove: %v", i, err)
+		}
+		if len(lb.services) != 0 {
+			t.Errorf("%d: addresses still advertised after remove: %v", i, lb.services)
+		}
+		for _, id := range ips.removed {
+			if id == "user-block" || id == "other" {
+				t.Errorf("%d: released reservation %s that is not the service's own", i, id)
+			}
+		}
+	}
+}
+
+// fakeDevices implements only the BGP neighbour lookup of packngo.DeviceService, counting calls
+type fakeDevices struct {
+	packngo.DeviceService
+	lock          sync.Mutex
+	neighborCalls int
+	// neighbors if set, the BGP neighbours of each device; otherwise every device has the same
+	neighbors map[string][]packngo.BGPNeighbor
+}
+
+func (f *fakeDevices) ListBGPNeighbors(deviceID string, opts *packngo.ListOptions) ([]packngo.BGPNeighbor, *packngo.Response, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.neighborCalls++
+	if f.neighbors != nil {
+		return f.neighbors[deviceID], nil, nil
+	}
+	return []packngo.BGPNeighbor{
+		{AddressFamily: 4, CustomerAs: 65000, CustomerIP: "10.0.0.1", PeerAs: 65530, PeerIps: []string{"169.254.255.1", "169.254.255.2"}},
+	}, nil, nil
+}
+
+func TestReconcileNodesSyncLookups(t *testing.T) {
+	testNodes := func(from, to int) []*v1.Node {
+		nodes := []*v1.Node{}
+		for i := from; i < to; i++ {
+			nodes = append(nodes, &v1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("node-%d", i)},
+				Spec:       v1.NodeSpec{ProviderID: fmt.Sprintf("equinixmetal://device-%d", i)},
+			})
+		}
+		return nodes
+	}
+	syncNodes := func(l *loadBalancers, devices *fakeDevices, nodes []*v1.Node) int {
+		before := devices.neighborCalls
+		if err := l.reconcileNodes(context.Background(), nodes, ModeSync); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return devices.neighborCalls - before
+	}
+
+	// an implementation that cannot list its nodes must look up each one every time
+	naiveDevices := &fakeDevices{}
+	naive, naiveLB := testGetLoadBalancers(&fakeProjectIPs{})
+	naive.client.Devices = naiveDevices
+	naive.implementor = struct{ loadbalancers.LB }{naiveLB}
+
+	devices := &fakeDevices{}
+	l, lb := testGetLoadBalancers(&fakeProjectIPs{})
+	l.client.Devices = devices
+
+	nodes := testNodes(0, 300)
+	tests := []struct {
+		description string
+		nodes       []*v1.Node
+		naive       int
+		optimized   int
+	}{
+		{"cold", nodes, 300, 300},
+		{"warm", nodes, 300, 0},
+		{"some added", append(nodes, testNodes(300, 305)...), 305, 5},
+		{"some removed", nodes[10:], 290, 0},
+	}
+	for i, tt := range tests {
+		if calls := syncNodes(naive, naiveDevices, tt.nodes); calls != tt.naive {
+			t.Errorf("%d: %s: mismatched naive lookups, actual %d expected %d", i, tt.description, calls, tt.naive)
+		}
+		if calls := syncNodes(l, devices, tt.nodes); calls != tt.optimized {
+			t.Errorf("%d: %s: mismatched lookups, actual %d expected %d", i, tt.description, calls, tt.optimized)
+		}
+		if len(lb.nodes) != len(tt.nodes) || len(naiveLB.nodes) != len(tt.nodes) {
+			t.Errorf("%d: %s: mismatched synced nodes, actual %d and naive %d expected %d", i, tt.description, len(lb.nodes), len(naiveLB.nodes), len(tt.nodes))
+		}
+	}
+}
+
+func TestReconcileNodesLookupCancelled(t *testing.T) {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "metallb-system"},
+		Data:       map[string]string{"config": ""},
+	}
+	l, _ := testGetLoadBalancers(&fakeProjectIPs{}, cm)
+	l.implementor = metallb.NewLB(l.k8sclient, "")
+	// the lookup hangs until the test ends
+	release := make(chan struct{})
+	defer close(release)
+	l.peers = newPeerCache(0, func(providerID string) (*packngo.BGPNeighbor, error) {
+		<-release
+		return &packngo.BGPNeighbor{CustomerAs: 65000, PeerAs: 65530, PeerIps: []string{"169.254.255.1"}}, nil
+	})
+	nodes := []*v1.Node{{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-a"},
+		Spec:       v1.NodeSpec{ProviderID: "equinixmetal://device-a"},
+	}}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- l.reconcileNodes(ctx, nodes, ModeAdd)
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("expected an error, as the lookup did not finish")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("reconcile did not return within %s of the context being done", time.Since(start))
+	}
+}
+
+func TestReconcileNodesConcurrentLookups(t *testing.T) {
+	const count = 50
+	for _, mode := range []UpdateMode{ModeAdd, ModeSync} {
+		cm := &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "metallb-system"},
+			Data:       map[string]string{"config": ""},
+		}
+		l, _ := testGetLoadBalancers(&fakeProjectIPs{}, cm)
+		l.implementor = metallb.NewLB(l.k8sclient, "")
+		client := l.k8sclient.(*fake.Clientset)
+		var (
+			lock                       sync.Mutex
+			inflight, maxInflight, all int
+		)
+		l.peers = newPeerCache(0, func(providerID string) (*packngo.BGPNeighbor, error) {
+			lock.Lock()
+			all++
+			inflight++
+			if inflight > maxInflight {
+				maxInflight = inflight
+			}
+			lock.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			lock.Lock()
+			inflight--
+			lock.Unlock()
+			return &packngo.BGPNeighbor{CustomerAs: 65000, PeerAs: 65530, PeerIps: []string{"169.254.255.1", "169.254.255.2"}}, nil
+		})
+		// in reverse, so that the order of the config is not simply that of the nodes given
+		nodes := []*v1.Node{}
+		for i := count - 1; i >= 0; i-- {
+			nodes = append(nodes, &v1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("node-%02d", i)},
+				Spec:       v1.NodeSpec{ProviderID: fmt.Sprintf("equinixmetal://device-%d", i)},
+			})
+		}
+		client.ClearActions()
+
+		if err := l.reconcileNodes(context.Background(), nodes, mode); err != nil {
+			t.Fatalf("%v: unexpected error: %v", mode, err)
+		}
+		if all != count {
+			t.Errorf("%v: mismatched lookups, actual %d expected %d", mode, all, count)
+		}
+		if maxInflight < 2 || maxInflight > peerLookupConcurrency {
+			t.Errorf("%v: expected between 2 and %d lookups at once, had %d", mode, peerLookupConcurrency, maxInflight)
+		}
+		var updates int
+		for _, action := range client.Actions() {
+			if action.GetVerb() == "update" && action.GetResource().Resource == "configmaps" {
+				updates++
+			}
+		}
+		if updates != 1 {
+			t.Errorf("%v: expected a single update of the configmap, had %d", mode, updates)
+		}
+		saved, err := client.CoreV1().ConfigMaps("metallb-system").Get(context.Background(), "config", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("%v: unable to get configmap: %v", mode, err)
+		}
+		cfg, err := metallb.ParseConfig([]byte(saved.Data["config"]))
+		if err != nil {
+			t.Fatalf("%v: unable to parse config: %v", mode, err)
+		}
+		if len(cfg.Peers) != 2*count {
+			t.Fatalf("%v: mismatched peers, actual %d expected %d", mode, len(cfg.Peers), 2*count)
+		}
+		for i, p := range cfg.Peers {
+			if name := p.NodeSelectors[0].MatchLabels["kubernetes.io/hostname"]; name != fmt.Sprintf("node-%02d", i/2) {
+				t.Errorf("%v: peer %d is of %s, expected node-%02d", mode, i, name, i/2)
+				break
+			}
+		}
+	}
+}
+
+func TestReconcileNodesPeerPassword(t *testing.T) {
+	l, lb := testGetLoadBalancers(&fakeProjectIPs{})
+	l.client.Devices = &fakeDevices{}
+	l.bgpAnnotations.bgpPass = DefaultAnnotationBGPPass
+	l.bgpPass = "global"
+	node := func(name, annotation string) *v1.Node {
+		n := &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       v1.NodeSpec{ProviderID: "equinixmetal://device-" + name},
+		}
+		if annotation != "" {
+			n.Annotations = map[string]string{overrideAnnotation(DefaultAnnotationBGPPass): annotation}
+		}
+		return n
+	}
+	encode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	// as the bgp reconciler annotates it, with the password of its neighbour
+	reconciled := node("r", "")
+	reconciled.Annotations = map[string]string{DefaultAnnotationBGPPass: encode("neighbour-md5")}
+
+	tests := []struct {
+		description string
+		mode        UpdateMode
+		bgpPass     string
+		nodes       []*v1.Node
+		passwords   map[string]string
+	}{
+		{"override and global", ModeAdd, "global", []*v1.Node{node("a", encode("node-secret")), node("b", "")}, map[string]string{"a": "node-secret", "b": "global"}},
+		{"override changed", ModeSync, "global", []*v1.Node{node("a", encode("rotated")), node("b", "")}, map[string]string{"a": "rotated", "b": "global"}},
+		{"invalid override", ModeSync, "global", []*v1.Node{node("a", "not base64!"), node("b", "")}, map[string]string{"a": "global", "b": "global"}},
+		// the global wins over the password the bgp reconciler annotates
+		{"global over reconciled", ModeAdd, "global", []*v1.Node{reconciled}, map[string]string{"r": "global"}},
+		{"no global", ModeSync, "", []*v1.Node{node("a", encode("rotated")), node("b", "")}, map[string]string{"a": "rotated", "b": "global"}},
+	}
+	for i, tt := range tests {
+		l.bgpPass = tt.bgpPass
+		if err := l.reconcileNodes(context.Background(), tt.nodes, tt.mode); err != nil {
+			t.Fatalf("%d: %s: unexpected error: %v", i, tt.description, err)
+		}
+		for name, password := range tt.passwords {
+			if actual := lb.nodes[name].Password; actual != password {
+				t.Errorf("%d: %s: mismatched password of %s, actual %q expected %q", i, tt.description, name, actual, password)
+			}
+		}
+	}
+
+	// a node new to the sync, with neither, has the password of its BGP neighbour, here none
+	if err := l.reconcileNodes(context.Background(), []*v1.Node{node("c", "")}, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if actual := lb.nodes["c"].Password; actual != "" {
+		t.Errorf("mismatched password of c, actual %q expected none", actual)
+	}
+}
+
+func TestReconcileServicesAllocateOnly(t *testing.T) {
+	allocateOnlyAnnotations := map[string]string{annotationEIPAllocateOnly: "true"}
+	tests := []struct {
+		description string
+		annotations map[string]string
+		ingress     []string
+	}{
+		{"ipv4", allocateOnlyAnnotations, []string{"147.75.100.1"}},
+		{"dual-stack", map[string]string{annotationEIPAllocateOnly: "true", annotationEIPDualStack: "true"}, []string{"147.75.100.1", "2604:1380:100::2"}},
+	}
+	for i, tt := range tests {
+		svc := testLoadBalancerService("default", "dns-only", tt.annotations)
+		cm := &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "metallb-system"},
+			Data:       map[string]string{"config": ""},
+		}
+		ips := &fakeProjectIPs{}
+		l, _ := testGetLoadBalancers(ips, svc, cm)
+		l.implementor = metallb.NewLB(l.k8sclient, "")
+		client := l.k8sclient.(*fake.Clientset)
+		client.ClearActions()
+
+		if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+			t.Fatalf("%d: %s: unexpected error: %v", i, tt.description, err)
+		}
+		if len(ips.requests) != len(tt.ingress) {
+			t.Errorf("%d: %s: mismatched requests, actual %d expected %d", i, tt.description, len(ips.requests), len(tt.ingress))
+		}
+		updated, err := l.k8sclient.CoreV1().Services("default").Get(context.Background(), "dns-only", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("%d: %s: unable to get service: %v", i, tt.description, err)
+		}
+		if updated.Spec.LoadBalancerIP != tt.ingress[0] {
+			t.Errorf("%d: %s: mismatched loadBalancerIP, actual %s expected %s", i, tt.description, updated.Spec.LoadBalancerIP, tt.ingress[0])
+		}
+		ingress := []string{}
+		for _, in := range updated.Status.LoadBalancer.Ingress {
+			ingress = append(ingress, in.IP)
+		}
+		if !reflect.DeepEqual(ingress, tt.ingress) {
+			t.Errorf("%d: %s: mismatched status ingress, actual %v expected %v", i, tt.description, ingress, tt.ingress)
+		}
+
+		// sync keeps the reservations, and removal releases them, all without touching the configmap
+		if err := l.reconcileServices(context.Background(), []*v1.Service{updated}, ModeSync); err != nil {
+			t.Fatalf("%d: %s: unexpected error on sync: %v", i, tt.description, err)
+		}
+		if len(ips.removed) != 0 || len(ips.requests) != len(tt.ingress) {
+			t.Errorf("%d: %s: sync changed reservations: %d requests, removed %v", i, tt.description, len(ips.requests), ips.removed)
+		}
+		if err := l.reconcileServices(context.Background(), []*v1.Service{updated}, ModeRemove); err != nil {
+			t.Fatalf("%d: %s: unexpected error on remove: %v", i, tt.description, err)
+		}
+		if len(ips.removed) != len(tt.ingress) {
+			t.Errorf("%d: %s: mismatched removed reservations, actual %v expected %d", i, tt.description, ips.removed, len(tt.ingress))
+		}
+		for _, action := range client.Actions() {
+			if action.GetResource().Resource == "configmaps" && action.GetVerb() != "get" {
+				t.Errorf("%d: %s: unexpected configmap %s", i, tt.description, action.GetVerb())
+			}
+		}
+	}
+}
+
+func TestAddServiceUpdateFailure(t *testing.T) {
+	web := testLoadBalancerService("default", "web", nil)
+	other := testLoadBalancerService("default", "other", nil)
+	ips := &fakeProjectIPs{}
+	l, lb := testGetLoadBalancers(ips, web, other)
+	client := l.k8sclient.(*fake.Clientset)
+	failing := true
+	client.PrependReactor("update", "services", func(action clienttesting.Action) (bool, runtime.Object, error) {
+		svc := action.(clienttesting.UpdateAction).GetObject().(*v1.Service)
+		if failing && svc.Name == "web" {
+			return true, nil, errors.New("apiserver unavailable")
+		}
+		return false, nil, nil
+	})
+	loadBalancerIP := func(name string) string {
+		existing, err := l.k8sclient.CoreV1().Services("default").Get(context.Background(), name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unable to get service %s: %v", name, err)
+		}
+		return existing.Spec.LoadBalancerIP
+	}
+
+	// the reservation is kept, and the rest of the reconcile goes on
+	if err := l.reconcileServices(context.Background(), []*v1.Service{web, other}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.requests) != 2 || len(ips.removed) != 0 {
+		t.Fatalf("mismatched reservations: %d requests, removed %v", len(ips.requests), ips.removed)
+	}
+	if ip := loadBalancerIP("web"); ip != "" {
+		t.Errorf("service web has loadBalancerIP %s despite failed update", ip)
+	}
+	if ip := loadBalancerIP("other"); ip == "" {
+		t.Errorf("service other was not assigned an IP after failure of web")
+	}
+	if len(lb.services) != 1 {
+		t.Errorf("expected only the written service mapped, have %v", lb.services)
+	}
+
+	// once the apiserver is back, the same reservation is written
+	failing = false
+	reserved := ips.reservations[0]
+	if err := l.reconcileServices(context.Background(), []*v1.Service{web}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error on retry: %v", err)
+	}
+	if len(ips.requests) != 2 {
+		t.Errorf("retry reserved again, %d requests", len(ips.requests))
+	}
+	if ip := loadBalancerIP("web"); ip != reserved.Address {
+		t.Errorf("mismatched loadBalancerIP after retry, actual %s expected %s", ip, reserved.Address)
+	}
+	if lb.services[reserved.Address+"/32"] != "default/web" {
+		t.Errorf("address %s not mapped after retry, have %v", reserved.Address, lb.services)
+	}
+}
+
+func TestReservationLabelTags(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", nil)
+	svc.Labels = map[string]string{"cost-center": "eng", "app": "web"}
+	ips := &fakeProjectIPs{}
+	l, _ := testGetLoadBalancers(ips, svc)
+	l.labelTags = []string{"cost-center", "team"}
+	managed := []string{emTag, serviceTag(svc), clusterTag(testClusterID)}
+	reconcile := func(labels map[string]string, mode UpdateMode) {
+		existing, err := l.k8sclient.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unable to get service: %v", err)
+		}
+		existing.Labels = labels
+		if err := l.reconcileServices(context.Background(), []*v1.Service{existing}, mode); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// only configured labels are copied at creation
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := append(append([]string{}, managed...), "label:cost-center=eng")
+	if len(ips.requests) != 1 || !reflect.DeepEqual(ips.requests[0].Tags, expected) {
+		t.Fatalf("mismatched request tags, actual %v expected %v", ips.requests, expected)
+	}
+
+	tests := []struct {
+		description string
+		labels      map[string]string
+		tags        []string
+	}{
+		{"changed and added", map[string]string{"cost-center": "ops", "team": "web"}, []string{"label:cost-center=ops", "label:team=web"}},
+		{"unchanged", map[string]string{"cost-center": "ops", "team": "web"}, []string{"label:cost-center=ops", "label:team=web"}},
+		{"removed", map[string]string{"app": "web"}, []string{}},
+	}
+	for i, tt := range tests {
+		reconcile(tt.labels, ModeSync)
+		expected := append(append([]string{}, managed...), tt.tags...)
+		if tags := ips.reservations[0].Tags; !reflect.DeepEqual(tags, expected) {
+			t.Errorf("%d: %s: mismatched tags, actual %v expected %v", i, tt.description, tags, expected)
+		}
+		// label tags play no part in finding the reservation
+		if len(ips.requests) != 1 || len(ips.removed) != 0 {
+			t.Errorf("%d: %s: reservations changed: %d requests, removed %v", i, tt.description, len(ips.requests), ips.removed)
+		}
+	}
+}
+
+func TestReservationAdditionalTags(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", map[string]string{annotationEIPTags: "cost-center=eng, env=prod,usage=mine,label:team=web,"})
+	ips := &fakeProjectIPs{}
+	l, _ := testGetLoadBalancers(ips, svc)
+	l.additionalTags = []string{"env=prod", "owner"}
+	managed := []string{emTag, serviceTag(svc), clusterTag(testClusterID)}
+	current := func() *v1.Service {
+		existing, err := l.k8sclient.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unable to get service: %v", err)
+		}
+		return existing
+	}
+
+	// those of the config, then those of the annotation, without managed ones or repeats
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := append(append([]string{}, managed...), "env=prod", "owner", "cost-center=eng")
+	if len(ips.requests) != 1 || !reflect.DeepEqual(ips.requests[0].Tags, expected) {
+		t.Fatalf("mismatched request tags, actual %v expected %v", ips.requests, expected)
+	}
+
+	// the reservation still is found by its managed tags
+	if ipr := ipReservationByAllTags(managed, ips.reservations); ipr == nil || ipr.ID != ips.reservations[0].ID {
+		t.Errorf("reservation with additional tags not found by its managed tags")
+	}
+	for i, mode := range []UpdateMode{ModeAdd, ModeSync} {
+		if err := l.reconcileServices(context.Background(), []*v1.Service{current()}, mode); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		if len(ips.requests) != 1 || len(ips.removed) != 0 {
+			t.Errorf("%d: reservations changed: %d requests, removed %v", i, len(ips.requests), ips.removed)
+		}
+		if tags := ips.reservations[0].Tags; !reflect.DeepEqual(tags, expected) {
+			t.Errorf("%d: mismatched tags, actual %v expected %v", i, tags, expected)
+		}
+	}
+}
+
+func TestDuplicateSelectorServices(t *testing.T) {
+	service := func(namespace, name, ip string, selector map[string]string) *v1.Service {
+		svc := testLoadBalancerService(namespace, name, nil)
+		svc.Spec.LoadBalancerIP = ip
+		svc.Spec.Selector = selector
+		return svc
+	}
+	web := map[string]string{"app": "web", "tier": "frontend"}
+	tests := []struct {
+		description string
+		svcs        []*v1.Service
+		expected    [][]string
+	}{
+		{"distinct selectors", []*v1.Service{
+			service("default", "a", "147.75.100.1", web),
+			service("default", "b", "147.75.100.2", map[string]string{"app": "api"}),
+		}, [][]string{}},
+		{"duplicate selectors", []*v1.Service{
+			service("default", "b", "147.75.100.2", map[string]string{"tier": "frontend", "app": "web"}),
+			service("default", "a", "147.75.100.1", web),
+			service("default", "c", "147.75.100.3", map[string]string{"app": "api"}),
+		}, [][]string{{"default/a", "default/b"}}},
+		{"other namespace", []*v1.Service{
+			service("default", "a", "147.75.100.1", web),
+			service("other", "a", "147.75.100.2", web),
+		}, [][]string{}},
+		{"shared address", []*v1.Service{
+			service("default", "a", "147.75.100.1", web),
+			service("default", "b", "147.75.100.1", web),
+		}, [][]string{}},
+		{"no address yet", []*v1.Service{
+			service("default", "a", "147.75.100.1", web),
+			service("default", "b", "", web),
+		}, [][]string{}},
+		{"no selector", []*v1.Service{
+			service("default", "a", "147.75.100.1", nil),
+			service("default", "b", "147.75.100.2", nil),
+		}, [][]string{}},
+	}
+	for i, tt := range tests {
+		if groups := duplicateSelectorServices(tt.svcs); !reflect.DeepEqual(groups, tt.expected) {
+			t.Errorf("%d: %s: mismatched groups, actual %v expected %v", i, tt.description, groups, tt.expected)
+		}
+	}
+}
+
+func TestWarnDuplicateSelectors(t *testing.T) {
+	service := func(name, ip, app string) *v1.Service {
+		svc := testLoadBalancerService("default", name, nil)
+		svc.Spec.LoadBalancerIP = ip
+		svc.Spec.Selector = map[string]string{"app": app}
+		return svc
+	}
+	a, b := service("a", "147.75.100.1", "web"), service("b", "147.75.100.2", "web")
+	c, d := service("c", "147.75.100.3", "api"), service("d", "147.75.100.4", "api")
+	l, _ := testGetLoadBalancers(&fakeProjectIPs{})
+	// each sync in turn, with the groups it warns about
+	tests := []struct {
+		description string
+		svcs        []*v1.Service
+		expected    [][]string
+	}{
+		{"first", []*v1.Service{a, b}, [][]string{{"default/a", "default/b"}}},
+		{"unchanged", []*v1.Service{a, b}, [][]string{}},
+		{"another", []*v1.Service{a, b, c, d}, [][]string{{"default/c", "default/d"}}},
+		{"resolved", []*v1.Service{a, c, d}, [][]string{}},
+		{"back", []*v1.Service{a, b, c, d}, [][]string{{"default/a", "default/b"}}},
+	}
+	for i, tt := range tests {
+		if warned := l.warnDuplicateSelectors(tt.svcs); !reflect.DeepEqual(warned, tt.expected) {
+			t.Errorf("%d: %s: mismatched warnings, actual %v expected %v", i, tt.description, warned, tt.expected)
+		}
+	}
+}
+
+func TestAddServiceFacilitySelection(t *testing.T) {
+	a := testLoadBalancerService("default", "a", nil)
+	b := testLoadBalancerService("default", "b", map[string]string{annotationEIPDualStack: "true"})
+	c := testLoadBalancerService("default", "c", nil)
+	ips := &fakeProjectIPs{}
+	l, _ := testGetLoadBalancers(ips, a, b, c)
+	l.facilitySelector = newFacilitySelector(FacilitySelectionRoundRobin, testFacility, []string{"sjc1", "ams1"}, nil)
+	if err := l.reconcileServices(context.Background(), []*v1.Service{a, b, c}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.requests) != 4 {
+		t.Fatalf("expected 4 requests, had %d", len(ips.requests))
+	}
+	// both halves of a dual-stack service are in the same facility
+	for i, expected := range []string{"sjc1", "ams1", "ams1", "sjc1"} {
+		if f := ips.requests[i].Facility; f == nil || *f != expected {
+			t.Errorf("%d: mismatched facility, actual %v expected %s", i, f, expected)
+		}
+	}
+}
+
+func TestAddServiceInvalidLoadBalancerIP(t *testing.T) {
+	tests := []struct {
+		description string
+		ip          string
+	}{
+		{"hostname", "web.example.com"},
+		{"cidr", "147.75.100.1/32"},
+		{"partial", "147.75.100"},
+		{"port", "147.75.100.1:80"},
+		{"whitespace", " 147.75.100.1"},
+	}
+	for i, tt := range tests {
+		svc := testLoadBalancerService("default", "web", nil)
+		svc.Spec.LoadBalancerIP = tt.ip
+		valid := testLoadBalancerService("default", "valid", nil)
+		ips := &fakeProjectIPs{}
+		l, lb := testGetLoadBalancers(ips, svc, valid)
+		if err := l.reconcileServices(context.Background(), []*v1.Service{svc, valid}, ModeAdd); err != nil {
+			t.Fatalf("%d: %s: unexpected error: %v", i, tt.description, err)
+		}
+		// nothing is mapped for the invalid one, and the others still are handled
+		if len(lb.services) != 1 {
+			t.Errorf("%d: %s: expected only the valid service mapped, have %v", i, tt.description, lb.services)
+		}
+		for cidr, name := range lb.services {
+			if name != "default/valid" {
+				t.Errorf("%d: %s: unexpected mapping %s to %s", i, tt.description, cidr, name)
+			}
+		}
+		if len(ips.requests) != 1 {
+			t.Errorf("%d: %s: mismatched requests, actual %d expected 1", i, tt.description, len(ips.requests))
+		}
+	}
+}
+
+func TestAddServiceLostResponse(t *testing.T) {
+	tests := []struct {
+		description   string
+		lostResponses int
+		requestErr    error
+	}{
+		{"no loss", 0, nil},
+		{"one retry", 1, nil},
+		{"several retries", 3, nil},
+		{"retry failed after create", 1, errors.New("timeout")},
+	}
+	for i, tt := range tests {
+		svc := testLoadBalancerService("default", "web", nil)
+		ips := &fakeProjectIPs{lostResponses: tt.lostResponses, requestErr: tt.requestErr}
+		l, lb := testGetLoadBalancers(ips, svc)
+		if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+			t.Fatalf("%d: %s: unexpected error: %v", i, tt.description, err)
+		}
+		tagged := ipReservationsByAllTags([]string{emTag, serviceTag(svc), clusterTag(testClusterID)}, ips.reservations)
+		if len(tagged) != 1 {
+			t.Fatalf("%d: %s: expected 1 reservation left, have %d", i, tt.description, len(tagged))
+		}
+		if len(ips.removed) != tt.lostResponses {
+			t.Errorf("%d: %s: mismatched removed, actual %v expected %d", i, tt.description, ips.removed, tt.lostResponses)
+		}
+		cidr := fmt.Sprintf("%s/32", tagged[0].Address)
+		if name := lb.services[cidr]; name != serviceRep(svc) || len(lb.services) != 1 {
+			t.Errorf("%d: %s: mismatched services, actual %v expected %s mapped to %s", i, tt.description, lb.services, cidr, serviceRep(svc))
+		}
+	}
+}
+
+func TestReconcileServicesSyncManageable(t *testing.T) {
+	gone := testLoadBalancerService("default", "gone", nil)
+	tags := []string{emTag, serviceTag(gone), clusterTag(testClusterID)}
+	reservation := func(id string, manageable, management bool, assignments int) packngo.IPAddressReservation {
+		ipr := packngo.IPAddressReservation{
+			IpAddressCommon: packngo.IpAddressCommon{ID: id, Address: "147.75.50.1", CIDR: 32, Tags: tags, Manageable: manageable, Management: management},
+		}
+		for i := 0; i < assignments; i++ {
+			ipr.Assignments = append(ipr.Assignments, &packngo.IPAddressAssignment{})
+		}
+		return ipr
+	}
+	tests := []struct {
+		description string
+		check       bool
+		reservation packngo.IPAddressReservation
+		removed     bool
+	}{
+		{"manageable", true, reservation("r", true, false, 0), true},
+		{"not manageable", true, reservation("r", false, false, 0), false},
+		{"management", true, reservation("r", true, true, 0), false},
+		{"assigned", true, reservation("r", true, false, 1), false},
+		{"unchecked", false, reservation("r", false, false, 2), true},
+	}
+	for i, tt := range tests {
+		ips := &fakeProjectIPs{reservations: []packngo.IPAddressReservation{tt.reservation}}
+		l, _ := testGetLoadBalancers(ips)
+		l.checkManageable = tt.check
+		if err := l.reconcileServices(context.Background(), []*v1.Service{}, ModeSync); err != nil {
+			t.Fatalf("%d: %s: unexpected error: %v", i, tt.description, err)
+		}
+		if removed := len(ips.removed) == 1; removed != tt.removed {
+			t.Errorf("%d: %s: mismatched removal, actual %v expected %v", i, tt.description, removed, tt.removed)
+		}
+	}
+}
+
+func TestAddServiceAdvertisePrefix(t *testing.T) {
+	tests := []struct {
+		description string
+		annotations map[string]string
+		advertised  string
+	}{
+		{"default", nil, "147.75.100.8/32"},
+		{"host from block", map[string]string{annotationEIPAdvertisePrefix: "32"}, "147.75.100.8/32"},
+		{"part of block", map[string]string{annotationEIPAdvertisePrefix: "30"}, "147.75.100.8/30"},
+		{"whole block", map[string]string{annotationEIPAdvertisePrefix: "29"}, "147.75.100.8/29"},
+		{"wider than block", map[string]string{annotationEIPAdvertisePrefix: "28"}, "147.75.100.8/32"},
+		{"too long", map[string]string{annotationEIPAdvertisePrefix: "33"}, "147.75.100.8/32"},
+		{"not a number", map[string]string{annotationEIPAdvertisePrefix: "/29"}, "147.75.100.8/32"},
+	}
+	for i, tt := range tests {
+		svc := testLoadBalancerService("default", "web", tt.annotations)
+		svc.Spec.LoadBalancerIP = "147.75.100.8"
+		ips := &fakeProjectIPs{
+			reservations: []packngo.IPAddressReservation{
+				{IpAddressCommon: packngo.IpAddressCommon{ID: "block", Address: "147.75.100.8", CIDR: 29, Tags: []string{emTag, serviceTag(svc), clusterTag(testClusterID)}}},
+			},
+		}
+		l, lb := testGetLoadBalancers(ips, svc)
+		if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+			t.Fatalf("%d: %s: unexpected error: %v", i, tt.description, err)
+		}
+		expected := map[string]string{tt.advertised: "default/web"}
+		if !reflect.DeepEqual(lb.services, expected) {
+			t.Errorf("%d: %s: mismatched advertised, actual %v expected %v", i, tt.description, lb.services, expected)
+		}
+		// sync must agree, or it would withdraw it again
+		if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeSync); err != nil {
+			t.Fatalf("%d: %s: unexpected error on sync: %v", i, tt.description, err)
+		}
+		if !reflect.DeepEqual(lb.services, expected) {
+			t.Errorf("%d: %s: mismatched advertised after sync, actual %v expected %v", i, tt.description, lb.services, expected)
+		}
+		if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeRemove); err != nil {
+			t.Fatalf("%d: %s: unexpected error on remove: %v", i, tt.description, err)
+		}
+		if len(lb.services) != 0 {
+			t.Errorf("%d: %s: expected withdrawn on remove, have %v", i, tt.description, lb.services)
+		}
+	}
+}
+
+func TestReconcileNodesNoProviderID(t *testing.T) {
+	nodes := []*v1.Node{
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-a"}, Spec: v1.NodeSpec{ProviderID: "equinixmetal://device-a"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "joining"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "node-b"}, Spec: v1.NodeSpec{ProviderID: "equinixmetal://device-b"}},
+	}
+	for _, mode := range []UpdateMode{ModeAdd, ModeSync} {
+		l, lb := testGetLoadBalancers(&fakeProjectIPs{})
+		l.client.Devices = &fakeDevices{}
+		if err := l.reconcileNodes(context.Background(), nodes, mode); err != nil {
+			t.Fatalf("%v: unexpected error: %v", mode, err)
+		}
+		if len(lb.nodes) != 2 || lb.nodes["node-a"].Name == "" || lb.nodes["node-b"].Name == "" {
+			t.Errorf("%v: expected the nodes with provider IDs reconciled, have %v", mode, lb.nodes)
+		}
+
+		// once it has its provider ID, the next sync picks it up
+		joined := nodes[1].DeepCopy()
+		joined.Spec.ProviderID = "equinixmetal://device-joining"
+		if err := l.reconcileNodes(context.Background(), []*v1.Node{nodes[0], joined, nodes[2]}, ModeSync); err != nil {
+			t.Fatalf("%v: unexpected error on sync: %v", mode, err)
+		}
+		if len(lb.nodes) != 3 {
+			t.Errorf("%v: expected all nodes after provider ID set, have %v", mode, lb.nodes)
+		}
+	}
+}
+
+func TestParseLoadBalancerSetting(t *testing.T) {
+	tests := []struct {
+		setting string
+		impl    string
+		config  string
+		err     bool
+	}{
+		// unset disables
+		{"", "", "", false},
+		// explicit
+		{"metallb://", LoadBalancerMetalLB, "", false},
+		{"metallb:///", LoadBalancerMetalLB, "/", false},
+		{"metallb:///ns/cm", LoadBalancerMetalLB, "/ns/cm", false},
+		{"metallb:///ns/cm?key=x", LoadBalancerMetalLB, "/ns/cm?key=x", false},
+		{"metallb:///ns", LoadBalancerMetalLB, "/ns", false},
+		{"kube-vip://", LoadBalancerKubeVIP, "", false},
+		{"empty://", LoadBalancerEmpty, "", false},
+		// malformed
+		{"metallb-system:config", "", "", true},
+		{"metallb", "", "", true},
+		{"metallb:/ns/cm", "", "", true},
+		{"metallb:///metallb-system:config", "", "", true},
+		{"metallb:///ns/cm/extra", "", "", true},
+		{"metallb:///Metallb-System/config", "", "", true},
+		{"metallb:///ns/config_map", "", "", true},
+		{"unknown:///ns/cm", "", "", true},
+		{"://ns/cm", "", "", true},
+	}
+	for _, tt := range tests {
+		impl, config, err := ParseLoadBalancerSetting(tt.setting)
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("%q: expected an error, had none", tt.setting)
+		case !tt.err && err != nil:
+			t.Errorf("%q: unexpected error: %v", tt.setting, err)
+		case !tt.err && (impl != tt.impl || config != tt.config):
+			t.Errorf("%q: mismatched result, actual %q %q expected %q %q", tt.setting, impl, config, tt.impl, tt.config)
+		}
+	}
+}
+
+func TestLoadBalancersInitSetting(t *testing.T) {
+	// the setting through to the configmap that metallb writes, with its defaults for what is left out
+	tests := []struct {
+		setting   string
+		enabled   bool
+		namespace string
+		name      string
+		err       bool
+	}{
+		{"", false, "", "", false},
+		{"metallb://", true, "metallb-system", "config", false},
+		{"metallb:///", true, "metallb-system", "config", false},
+		{"metallb:///ns/cm", true, "ns", "cm", false},
+		{"metallb:///ns/cm/", true, "ns", "cm", false},
+		{"metallb:///ns", true, "ns", "config", false},
+		{"metallb-system:config", false, "", "", true},
+	}
+	for _, tt := range tests {
+		objects := []runtime.Object{&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system", UID: testClusterID}}}
+		if tt.enabled {
+			objects = append(objects, &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: tt.namespace, Name: tt.name}})
+		}
+		client := fake.NewSimpleClientset(objects...)
+		l := newLoadBalancers(&packngo.Client{ProjectIPs: &fakeProjectIPs{}}, testLoadBalancersConfig(tt.setting), nil)
+		err := l.init(client)
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("%q: expected an error, had none", tt.setting)
+			continue
+		case !tt.err && err != nil:
+			t.Errorf("%q: unexpected error: %v", tt.setting, err)
+			continue
+		}
+		if (l.implementor != nil) != tt.enabled {
+			t.Errorf("%q: mismatched enabled, actual %v expected %v", tt.setting, l.implementor != nil, tt.enabled)
+			continue
+		}
+		if !tt.enabled {
+			continue
+		}
+		if _, ok := l.implementor.(*metallb.LB); !ok {
+			t.Errorf("%q: mismatched implementation %T", tt.setting, l.implementor)
+			continue
+		}
+		if err := l.implementor.AddService(context.Background(), "default/web", "10.0.0.1/32", loadbalancers.ServiceOptions{}); err != nil {
+			t.Errorf("%q: unexpected error adding service: %v", tt.setting, err)
+			continue
+		}
+		cm, err := client.CoreV1().ConfigMaps(tt.namespace).Get(context.Background(), tt.name, metav1.GetOptions{})
+		if err != nil {
+			t.Errorf("%q: configmap %s/%s not written: %v", tt.setting, tt.namespace, tt.name, err)
+			continue
+		}
+		if !strings.Contains(cm.Data["config"], "10.0.0.1/32") {
+			t.Errorf("%q: address missing from configmap %s/%s: %v", tt.setting, tt.namespace, tt.name, cm.Data)
+		}
+	}
+}
+
+func TestReconcileServicesLoadBalancerClass(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		managed     bool
+	}{
+		{nil, true},
+		{map[string]string{annotationLoadBalancerClass: DefaultLoadBalancerClass}, true},
+		{map[string]string{annotationLoadBalancerClass: "example.com/other"}, false},
+		{map[string]string{annotationLoadBalancerClass: ""}, false},
+	}
+	for i, tt := range tests {
+		svc := testLoadBalancerService("default", "web", tt.annotations)
+		ips := &fakeProjectIPs{}
+		l, lb := testGetLoadBalancers(ips, svc)
+		if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		updated, _ := l.k8sclient.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+		if err := l.reconcileServices(context.Background(), []*v1.Service{updated}, ModeSync); err != nil {
+			t.Fatalf("%d: unexpected error on sync: %v", i, err)
+		}
+		switch {
+		case tt.managed && (len(ips.reservations) != 1 || len(lb.services) != 1 || updated.Spec.LoadBalancerIP == ""):
+			t.Errorf("%d: expected the service managed, reservations %v, load balancer %v, loadBalancerIP %q", i, ips.reservations, lb.services, updated.Spec.LoadBalancerIP)
+		case !tt.managed && (len(ips.requests) != 0 || len(lb.services) != 0 || updated.Spec.LoadBalancerIP != ""):
+			t.Errorf("%d: expected the service left alone, requests %v, load balancer %v, loadBalancerIP %q", i, ips.requests, lb.services, updated.Spec.LoadBalancerIP)
+		}
+	}
+}
+
+func TestReconcileServicesPartialFailure(t *testing.T) {
+	for _, mode := range []UpdateMode{ModeAdd, ModeSync} {
+		first := testLoadBalancerService("default", "first", nil)
+		// of a pool that has no reservation to draw
+		bad := testLoadBalancerService("default", "bad", map[string]string{annotationEIPPool: "empty"})
+		last := testLoadBalancerService("default", "last", nil)
+		ips := &fakeProjectIPs{}
+		l, lb := testGetLoadBalancers(ips, first, bad, last)
+		recorder := record.NewFakeRecorder(10)
+		l.recorder = recorder
+
+		current := func() []*v1.Service {
+			svcs := []*v1.Service{}
+			for _, s := range []*v1.Service{first, bad, last} {
+				updated, _ := l.k8sclient.CoreV1().Services(s.Namespace).Get(context.Background(), s.Name, metav1.GetOptions{})
+				svcs = append(svcs, updated)
+			}
+			return svcs
+		}
+
+		err := l.reconcileServices(context.Background(), current(), mode)
+		if err == nil || !strings.Contains(err.Error(), "service default/bad:") || strings.Contains(err.Error(), "default/first") || strings.Contains(err.Error(), "default/last") {
+			t.Errorf("%v: mismatched error %v, expected that of the bad service only", mode, err)
+		}
+		// the others still are reconciled
+		for _, svc := range []*v1.Service{first, last} {
+			if ipReservationByAllTags([]string{serviceTag(svc)}, ips.reservations) == nil {
+				t.Errorf("%v: no reservation for %s, reservations %v", mode, svc.Name, ips.reservations)
+			}
+			updated, _ := l.k8sclient.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+			if updated.Spec.LoadBalancerIP == "" {
+				t.Errorf("%v: no loadBalancerIP for %s", mode, svc.Name)
+			}
+		}
+		// a sync maps those that have their loadBalancerIP, and keeps them
+		if mode == ModeSync {
+			if err := l.reconcileServices(context.Background(), current(), mode); err == nil {
+				t.Errorf("%v: expected the error of the bad service again", mode)
+			}
+		}
+		if len(lb.services) != 2 || len(ips.removed) != 0 {
+			t.Errorf("%v: expected the 2 other services mapped, load balancer %v removed %v", mode, lb.services, ips.removed)
+		}
+		var failed int
+		for len(recorder.Events) > 0 {
+			if e := <-recorder.Events; strings.HasPrefix(e, v1.EventTypeWarning+" "+eventReasonSyncFailed+" ") {
+				failed++
+			}
+		}
+		if expected := map[UpdateMode]int{ModeAdd: 1, ModeSync: 2}[mode]; failed != expected {
+			t.Errorf("%v: expected %d %s events, had %d", mode, expected, eventReasonSyncFailed, failed)
+		}
+	}
+}
+
+func TestReconcileServicesSyncKeepsAddFailures(t *testing.T) {
+	first := testLoadBalancerService("default", "first", nil)
+	// of a pool that has no reservation to draw
+	bad := testLoadBalancerService("default", "bad", map[string]string{annotationEIPPool: "empty"})
+	ips := &fakeProjectIPs{}
+	l, _ := testGetLoadBalancers(ips, first, bad)
+	// every list after the reservation of the first service fails, thus the one after the services are added
+	listErr := errors.New("list failed")
+	ips.onRequest = func() {
+		ips.mu.Lock()
+		defer ips.mu.Unlock()
+		ips.listErr = listErr
+	}
+
+	err := l.reconcileServices(context.Background(), []*v1.Service{first, bad}, ModeSync)
+	if err == nil || !strings.Contains(err.Error(), "service default/bad:") || !strings.Contains(err.Error(), "unable to retrieve IP reservations") {
+		t.Errorf("mismatched error %v, expected that of the bad service and of the list", err)
+	}
+}
+
+func TestReconcileServicesExcludedNamespaces(t *testing.T) {
+	svc := testLoadBalancerService("tenant", "web", nil)
+	other := testLoadBalancerService("default", "web", nil)
+	ips := &fakeProjectIPs{}
+	l, lb := testGetLoadBalancers(ips, svc, other)
+	l.excludedNS = map[string]bool{"tenant": true}
+	// the services as the last pass left them, e.g. with their loadBalancerIP
+	current := func() []*v1.Service {
+		svcs := []*v1.Service{}
+		for _, s := range []*v1.Service{svc, other} {
+			updated, _ := l.k8sclient.CoreV1().Services(s.Namespace).Get(context.Background(), s.Name, metav1.GetOptions{})
+			svcs = append(svcs, updated)
+		}
+		return svcs
+	}
+
+	for _, mode := range []UpdateMode{ModeAdd, ModeSync} {
+		if err := l.reconcileServices(context.Background(), current(), mode); err != nil {
+			t.Fatalf("%v: unexpected error: %v", mode, err)
+		}
+		if len(ips.requests) != 1 || ipReservationByAllTags([]string{serviceTag(svc)}, ips.reservations) != nil {
+			t.Errorf("%v: expected a reservation only for the service not excluded, had %v", mode, ips.reservations)
+		}
+		if len(lb.services) != 1 {
+			t.Errorf("%v: expected only the service not excluded mapped, load balancer %v", mode, lb.services)
+		}
+	}
+	if ip := current()[0].Spec.LoadBalancerIP; ip != "" {
+		t.Errorf("expected no loadBalancerIP on the excluded service, had %q", ip)
+	}
+
+	// no longer excluded, so picked up on the next sync
+	l.excludedNS = map[string]bool{}
+	if err := l.reconcileServices(context.Background(), current(), ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.requests) != 2 || ipReservationByAllTags([]string{serviceTag(svc)}, ips.reservations) == nil || current()[0].Spec.LoadBalancerIP == "" {
+		t.Errorf("expected the service managed once not excluded, requests %d, reservations %v", len(ips.requests), ips.reservations)
+	}
+
+	// excluded again, so its reservation is released as for a service of another class
+	l.excludedNS = map[string]bool{"tenant": true}
+	if err := l.reconcileServices(context.Background(), current(), ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ipReservationByAllTags([]string{serviceTag(svc)}, ips.reservations) != nil || len(lb.services) != 1 {
+		t.Errorf("expected the reservation of the excluded service released, reservations %v, load balancer %v", ips.reservations, lb.services)
+	}
+}
+
+func TestReconcileServicesDisableLoadBalancer(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", map[string]string{annotationDisableLoadBalancer: "true"})
+	// the user manages its address, and its status
+	svc.Spec.LoadBalancerIP = "192.0.2.10"
+	svc.Status.LoadBalancer = v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "192.0.2.10"}}}
+	ips := &fakeProjectIPs{}
+	l, lb := testGetLoadBalancers(ips, svc)
+	current := func() *v1.Service {
+		updated, _ := l.k8sclient.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+		return updated
+	}
+
+	for _, mode := range []UpdateMode{ModeAdd, ModeSync} {
+		if err := l.reconcileServices(context.Background(), []*v1.Service{current()}, mode); err != nil {
+			t.Fatalf("%v: unexpected error: %v", mode, err)
+		}
+		if len(ips.requests) != 0 || len(lb.services) != 0 {
+			t.Errorf("%v: expected the opted out service left alone, requests %v load balancer %v", mode, ips.requests, lb.services)
+		}
+		if updated := current(); updated.Spec.LoadBalancerIP != "192.0.2.10" || !reflect.DeepEqual(updated.Status, svc.Status) {
+			t.Errorf("%v: opted out service changed, spec %v status %v", mode, updated.Spec, updated.Status)
+		}
+	}
+	status, err := l.EnsureLoadBalancer(context.Background(), "", current(), nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(*status, svc.Status.LoadBalancer) {
+		t.Errorf("mismatched status of the opted out service, actual %v expected %v", status, svc.Status.LoadBalancer)
+	}
+
+	// opted in again, so adopted on the next sync
+	updated := current()
+	delete(updated.Annotations, annotationDisableLoadBalancer)
+	updated.Spec.LoadBalancerIP = ""
+	if _, err := l.k8sclient.CoreV1().Services(svc.Namespace).Update(context.Background(), updated, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unable to update service: %v", err)
+	}
+	if err := l.reconcileServices(context.Background(), []*v1.Service{current()}, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.requests) != 1 || ipReservationByAllTags([]string{serviceTag(svc)}, ips.reservations) == nil || current().Spec.LoadBalancerIP == "" {
+		t.Errorf("expected the service managed once opted in, requests %d, reservations %v", len(ips.requests), ips.reservations)
+	}
+}
+
+func TestEnsureLoadBalancerUnmanaged(t *testing.T) {
+	status := v1.LoadBalancerStatus{Ingress: []v1.LoadBalancerIngress{{IP: "192.0.2.10"}}}
+	tests := []struct {
+		description string
+		namespace   string
+		annotations map[string]string
+	}{
+		{"other class", "default", map[string]string{annotationLoadBalancerClass: "example.com/other"}},
+		{"excluded namespace", "tenant", nil},
+		{"opted out", "default", map[string]string{annotationDisableLoadBalancer: "true"}},
+	}
+	for _, tt := range tests {
+		svc := testLoadBalancerService(tt.namespace, "web", tt.annotations)
+		svc.Status.LoadBalancer = status
+		// a reservation of the tag of the service is not reported, as another manages its address
+		ips := &fakeProjectIPs{reservations: []packngo.IPAddressReservation{
+			{IpAddressCommon: packngo.IpAddressCommon{ID: "web", Address: "147.75.1.1", CIDR: 32, Tags: []string{emTag, serviceTag(svc), clusterTag(testClusterID)}}},
+		}}
+		l, _ := testGetLoadBalancers(ips, svc)
+		l.excludedNS = map[string]bool{"tenant": true}
+		ensured, err := l.EnsureLoadBalancer(context.Background(), "", svc, nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.description, err)
+		}
+		if !reflect.DeepEqual(*ensured, status) {
+			t.Errorf("%s: mismatched status, actual %v expected %v", tt.description, ensured, status)
+		}
+	}
+}
+
+func TestReconcileServicesOptOutManaged(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", map[string]string{annotationEIPDualStack: "true"})
+	ips := &fakeProjectIPs{}
+	l, lb := testGetLoadBalancers(ips, svc)
+	ctx := context.Background()
+	if err := l.reconcileServices(ctx, []*v1.Service{svc}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.reservations) != 2 || len(lb.services) == 0 {
+		t.Fatalf("expected the service managed, reservations %v, load balancer %v", ips.reservations, lb.services)
+	}
+
+	// opted out once managed, it keeps both of its reservations, but they are no longer advertised
+	updated, _ := l.k8sclient.CoreV1().Services("default").Get(ctx, "web", metav1.GetOptions{})
+	updated.Annotations[annotationDisableLoadBalancer] = "true"
+	if _, err := l.k8sclient.CoreV1().Services("default").Update(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unable to update service: %v", err)
+	}
+	if err := l.reconcileServices(ctx, []*v1.Service{updated}, ModeSync); err != nil {
+		t.Fatalf("unexpected error on sync: %v", err)
+	}
+	if err := l.releaseOrphans(ctx); err != nil {
+		t.Fatalf("unexpected error on the orphan sweep: %v", err)
+	}
+	if len(ips.removed) != 0 || len(ips.reservations) != 2 {
+		t.Errorf("expected the reservations of the opted out service kept, removed %v", ips.removed)
+	}
+	if len(lb.services) != 0 {
+		t.Errorf("expected the opted out service no longer advertised, load balancer %v", lb.services)
+	}
+
+	// and they are released once it is deleted
+	if err := l.EnsureLoadBalancerDeleted(ctx, "", updated); err != nil {
+		t.Fatalf("unexpected error on delete: %v", err)
+	}
+	if len(ips.removed) != 2 {
+		t.Errorf("expected the reservations released on delete, removed %v", ips.removed)
+	}
+}
+
+func TestLoadBalancerDisabled(t *testing.T) {
+	tests := []struct {
+		annotations map[string]string
+		expected    bool
+	}{
+		{nil, false},
+		{map[string]string{annotationDisableLoadBalancer: "true"}, true},
+		{map[string]string{annotationDisableLoadBalancer: "false"}, false},
+		// an invalid annotation does not opt out
+		{map[string]string{annotationDisableLoadBalancer: "yes please"}, false},
+	}
+	for i, tt := range tests {
+		if disabled := loadBalancerDisabled(testLoadBalancerService("default", "web", tt.annotations)); disabled != tt.expected {
+			t.Errorf("%d: mismatched disabled, actual %t expected %t", i, disabled, tt.expected)
+		}
+	}
+}
+
+func TestEnsureLoadBalancerHostname(t *testing.T) {
+	tests := []struct {
+		description string
+		annotations map[string]string
+		hostname    string
+	}{
+		{"no annotation", nil, ""},
+		{"hostname", map[string]string{annotationEIPHostname: "web.example.com"}, "web.example.com"},
+		{"dual-stack", map[string]string{annotationEIPHostname: "web.example.com", annotationEIPDualStack: "true"}, "web.example.com"},
+		{"not a DNS name", map[string]string{annotationEIPHostname: "web_example.com"}, ""},
+	}
+	for _, tt := range tests {
+		svc := testLoadBalancerService("default", "web", tt.annotations)
+		ips := &fakeProjectIPs{}
+		l, _ := testGetLoadBalancers(ips, svc)
+		// the status is written by the reconciler too, so it must agree with that of EnsureLoadBalancer
+		l.writeSpecIP = false
+		if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.description, err)
+		}
+		existing, err := l.k8sclient.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("%s: unable to get service: %v", tt.description, err)
+		}
+		status, err := l.EnsureLoadBalancer(context.Background(), "", existing, nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.description, err)
+		}
+		if len(status.Ingress) == 0 || len(status.Ingress) != len(existing.Status.LoadBalancer.Ingress) {
+			t.Fatalf("%s: mismatched ingress, ensured %v written %v", tt.description, status.Ingress, existing.Status.LoadBalancer.Ingress)
+		}
+		for i, ingress := range status.Ingress {
+			switch {
+			case ingress.IP == "":
+				t.Errorf("%s: %d: ingress without address", tt.description, i)
+			case ingress.Hostname != tt.hostname:
+				t.Errorf("%s: %d: mismatched hostname, actual %q expected %q", tt.description, i, ingress.Hostname, tt.hostname)
+			case existing.Status.LoadBalancer.Ingress[i] != ingress:
+				t.Errorf("%s: %d: mismatched written ingress, actual %v expected %v", tt.description, i, existing.Status.LoadBalancer.Ingress[i], ingress)
+			}
+		}
+	}
+}
+
+func TestEnsureLoadBalancerDeleted(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", map[string]string{annotationEIPDualStack: "true"})
+	other := testLoadBalancerService("default", "other", nil)
+	ips := &fakeProjectIPs{}
+	l, _ := testGetLoadBalancers(ips, svc, other)
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc, other}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.reservations) != 3 {
+		t.Fatalf("expected 3 reservations, have %v", ips.reservations)
+	}
+	// without a load balancer implementation, e.g. the configmap is disabled, both families are released
+	l.implementor = nil
+	if err := l.EnsureLoadBalancerDeleted(context.Background(), "", svc); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.removed) != 2 || len(ips.reservations) != 1 || ipReservationByAllTags([]string{serviceTag(other)}, ips.reservations) == nil {
+		t.Errorf("expected only the reservations of the service removed, removed %v, remaining %v", ips.removed, ips.reservations)
+	}
+	// again, with nothing left to release
+	if err := l.EnsureLoadBalancerDeleted(context.Background(), "", svc); err != nil {
+		t.Errorf("unexpected error on second delete: %v", err)
+	}
+	if len(ips.removed) != 2 {
+		t.Errorf("second delete removed more, removed %v", ips.removed)
+	}
+}
+
+func TestEnsureLoadBalancerDeletedWithdraws(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", map[string]string{annotationEIPDualStack: "true"})
+	ips := &fakeProjectIPs{}
+	l, lb := testGetLoadBalancers(ips, svc)
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(lb.services) != 2 {
+		t.Fatalf("expected both families advertised, have %v", lb.services)
+	}
+	assigned, err := l.k8sclient.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unable to get service: %v", err)
+	}
+	if err := l.EnsureLoadBalancerDeleted(context.Background(), "", assigned); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(lb.services) != 0 || len(ips.reservations) != 0 {
+		t.Errorf("expected the service withdrawn and released, advertised %v, remaining %v", lb.services, ips.reservations)
+	}
+
+	// released before the remove, the reconciler still withdraws the address assigned to it
+	lb.services[hostCIDR(assigned.Spec.LoadBalancerIP)] = "default/web"
+	if err := l.reconcileServices(context.Background(), []*v1.Service{assigned}, ModeRemove); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(lb.services) != 0 {
+		t.Errorf("expected the assigned address withdrawn, advertised %v", lb.services)
+	}
+}
+
+func TestEnsureLoadBalancerDeletedAlreadyGone(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", nil)
+	ips := &fakeProjectIPs{}
+	l, _ := testGetLoadBalancers(ips, svc)
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// listed, but removed by the time it is deleted
+	ips.beforeRemove = func() {
+		ips.mu.Lock()
+		ips.reservations = nil
+		ips.mu.Unlock()
+	}
+	if err := l.EnsureLoadBalancerDeleted(context.Background(), "", svc); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestReconcileServicesDryRun(t *testing.T) {
+	cls := clusterTag(testClusterID)
+	web := testLoadBalancerService("default", "web", nil)
+	// has its reservation, but not yet its address, nor its label tags
+	labelled := testLoadBalancerService("default", "labelled", nil)
+	labelled.Labels = map[string]string{"team": "web"}
+	drop := testLoadBalancerService("default", "drop", nil)
+	drop.Spec.LoadBalancerIP = "147.75.1.2"
+	gone := testLoadBalancerService("default", "gone", nil)
+	reservation := func(id, addr string, svc *v1.Service) packngo.IPAddressReservation {
+		return packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{ID: id, Address: addr, CIDR: 32, Tags: []string{emTag, serviceTag(svc), cls}}}
+	}
+	ips := &fakeProjectIPs{
+		reservations: []packngo.IPAddressReservation{
+			reservation("labelled", "147.75.1.1", labelled),
+			reservation("drop", "147.75.1.2", drop),
+			reservation("gone", "147.75.1.3", gone),
+		},
+	}
+	l, _ := testGetLoadBalancers(ips, testNamespace("default", nil), web, labelled, drop)
+	l.labelTags = []string{"team"}
+	l.dryRun = true
+	sink := &recordingEventSink{}
+	l.events = sink
+	ctx := context.Background()
+
+	if err := l.reconcileServices(ctx, []*v1.Service{web, labelled}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error adding services: %v", err)
+	}
+	if err := l.reconcileServices(ctx, []*v1.Service{drop}, ModeRemove); err != nil {
+		t.Fatalf("unexpected error removing service: %v", err)
+	}
+	if err := l.reconcileServices(ctx, []*v1.Service{web, labelled}, ModeSync); err != nil {
+		t.Fatalf("unexpected error syncing services: %v", err)
+	}
+
+	if len(ips.requests) != 0 || len(ips.removed) != 0 {
+		t.Errorf("dry run changed reservations: requests %v, removed %v", ips.requests, ips.removed)
+	}
+	if tags := ips.reservations[0].Tags; len(tags) != 3 {
+		t.Errorf("dry run changed tags of %s: %v", ips.reservations[0].ID, tags)
+	}
+	for _, action := range l.k8sclient.(*fake.Clientset).Actions() {
+		if action.GetVerb() != "get" && action.GetVerb() != "list" {
+			t.Errorf("unexpected %s of %s in dry run", action.GetVerb(), action.GetResource().Resource)
+		}
+	}
+	if len(sink.events) != 0 {
+		t.Errorf("dry run published events %v", sink.events)
+	}
+}
+
+func TestReconcileServicesStatusOnly(t *testing.T) {
+	web := testLoadBalancerService("default", "web", nil)
+	ips := &fakeProjectIPs{}
+	l, lb := testGetLoadBalancers(ips, web)
+	l.writeSpecIP = false
+	ctx := context.Background()
+	current := func() *v1.Service {
+		svc, err := l.k8sclient.CoreV1().Services("default").Get(ctx, "web", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unable to get service: %v", err)
+		}
+		return svc
+	}
+
+	if err := l.reconcileServices(ctx, []*v1.Service{web}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	addr := ips.reservations[0].Address
+	svc := current()
+	if svc.Spec.LoadBalancerIP != "" {
+		t.Errorf("spec.loadBalancerIP written as %s", svc.Spec.LoadBalancerIP)
+	}
+	if len(svc.Status.LoadBalancer.Ingress) != 1 || svc.Status.LoadBalancer.Ingress[0].IP != addr {
+		t.Errorf("mismatched status ingress %v, expected %s", svc.Status.LoadBalancer.Ingress, addr)
+	}
+	if lb.services[addr+"/32"] != "default/web" {
+		t.Errorf("address %s not advertised, have %v", addr, lb.services)
+	}
+	for _, action := range l.k8sclient.(*fake.Clientset).Actions() {
+		if action.GetVerb() == "update" && action.GetSubresource() != "status" {
+			t.Errorf("unexpected update of the %s spec", action.GetResource().Resource)
+		}
+	}
+
+	// the address is found again from the status, rather than requested again, and kept by a sync
+	if err := l.reconcileServices(ctx, []*v1.Service{current()}, ModeSync); err != nil {
+		t.Fatalf("unexpected error on sync: %v", err)
+	}
+	if len(ips.requests) != 1 || len(ips.removed) != 0 {
+		t.Errorf("sync changed reservations: requests %d, removed %v", len(ips.requests), ips.removed)
+	}
+	if _, ok := lb.services[addr+"/32"]; !ok {
+		t.Errorf("address %s no longer advertised after sync, have %v", addr, lb.services)
+	}
+
+	// and released with the service
+	if err := l.reconcileServices(ctx, []*v1.Service{current()}, ModeRemove); err != nil {
+		t.Fatalf("unexpected error on remove: %v", err)
+	}
+	if len(ips.removed) != 1 || len(lb.services) != 0 {
+		t.Errorf("service not removed: removed %v, services %v", ips.removed, lb.services)
+	}
+}
+
+func TestGetLoadBalancer(t *testing.T) {
+	cls := clusterTag(testClusterID)
+	web := testLoadBalancerService("default", "web", nil)
+	dual := testLoadBalancerService("default", "dual", map[string]string{annotationEIPDualStack: "true"})
+	none := testLoadBalancerService("default", "none", nil)
+	ips := &fakeProjectIPs{
+		reservations: []packngo.IPAddressReservation{
+			{IpAddressCommon: packngo.IpAddressCommon{ID: "web", Address: "147.75.1.1", CIDR: 32, Tags: []string{emTag, serviceTag(web), cls}}},
+			{IpAddressCommon: packngo.IpAddressCommon{ID: "dual", Address: "147.75.1.2", CIDR: 32, Tags: []string{emTag, serviceTag(dual), cls, ipv4FamilyTag}}},
+			{IpAddressCommon: packngo.IpAddressCommon{ID: "dual6", Address: "2604:1380::1", CIDR: 128, Tags: []string{emTag, serviceTag(dual), cls, ipv6FamilyTag}}},
+		},
+	}
+	l, _ := testGetLoadBalancers(ips, web, dual, none)
+	ctx := context.Background()
+
+	tests := []struct {
+		svc    *v1.Service
+		exists bool
+		addrs  []string
+	}{
+		{web, true, []string{"147.75.1.1"}},
+		{dual, true, []string{"147.75.1.2", "2604:1380::1"}},
+		{none, false, nil},
+	}
+	for _, tt := range tests {
+		status, exists, err := l.GetLoadBalancer(ctx, "", tt.svc)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.svc.Name, err)
+		}
+		if exists != tt.exists {
+			t.Errorf("%s: mismatched exists, actual %t expected %t", tt.svc.Name, exists, tt.exists)
+		}
+		ensured, err := l.EnsureLoadBalancer(ctx, "", tt.svc, nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error on ensure: %v", tt.svc.Name, err)
+		}
+		for _, s := range []*v1.LoadBalancerStatus{status, ensured} {
+			addrs := []string{}
+			if s != nil {
+				for _, ingress := range s.Ingress {
+					addrs = append(addrs, ingress.IP)
+				}
+			}
+			if strings.Join(addrs, ",") != strings.Join(tt.addrs, ",") {
+				t.Errorf("%s: mismatched addresses, actual %v expected %v", tt.svc.Name, addrs, tt.addrs)
+			}
+		}
+		if ensured == nil {
+			t.Errorf("%s: ensure returned no status", tt.svc.Name)
+		}
+	}
+}
@@ -1,9 +1,23 @@
 package metal
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"sync"
+
+	"github.com/packethost/packngo"
 	"github.com/packethost/packngo/metadata"
 )
 
+// ErrNoMetadataFacility the metadata of the device has no facility, e.g. as what answered at the
+// metadata URL is not the metadata service of Equinix Metal
+var ErrNoMetadataFacility = errors.New("the metadata of this device has no facility")
+
+// ErrNoMetadataDevice the metadata of the device has no device ID, so its project cannot be found
+var ErrNoMetadataDevice = errors.New("the metadata of this device has no device ID")
+
 // GetAndParseMetadata retrieve metadata from a specific URL or Packet's standard
 func GetAndParseMetadata(u string) (*metadata.CurrentDevice, error) {
 	if u == "" {
@@ -11,3 +25,99 @@ func GetAndParseMetadata(u string) (*metadata.CurrentDevice, error) {
 	}
 	return metadata.GetMetadataFromURL(u)
 }
+
+// MetadataCache holds the metadata of the device the CCM runs on, from a specific URL or Packet's
+// standard, once it was retrieved; it changes rarely, if ever, so is retrieved again only on a
+// refresh. An error is not cached, so the next Get tries again.
+type MetadataCache struct {
+	url  string
+	lock sync.Mutex
+	md   *metadata.CurrentDevice
+}
+
+// NewMetadataCache get a cache of the metadata at the given URL, or at Packet's standard if ""
+func NewMetadataCache(u string) *MetadataCache {
+	return &MetadataCache{url: u}
+}
+
+// Get the metadata, retrieving it only if it was not yet
+func (m *MetadataCache) Get() (*metadata.CurrentDevice, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.md != nil {
+		return m.md, nil
+	}
+	return m.refresh()
+}
+
+// Refresh retrieve the metadata again, e.g. after the device moved; on an error, the metadata
+// retrieved before is kept
+func (m *MetadataCache) Refresh() (*metadata.CurrentDevice, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.refresh()
+}
+
+func (m *MetadataCache) refresh() (*metadata.CurrentDevice, error) {
+	md, err := GetAndParseMetadata(m.url)
+	if err != nil {
+		return nil, err
+	}
+	// an empty document parses to none at all
+	if md == nil {
+		md = &metadata.CurrentDevice{}
+	}
+	m.md = md
+	return md, nil
+}
+
+// Facility get the facility of the device from its metadata, or an error if it has none, rather
+// than an empty facility in which no reservation could be requested
+func (m *MetadataCache) Facility() (string, error) {
+	md, err := m.Get()
+	if err != nil {
+		return "", err
+	}
+	if md.Facility == "" {
+		return "", ErrNoMetadataFacility
+	}
+	return md.Facility, nil
+}
+
+// Project get the ID of the project of the device, which its metadata does not have, from its
+// device in the Equinix Metal API, with the auth token and base URL of the config
+func (m *MetadataCache) Project(config Config) (string, error) {
+	md, err := m.Get()
+	if err != nil {
+		return "", err
+	}
+	if md.ID == "" {
+		return "", ErrNoMetadataDevice
+	}
+	client, err := newMetalClient(context.Background(), config)
+	if err != nil {
+		return "", err
+	}
+	device, _, err := client.Devices.Get(md.ID, nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to get device %s: %v", md.ID, err)
+	}
+	project := deviceProjectID(device)
+	if project == "" {
+		return "", fmt.Errorf("device %s has no project", md.ID)
+	}
+	return project, nil
+}
+
+// deviceProjectID get the ID of the project of the device; the API may give only its href
+func deviceProjectID(device *packngo.Device) string {
+	switch {
+	case device.Project == nil:
+		return ""
+	case device.Project.ID != "":
+		return device.Project.ID
+	case device.Project.URL != "":
+		return path.Base(device.Project.URL)
+	}
+	return ""
+}
@@ -0,0 +1,45 @@
+package metal
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetadataCacheRefresh(t *testing.T) {
+	facility := "ewr1"
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		_, _ = w.Write([]byte(`{"id": "device", "facility": "` + facility + `"}`))
+	}))
+	defer ts.Close()
+	m := NewMetadataCache(ts.URL)
+
+	for i := 0; i < 2; i++ {
+		if f, err := m.Facility(); err != nil || f != "ewr1" {
+			t.Errorf("%d: mismatched facility %q, error %v", i, f, err)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 call before a refresh, had %d", calls)
+	}
+
+	// the device moved
+	facility = "da11"
+	if _, err := m.Refresh(); err != nil {
+		t.Fatalf("unexpected error on refresh: %v", err)
+	}
+	if f, err := m.Facility(); err != nil || f != "da11" {
+		t.Errorf("mismatched facility after refresh %q, error %v", f, err)
+	}
+
+	// a failed refresh keeps what it had
+	ts.Close()
+	if _, err := m.Refresh(); err == nil {
+		t.Errorf("expected an error refreshing from a closed server")
+	}
+	if f, err := m.Facility(); err != nil || f != "da11" {
+		t.Errorf("mismatched facility after failed refresh %q, error %v", f, err)
+	}
+}
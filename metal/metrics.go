@@ -0,0 +1,148 @@
+package metal
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const (
+	// MetricsGranularityAggregate metrics are labelled by kind of object and result only
+	MetricsGranularityAggregate = "aggregate"
+	// MetricsGranularityPerObject metrics also are labelled with the name of each object
+	MetricsGranularityPerObject = "per-object"
+
+	metricsSubsystem = "metal_ccm"
+
+	metricsResultSuccess = "success"
+	metricsResultError   = "error"
+)
+
+var (
+	// objectReconcileTotal the reconciles of single objects, always recorded
+	objectReconcileTotal = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "object_reconcile_total",
+			Help:           "Number of reconciles of single services and nodes, by resource, operation and result.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"resource", "operation", "result"},
+	)
+	// objectReconcileByNameTotal the same, by the name of the object; one series per object, so only
+	// recorded at per-object granularity
+	objectReconcileByNameTotal = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "object_reconcile_by_name_total",
+			Help:           "Number of reconciles of single services and nodes, by resource, name, operation and result.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"resource", "name", "operation", "result"},
+	)
+
+	// reconcileTotal the runs of the node and service reconcilers, whatever the number of objects
+	reconcileTotal = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "reconcile_total",
+			Help:           "Number of runs of the node and service reconcilers, by resource, mode and result.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"resource", "mode", "result"},
+	)
+	// packngoRequestDuration the duration of each call to the Equinix Metal API, each retry on its own
+	packngoRequestDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "packngo_request_duration_seconds",
+			Help:           "Duration of calls to the Equinix Metal API by the load balancer, by operation.",
+			Buckets:        metrics.DefBuckets,
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"operation"},
+	)
+	// eipReservations the reservations of the services of the cluster as of the last list of them
+	eipReservations = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "eip_reservations",
+			Help:           "Number of Elastic IP reservations for the services of the cluster, as of the last reconcile.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+	// rateLimitRemaining the requests to the Equinix Metal API remaining in its rate limit, as of the
+	// last response that had them
+	rateLimitRemaining = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "ratelimit_remaining",
+			Help:           "Number of requests to the Equinix Metal API remaining before it rate limits, as of the last response.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+	// rateLimitLimit the rate limit of the Equinix Metal API, as of the last response that had it
+	rateLimitLimit = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Subsystem:      metricsSubsystem,
+			Name:           "ratelimit_limit",
+			Help:           "Number of requests to the Equinix Metal API in its rate limit, as of the last response.",
+			StabilityLevel: metrics.ALPHA,
+		},
+	)
+
+	registerMetricsOnce sync.Once
+)
+
+// registerMetrics register the metrics with the registry that the controller manager serves
+func registerMetrics() {
+	registerMetricsOnce.Do(func() {
+		legacyregistry.MustRegister(objectReconcileTotal)
+		legacyregistry.MustRegister(objectReconcileByNameTotal)
+		legacyregistry.MustRegister(reconcileTotal)
+		legacyregistry.MustRegister(packngoRequestDuration)
+		legacyregistry.MustRegister(eipReservations)
+		legacyregistry.MustRegister(rateLimitRemaining)
+		legacyregistry.MustRegister(rateLimitLimit)
+	})
+}
+
+// reconcileMetrics records reconcile metrics at a granularity. Labelling by object name gives a
+// series for each service or node, which in a large cluster may be more than the metrics backend
+// can take, so it is opt-in.
+type reconcileMetrics struct {
+	perObject bool
+}
+
+func newReconcileMetrics(granularity string) reconcileMetrics {
+	return reconcileMetrics{perObject: granularity == MetricsGranularityPerObject}
+}
+
+// observe record the result of an operation on a single object
+func (m reconcileMetrics) observe(resource, name, operation string, ok bool) {
+	result := metricsResult(ok)
+	objectReconcileTotal.WithLabelValues(resource, operation, result).Inc()
+	if m.perObject {
+		objectReconcileByNameTotal.WithLabelValues(resource, name, operation, result).Inc()
+	}
+}
+
+// observeReconcile record a run of a reconciler, which failed if it returned an error
+func observeReconcile(resource string, mode UpdateMode, err error) {
+	reconcileTotal.WithLabelValues(resource, mode.String(), metricsResult(err == nil)).Inc()
+}
+
+// observePackngoRequest record the duration of a call to the API that started at start; deferred
+// at the start of the call, as in defer observePackngoRequest("list_ip_reservations", time.Now())
+func observePackngoRequest(operation string, start time.Time) {
+	packngoRequestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+func metricsResult(ok bool) string {
+	if ok {
+		return metricsResultSuccess
+	}
+	return metricsResultError
+}
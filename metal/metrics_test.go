@@ -0,0 +1,124 @@
+package metal
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func TestReconcileMetricsGranularity(t *testing.T) {
+	registerMetrics()
+	tests := []struct {
+		granularity string
+		byName      string
+	}{
+		{MetricsGranularityAggregate, ""},
+		{MetricsGranularityPerObject, `
+# HELP metal_ccm_object_reconcile_by_name_total [ALPHA] Number of reconciles of single services and nodes, by resource, name, operation and result.
+# TYPE metal_ccm_object_reconcile_by_name_total counter
+metal_ccm_object_reconcile_by_name_total{name="default/a",operation="add",resource="service",result="success"} 1
+metal_ccm_object_reconcile_by_name_total{name="default/b",operation="add",resource="service",result="success"} 1
+`},
+	}
+	for i, tt := range tests {
+		objectReconcileTotal.Reset()
+		objectReconcileByNameTotal.Reset()
+		a := testLoadBalancerService("default", "a", nil)
+		b := testLoadBalancerService("default", "b", nil)
+		l, _ := testGetLoadBalancers(&fakeProjectIPs{}, a, b)
+		l.metrics = newReconcileMetrics(tt.granularity)
+		if err := l.reconcileServices(context.Background(), []*v1.Service{a, b}, ModeAdd); err != nil {
+			t.Fatalf("%d: %s: unexpected error: %v", i, tt.granularity, err)
+		}
+		// the aggregate is there either way, without the names
+		expected := `
+# HELP metal_ccm_object_reconcile_total [ALPHA] Number of reconciles of single services and nodes, by resource, operation and result.
+# TYPE metal_ccm_object_reconcile_total counter
+metal_ccm_object_reconcile_total{operation="add",resource="service",result="success"} 2
+` + tt.byName
+		if err := testutil.GatherAndCompare(legacyregistry.DefaultGatherer, strings.NewReader(expected), "metal_ccm_object_reconcile_total", "metal_ccm_object_reconcile_by_name_total"); err != nil {
+			t.Errorf("%d: %s: mismatched metrics: %v", i, tt.granularity, err)
+		}
+	}
+}
+
+// testRequestCounts get the number of API calls recorded by operation
+func testRequestCounts(t *testing.T) map[string]uint64 {
+	families, err := legacyregistry.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatalf("unable to gather metrics: %v", err)
+	}
+	counts := map[string]uint64{}
+	for _, family := range families {
+		if family.GetName() != "metal_ccm_packngo_request_duration_seconds" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "operation" {
+					counts[label.GetValue()] = m.GetHistogram().GetSampleCount()
+				}
+			}
+		}
+	}
+	return counts
+}
+
+func TestReconcileMetrics(t *testing.T) {
+	registerMetrics()
+	reconcileTotal.Reset()
+	packngoRequestDuration.Reset()
+	a := testLoadBalancerService("default", "a", nil)
+	b := testLoadBalancerService("default", "b", nil)
+	ips := &fakeProjectIPs{}
+	l, _ := testGetLoadBalancers(ips, a, b)
+	ctx := context.Background()
+
+	if err := l.reconcileServices(ctx, []*v1.Service{a, b}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := l.reconcileNodes(ctx, []*v1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "node"}}}, ModeRemove); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := l.reconcileServices(ctx, []*v1.Service{a, b}, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// a failed list fails the whole reconcile, and leaves the count as last listed
+	ips.failures = []error{errors.New("unavailable")}
+	if err := l.reconcileServices(ctx, []*v1.Service{a, b}, ModeSync); err == nil {
+		t.Fatal("expected an error for a failed list")
+	}
+
+	expected := `
+# HELP metal_ccm_reconcile_total [ALPHA] Number of runs of the node and service reconcilers, by resource, mode and result.
+# TYPE metal_ccm_reconcile_total counter
+metal_ccm_reconcile_total{mode="add",resource="service",result="success"} 1
+metal_ccm_reconcile_total{mode="remove",resource="node",result="success"} 1
+metal_ccm_reconcile_total{mode="sync",resource="service",result="error"} 1
+metal_ccm_reconcile_total{mode="sync",resource="service",result="success"} 1
+`
+	if err := testutil.CollectAndCompare(reconcileTotal, strings.NewReader(expected), "metal_ccm_reconcile_total"); err != nil {
+		t.Errorf("mismatched reconcile metrics: %v", err)
+	}
+	expected = `
+# HELP metal_ccm_eip_reservations [ALPHA] Number of Elastic IP reservations for the services of the cluster, as of the last reconcile.
+# TYPE metal_ccm_eip_reservations gauge
+metal_ccm_eip_reservations 2
+`
+	if err := testutil.CollectAndCompare(eipReservations, strings.NewReader(expected), "metal_ccm_eip_reservations"); err != nil {
+		t.Errorf("mismatched reservation metrics: %v", err)
+	}
+
+	// each reservation is requested then listed to check for duplicates, besides the list at the
+	// start of each reconcile, and the one before the removals of the sync; failed calls count too
+	counts := testRequestCounts(t)
+	if counts["request_ip_reservation"] != 2 || counts["list_ip_reservations"] != 6 {
+		t.Errorf("mismatched API call counts %v", counts)
+	}
+}
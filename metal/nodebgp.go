@@ -0,0 +1,184 @@
+package metal
+
+import (
+	"encoding/base64"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers"
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+// bgpAnnotations the names of the node annotations that give its BGP settings. The bgp reconciler
+// sets them from the BGP neighbour of the device of the node, on every add and sync, so they are
+// not the user's to set; for the peers of the load balancer, the user sets those of the same names
+// with the override suffix instead, see overrideAnnotation, e.g. for a node whose device peers
+// elsewhere. The BGP timers are not set by the bgp reconciler, so are the user's as they are.
+type bgpAnnotations struct {
+	localASN  string
+	peerASNs  string
+	peerIPs   string
+	bgpPass   string
+	holdTime  string
+	keepalive string
+}
+
+// overrideAnnotationSuffix the suffix of the annotation that overrides a BGP setting of a node
+const overrideAnnotationSuffix = "-override"
+
+// overrideAnnotation get the name of the annotation that overrides the BGP setting of a node that
+// the given annotation has, e.g. metal.equinix.com/node-asn-override for metal.equinix.com/node-asn,
+// or none if the setting has no annotation
+func overrideAnnotation(name string) string {
+	if name == "" {
+		return ""
+	}
+	return name + overrideAnnotationSuffix
+}
+
+// selectedNodes get the nodes that match the BGP node selector, i.e. those that peer; without a
+// selector, that is every node. If BGP is withdrawn on cordon, a cordoned node does not peer.
+func (l *loadBalancers) selectedNodes(nodes []*v1.Node) []*v1.Node {
+	selected := []*v1.Node{}
+	for _, node := range nodes {
+		switch {
+		case !l.nodeSelector.Matches(labels.Set(node.Labels)):
+			klog.V(2).Infof("loadbalancers.reconcileNodes(): node %s does not match the BGP node selector %s, not peering", node.Name, l.nodeSelector)
+		case l.cordoned(node):
+			klog.V(2).Infof("loadbalancers.reconcileNodes(): node %s is cordoned, withdrawing its peers until it is not", node.Name)
+		default:
+			selected = append(selected, node)
+		}
+	}
+	return selected
+}
+
+// cordoned report if the peers of the node are to be withdrawn as it is cordoned, i.e.
+// unschedulable, or has the withdraw taint, e.g. for maintenance. It is false unless BGP is
+// withdrawn on cordon.
+func (l *loadBalancers) cordoned(node *v1.Node) bool {
+	if !l.withdrawOnCordon {
+		return false
+	}
+	if node.Spec.Unschedulable {
+		return true
+	}
+	if l.withdrawTaint == "" {
+		return false
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == l.withdrawTaint {
+			return true
+		}
+	}
+	return false
+}
+
+// bgpNode get the load balancer node for a node with the given BGP neighbour, with the overrides
+// of its annotations
+func (l *loadBalancers) bgpNode(node *v1.Node, peer *packngo.BGPNeighbor) loadbalancers.Node {
+	return l.nodeOverrides(node, loadbalancers.Node{
+		Name:     node.Name,
+		LocalASN: peer.CustomerAs,
+		PeerASN:  peer.PeerAs,
+		SourceIP: peer.CustomerIP,
+		Peers:    peer.PeerIps,
+		Password: peer.Md5Password,
+	})
+}
+
+// nodeOverrides apply the override annotations of a node, see overrideAnnotation, to its load
+// balancer node: its local ASN, peer ASN and peer IPs, its password, see peerPassword, and its BGP
+// timers, see bgpTimers. An annotation that does not parse is ignored, with an error.
+func (l *loadBalancers) nodeOverrides(node *v1.Node, n loadbalancers.Node) loadbalancers.Node {
+	annotation := func(name string) string {
+		if name == "" {
+			return ""
+		}
+		return node.Annotations[name]
+	}
+	localASN, peerIPs := overrideAnnotation(l.bgpAnnotations.localASN), overrideAnnotation(l.bgpAnnotations.peerIPs)
+	if v := annotation(localASN); v != "" {
+		if asn, err := strconv.Atoi(v); err == nil && asn > 0 {
+			n.LocalASN = asn
+		} else {
+			klog.Errorf("invalid %s annotation %q on node %s, must be an ASN, ignoring", localASN, v, node.Name)
+		}
+	}
+	if v := annotation(peerIPs); v != "" {
+		if peers, ok := parsePeerIPs(v); ok {
+			n.Peers = peers
+		} else {
+			klog.Errorf("invalid %s annotation %q on node %s, must be comma-separated IPs, ignoring", peerIPs, v, node.Name)
+		}
+	}
+	// a single ASN is that of every peer; several are those of each of the peers, in order. The bgp
+	// reconciler sets the annotation itself to the single ASN of the neighbour.
+	peerASNs := overrideAnnotation(l.bgpAnnotations.peerASNs)
+	if v := annotation(peerASNs); v != "" {
+		asns, ok := parsePeerASNs(v)
+		switch {
+		case !ok:
+			klog.Errorf("invalid %s annotation %q on node %s, must be comma-separated ASNs, ignoring", peerASNs, v, node.Name)
+		case len(asns) == 1:
+			n.PeerASN, n.PeerASNs = asns[0], nil
+		case len(asns) == len(n.Peers):
+			n.PeerASN, n.PeerASNs = asns[0], asns
+		default:
+			klog.Errorf("invalid %s annotation %q on node %s, must be one ASN, or one for each of its %d peers, ignoring", peerASNs, v, node.Name, len(n.Peers))
+		}
+	}
+	n.Password = l.peerPassword(node, n.Password)
+	n.HoldTime, n.KeepaliveTime = l.bgpTimers(node)
+	return n
+}
+
+// parsePeerASNs parse comma-separated ASNs, reporting false if any is not an ASN
+func parsePeerASNs(v string) ([]int, bool) {
+	asns := []int{}
+	for _, s := range strings.Split(v, ",") {
+		asn, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || asn <= 0 {
+			return nil, false
+		}
+		asns = append(asns, asn)
+	}
+	return asns, true
+}
+
+// parsePeerIPs parse comma-separated IPs, reporting false if any is not an IP
+func parsePeerIPs(v string) ([]string, bool) {
+	peers := []string{}
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if net.ParseIP(s) == nil {
+			return nil, false
+		}
+		peers = append(peers, s)
+	}
+	return peers, true
+}
+
+// peerPassword get the BGP password for the peers of a node: that of its override annotation, see
+// overrideAnnotation, base64 encoded as the bgp reconciler writes the annotation itself, else the
+// global BGP password, else the given one, e.g. that of its BGP neighbour. The annotation the bgp
+// reconciler writes is the password of the neighbour, so it does not count. An empty password is
+// none.
+func (l *loadBalancers) peerPassword(node *v1.Node, fallback string) string {
+	name := overrideAnnotation(l.bgpAnnotations.bgpPass)
+	if v := node.Annotations[name]; name != "" && v != "" {
+		pass, err := base64.StdEncoding.DecodeString(v)
+		if err == nil {
+			return string(pass)
+		}
+		klog.Errorf("invalid %s annotation on node %s, must be base64 encoded, ignoring: %v", name, node.Name, err)
+	}
+	if l.bgpPass != "" {
+		return l.bgpPass
+	}
+	return fallback
+}
@@ -0,0 +1,290 @@
+package metal
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers"
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers/metallb"
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func testBGPNode(name string, annotations map[string]string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Annotations: annotations},
+		Spec:       v1.NodeSpec{ProviderID: "equinixmetal://device-" + name},
+	}
+}
+
+func TestReconcileNodesMetros(t *testing.T) {
+	l, lb := testGetLoadBalancers(&fakeProjectIPs{})
+	l.client.Devices = &fakeDevices{neighbors: map[string][]packngo.BGPNeighbor{
+		"device-ny": {{AddressFamily: 4, CustomerAs: 65000, CustomerIP: "10.1.0.1", PeerAs: 65530, PeerIps: []string{"169.254.255.1", "169.254.255.2"}}},
+		"device-da": {
+			{AddressFamily: 6, CustomerAs: 65000, CustomerIP: "fc00::1", PeerAs: 65530, PeerIps: []string{"fc00::fe"}},
+			{AddressFamily: 4, CustomerAs: 65001, CustomerIP: "10.2.0.1", PeerAs: 65531, PeerIps: []string{"169.254.254.1"}},
+		},
+	}}
+	nodes := []*v1.Node{testBGPNode("ny", nil), testBGPNode("da", nil)}
+	expected := map[string]loadbalancers.Node{
+		"ny": {Name: "ny", LocalASN: 65000, PeerASN: 65530, SourceIP: "10.1.0.1", Peers: []string{"169.254.255.1", "169.254.255.2"}},
+		"da": {Name: "da", LocalASN: 65001, PeerASN: 65531, SourceIP: "10.2.0.1", Peers: []string{"169.254.254.1"}},
+	}
+	for _, mode := range []UpdateMode{ModeAdd, ModeSync} {
+		lb.nodes = map[string]loadbalancers.Node{}
+		if err := l.reconcileNodes(context.Background(), nodes, mode); err != nil {
+			t.Fatalf("%s: unexpected error: %v", mode, err)
+		}
+		if !reflect.DeepEqual(lb.nodes, expected) {
+			t.Errorf("%s: mismatched nodes, actual %#v expected %#v", mode, lb.nodes, expected)
+		}
+	}
+}
+
+func TestReconcileNodesSelector(t *testing.T) {
+	bgp := map[string]string{"bgp": "true"}
+	labelled := func(name string, nodeLabels map[string]string) *v1.Node {
+		node := testBGPNode(name, nil)
+		node.Labels = nodeLabels
+		return node
+	}
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "metallb-system"},
+		Data:       map[string]string{"config": ""},
+	}
+	neighbor := []packngo.BGPNeighbor{{AddressFamily: 4, CustomerAs: 65000, CustomerIP: "10.1.0.1", PeerAs: 65530, PeerIps: []string{"169.254.255.1"}}}
+	ctx := context.Background()
+
+	tests := []struct {
+		selector string
+		nodes    []*v1.Node
+		added    []string
+		synced   []string
+	}{
+		// no selector is every node
+		{"", []*v1.Node{labelled("a", bgp), labelled("b", nil)}, []string{"a", "b"}, []string{"a", "b"}},
+		// a node that stops matching is removed on the sync
+		{"bgp=true", []*v1.Node{labelled("a", bgp), labelled("b", nil), labelled("c", bgp)}, []string{"a", "c"}, []string{"a"}},
+	}
+	for i, tt := range tests {
+		l, _ := testGetLoadBalancers(&fakeProjectIPs{}, cm.DeepCopy())
+		l.nodeSelector, _ = labels.Parse(tt.selector)
+		impl := metallb.NewLB(l.k8sclient, "")
+		l.implementor = impl
+		l.client.Devices = &fakeDevices{neighbors: map[string][]packngo.BGPNeighbor{
+			"device-a": neighbor, "device-b": neighbor, "device-c": neighbor,
+		}}
+		peered := func() []string {
+			nodes, err := impl.Nodes(ctx)
+			if err != nil {
+				t.Fatalf("%d: unable to get nodes of the configmap: %v", i, err)
+			}
+			names := []string{}
+			for name := range nodes {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return names
+		}
+
+		if err := l.reconcileNodes(ctx, tt.nodes, ModeAdd); err != nil {
+			t.Fatalf("%d: unexpected error on add: %v", i, err)
+		}
+		if names := peered(); !reflect.DeepEqual(names, tt.added) {
+			t.Errorf("%d: mismatched nodes after add, actual %v expected %v", i, names, tt.added)
+		}
+		if tt.selector != "" {
+			tt.nodes[2].Labels = nil
+		}
+		if err := l.reconcileNodes(ctx, tt.nodes, ModeSync); err != nil {
+			t.Fatalf("%d: unexpected error on sync: %v", i, err)
+		}
+		if names := peered(); !reflect.DeepEqual(names, tt.synced) {
+			t.Errorf("%d: mismatched nodes after sync, actual %v expected %v", i, names, tt.synced)
+		}
+	}
+}
+
+func TestReconcileNodesWithdrawOnCordon(t *testing.T) {
+	const taint = "maintenance.example.com/bgp"
+	peered := func(lb *fakeLB) []string {
+		names := []string{}
+		for name := range lb.nodes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	tests := []struct {
+		description string
+		withdraw    bool
+		change      func(node *v1.Node)
+		expected    []string
+	}{
+		{"cordoned", true, func(node *v1.Node) { node.Spec.Unschedulable = true }, []string{"a"}},
+		{"tainted", true, func(node *v1.Node) { node.Spec.Taints = []v1.Taint{{Key: taint, Effect: v1.TaintEffectNoSchedule}} }, []string{"a"}},
+		{"other taint", true, func(node *v1.Node) { node.Spec.Taints = []v1.Taint{{Key: "other", Effect: v1.TaintEffectNoSchedule}} }, []string{"a", "b"}},
+		// off unless enabled
+		{"not enabled", false, func(node *v1.Node) { node.Spec.Unschedulable = true }, []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		l, lb := testGetLoadBalancers(&fakeProjectIPs{})
+		l.client.Devices = &fakeDevices{}
+		l.withdrawOnCordon, l.withdrawTaint = tt.withdraw, taint
+		a, b := testBGPNode("a", nil), testBGPNode("b", nil)
+		ctx := context.Background()
+
+		if err := l.reconcileNodes(ctx, []*v1.Node{a, b}, ModeSync); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.description, err)
+		}
+		if names := peered(lb); !reflect.DeepEqual(names, []string{"a", "b"}) {
+			t.Errorf("%s: mismatched nodes before cordon, actual %v", tt.description, names)
+		}
+
+		// cordoned, then uncordoned, over a few syncs
+		for cycle := 0; cycle < 2; cycle++ {
+			cordoned := b.DeepCopy()
+			tt.change(cordoned)
+			if err := l.reconcileNodes(ctx, []*v1.Node{a, cordoned}, ModeSync); err != nil {
+				t.Fatalf("%s: %d: unexpected error on cordon: %v", tt.description, cycle, err)
+			}
+			if names := peered(lb); !reflect.DeepEqual(names, tt.expected) {
+				t.Errorf("%s: %d: mismatched nodes after cordon, actual %v expected %v", tt.description, cycle, names, tt.expected)
+			}
+			if err := l.reconcileNodes(ctx, []*v1.Node{a, b}, ModeSync); err != nil {
+				t.Fatalf("%s: %d: unexpected error on uncordon: %v", tt.description, cycle, err)
+			}
+			if names := peered(lb); !reflect.DeepEqual(names, []string{"a", "b"}) {
+				t.Errorf("%s: %d: mismatched nodes after uncordon, actual %v", tt.description, cycle, names)
+			}
+		}
+	}
+
+	// a node that joins cordoned is not added
+	l, lb := testGetLoadBalancers(&fakeProjectIPs{})
+	l.client.Devices = &fakeDevices{}
+	l.withdrawOnCordon = true
+	joining := testBGPNode("c", nil)
+	joining.Spec.Unschedulable = true
+	if err := l.reconcileNodes(context.Background(), []*v1.Node{joining}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(lb.nodes) != 0 {
+		t.Errorf("cordoned node added, have %v", lb.nodes)
+	}
+}
+
+func TestReconcileNodesPeerASNs(t *testing.T) {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "metallb-system"},
+		Data:       map[string]string{"config": ""},
+	}
+	l, _ := testGetLoadBalancers(&fakeProjectIPs{}, cm)
+	l.bgpAnnotations = bgpAnnotations{localASN: DefaultAnnotationNodeASN, peerASNs: DefaultAnnotationPeerASNs, peerIPs: DefaultAnnotationPeerIPs}
+	impl := metallb.NewLB(l.k8sclient, "")
+	l.implementor = impl
+	l.client.Devices = &fakeDevices{}
+	nodes := []*v1.Node{
+		testBGPNode("single", map[string]string{overrideAnnotation(DefaultAnnotationNodeASN): "65100", overrideAnnotation(DefaultAnnotationPeerASNs): "65531"}),
+		testBGPNode("multi", map[string]string{overrideAnnotation(DefaultAnnotationPeerASNs): "65531, 65532"}),
+		testBGPNode("neighbour", nil),
+		// as the bgp reconciler sets it, from the neighbour, which does not override it
+		testBGPNode("reconciled", map[string]string{DefaultAnnotationPeerASNs: "65599"}),
+	}
+	// of the peers of the BGP neighbour of fakeDevices, 169.254.255.1 and 169.254.255.2
+	expected := map[string][][2]uint32{
+		"single":     {{65100, 65531}, {65100, 65531}},
+		"multi":      {{65000, 65531}, {65000, 65532}},
+		"neighbour":  {{65000, 65530}, {65000, 65530}},
+		"reconciled": {{65000, 65530}, {65000, 65530}},
+	}
+	ctx := context.Background()
+	for _, mode := range []UpdateMode{ModeAdd, ModeSync} {
+		if err := l.reconcileNodes(ctx, nodes, mode); err != nil {
+			t.Fatalf("%s: unexpected error: %v", mode, err)
+		}
+		saved, err := l.k8sclient.CoreV1().ConfigMaps("metallb-system").Get(ctx, "config", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("%s: unable to get configmap: %v", mode, err)
+		}
+		cfg, err := metallb.ParseConfig([]byte(saved.Data["config"]))
+		if err != nil {
+			t.Fatalf("%s: unable to parse config: %v", mode, err)
+		}
+		actual := map[string][][2]uint32{}
+		for _, p := range cfg.Peers {
+			name := p.NodeSelectors[0].MatchLabels["kubernetes.io/hostname"]
+			actual[name] = append(actual[name], [2]uint32{p.MyASN, p.ASN})
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: mismatched ASNs of the peers, actual %v expected %v", mode, actual, expected)
+		}
+	}
+
+	// the configured peers of their own ASNs are read back as such
+	configured, err := impl.Nodes(ctx)
+	if err != nil {
+		t.Fatalf("unable to get configured nodes: %v", err)
+	}
+	if asns := configured["multi"].PeerASNs; !reflect.DeepEqual(asns, []int{65531, 65532}) {
+		t.Errorf("mismatched configured peer ASNs of multi, actual %v", asns)
+	}
+	if asns := configured["single"].PeerASNs; asns != nil {
+		t.Errorf("unexpected configured peer ASNs of single %v", asns)
+	}
+}
+
+func TestNodeOverrides(t *testing.T) {
+	l, _ := testGetLoadBalancers(&fakeProjectIPs{})
+	l.bgpAnnotations = bgpAnnotations{
+		localASN: DefaultAnnotationNodeASN,
+		peerASNs: DefaultAnnotationPeerASNs,
+		peerIPs:  DefaultAnnotationPeerIPs,
+		bgpPass:  DefaultAnnotationBGPPass,
+	}
+	neighbour := loadbalancers.Node{Name: "a", LocalASN: 65000, PeerASN: 65530, SourceIP: "10.0.0.1", Peers: []string{"169.254.255.1"}}
+	tests := []struct {
+		description string
+		annotations map[string]string
+		expected    loadbalancers.Node
+	}{
+		{"none", nil, neighbour},
+		// as the bgp reconciler sets them, from the neighbour, so they are not overrides
+		{"of the bgp reconciler", map[string]string{
+			DefaultAnnotationNodeASN:  "65099",
+			DefaultAnnotationPeerASNs: "65599",
+			DefaultAnnotationPeerIPs:  "169.254.9.9",
+		}, neighbour},
+		{"all", map[string]string{
+			overrideAnnotation(DefaultAnnotationNodeASN):  "65100",
+			overrideAnnotation(DefaultAnnotationPeerASNs): "65531,65532",
+			overrideAnnotation(DefaultAnnotationPeerIPs):  "169.254.0.1, 169.254.0.2",
+		}, loadbalancers.Node{Name: "a", LocalASN: 65100, PeerASN: 65531, PeerASNs: []int{65531, 65532}, SourceIP: "10.0.0.1", Peers: []string{"169.254.0.1", "169.254.0.2"}}},
+		// one ASN is that of every peer
+		{"single peer ASN", map[string]string{
+			overrideAnnotation(DefaultAnnotationPeerASNs): "65531",
+			overrideAnnotation(DefaultAnnotationPeerIPs):  "169.254.0.1,169.254.0.2",
+		}, loadbalancers.Node{Name: "a", LocalASN: 65000, PeerASN: 65531, SourceIP: "10.0.0.1", Peers: []string{"169.254.0.1", "169.254.0.2"}}},
+		{"peer ASN of neighbour peers", map[string]string{overrideAnnotation(DefaultAnnotationPeerASNs): "65531"}, loadbalancers.Node{Name: "a", LocalASN: 65000, PeerASN: 65531, SourceIP: "10.0.0.1", Peers: []string{"169.254.255.1"}}},
+		// not one for each peer
+		{"mismatched peer ASNs", map[string]string{overrideAnnotation(DefaultAnnotationPeerASNs): "65531,65532"}, neighbour},
+		{"invalid peer ASN", map[string]string{overrideAnnotation(DefaultAnnotationPeerASNs): "65531,router"}, neighbour},
+		{"invalid", map[string]string{
+			overrideAnnotation(DefaultAnnotationNodeASN):  "node",
+			overrideAnnotation(DefaultAnnotationPeerASNs): "-1",
+			overrideAnnotation(DefaultAnnotationPeerIPs):  "169.254.0.1,router",
+		}, neighbour},
+	}
+	for i, tt := range tests {
+		n := neighbour
+		n.Peers = append([]string{}, neighbour.Peers...)
+		if actual := l.nodeOverrides(testBGPNode("a", tt.annotations), n); !reflect.DeepEqual(actual, tt.expected) {
+			t.Errorf("%d: %s: mismatched node, actual %#v expected %#v", i, tt.description, actual, tt.expected)
+		}
+	}
+}
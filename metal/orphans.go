@@ -0,0 +1,112 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// DefaultOrphanSweepInterval how often the reservations of services that no longer exist are
+// looked for and released, besides once on startup
+const DefaultOrphanSweepInterval = 10 * time.Minute
+
+// orphanedReservations get the reservations of this cluster of which no service of the given ones
+// holds the service tag, e.g. of a service deleted while the CCM was down. Those of a tag scheme
+// that is not known, which includes those without a service tag, or of a shared block, which the
+// sync releases address by address, are never orphans.
+func (l *loadBalancers) orphanedReservations(svcs []*v1.Service, ips []packngo.IPAddressReservation) []*packngo.IPAddressReservation {
+	validTags := map[string]bool{}
+	for _, svc := range svcs {
+		validTags[serviceTag(svc)] = true
+	}
+	orphans := []*packngo.IPAddressReservation{}
+	for _, ipr := range ipReservationsByAllTags([]string{emTag, clusterTag(l.clusterID)}, ips) {
+		if !knownTagScheme(ipr.Tags) || isSharedBlock(ipr) {
+			continue
+		}
+		var held bool
+		for _, tag := range ipr.Tags {
+			held = held || validTags[tag]
+		}
+		if !held {
+			orphans = append(orphans, ipr)
+		}
+	}
+	return orphans
+}
+
+// holdingServices get the services that hold the reservations of their service tag: every one of
+// type LoadBalancer, whether or not we manage it, see loadBalancerServices, as one of another
+// class or of an excluded namespace, or that opted out, keeps the reservations it had
+func holdingServices(svcs []*v1.Service) []*v1.Service {
+	holding := []*v1.Service{}
+	for _, svc := range svcs {
+		if svc.Spec.Type == v1.ServiceTypeLoadBalancer {
+			holding = append(holding, svc)
+		}
+	}
+	return holding
+}
+
+// releaseOrphans release the reservations of services that no longer exist, returning those of a
+// pool to it. The reservations are listed before the services, so that a reservation requested
+// for a service created in between is not taken for an orphan. The services that hold them are
+// those of holdingServices, not only those we manage.
+func (l *loadBalancers) releaseOrphans(ctx context.Context) error {
+	ips, err := l.listReservations(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to retrieve IP reservations for project %s: %w", l.project, err)
+	}
+	list, err := l.k8sclient.CoreV1().Services("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to list services: %w", err)
+	}
+	svcs := make([]*v1.Service, 0, len(list.Items))
+	for i := range list.Items {
+		svcs = append(svcs, &list.Items[i])
+	}
+	svcs = holdingServices(svcs)
+	// those of the legacy tags still are held
+	if ips, err = l.migrateServiceTags(ctx, svcs, ips); err != nil {
+		return err
+	}
+	for _, ipr := range l.orphanedReservations(svcs, ips) {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("release of orphaned reservations stopped, remaining deferred to next pass: %w", err)
+		}
+		klog.Infof("releasing orphaned IP reservation %s of %s with tags %v, its service no longer exists", ipr.ID, ipr.Address, ipr.Tags)
+		if isPoolReservation(ipr) {
+			err = l.returnToPool(ctx, "", ipr)
+		} else {
+			err = l.removeReservation(ctx, nil, ipr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// orphansLoop release orphaned reservations once on startup, and then every interval, unless it
+// is 0
+func orphansLoop(ctx context.Context, l *loadBalancers, interval, timeout time.Duration, errs reconcileErrorSink) {
+	for {
+		if err := runReconciler(ctx, timeout, l.releaseOrphans); err != nil {
+			klog.Errorf("failed to release orphaned reservations: %v", err)
+			errs.report("release orphaned reservations", err)
+		}
+		if interval == 0 {
+			return
+		}
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package metal
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestReleaseOrphans(t *testing.T) {
+	web := testLoadBalancerService("default", "web", nil)
+	api := testLoadBalancerService("default", "api", nil)
+	gone := testLoadBalancerService("default", "gone", nil)
+	// of a service that now is of another type, which no longer holds it
+	internal := testLoadBalancerService("default", "internal", nil)
+	internal.Spec.Type = v1.ServiceTypeClusterIP
+	// not managed, but still of type LoadBalancer, so each holds its reservation
+	other := testLoadBalancerService("default", "other", map[string]string{annotationLoadBalancerClass: "example.com/other"})
+	tenant := testLoadBalancerService("tenant", "web", nil)
+	disabled := testLoadBalancerService("default", "disabled", map[string]string{annotationDisableLoadBalancer: "true"})
+	reservation := func(id string, tags ...string) packngo.IPAddressReservation {
+		return packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{
+			ID:      id,
+			Address: "147.75.1." + id,
+			CIDR:    32,
+			Tags:    tags,
+		}}
+	}
+	clsTag := clusterTag(testClusterID)
+	ips := &fakeProjectIPs{reservations: []packngo.IPAddressReservation{
+		reservation("1", emTag, serviceTag(web), clsTag),
+		reservation("2", emTag, serviceTag(api), clsTag, ipv6FamilyTag),
+		reservation("3", emTag, serviceTag(gone), clsTag),
+		reservation("4", emTag, serviceTag(gone), clsTag, standbyTag),
+		reservation("5", emTag, serviceTag(internal), clsTag),
+		// of another cluster, retained, or of unknown tags, none of which are ours to release
+		reservation("6", emTag, serviceTag(gone), clusterTag("other")),
+		reservation("7", emRetainedTag, serviceTag(gone), clsTag),
+		reservation("8", emTag, serviceTag(gone), clsTag, "family=ipv5"),
+		// of a pool, which returns to it
+		reservation("9", emTag, serviceTag(gone), clsTag, poolTagPrefix+"gold"),
+		reservation("10", emTag, serviceTag(other), clsTag),
+		reservation("11", emTag, serviceTag(tenant), clsTag),
+		reservation("12", emTag, serviceTag(disabled), clsTag),
+	}}
+	l, _ := testGetLoadBalancers(ips, web, api, internal, other, tenant, disabled)
+	l.excludedNS = map[string]bool{"tenant": true}
+
+	if err := l.releaseOrphans(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	removed := append([]string{}, ips.removed...)
+	sort.Strings(removed)
+	if expected := []string{"3", "4", "5"}; strings.Join(removed, ",") != strings.Join(expected, ",") {
+		t.Errorf("mismatched removed, actual %v expected %v", removed, expected)
+	}
+	for _, ipr := range ips.reservations {
+		if ipr.ID != "9" {
+			continue
+		}
+		for _, tag := range ipr.Tags {
+			if strings.HasPrefix(tag, "service=") || tag == emTag {
+				t.Errorf("pool reservation not returned to its pool, has tags %v", ipr.Tags)
+			}
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// rejectUnowned report if the address of the service, e.g. set by the user, is not of a
+// reservation of the project, tagged or not, in which case it must not be mapped: the load
+// balancer would advertise an address that the project does not own. A reservation just created
+// may not be in the given list yet, so the reservations are listed afresh before rejecting. The
+// rejection is recorded as a warning event on the service.
+func (l *loadBalancers) rejectUnowned(ctx context.Context, svc *v1.Service, addr string, ips []packngo.IPAddressReservation) (bool, error) {
+	if ipReservationByAddress(addr, ips) != nil {
+		return false, nil
+	}
+	l.ipCache.invalidate(l.project)
+	current, err := l.listReservations(ctx)
+	if err != nil {
+		return false, fmt.Errorf("unable to retrieve IP reservations for project %s: %w", l.project, err)
+	}
+	if ipReservationByAddress(addr, current) != nil {
+		return false, nil
+	}
+	klog.Errorf("IP %s for service %s is not an Elastic IP of project %s, not mapping it", addr, serviceRep(svc), l.project)
+	l.serviceEvent(svc, v1.EventTypeWarning, eventReasonNotOwned, "spec.loadBalancerIP %s is not an Elastic IP of project %s, not mapping it; reserve it in the project, or remove it to have one assigned", addr, l.project)
+	return true, nil
+}
@@ -0,0 +1,74 @@
+package metal
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestReconcileServicesUnownedLoadBalancerIP(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", nil)
+	svc.Spec.LoadBalancerIP = "147.75.200.1"
+	reservation := func(tags ...string) []packngo.IPAddressReservation {
+		return []packngo.IPAddressReservation{{IpAddressCommon: packngo.IpAddressCommon{ID: "user", Address: "147.75.200.0", CIDR: 30, Tags: tags}}}
+	}
+	tests := []struct {
+		name         string
+		reservations []packngo.IPAddressReservation
+		owned        bool
+	}{
+		{"owned", reservation(emTag, serviceTag(svc), clusterTag(testClusterID)), true},
+		{"untagged", reservation(), true},
+		{"not owned", nil, false},
+	}
+	for _, tt := range tests {
+		ips := &fakeProjectIPs{reservations: tt.reservations}
+		l, lb := testGetLoadBalancers(ips, svc)
+		recorder := record.NewFakeRecorder(10)
+		l.recorder = recorder
+		if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if len(ips.requests) != 0 {
+			t.Errorf("%s: unexpected requests %v", tt.name, ips.requests)
+		}
+		if tt.owned {
+			if lb.services["147.75.200.1/32"] != "default/web" {
+				t.Errorf("%s: expected 147.75.200.1/32 advertised, have %v", tt.name, lb.services)
+			}
+			if len(recorder.Events) != 0 {
+				t.Errorf("%s: unexpected event %s", tt.name, <-recorder.Events)
+			}
+			continue
+		}
+		if len(lb.services) != 0 {
+			t.Errorf("%s: expected nothing advertised, have %v", tt.name, lb.services)
+		}
+		select {
+		case e := <-recorder.Events:
+			if !strings.HasPrefix(e, v1.EventTypeWarning+" "+eventReasonNotOwned+" ") || !strings.Contains(e, "147.75.200.1") {
+				t.Errorf("%s: mismatched event %s", tt.name, e)
+			}
+		default:
+			t.Errorf("%s: no event", tt.name)
+		}
+	}
+}
+
+func TestRejectUnownedListedLate(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", nil)
+	ips := &fakeProjectIPs{reservations: []packngo.IPAddressReservation{{IpAddressCommon: packngo.IpAddressCommon{ID: "new", Address: "147.75.200.1", CIDR: 32}}}}
+	l, _ := testGetLoadBalancers(ips, svc)
+	// not in the list given, e.g. as it was just created, but in a fresh one
+	rejected, err := l.rejectUnowned(context.Background(), svc, "147.75.200.1", nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rejected || ips.lists != 1 {
+		t.Errorf("mismatched rejected %t with %d lists, expected accepted with 1", rejected, ips.lists)
+	}
+}
@@ -0,0 +1,98 @@
+package metal
+
+import (
+	"sync"
+	"time"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// peerCache the BGP neighbour of each device, as last looked up, so that reconciles do not ask
+// the API again for every node every time. The peers of a device rarely change, but they may
+// when it is re-imaged or replaced; as the node then registers anew, with a new UID, an entry
+// is used only for the same node UID, as well as only until it expires. A TTL of 0 disables it,
+// but for last, which gets the peers last looked up whatever the TTL.
+type peerCache struct {
+	ttl     time.Duration
+	now     func() time.Time
+	lookup  func(providerID string) (*packngo.BGPNeighbor, error)
+	lock    sync.Mutex
+	entries map[string]peerCacheEntry
+}
+
+type peerCacheEntry struct {
+	peer    *packngo.BGPNeighbor
+	nodeUID types.UID
+	expires time.Time
+}
+
+func newPeerCache(ttl time.Duration, lookup func(providerID string) (*packngo.BGPNeighbor, error)) *peerCache {
+	return &peerCache{
+		ttl:     ttl,
+		now:     time.Now,
+		lookup:  lookup,
+		entries: map[string]peerCacheEntry{},
+	}
+}
+
+// get the BGP neighbour of the device of the node, from the cache if it still holds for the node
+func (c *peerCache) get(node *v1.Node) (*packngo.BGPNeighbor, error) {
+	id, err := deviceIDFromProviderID(node.Spec.ProviderID)
+	if err != nil {
+		return nil, err
+	}
+	now := c.now()
+	c.lock.Lock()
+	entry, ok := c.entries[id]
+	c.lock.Unlock()
+	switch {
+	case c.ttl <= 0:
+	case !ok:
+	case entry.nodeUID != node.UID:
+		klog.V(2).Infof("node %s for device %s has changed, looking up its peers again", node.Name, id)
+	case !now.Before(entry.expires):
+	default:
+		return entry.peer, nil
+	}
+
+	peer, err := c.lookup(node.Spec.ProviderID)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err != nil || peer == nil {
+		delete(c.entries, id)
+		return peer, err
+	}
+	c.entries[id] = peerCacheEntry{peer: peer, nodeUID: node.UID, expires: now.Add(c.ttl)}
+	return peer, nil
+}
+
+// last get the peers last looked up for the device of the node, if it is still the same node,
+// whether or not they have expired. Every reconcile looks them up, so they are as current as the
+// last one; they are for what only shows the peers, e.g. the desired config, not for a reconcile.
+func (c *peerCache) last(node *v1.Node) (*packngo.BGPNeighbor, bool) {
+	id, err := deviceIDFromProviderID(node.Spec.ProviderID)
+	if err != nil {
+		return nil, false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry, ok := c.entries[id]
+	if !ok || entry.nodeUID != node.UID {
+		return nil, false
+	}
+	return entry.peer, true
+}
+
+// invalidate forget the peers of the device of the node, e.g. when it is removed
+func (c *peerCache) invalidate(node *v1.Node) {
+	id, err := deviceIDFromProviderID(node.Spec.ProviderID)
+	if err != nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.entries, id)
+}
@@ -0,0 +1,114 @@
+package metal
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestPeerCache(t *testing.T) {
+	var (
+		lookups int
+		fail    bool
+	)
+	cache := newPeerCache(time.Minute, func(providerID string) (*packngo.BGPNeighbor, error) {
+		lookups++
+		if fail {
+			return nil, errors.New("unavailable")
+		}
+		return &packngo.BGPNeighbor{AddressFamily: 4, CustomerAs: 65000 + lookups, PeerIps: []string{"169.254.255.1"}}, nil
+	})
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	node := func(name, uid string) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, UID: types.UID(uid)},
+			Spec:       v1.NodeSpec{ProviderID: "equinixmetal://device-" + name},
+		}
+	}
+	get := func(step string, n *v1.Node, expectedLookups, expectedASN int) {
+		peer, err := cache.get(n)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", step, err)
+		}
+		if lookups != expectedLookups {
+			t.Errorf("%s: mismatched lookups, actual %d expected %d", step, lookups, expectedLookups)
+		}
+		if peer.CustomerAs != expectedASN {
+			t.Errorf("%s: mismatched peer, actual ASN %d expected %d", step, peer.CustomerAs, expectedASN)
+		}
+	}
+
+	// the first is looked up, the next are hits
+	get("first", node("a", "uid-1"), 1, 65001)
+	get("hit", node("a", "uid-1"), 1, 65001)
+	now = now.Add(59 * time.Second)
+	get("hit before expiry", node("a", "uid-1"), 1, 65001)
+
+	// another device is its own entry
+	get("other device", node("b", "uid-2"), 2, 65002)
+
+	// after the TTL it is looked up again
+	now = now.Add(2 * time.Second)
+	get("expired", node("a", "uid-1"), 3, 65003)
+	get("hit after refresh", node("a", "uid-1"), 3, 65003)
+
+	// the same device registered as a new node, e.g. re-imaged, is looked up again
+	get("device changed", node("a", "uid-3"), 4, 65004)
+	get("hit after change", node("a", "uid-3"), 4, 65004)
+
+	// and removal forgets it
+	cache.invalidate(node("a", "uid-3"))
+	get("invalidated", node("a", "uid-3"), 5, 65005)
+
+	// a failed lookup is not cached
+	now = now.Add(2 * time.Minute)
+	fail = true
+	if _, err := cache.get(node("a", "uid-3")); err == nil {
+		t.Error("expected an error from a failed lookup")
+	}
+	fail = false
+	get("after failure", node("a", "uid-3"), 7, 65007)
+}
+
+func TestPeerCacheDisabled(t *testing.T) {
+	var lookups int
+	cache := newPeerCache(0, func(providerID string) (*packngo.BGPNeighbor, error) {
+		lookups++
+		return &packngo.BGPNeighbor{AddressFamily: 4}, nil
+	})
+	n := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "a", UID: "uid-1"},
+		Spec:       v1.NodeSpec{ProviderID: "equinixmetal://device-a"},
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := cache.get(n); err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+	}
+	if lookups != 3 {
+		t.Errorf("mismatched lookups with the cache disabled, actual %d expected 3", lookups)
+	}
+
+	// the last peers are kept all the same, for the same node only
+	if peer, ok := cache.last(n); !ok || peer.AddressFamily != 4 {
+		t.Errorf("expected the last peers with the cache disabled, had %v", peer)
+	}
+	replaced := n.DeepCopy()
+	replaced.UID = "uid-2"
+	if _, ok := cache.last(replaced); ok {
+		t.Error("expected no last peers for a new node of the device")
+	}
+	cache.invalidate(n)
+	if _, ok := cache.last(n); ok {
+		t.Error("expected no last peers after invalidation")
+	}
+	if lookups != 3 {
+		t.Errorf("mismatched lookups for the last peers, actual %d expected 3", lookups)
+	}
+}
@@ -0,0 +1,99 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// reservationIDPattern the form of the ID of a reservation, a UUID
+var reservationIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// pinnedReservation get the reservation of the given ID, to which the service is pinned by its
+// annotation, e.g. one reserved in the portal, tagged for the service, so that it is kept, and
+// released, as one requested for it would be. Whatever tags it had of the CCM, e.g. of another
+// service, are replaced. An ID that is not a UUID, or a reservation that does not exist, is of
+// another project, is a shared block, or is not a single public address that is not of management,
+// as for adoptByAddress, is logged and recorded as an event on the service, and nil is returned,
+// so that the service is skipped until the annotation is fixed.
+func (l *loadBalancers) pinnedReservation(ctx context.Context, svc *v1.Service, id string) (*packngo.IPAddressReservation, error) {
+	svcName := serviceRep(svc)
+	var (
+		ipr *packngo.IPAddressReservation
+		err error
+	)
+	if reservationIDPattern.MatchString(id) {
+		if ipr, err = l.currentReservation(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+	var reason string
+	switch {
+	case !reservationIDPattern.MatchString(id):
+		reason = "is not a UUID"
+	case ipr == nil:
+		reason = "does not exist"
+	case path.Base(ipr.Project.Href) != l.project:
+		reason = fmt.Sprintf("is not of project %s", l.project)
+	case isSharedBlock(ipr):
+		reason = "is a shared block of other services"
+	case ipr.CIDR != 32:
+		reason = fmt.Sprintf("is a block of /%d rather than a single address", ipr.CIDR)
+	case ipr.Management:
+		reason = "is a management address"
+	case !ipr.Public:
+		reason = "is not public"
+	}
+	if reason != "" {
+		klog.Errorf("service %s is pinned to IP reservation %s, which %s, not mapping it", svcName, id, reason)
+		l.serviceEvent(svc, v1.EventTypeWarning, eventReasonEIPReservationInvalid, "%s %s %s, not mapping it; set the ID of a reservation of project %s, or remove the annotation", annotationEIPReservationID, id, reason, l.project)
+		return nil, nil
+	}
+	want := []string{emTag, serviceTag(svc), clusterTag(l.clusterID)}
+	if ipReservationByAllTags(want, []packngo.IPAddressReservation{*ipr}) != nil {
+		return ipr, nil
+	}
+	tags := []string{}
+	for _, tag := range ipr.Tags {
+		if strings.HasPrefix(tag, "usage=") || strings.HasPrefix(tag, "service=") || strings.HasPrefix(tag, "cluster=") {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	tags = append(tags, want...)
+	klog.V(2).Infof("adopting reservation %s of %s, to which %s is pinned, had tags %v", id, ipr.Address, svcName, ipr.Tags)
+	updated, _, err := l.updateTags(ctx, id, tags)
+	if err != nil {
+		return nil, fmt.Errorf("failed to tag reservation %s, to which %s is pinned: %v", id, svcName, err)
+	}
+	return updated, nil
+}
+
+// replaceWithPinned stop using the reservation the service held before it was pinned to another,
+// if any: the address it had no longer is advertised, and that reservation is released, or
+// returned to its pool, as the sync would once no service holds it. Returns the address of the
+// service to keep, which is "" if it is not that of the pinned reservation, so it is assigned.
+func (l *loadBalancers) replaceWithPinned(ctx context.Context, svc *v1.Service, svcIP string, held, pinned *packngo.IPAddressReservation, ips []packngo.IPAddressReservation) (string, error) {
+	svcName := serviceRep(svc)
+	if svcIP != "" && svcIP != pinned.Address {
+		klog.V(2).Infof("service %s is pinned to reservation %s, replacing address %s", svcName, pinned.ID, svcIP)
+		if err := l.unadvertise(ctx, svc, svcIP, ips); err != nil {
+			return svcIP, err
+		}
+		svcIP = ""
+	}
+	if held == nil || held.ID == pinned.ID {
+		return svcIP, nil
+	}
+	klog.V(2).Infof("service %s is pinned to reservation %s, releasing reservation %s it held", svcName, pinned.ID, held.ID)
+	if isPoolReservation(held) {
+		return svcIP, l.returnToPool(ctx, svcName, held)
+	}
+	return svcIP, l.removeReservation(ctx, svc, held)
+}
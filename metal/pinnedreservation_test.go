@@ -0,0 +1,132 @@
+package metal
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestAddServicePinnedReservation(t *testing.T) {
+	const (
+		pinnedAddress = "147.75.50.5"
+		pinnedID      = "5c5b8b1e-3f2a-4d6e-9a1b-2c3d4e5f6a7b"
+	)
+	pinned := func(project string, tags ...string) packngo.IPAddressReservation {
+		return packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{
+			ID:      pinnedID,
+			Address: pinnedAddress,
+			CIDR:    32,
+			Public:  true,
+			Project: packngo.Href{Href: "/metal/v1/projects/" + project},
+			Tags:    tags,
+		}}
+	}
+	held := packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{
+		ID:      "held",
+		Address: "147.75.100.1",
+		CIDR:    32,
+		Public:  true,
+	}}
+	// as adoptByAddress, only a single public address that is not of management
+	block, management, private := pinned(projectID), pinned(projectID), pinned(projectID)
+	block.CIDR = 29
+	management.Management = true
+	private.Public = false
+	tests := []struct {
+		description  string
+		reservations []packngo.IPAddressReservation
+		// held if the service held a reservation before it was pinned
+		held     bool
+		assigned string
+		removed  string
+		event    string
+		// id the annotation, if not pinnedID
+		id string
+	}{
+		{"untagged", []packngo.IPAddressReservation{pinned(projectID, "env=prod")}, false, pinnedAddress, "", "", ""},
+		{"of another service", []packngo.IPAddressReservation{pinned(projectID, emTag, "service=other", clusterTag("other-cluster"))}, false, pinnedAddress, "", "", ""},
+		{"replacing one held", []packngo.IPAddressReservation{pinned(projectID, "env=prod"), held}, true, pinnedAddress, "held", "", ""},
+		{"of another project", []packngo.IPAddressReservation{pinned("other-project", "env=prod")}, false, "", "", eventReasonEIPReservationInvalid, ""},
+		{"nonexistent", nil, false, "", "", eventReasonEIPReservationInvalid, ""},
+		{"block", []packngo.IPAddressReservation{block}, false, "", "", eventReasonEIPReservationInvalid, ""},
+		{"management", []packngo.IPAddressReservation{management}, false, "", "", eventReasonEIPReservationInvalid, ""},
+		{"private", []packngo.IPAddressReservation{private}, false, "", "", eventReasonEIPReservationInvalid, ""},
+		// not even looked up
+		{"not a UUID", []packngo.IPAddressReservation{pinned(projectID)}, false, "", "", eventReasonEIPReservationInvalid, "pinned"},
+	}
+	for _, tt := range tests {
+		id := pinnedID
+		if tt.id != "" {
+			id = tt.id
+		}
+		svc := testLoadBalancerService("default", "web", map[string]string{annotationEIPReservationID: id})
+		reservations := append([]packngo.IPAddressReservation{}, tt.reservations...)
+		if tt.held {
+			svc.Spec.LoadBalancerIP = held.Address
+			for i := range reservations {
+				if reservations[i].ID == held.ID {
+					reservations[i].Tags = []string{emTag, serviceTag(svc), clusterTag(testClusterID)}
+				}
+			}
+		}
+		ips := &fakeProjectIPs{reservations: reservations}
+		l, lb := testGetLoadBalancers(ips, svc)
+		recorder := record.NewFakeRecorder(10)
+		l.recorder = recorder
+
+		if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.description, err)
+		}
+		if len(ips.requests) != 0 {
+			t.Errorf("%s: requested a reservation, had requests %v", tt.description, ips.requests)
+		}
+		updated, _ := l.k8sclient.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+		expectedIP := tt.assigned
+		if expectedIP == "" {
+			expectedIP = svc.Spec.LoadBalancerIP
+		}
+		if updated.Spec.LoadBalancerIP != expectedIP {
+			t.Errorf("%s: mismatched loadBalancerIP, actual %q expected %q", tt.description, updated.Spec.LoadBalancerIP, expectedIP)
+		}
+		if strings.Join(ips.removed, ",") != tt.removed {
+			t.Errorf("%s: mismatched removed, actual %v expected %q", tt.description, ips.removed, tt.removed)
+		}
+		if tt.assigned != "" {
+			if lb.services[tt.assigned+"/32"] != "default/web" {
+				t.Errorf("%s: pinned address not mapped, load balancer %v", tt.description, lb.services)
+			}
+			if _, ok := lb.services[held.Address+"/32"]; ok {
+				t.Errorf("%s: address held before still mapped", tt.description)
+			}
+			// tagged for the service, and found by the tags from now on
+			want := []string{emTag, serviceTag(svc), clusterTag(testClusterID)}
+			if ipr := ipReservationByAllTags(want, ips.reservations); ipr == nil || ipr.ID != pinnedID {
+				t.Errorf("%s: pinned reservation not tagged for the service, reservations %v", tt.description, ips.reservations)
+			}
+			if ipReservationByAllTags([]string{"service=other"}, ips.reservations) != nil {
+				t.Errorf("%s: pinned reservation still tagged for another service", tt.description)
+			}
+		}
+		if tt.assigned == "" && len(lb.services) != 0 {
+			t.Errorf("%s: mapped an address, load balancer %v", tt.description, lb.services)
+		}
+		// the warnings only; an assignment, or a release, is recorded too
+		var warnings []string
+		for len(recorder.Events) > 0 {
+			if e := <-recorder.Events; strings.HasPrefix(e, v1.EventTypeWarning+" ") {
+				warnings = append(warnings, e)
+			}
+		}
+		switch {
+		case tt.event == "" && len(warnings) != 0:
+			t.Errorf("%s: unexpected warnings %v", tt.description, warnings)
+		case tt.event != "" && (len(warnings) != 1 || !strings.HasPrefix(warnings[0], v1.EventTypeWarning+" "+tt.event+" ")):
+			t.Errorf("%s: mismatched warnings %v, expected %s", tt.description, warnings, tt.event)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package metal
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	headerRateLimitLimit     = "X-RateLimit-Limit"
+	headerRateLimitRemaining = "X-RateLimit-Remaining"
+
+	// rateLimitWarnFraction the fraction of the rate limit below which the requests remaining are
+	// logged as a warning, before the API starts to answer with a 429
+	rateLimitWarnFraction = 0.1
+)
+
+// rateLimitTransport records the rate limit of the Equinix Metal API from the headers of each of its
+// responses, in the ratelimit metrics, and logs a warning once the requests remaining drop below
+// rateLimitWarnFraction of the limit. packngo parses these too, but only into the response it gives
+// the caller, which the CCM discards.
+type rateLimitTransport struct {
+	base http.RoundTripper
+
+	lock sync.Mutex
+	low  bool
+}
+
+func newRateLimitTransport(base http.RoundTripper) *rateLimitTransport {
+	return &rateLimitTransport{base: base}
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err == nil {
+		t.observe(resp.Header)
+	}
+	return resp, err
+}
+
+// observe record the rate limit of the headers of a response; one without them, e.g. of an error
+// page of a proxy, leaves the metrics as they were
+func (t *rateLimitTransport) observe(header http.Header) {
+	remaining, err := strconv.Atoi(header.Get(headerRateLimitRemaining))
+	if err != nil {
+		return
+	}
+	rateLimitRemaining.Set(float64(remaining))
+	limit, err := strconv.Atoi(header.Get(headerRateLimitLimit))
+	if err != nil || limit <= 0 {
+		return
+	}
+	rateLimitLimit.Set(float64(limit))
+
+	low := float64(remaining) < float64(limit)*rateLimitWarnFraction
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	// only when it crosses the threshold, rather than on every call below it
+	switch {
+	case low && !t.low:
+		klog.Warningf("Equinix Metal API rate limit nearly reached: %d of %d requests remaining", remaining, limit)
+	case !low && t.low:
+		klog.Infof("Equinix Metal API rate limit recovered: %d of %d requests remaining", remaining, limit)
+	}
+	t.low = low
+}
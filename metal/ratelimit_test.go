@@ -0,0 +1,67 @@
+package metal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"k8s.io/component-base/metrics/testutil"
+)
+
+func TestRateLimitTransport(t *testing.T) {
+	registerMetrics()
+	remaining := "4500"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if remaining != "" {
+			w.Header().Set(headerRateLimitLimit, "5000")
+			w.Header().Set(headerRateLimitRemaining, remaining)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	transport := newRateLimitTransport(http.DefaultTransport)
+	client := &http.Client{Transport: contextTransport{ctx: context.Background(), base: transport}}
+
+	tests := []struct {
+		remaining string
+		expected  int
+		low       bool
+	}{
+		{"4500", 4500, false},
+		{"400", 400, true},
+		{"300", 300, true},
+		// a response without the headers leaves the metrics as they were
+		{"", 300, true},
+		{"4999", 4999, false},
+	}
+	for i, tt := range tests {
+		remaining = tt.remaining
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", i, err)
+		}
+		resp.Body.Close()
+		expected := `
+# HELP metal_ccm_ratelimit_remaining [ALPHA] Number of requests to the Equinix Metal API remaining before it rate limits, as of the last response.
+# TYPE metal_ccm_ratelimit_remaining gauge
+metal_ccm_ratelimit_remaining ` + strconv.Itoa(tt.expected) + `
+`
+		if err := testutil.CollectAndCompare(rateLimitRemaining, strings.NewReader(expected), "metal_ccm_ratelimit_remaining"); err != nil {
+			t.Errorf("%d: mismatched remaining: %v", i, err)
+		}
+		if transport.low != tt.low {
+			t.Errorf("%d: mismatched low, actual %t expected %t", i, transport.low, tt.low)
+		}
+	}
+	expected := `
+# HELP metal_ccm_ratelimit_limit [ALPHA] Number of requests to the Equinix Metal API in its rate limit, as of the last response.
+# TYPE metal_ccm_ratelimit_limit gauge
+metal_ccm_ratelimit_limit 5000
+`
+	if err := testutil.CollectAndCompare(rateLimitLimit, strings.NewReader(expected), "metal_ccm_ratelimit_limit"); err != nil {
+		t.Errorf("mismatched limit: %v", err)
+	}
+}
@@ -0,0 +1,60 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// nodeReady report if the node has the condition Ready true
+func nodeReady(node *v1.Node) bool {
+	for _, c := range node.Status.Conditions {
+		if c.Type == v1.NodeReady {
+			return c.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// readyNodes count the nodes that are ready, match the BGP node selector and are not withdrawn as
+// cordoned, i.e. those that could peer and advertise
+func (l *loadBalancers) readyNodes(nodes []*v1.Node) int {
+	var count int
+	for _, node := range nodes {
+		if nodeReady(node) && l.nodeSelector.Matches(labels.Set(node.Labels)) && !l.cordoned(node) {
+			count++
+		}
+	}
+	return count
+}
+
+// holdWithoutReadyNodes report if changes are to be held because no node is ready to peer, e.g.
+// in the middle of replacing every node. Without any, removing the peers of the nodes that are
+// going leaves nothing to advertise the addresses already in use, and adding or syncing service
+// addresses has nothing to advertise them. It is false unless the hold is enabled.
+func (l *loadBalancers) holdWithoutReadyNodes(ctx context.Context) (bool, error) {
+	if !l.holdNoReadyNodes {
+		return false, nil
+	}
+	list, err := l.k8sclient.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return false, fmt.Errorf("unable to list nodes to find those ready: %v", err)
+	}
+	nodes := make([]*v1.Node, 0, len(list.Items))
+	for i := range list.Items {
+		nodes = append(nodes, &list.Items[i])
+	}
+	return l.readyNodes(nodes) == 0, nil
+}
+
+// nodeNames get the names of the nodes, for logging
+func nodeNames(nodes []*v1.Node) []string {
+	names := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		names = append(names, node.Name)
+	}
+	return names
+}
@@ -0,0 +1,119 @@
+package metal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers"
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func testReadyNode(name string, ready bool, nodeLabels map[string]string) *v1.Node {
+	status := v1.ConditionFalse
+	if ready {
+		status = v1.ConditionTrue
+	}
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: nodeLabels},
+		Spec:       v1.NodeSpec{ProviderID: "equinixmetal://device-" + name},
+		Status:     v1.NodeStatus{Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: status}}},
+	}
+}
+
+// testHoldLoadBalancers get a loadBalancers with the hold as given, the given objects in the
+// cluster, and node "a" already peered
+func testHoldLoadBalancers(hold bool, selector string, objects ...runtime.Object) (*loadBalancers, *fakeLB, *fakeProjectIPs) {
+	ips := &fakeProjectIPs{}
+	l, lb := testGetLoadBalancers(ips, objects...)
+	l.holdNoReadyNodes = hold
+	l.nodeSelector, _ = labels.Parse(selector)
+	l.peers = newPeerCache(0, func(providerID string) (*packngo.BGPNeighbor, error) {
+		return &packngo.BGPNeighbor{CustomerAs: 65000, PeerAs: 65530, PeerIps: []string{"169.254.255.1"}}, nil
+	})
+	lb.nodes["a"] = loadbalancers.Node{Name: "a", Peers: []string{"169.254.255.1"}}
+	return l, lb, ips
+}
+
+func TestReconcileNodesSyncWithoutReadyNodes(t *testing.T) {
+	tests := []struct {
+		name     string
+		hold     bool
+		selector string
+		nodes    []*v1.Node
+		expected []string
+	}{
+		{"no hold", false, "", []*v1.Node{testReadyNode("b", false, nil)}, []string{"b"}},
+		{"none ready", true, "", []*v1.Node{testReadyNode("b", false, nil)}, []string{"a"}},
+		{"no nodes", true, "", nil, []string{"a"}},
+		{"ready not selected", true, "bgp=true", []*v1.Node{testReadyNode("b", true, nil)}, []string{"a"}},
+		{"ready", true, "bgp=true", []*v1.Node{testReadyNode("b", true, map[string]string{"bgp": "true"})}, []string{"b"}},
+	}
+	for _, tt := range tests {
+		l, lb, _ := testHoldLoadBalancers(tt.hold, tt.selector)
+		if err := l.reconcileNodes(context.Background(), tt.nodes, ModeSync); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if len(lb.nodes) != len(tt.expected) {
+			t.Errorf("%s: mismatched peered nodes, actual %v expected %v", tt.name, lb.nodes, tt.expected)
+			continue
+		}
+		for _, name := range tt.expected {
+			if _, ok := lb.nodes[name]; !ok {
+				t.Errorf("%s: node %s not peered, have %v", tt.name, name, lb.nodes)
+			}
+		}
+	}
+}
+
+func TestReconcileNodesRemoveWithoutReadyNodes(t *testing.T) {
+	tests := []struct {
+		name      string
+		remaining []runtime.Object
+		kept      bool
+	}{
+		{"none remaining", nil, true},
+		{"none ready", []runtime.Object{testReadyNode("b", false, nil)}, true},
+		{"ready", []runtime.Object{testReadyNode("b", true, nil)}, false},
+	}
+	for _, tt := range tests {
+		l, lb, _ := testHoldLoadBalancers(true, "", tt.remaining...)
+		if err := l.reconcileNodes(context.Background(), []*v1.Node{testReadyNode("a", true, nil)}, ModeRemove); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if _, ok := lb.nodes["a"]; ok != tt.kept {
+			t.Errorf("%s: mismatched peer of removed node kept, actual %v expected %v", tt.name, ok, tt.kept)
+		}
+	}
+}
+
+func TestReconcileServicesWithoutReadyNodes(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", nil)
+	unready := testReadyNode("b", false, nil)
+	l, lb, ips := testHoldLoadBalancers(true, "", svc, unready)
+
+	// deferred while no node is ready
+	for _, mode := range []UpdateMode{ModeAdd, ModeSync} {
+		if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, mode); err != nil {
+			t.Fatalf("%v: unexpected error: %v", mode, err)
+		}
+		if len(ips.requests) != 0 || len(lb.services) != 0 {
+			t.Errorf("%v: expected no changes, had %d requests, advertised %v", mode, len(ips.requests), lb.services)
+		}
+	}
+
+	// and go ahead once one is
+	unready.Status.Conditions[0].Status = v1.ConditionTrue
+	if _, err := l.k8sclient.CoreV1().Nodes().UpdateStatus(context.Background(), unready, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("unable to update node: %v", err)
+	}
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.requests) != 1 || len(lb.services) != 1 {
+		t.Errorf("expected the service added, had %d requests, advertised %v", len(ips.requests), lb.services)
+	}
+}
@@ -0,0 +1,80 @@
+package metal
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/klog/v2"
+)
+
+const (
+	reconcileErrorsBufferSize = 100
+	reconcileErrorsTimeout    = 10 * time.Second
+	// reconcileErrorsQPS and reconcileErrorsBurst limit how many errors are sent, so that a cluster
+	// that fails every pass cannot flood the collector
+	reconcileErrorsQPS   = 1
+	reconcileErrorsBurst = 10
+)
+
+// reconcileError a single failed reconcile, as published to an external sink. Operation is
+// what failed, e.g. "sync services"; Message is the error.
+type reconcileError struct {
+	ClusterID string    `json:"clusterId"`
+	Operation string    `json:"operation"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// reconcileErrorSink receives reconcile errors. Implementations must not block.
+type reconcileErrorSink interface {
+	report(operation string, err error)
+}
+
+// newReconcileErrorSink get a sink for the given URL, which labels each error with the cluster ID;
+// if the URL is empty, errors are discarded
+func newReconcileErrorSink(url, clusterID string) reconcileErrorSink {
+	if url == "" {
+		return nopReconcileErrorSink{}
+	}
+	limiter := flowcontrol.NewTokenBucketRateLimiter(reconcileErrorsQPS, reconcileErrorsBurst)
+	return newWebhookReconcileErrorSink(url, clusterID, &http.Client{Timeout: reconcileErrorsTimeout}, reconcileErrorsBufferSize, limiter)
+}
+
+type nopReconcileErrorSink struct{}
+
+func (n nopReconcileErrorSink) report(operation string, err error) {}
+
+// webhookReconcileErrorSink POSTs each error as json to a URL, see webhookPoster, rate-limited;
+// if the limit is reached, the buffer is full, or the POST fails, the error is dropped. It is
+// logged by the caller regardless.
+type webhookReconcileErrorSink struct {
+	clusterID string
+	limiter   flowcontrol.RateLimiter
+	poster    *webhookPoster
+}
+
+func newWebhookReconcileErrorSink(url, clusterID string, client *http.Client, size int, limiter flowcontrol.RateLimiter) *webhookReconcileErrorSink {
+	return &webhookReconcileErrorSink{
+		clusterID: clusterID,
+		limiter:   limiter,
+		poster:    newWebhookPoster(url, client, size),
+	}
+}
+
+func (w *webhookReconcileErrorSink) report(operation string, err error) {
+	if !w.limiter.TryAccept() {
+		klog.V(2).Infof("reconcile errors rate limit reached, dropping %s error", operation)
+		return
+	}
+	e := reconcileError{
+		ClusterID: w.clusterID,
+		Operation: operation,
+		Message:   err.Error(),
+		Timestamp: time.Now().UTC(),
+	}
+	if !w.poster.post(fmt.Sprintf("%s reconcile error", operation), e) {
+		klog.Warningf("reconcile errors buffer full, dropping %s error", operation)
+	}
+}
@@ -0,0 +1,133 @@
+package metal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+// recordingErrorSink keeps every error it is given
+type recordingErrorSink struct {
+	mu     sync.Mutex
+	errors []reconcileError
+}
+
+func (r *recordingErrorSink) report(operation string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.errors = append(r.errors, reconcileError{Operation: operation, Message: err.Error()})
+}
+
+func (r *recordingErrorSink) reported() []reconcileError {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]reconcileError{}, r.errors...)
+}
+
+func TestNewReconcileErrorSink(t *testing.T) {
+	if _, ok := newReconcileErrorSink("", testClusterID).(nopReconcileErrorSink); !ok {
+		t.Errorf("empty URL did not give a no-op sink")
+	}
+	if _, ok := newReconcileErrorSink("http://localhost:1/errors", testClusterID).(*webhookReconcileErrorSink); !ok {
+		t.Errorf("URL did not give a webhook sink")
+	}
+}
+
+func TestWebhookReconcileErrorSink(t *testing.T) {
+	received := make(chan reconcileError, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e reconcileError
+		if r.Method != http.MethodPost {
+			t.Errorf("unexpected method %s", r.Method)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Errorf("could not decode error: %v", err)
+		}
+		received <- e
+	}))
+	defer ts.Close()
+
+	sink := newWebhookReconcileErrorSink(ts.URL, testClusterID, ts.Client(), 10, flowcontrol.NewFakeAlwaysRateLimiter())
+	sink.report("sync services", errors.New("failed to request an IP"))
+
+	select {
+	case e := <-received:
+		if e.ClusterID != testClusterID || e.Operation != "sync services" || e.Message != "failed to request an IP" {
+			t.Errorf("mismatched error received: %#v", e)
+		}
+		if e.Timestamp.IsZero() {
+			t.Errorf("error timestamp not set")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for error")
+	}
+}
+
+func TestWebhookReconcileErrorSinkLimits(t *testing.T) {
+	// no goroutine is draining this sink, so report must drop rather than block
+	sink := &webhookReconcileErrorSink{
+		limiter: flowcontrol.NewFakeAlwaysRateLimiter(),
+		poster:  &webhookPoster{posts: make(chan webhookPost, 1)},
+	}
+	done := make(chan struct{})
+	go func() {
+		sink.report("sync services", errors.New("first"))
+		sink.report("sync services", errors.New("second"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("report blocked on a full buffer")
+	}
+	if len(sink.poster.posts) != 1 {
+		t.Errorf("expected 1 buffered error, found %d", len(sink.poster.posts))
+	}
+
+	// errors over the rate are dropped before they are buffered
+	sink = &webhookReconcileErrorSink{
+		limiter: flowcontrol.NewFakeNeverRateLimiter(),
+		poster:  &webhookPoster{posts: make(chan webhookPost, 10)},
+	}
+	sink.report("sync nodes", errors.New("limited"))
+	if len(sink.poster.posts) != 0 {
+		t.Errorf("expected no buffered errors over the rate, found %d", len(sink.poster.posts))
+	}
+}
+
+func TestServicesWatcherReportsErrors(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	svc := testLoadBalancerService("default", "web", nil)
+	informer := informers.NewSharedInformerFactory(fake.NewSimpleClientset(svc), 0)
+	failing := func(ctx context.Context, svcs []*v1.Service, mode UpdateMode) error {
+		return errors.New("failed to request an IP")
+	}
+	sink := &recordingErrorSink{}
+	if err := startServicesWatcher(ctx, informer, []serviceReconciler{failing}, 0, 0, sink); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.reported()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	reported := sink.reported()
+	if len(reported) != 1 {
+		t.Fatalf("expected 1 reported error, found %d", len(reported))
+	}
+	if reported[0].Operation != "add service" || !strings.Contains(reported[0].Message, "default/web") || !strings.Contains(reported[0].Message, "failed to request an IP") {
+		t.Errorf("mismatched reported error: %#v", reported[0])
+	}
+}
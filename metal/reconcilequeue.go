@@ -0,0 +1,106 @@
+package metal
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/clock"
+)
+
+const (
+	// DefaultResyncPeriod how often all nodes and services are reconciled in a sync, besides on
+	// their events
+	DefaultResyncPeriod = 60 * time.Second
+	// DefaultReconcileMinInterval the shortest time between two reconciles of events; those that
+	// come in between are reconciled together in the next one
+	DefaultReconcileMinInterval = time.Second
+)
+
+// queuedEvent the latest event of an object, waiting to be reconciled
+type queuedEvent struct {
+	obj  interface{}
+	mode UpdateMode
+}
+
+// reconcileQueue coalesce the events of objects, e.g. of services, into as few reconciles as it
+// can: each object is reconciled once for its latest event, however many it had since the last
+// reconcile, and all of those pending are reconciled together, once for each mode. The first event
+// is reconciled straight away; while events keep coming, reconciles are no closer than minInterval.
+type reconcileQueue struct {
+	clock       clock.Clock
+	minInterval time.Duration
+	// reconcile the objects of the same mode, in the order of their keys
+	reconcile func(ctx context.Context, objs []interface{}, mode UpdateMode)
+	lock      sync.Mutex
+	pending   map[string]queuedEvent
+	wake      chan struct{}
+}
+
+func newReconcileQueue(clk clock.Clock, minInterval time.Duration, reconcile func(ctx context.Context, objs []interface{}, mode UpdateMode)) *reconcileQueue {
+	return &reconcileQueue{
+		clock:       clk,
+		minInterval: minInterval,
+		reconcile:   reconcile,
+		pending:     map[string]queuedEvent{},
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// add queue the event of the object by its key, replacing any of the same key not yet reconciled,
+// e.g. a removal replaces an add
+func (q *reconcileQueue) add(key string, obj interface{}, mode UpdateMode) {
+	q.lock.Lock()
+	q.pending[key] = queuedEvent{obj: obj, mode: mode}
+	q.lock.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run reconcile the events as they are queued, until ctx is done
+func (q *reconcileQueue) run(ctx context.Context) {
+	var last time.Time
+	for {
+		select {
+		case <-q.wake:
+		case <-ctx.Done():
+			return
+		}
+		if wait := q.minInterval - q.clock.Since(last); !last.IsZero() && wait > 0 {
+			select {
+			case <-q.clock.After(wait):
+			case <-ctx.Done():
+				return
+			}
+		}
+		q.lock.Lock()
+		pending := q.pending
+		q.pending = map[string]queuedEvent{}
+		q.lock.Unlock()
+		last = q.clock.Now()
+		q.flush(ctx, pending)
+	}
+}
+
+// flush reconcile the events, removals first, so that what they release can be used by the adds
+func (q *reconcileQueue) flush(ctx context.Context, pending map[string]queuedEvent) {
+	keys := make([]string, 0, len(pending))
+	for key := range pending {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, mode := range []UpdateMode{ModeRemove, ModeAdd} {
+		objs := []interface{}{}
+		for _, key := range keys {
+			if pending[key].mode == mode {
+				objs = append(objs, pending[key].obj)
+			}
+		}
+		if len(objs) > 0 {
+			q.reconcile(ctx, objs, mode)
+		}
+	}
+}
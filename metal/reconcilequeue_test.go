@@ -0,0 +1,209 @@
+package metal
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers"
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers/metallb"
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// queueCall a call to reconcile of a reconcileQueue
+type queueCall struct {
+	mode UpdateMode
+	objs string
+}
+
+// waitForWaiters wait until something waits on the fake clock
+func waitForWaiters(t *testing.T, clk *clock.FakeClock) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !clk.HasWaiters() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for a waiter on the clock")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReconcileQueueCoalesces(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	clk := clock.NewFakeClock(time.Now())
+	calls := make(chan queueCall, 10)
+	q := newReconcileQueue(clk, time.Second, func(ctx context.Context, objs []interface{}, mode UpdateMode) {
+		names := []string{}
+		for _, obj := range objs {
+			names = append(names, obj.(string))
+		}
+		calls <- queueCall{mode: mode, objs: strings.Join(names, ",")}
+	})
+	next := func(step string) queueCall {
+		select {
+		case call := <-calls:
+			return call
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: timed out waiting for reconcile", step)
+		}
+		return queueCall{}
+	}
+	none := func(step string) {
+		select {
+		case call := <-calls:
+			t.Errorf("%s: unexpected reconcile %v", step, call)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	// a burst before the queue runs: the latest event of each wins, removals go first
+	q.add("default/web", "web-1", ModeAdd)
+	q.add("default/web", "web-2", ModeAdd)
+	q.add("default/other", "other", ModeAdd)
+	q.add("default/gone", "gone", ModeAdd)
+	q.add("default/gone", "gone", ModeRemove)
+	go q.run(ctx)
+	if call := next("burst removals"); call.mode != ModeRemove || call.objs != "gone" {
+		t.Errorf("mismatched first reconcile %v", call)
+	}
+	if call := next("burst adds"); call.mode != ModeAdd || call.objs != "other,web-2" {
+		t.Errorf("mismatched second reconcile %v", call)
+	}
+	none("after burst")
+
+	// events right after wait for the interval, then go together
+	q.add("default/web", "web-3", ModeAdd)
+	q.add("default/new", "new", ModeAdd)
+	waitForWaiters(t, clk)
+	none("within interval")
+	clk.Step(time.Second)
+	if call := next("after interval"); call.mode != ModeAdd || call.objs != "new,web-3" {
+		t.Errorf("mismatched reconcile after interval %v", call)
+	}
+
+	// once the interval has passed, an event goes straight away
+	clk.Step(time.Second)
+	q.add("default/late", "late", ModeRemove)
+	if call := next("late"); call.mode != ModeRemove || call.objs != "late" {
+		t.Errorf("mismatched late reconcile %v", call)
+	}
+}
+
+func TestTimerLoopResync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	svc := testLoadBalancerService("default", "web", nil)
+	node := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-a"}}
+	informer := informers.NewSharedInformerFactory(fake.NewSimpleClientset(svc, node), 0)
+	informer.Core().V1().Services().Informer()
+	informer.Core().V1().Nodes().Informer()
+	informer.Start(ctx.Done())
+	informer.WaitForCacheSync(ctx.Done())
+
+	syncs := make(chan string, 10)
+	services := func(ctx context.Context, svcs []*v1.Service, mode UpdateMode) error {
+		if mode == ModeSync && len(svcs) == 1 {
+			syncs <- "services"
+		}
+		return nil
+	}
+	nodes := func(ctx context.Context, nodes []*v1.Node, mode UpdateMode) error {
+		if mode == ModeSync && len(nodes) == 1 {
+			syncs <- "nodes"
+		}
+		return nil
+	}
+	clk := clock.NewFakeClock(time.Now())
+	go timerLoop(ctx, clk, informer, []nodeReconciler{nodes}, []serviceReconciler{services}, time.Minute, 0, nopReconcileErrorSink{})
+
+	for pass := 0; pass < 2; pass++ {
+		waitForWaiters(t, clk)
+		clk.Step(time.Minute - time.Second)
+		select {
+		case s := <-syncs:
+			t.Fatalf("pass %d: sync of %s before the resync period", pass, s)
+		case <-time.After(50 * time.Millisecond):
+		}
+		clk.Step(time.Second)
+		for _, expected := range []string{"services", "nodes"} {
+			select {
+			case s := <-syncs:
+				if s != expected {
+					t.Errorf("pass %d: mismatched sync, actual %s expected %s", pass, s, expected)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("pass %d: timed out waiting for sync of %s", pass, expected)
+			}
+		}
+	}
+}
+
+func TestTimerLoopPrunesGhostPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "metallb-system"},
+		Data:       map[string]string{"config": ""},
+	}
+	l, _ := testGetLoadBalancers(&fakeProjectIPs{}, cm)
+	l.implementor = metallb.NewLB(l.k8sclient, "")
+	l.peers = newPeerCache(0, func(providerID string) (*packngo.BGPNeighbor, error) {
+		return &packngo.BGPNeighbor{CustomerAs: 65000, PeerAs: 65530, PeerIps: []string{"169.254.255.1"}}, nil
+	})
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-a"},
+		Spec:       v1.NodeSpec{ProviderID: "equinixmetal://device-a"},
+	}
+	// the ghost was peered, and then deleted with no event that reached the CCM
+	ghost := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "ghost"},
+		Spec:       v1.NodeSpec{ProviderID: "equinixmetal://device-ghost"},
+	}
+	if err := l.reconcileNodes(ctx, []*v1.Node{node, ghost}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	peered := func() map[string]bool {
+		nodes, err := l.implementor.(loadbalancers.NodeLister).Nodes(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		names := map[string]bool{}
+		for name := range nodes {
+			names[name] = true
+		}
+		return names
+	}
+	if names := peered(); !names["node-a"] || !names["ghost"] {
+		t.Fatalf("expected peers of node-a and ghost, had %v", names)
+	}
+
+	informer := informers.NewSharedInformerFactory(fake.NewSimpleClientset(node), 0)
+	informer.Core().V1().Services().Informer()
+	informer.Core().V1().Nodes().Informer()
+	informer.Start(ctx.Done())
+	informer.WaitForCacheSync(ctx.Done())
+	synced := make(chan struct{}, 1)
+	nodes := func(ctx context.Context, nodes []*v1.Node, mode UpdateMode) error {
+		defer func() { synced <- struct{}{} }()
+		return l.reconcileNodes(ctx, nodes, mode)
+	}
+	clk := clock.NewFakeClock(time.Now())
+	go timerLoop(ctx, clk, informer, []nodeReconciler{nodes}, nil, time.Minute, 0, nopReconcileErrorSink{})
+
+	waitForWaiters(t, clk)
+	clk.Step(time.Minute)
+	select {
+	case <-synced:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the sync of nodes")
+	}
+	if names := peered(); len(names) != 1 || !names["node-a"] {
+		t.Errorf("mismatched peers after the sync, actual %v expected only node-a", names)
+	}
+}
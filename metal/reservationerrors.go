@@ -0,0 +1,92 @@
+package metal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+var (
+	// ErrIPQuotaExceeded a request of an IP reservation failed as the project has no quota left
+	// for it; it succeeds only once the quota is raised, or reservations are released
+	ErrIPQuotaExceeded = errors.New("the project has no IP reservation quota left")
+	// ErrApprovalRequired a request of an IP reservation failed as it needs the approval of
+	// Equinix Metal support, and requests fail rather than wait for it
+	ErrApprovalRequired = errors.New("the IP reservation requires approval")
+)
+
+// reservationRequestError the error of a request of an IP reservation that the Equinix Metal API
+// rejected for a reason of its kind, e.g. no quota left, with the error of the API itself
+type reservationRequestError struct {
+	kind error
+	err  error
+}
+
+func (e *reservationRequestError) Error() string {
+	return fmt.Sprintf("%v: %v", e.kind, e.err)
+}
+
+// Is match the kind, so callers can tell it with errors.Is
+func (e *reservationRequestError) Is(target error) bool {
+	return target == e.kind
+}
+
+// Unwrap get the error of the API, e.g. for its response
+func (e *reservationRequestError) Unwrap() error {
+	return e.err
+}
+
+// mapReservationRequestError get the typed error for an error of the API from a request of an IP
+// reservation, if it rejected it for lack of quota or approval, else the error as it was. The API
+// tells these apart only in the messages of its errors, so they are matched on those.
+func mapReservationRequestError(err error) error {
+	perr, ok := err.(*packngo.ErrorResponse)
+	if !ok || perr.Response == nil {
+		return err
+	}
+	switch perr.Response.StatusCode {
+	case http.StatusForbidden, http.StatusUnprocessableEntity:
+	default:
+		return err
+	}
+	message := strings.ToLower(strings.Join(append(perr.Errors, perr.SingleError), " "))
+	switch {
+	case strings.Contains(message, "approval"):
+		return &reservationRequestError{kind: ErrApprovalRequired, err: err}
+	case strings.Contains(message, "quota"), strings.Contains(message, "limit"), strings.Contains(message, "maximum number"):
+		return &reservationRequestError{kind: ErrIPQuotaExceeded, err: err}
+	}
+	return err
+}
+
+// reservationRequestFailedReason get the reason of the event on a service for the failed request
+// of its IP reservation, so that lack of quota or approval shows as such
+func reservationRequestFailedReason(err error) string {
+	switch {
+	case errors.Is(err, ErrIPQuotaExceeded):
+		return eventReasonEIPQuotaExceeded
+	case errors.Is(err, ErrApprovalRequired):
+		return eventReasonEIPApprovalRequired
+	}
+	return eventReasonEIPRequestFailed
+}
+
+// failOnApprovalRequired report if the request of a reservation for the service should fail when it
+// needs approval, rather than wait for it. The annotation on the service takes precedence over the
+// default of the config; a request that waits leaves the service pending, with a reservation that
+// has no address yet, which hasAddress records and a later reconcile checks again.
+func (l *loadBalancers) failOnApprovalRequired(svc *v1.Service) bool {
+	if v, ok := svc.Annotations[annotationEIPWaitForApproval]; ok {
+		if wait, err := strconv.ParseBool(v); err == nil {
+			return !wait
+		}
+		klog.Errorf("service %s has invalid annotation %s, must be a boolean, was %s", serviceRep(svc), annotationEIPWaitForApproval, v)
+	}
+	return !l.waitForApproval
+}
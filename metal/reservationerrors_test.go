@@ -0,0 +1,169 @@
+package metal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// testRequestError get an error of the API for a request of an IP reservation, with the given body
+func testRequestError(status int, errs []string, single string) *packngo.ErrorResponse {
+	return &packngo.ErrorResponse{
+		Response: &http.Response{
+			StatusCode: status,
+			Request:    &http.Request{Method: http.MethodPost, URL: &url.URL{Path: "/projects/" + projectID + "/ips"}},
+		},
+		Errors:      errs,
+		SingleError: single,
+	}
+}
+
+func TestMapReservationRequestError(t *testing.T) {
+	tests := []struct {
+		description string
+		err         error
+		expected    error
+	}{
+		{"quota", testRequestError(http.StatusUnprocessableEntity, []string{"You have exceeded your IP quota of 4 /32 addresses"}, ""), ErrIPQuotaExceeded},
+		{"limit", testRequestError(http.StatusForbidden, nil, "Project IP reservation limit reached"), ErrIPQuotaExceeded},
+		{"maximum", testRequestError(http.StatusUnprocessableEntity, []string{"Maximum number of IP reservations for this project has been reached"}, ""), ErrIPQuotaExceeded},
+		{"approval", testRequestError(http.StatusUnprocessableEntity, []string{"This request requires approval, and fail_on_approval_required is set"}, ""), ErrApprovalRequired},
+		// any other rejection is left as it is
+		{"other rejection", testRequestError(http.StatusUnprocessableEntity, []string{"Facility is not valid"}, ""), nil},
+		{"other status", testRequestError(http.StatusInternalServerError, nil, "quota service unavailable"), nil},
+		{"not of the API", errors.New("quota exceeded"), nil},
+	}
+	for _, tt := range tests {
+		err := mapReservationRequestError(tt.err)
+		for _, kind := range []error{ErrIPQuotaExceeded, ErrApprovalRequired} {
+			if is := errors.Is(err, kind); is != (kind == tt.expected) {
+				t.Errorf("%s: errors.Is(%v, %v) is %t", tt.description, err, kind, is)
+			}
+		}
+		if tt.expected == nil && err != tt.err {
+			t.Errorf("%s: mismatched error, actual %v expected %v", tt.description, err, tt.err)
+		}
+		// the API error still is there, e.g. for its response
+		var perr *packngo.ErrorResponse
+		if tt.expected != nil && (!errors.As(err, &perr) || perr != tt.err) {
+			t.Errorf("%s: API error lost from %v", tt.description, err)
+		}
+	}
+}
+
+func TestReconcileServicesReservationRequestErrors(t *testing.T) {
+	tests := []struct {
+		description string
+		err         error
+		kind        error
+		reason      string
+	}{
+		{"quota", testRequestError(http.StatusUnprocessableEntity, []string{"You have exceeded your IP quota"}, ""), ErrIPQuotaExceeded, eventReasonEIPQuotaExceeded},
+		{"approval", testRequestError(http.StatusUnprocessableEntity, []string{"This request requires approval"}, ""), ErrApprovalRequired, eventReasonEIPApprovalRequired},
+	}
+	for _, tt := range tests {
+		svc := testLoadBalancerService("default", "web", nil)
+		// the list of the reconcile succeeds, the request then fails
+		ips := &fakeProjectIPs{failures: []error{nil, tt.err}}
+		l, _ := testGetLoadBalancers(ips, svc)
+		recorder := record.NewFakeRecorder(10)
+		l.recorder = recorder
+
+		err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd)
+		if !errors.Is(err, tt.kind) {
+			t.Errorf("%s: mismatched error, actual %v expected %v", tt.description, err, tt.kind)
+		}
+		select {
+		case e := <-recorder.Events:
+			if !strings.HasPrefix(e, v1.EventTypeWarning+" "+tt.reason+" ") {
+				t.Errorf("%s: mismatched event %s", tt.description, e)
+			}
+		default:
+			t.Errorf("%s: no event", tt.description)
+		}
+	}
+}
+
+func TestFailOnApprovalRequired(t *testing.T) {
+	tests := []struct {
+		annotation string
+		wait       bool
+		expected   bool
+	}{
+		{"", false, true},
+		{"", true, false},
+		{"true", false, false},
+		{"false", true, true},
+		// an invalid annotation is left to the config
+		{"maybe", true, false},
+		{"maybe", false, true},
+	}
+	for i, tt := range tests {
+		var annotations map[string]string
+		if tt.annotation != "" {
+			annotations = map[string]string{annotationEIPWaitForApproval: tt.annotation}
+		}
+		svc := testLoadBalancerService("default", "web", annotations)
+		l := &loadBalancers{waitForApproval: tt.wait}
+		if fail := l.failOnApprovalRequired(svc); fail != tt.expected {
+			t.Errorf("%d: mismatched fail on approval required, actual %t expected %t", i, fail, tt.expected)
+		}
+	}
+}
+
+func TestReconcileServicesWaitForApproval(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", map[string]string{annotationEIPWaitForApproval: "true"})
+	// a request awaiting approval has no address until it is approved
+	ips := &fakeProjectIPs{withholdAddress: true}
+	l, lb := testGetLoadBalancers(ips, svc)
+
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.requests) != 1 || ips.requests[0].FailOnApprovalRequired {
+		t.Fatalf("expected 1 request that waits for approval, had %v", ips.requests)
+	}
+	if len(lb.services) != 0 {
+		t.Errorf("mapped a reservation awaiting approval: %v", lb.services)
+	}
+
+	// still awaiting approval: neither another request, nor the release of the pending one
+	updated, _ := l.k8sclient.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+	if err := l.reconcileServices(context.Background(), []*v1.Service{updated}, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.requests) != 1 || len(ips.removed) != 0 || len(lb.services) != 0 {
+		t.Errorf("mismatched pass while pending, requests %v removed %v load balancer %v", ips.requests, ips.removed, lb.services)
+	}
+
+	// approved
+	ips.reservations[0].Address = "147.75.100.1"
+	if err := l.reconcileServices(context.Background(), []*v1.Service{updated}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.requests) != 1 {
+		t.Errorf("requested another reservation, had %d requests", len(ips.requests))
+	}
+	if lb.services["147.75.100.1/32"] != "default/web" {
+		t.Errorf("address not mapped once approved, load balancer %v", lb.services)
+	}
+	updated, _ = l.k8sclient.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+	if updated.Spec.LoadBalancerIP != "147.75.100.1" {
+		t.Errorf("mismatched loadBalancerIP, actual %q expected 147.75.100.1", updated.Spec.LoadBalancerIP)
+	}
+	// and the sync keeps it
+	if err := l.reconcileServices(context.Background(), []*v1.Service{updated}, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.removed) != 0 || lb.services["147.75.100.1/32"] != "default/web" {
+		t.Errorf("sync dropped the approved address, removed %v load balancer %v", ips.removed, lb.services)
+	}
+}
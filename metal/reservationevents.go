@@ -0,0 +1,67 @@
+package metal
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	reservationEventCreated    = "created"
+	reservationEventDeleted    = "deleted"
+	reservationEventRetained   = "retained"
+	reservationEventReassigned = "reassigned"
+	reservationEventRejected   = "rejected"
+	reservationEventReturned   = "returned"
+
+	reservationEventsBufferSize = 100
+	reservationEventsTimeout    = 10 * time.Second
+)
+
+// reservationEvent a single operation on an IP reservation, as published to an
+// external sink. Service is "<namespace>/<name>", empty for the control plane EIP.
+type reservationEvent struct {
+	Type          string    `json:"type"`
+	Service       string    `json:"service,omitempty"`
+	ReservationID string    `json:"reservationId"`
+	Address       string    `json:"address"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// reservationEventSink receives reservation events. Implementations must not block.
+type reservationEventSink interface {
+	emit(e reservationEvent)
+}
+
+// newReservationEventSink get a sink for the given URL; if the URL is empty, events are discarded
+func newReservationEventSink(url string) reservationEventSink {
+	if url == "" {
+		return nopReservationEventSink{}
+	}
+	return newWebhookReservationEventSink(url, &http.Client{Timeout: reservationEventsTimeout}, reservationEventsBufferSize)
+}
+
+type nopReservationEventSink struct{}
+
+func (n nopReservationEventSink) emit(e reservationEvent) {}
+
+// webhookReservationEventSink POSTs each event as json to a URL, see webhookPoster; if the
+// buffer is full, or the POST fails, the event is dropped and logged.
+type webhookReservationEventSink struct {
+	poster *webhookPoster
+}
+
+func newWebhookReservationEventSink(url string, client *http.Client, size int) *webhookReservationEventSink {
+	return &webhookReservationEventSink{poster: newWebhookPoster(url, client, size)}
+}
+
+func (w *webhookReservationEventSink) emit(e reservationEvent) {
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now().UTC()
+	}
+	if !w.poster.post(fmt.Sprintf("%s event for reservation %s", e.Type, e.ReservationID), e) {
+		klog.Warningf("reservation events buffer full, dropping %s event for reservation %s", e.Type, e.ReservationID)
+	}
+}
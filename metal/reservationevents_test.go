@@ -0,0 +1,76 @@
+package metal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// recordingEventSink keeps every event it is given
+type recordingEventSink struct {
+	events []reservationEvent
+}
+
+func (r *recordingEventSink) emit(e reservationEvent) {
+	r.events = append(r.events, e)
+}
+
+func TestNewReservationEventSink(t *testing.T) {
+	if _, ok := newReservationEventSink("").(nopReservationEventSink); !ok {
+		t.Errorf("empty URL did not give a no-op sink")
+	}
+	if _, ok := newReservationEventSink("http://localhost:1/events").(*webhookReservationEventSink); !ok {
+		t.Errorf("URL did not give a webhook sink")
+	}
+}
+
+func TestWebhookReservationEventSink(t *testing.T) {
+	received := make(chan reservationEvent, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e reservationEvent
+		if r.Method != http.MethodPost {
+			t.Errorf("unexpected method %s", r.Method)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Errorf("could not decode event: %v", err)
+		}
+		received <- e
+	}))
+	defer ts.Close()
+
+	sink := newWebhookReservationEventSink(ts.URL, ts.Client(), 10)
+	sink.emit(reservationEvent{Type: reservationEventCreated, Service: "default/web", ReservationID: "abc", Address: "147.75.100.1"})
+
+	select {
+	case e := <-received:
+		if e.Type != reservationEventCreated || e.Service != "default/web" || e.ReservationID != "abc" || e.Address != "147.75.100.1" {
+			t.Errorf("mismatched event received: %#v", e)
+		}
+		if e.Timestamp.IsZero() {
+			t.Errorf("event timestamp not set")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+}
+
+func TestWebhookReservationEventSinkFullBuffer(t *testing.T) {
+	// no goroutine is draining this sink, so emit must drop rather than block
+	sink := &webhookReservationEventSink{poster: &webhookPoster{posts: make(chan webhookPost, 1)}}
+	done := make(chan struct{})
+	go func() {
+		sink.emit(reservationEvent{Type: reservationEventCreated})
+		sink.emit(reservationEvent{Type: reservationEventDeleted})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("emit blocked on a full buffer")
+	}
+	if len(sink.poster.posts) != 1 {
+		t.Errorf("expected 1 buffered event, found %d", len(sink.poster.posts))
+	}
+}
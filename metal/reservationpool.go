@@ -0,0 +1,137 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	annotationEIPPool = "metal.equinix.com/eip-pool"
+	poolTagPrefix     = "pool="
+)
+
+// poolTag the tag of the reservations in a pool, set by whoever created them
+func poolTag(name string) string {
+	return poolTagPrefix + name
+}
+
+// reservationPool get the name of the pool the service draws its address from, if any
+func reservationPool(svc *v1.Service) string {
+	return svc.Annotations[annotationEIPPool]
+}
+
+// isPoolReservation report if the reservation belongs to a pool, and so is returned to it rather
+// than released
+func isPoolReservation(ipr *packngo.IPAddressReservation) bool {
+	for _, tag := range ipr.Tags {
+		if strings.HasPrefix(tag, poolTagPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// poolCandidates get the pools the service may draw from, in the order to draw: its own pool, then,
+// if that is in the pool priority of the config, each of lower priority after it. A pool that is
+// not in the priority has no fallback.
+func (l *loadBalancers) poolCandidates(pool string) []string {
+	for i, p := range l.poolPriority {
+		if p == pool {
+			return l.poolPriority[i:]
+		}
+	}
+	return []string{pool}
+}
+
+// rankByPoolPriority order the reservations by the priority of their pools in the config, highest
+// first, and those of a pool not in the priority last; those of the same rank keep their order
+func (l *loadBalancers) rankByPoolPriority(iprs []*packngo.IPAddressReservation) []*packngo.IPAddressReservation {
+	rank := func(ipr *packngo.IPAddressReservation) int {
+		for i, pool := range l.poolPriority {
+			if hasTag(ipr.Tags, poolTag(pool)) {
+				return i
+			}
+		}
+		return len(l.poolPriority)
+	}
+	sort.SliceStable(iprs, func(i, j int) bool { return rank(iprs[i]) < rank(iprs[j]) })
+	return iprs
+}
+
+// drawFromPool take a free reservation of the pool of the service, and tag it for the service.
+// The reservations of a pool are created ahead, and tagged with the pool, by the operator; one
+// is free if it has an address, and no service holds it. If the pool has none free, the service
+// falls back to the pools of lower priority, see poolCandidates; if none of those has one either,
+// it is an error: no other reservation is reused or requested for it.
+func (l *loadBalancers) drawFromPool(ctx context.Context, svc *v1.Service, ips []packngo.IPAddressReservation) (*packngo.IPAddressReservation, error) {
+	pool := reservationPool(svc)
+	svcName := serviceRep(svc)
+	candidates := l.poolCandidates(pool)
+	tags := make([]string, 0, len(candidates))
+	for _, p := range candidates {
+		tags = append(tags, poolTag(p))
+	}
+	free := func(ipr *packngo.IPAddressReservation) bool {
+		usage, _, service := reservationTagValues(ipr.Tags)
+		return ipr.Address != "" && usage == "" && service == ""
+	}
+	l.blockLock.Lock()
+	defer l.blockLock.Unlock()
+	for _, listed := range l.rankByPoolPriority(ipReservationsByAnyTags(tags, ips)) {
+		if !free(listed) {
+			continue
+		}
+		ipr, err := l.stillFree(ctx, listed, free)
+		if err != nil {
+			return nil, err
+		}
+		if ipr == nil {
+			continue
+		}
+		klog.V(2).Infof("drawing reservation %s from pool %s for %s", ipr.ID, reservationPoolOf(ipr), svcName)
+		updated, _, err := l.updateTags(ctx, ipr.ID, reassignedTags(ipr.Tags, serviceTag(svc), clusterTag(l.clusterID)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to tag reservation %s of pool %s for %s: %v", ipr.ID, reservationPoolOf(ipr), svcName, err)
+		}
+		l.emitReservationEvent(ctx, reservationEventReassigned, svcName, updated)
+		return updated, nil
+	}
+	if len(candidates) > 1 {
+		return nil, fmt.Errorf("reservation pool %s has no free reservation for %s, nor do its fallbacks %s", pool, svcName, strings.Join(candidates[1:], ", "))
+	}
+	return nil, fmt.Errorf("reservation pool %s has no free reservation for %s", pool, svcName)
+}
+
+// reservationPoolOf get the name of the pool the reservation belongs to, if any
+func reservationPoolOf(ipr *packngo.IPAddressReservation) string {
+	for _, tag := range ipr.Tags {
+		if strings.HasPrefix(tag, poolTagPrefix) {
+			return strings.TrimPrefix(tag, poolTagPrefix)
+		}
+	}
+	return ""
+}
+
+// returnToPool give the reservation back to its pool: remove the tags the CCM set for the service,
+// and keep the rest, so that it is free to draw again
+func (l *loadBalancers) returnToPool(ctx context.Context, svcName string, ipr *packngo.IPAddressReservation) error {
+	tags := []string{}
+	for _, tag := range ipr.Tags {
+		if strings.HasPrefix(tag, "usage=") || strings.HasPrefix(tag, "cluster=") || strings.HasPrefix(tag, "service=") || strings.HasPrefix(tag, labelTagPrefix) {
+			continue
+		}
+		tags = append(tags, tag)
+	}
+	klog.V(2).Infof("returning reservation %s of %s to its pool", ipr.ID, svcName)
+	if _, _, err := l.updateTags(ctx, ipr.ID, tags); err != nil {
+		return fmt.Errorf("failed to return IP address reservation %s to its pool: %v", ipr.String(), err)
+	}
+	l.emitReservationEvent(ctx, reservationEventReturned, svcName, ipr)
+	return nil
+}
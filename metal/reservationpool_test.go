@@ -0,0 +1,180 @@
+package metal
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+)
+
+// testPoolReservation a reservation of a pool, as created by the operator, with any extra tags
+func testPoolReservation(id, address, pool string, tags ...string) packngo.IPAddressReservation {
+	return packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{
+		ID:      id,
+		Address: address,
+		CIDR:    32,
+		Public:  true,
+		Tags:    append([]string{poolTag(pool), "owner=netops"}, tags...),
+	}}
+}
+
+func TestReconcileServicesDrawFromPool(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", map[string]string{annotationEIPPool: "public"})
+	other := testLoadBalancerService("default", "other", nil)
+	ips := &fakeProjectIPs{reservations: []packngo.IPAddressReservation{
+		testPoolReservation("elsewhere", "147.75.200.1", "internal"),
+		testPoolReservation("taken", "147.75.200.2", "public", emTag, serviceTag(other), clusterTag(testClusterID)),
+		testPoolReservation("pending", "", "public"),
+		testPoolReservation("free", "147.75.200.4", "public"),
+	}}
+	l, lb := testGetLoadBalancers(ips, svc)
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.requests) != 0 {
+		t.Errorf("expected no requests, had %d", len(ips.requests))
+	}
+	if len(lb.services) != 1 || lb.services["147.75.200.4/32"] != "default/web" {
+		t.Errorf("expected the free reservation advertised, have %v", lb.services)
+	}
+	drawn := ipReservationByAllTags([]string{poolTag("public"), emTag, serviceTag(svc), clusterTag(testClusterID), "owner=netops"}, ips.reservations)
+	if drawn == nil || drawn.ID != "free" {
+		t.Errorf("expected the free reservation tagged for the service, have %v", ips.reservations)
+	}
+}
+
+func TestReconcileServicesPoolExhausted(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", map[string]string{annotationEIPPool: "public"})
+	other := testLoadBalancerService("default", "other", nil)
+	ips := &fakeProjectIPs{reservations: []packngo.IPAddressReservation{
+		testPoolReservation("taken", "147.75.200.2", "public", emTag, serviceTag(other), clusterTag(testClusterID)),
+		// not in the pool, and free to reuse, but the service draws only from its pool
+		{IpAddressCommon: packngo.IpAddressCommon{ID: "retained", Address: "147.75.1.1", CIDR: 32, Tags: []string{emRetainedTag, clusterTag(testClusterID)}}},
+	}}
+	l, lb := testGetLoadBalancers(ips, svc)
+	l.reuseScope = ReuseScopeCluster
+	err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd)
+	if err == nil || !strings.Contains(err.Error(), "reservation pool public has no free reservation") {
+		t.Errorf("expected exhausted pool error, had %v", err)
+	}
+	if len(ips.requests) != 0 || len(lb.services) != 0 {
+		t.Errorf("expected no requests or advertised, had %d requests, advertised %v", len(ips.requests), lb.services)
+	}
+}
+
+func TestDrawFromPoolStaleList(t *testing.T) {
+	web := testLoadBalancerService("default", "web", map[string]string{annotationEIPPool: "public"})
+	api := testLoadBalancerService("default", "api", map[string]string{annotationEIPPool: "public"})
+	ips := &fakeProjectIPs{reservations: []packngo.IPAddressReservation{
+		testPoolReservation("free", "147.75.200.4", "public"),
+	}}
+	l, _ := testGetLoadBalancers(ips, web, api)
+	// both draw from the same listing, as concurrent reconciles would
+	stale := append([]packngo.IPAddressReservation{}, ips.reservations...)
+	if _, err := l.drawFromPool(context.Background(), web, stale); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	_, err := l.drawFromPool(context.Background(), api, stale)
+	if err == nil || !strings.Contains(err.Error(), "reservation pool public has no free reservation") {
+		t.Errorf("expected exhausted pool error for the claimed reservation, had %v", err)
+	}
+	if ipReservationByAllTags([]string{serviceTag(web)}, ips.reservations) == nil || ipReservationByAllTags([]string{serviceTag(api)}, ips.reservations) != nil {
+		t.Errorf("expected the reservation to stay with the first service, have %v", ips.reservations)
+	}
+}
+
+func TestReconcileServicesReturnToPool(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", map[string]string{annotationEIPPool: "public"})
+	for _, mode := range []UpdateMode{ModeRemove, ModeSync} {
+		ips := &fakeProjectIPs{reservations: []packngo.IPAddressReservation{testPoolReservation("free", "147.75.200.4", "public")}}
+		l, lb := testGetLoadBalancers(ips, svc)
+		l.labelTags = []string{"team"}
+		svc.Labels = map[string]string{"team": "web"}
+		if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+			t.Fatalf("%v: unexpected error: %v", mode, err)
+		}
+		// removed, or gone by the next sync
+		svcs := []*v1.Service{svc}
+		if mode == ModeSync {
+			svcs = nil
+		}
+		if err := l.reconcileServices(context.Background(), svcs, mode); err != nil {
+			t.Fatalf("%v: unexpected error on remove: %v", mode, err)
+		}
+		if len(ips.removed) != 0 {
+			t.Errorf("%v: expected nothing released, removed %v", mode, ips.removed)
+		}
+		if len(lb.services) != 0 {
+			t.Errorf("%v: expected nothing advertised, have %v", mode, lb.services)
+		}
+		expected := []string{poolTag("public"), "owner=netops"}
+		if len(ips.reservations) != 1 || !reflect.DeepEqual(ips.reservations[0].Tags, expected) {
+			t.Errorf("%v: mismatched reservations, actual %v expected one with tags %v", mode, ips.reservations, expected)
+		}
+	}
+}
+
+func TestReconcileServicesPoolPriority(t *testing.T) {
+	web := testLoadBalancerService("default", "web", map[string]string{annotationEIPPool: "reserved"})
+	api := testLoadBalancerService("default", "api", map[string]string{annotationEIPPool: "reserved"})
+	batch := testLoadBalancerService("default", "batch", map[string]string{annotationEIPPool: "fallback"})
+	ips := &fakeProjectIPs{reservations: []packngo.IPAddressReservation{
+		// listed first, but of the pool of lower priority
+		testPoolReservation("fallback", "147.75.200.1", "fallback"),
+		testPoolReservation("reserved", "147.75.200.2", "reserved"),
+	}}
+	l, lb := testGetLoadBalancers(ips, web, api, batch)
+	l.poolPriority = []string{"reserved", "fallback"}
+
+	tests := []struct {
+		svc      *v1.Service
+		expected string
+	}{
+		// both are free, so the pool of higher priority
+		{web, "147.75.200.2/32"},
+		// its pool is exhausted, so it falls back
+		{api, "147.75.200.1/32"},
+	}
+	for _, tt := range tests {
+		if err := l.reconcileServices(context.Background(), []*v1.Service{tt.svc}, ModeAdd); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.svc.Name, err)
+		}
+		if lb.services[tt.expected] != serviceRep(tt.svc) {
+			t.Errorf("%s: expected %s advertised, have %v", tt.svc.Name, tt.expected, lb.services)
+		}
+	}
+
+	// a pool of lower priority never draws from those above it
+	ips.reservations = append(ips.reservations, testPoolReservation("reserved-2", "147.75.200.3", "reserved"))
+	err := l.reconcileServices(context.Background(), []*v1.Service{batch}, ModeAdd)
+	if err == nil || !strings.Contains(err.Error(), "reservation pool fallback has no free reservation") {
+		t.Errorf("expected exhausted pool error, had %v", err)
+	}
+	if _, ok := lb.services["147.75.200.3/32"]; ok {
+		t.Errorf("drew from a pool of higher priority, have %v", lb.services)
+	}
+}
+
+func TestRankByPoolPriority(t *testing.T) {
+	l := &loadBalancers{poolPriority: []string{"a", "b"}}
+	reservations := []packngo.IPAddressReservation{
+		testPoolReservation("other", "147.75.200.1", "c"),
+		testPoolReservation("b1", "147.75.200.2", "b"),
+		testPoolReservation("a1", "147.75.200.3", "a"),
+		testPoolReservation("b2", "147.75.200.4", "b"),
+	}
+	iprs := []*packngo.IPAddressReservation{}
+	for i := range reservations {
+		iprs = append(iprs, &reservations[i])
+	}
+	ids := []string{}
+	for _, ipr := range l.rankByPoolPriority(iprs) {
+		ids = append(ids, ipr.ID)
+	}
+	if expected := []string{"a1", "b1", "b2", "other"}; !reflect.DeepEqual(ids, expected) {
+		t.Errorf("mismatched ranking, actual %v expected %v", ids, expected)
+	}
+}
@@ -0,0 +1,76 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/packethost/packngo"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DefaultAPIRetryCount the number of times a call to the Equinix Metal API is retried after a transient error
+	DefaultAPIRetryCount = 3
+	// DefaultAPIRetryBaseDelay the delay before the first retry; each retry after that waits twice as long
+	DefaultAPIRetryBaseDelay = 500 * time.Millisecond
+)
+
+// apiRetry retries calls to the Equinix Metal API that fail with an error that may pass, so that a
+// single 429 or 5xx does not fail the whole reconcile
+type apiRetry struct {
+	count     int
+	baseDelay time.Duration
+}
+
+// isTransient check if an error is one the API may not return when called again: rate limited,
+// or a server or gateway error
+func isTransient(err error) bool {
+	perr, ok := err.(*packngo.ErrorResponse)
+	if !ok || perr.Response == nil {
+		return false
+	}
+	switch perr.Response.StatusCode {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryOnTransient call op, a call that reads, until it succeeds, fails with an error that is not
+// transient, or has been retried count times. The delay doubles after each attempt, with jitter,
+// so that many clusters rate limited together do not retry together. It stops waiting when ctx is
+// done, see callWithContext.
+func (r apiRetry) retryOnTransient(ctx context.Context, name string, op func() error) error {
+	return r.retry(ctx, name, callWithContext, op)
+}
+
+// retryMutationOnTransient retry op as retryOnTransient does, but op is a call that changes state,
+// so an attempt that started runs to its end, see callToEnd; only the wait for the next one stops
+// when ctx is done.
+func (r apiRetry) retryMutationOnTransient(ctx context.Context, name string, op func() error) error {
+	return r.retry(ctx, name, callToEnd, op)
+}
+
+func (r apiRetry) retry(ctx context.Context, name string, call func(context.Context, func() error) error, op func() error) error {
+	delay := r.baseDelay
+	for attempt := 0; ; attempt++ {
+		err := call(ctx, op)
+		if ctx.Err() != nil && err == ctx.Err() {
+			return fmt.Errorf("%s aborted: %w", name, err)
+		}
+		if err == nil || !isTransient(err) || attempt >= r.count {
+			return err
+		}
+		d := wait.Jitter(delay, 1.0)
+		klog.V(2).Infof("%s failed with a transient error, retry %d of %d in %s: %v", name, attempt+1, r.count, d, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s not retried: %v, after %w", name, ctx.Err(), err)
+		case <-time.After(d):
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,192 @@
+package metal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+)
+
+func testAPIError(status int) error {
+	req, _ := http.NewRequest(http.MethodGet, "https://api.equinix.com/metal/v1/projects", nil)
+	return &packngo.ErrorResponse{Response: &http.Response{StatusCode: status, Request: req}}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		err       error
+		transient bool
+	}{
+		{nil, false},
+		{errors.New("connection reset"), false},
+		{&packngo.ErrorResponse{}, false},
+		{testAPIError(http.StatusTooManyRequests), true},
+		{testAPIError(http.StatusInternalServerError), true},
+		{testAPIError(http.StatusBadGateway), true},
+		{testAPIError(http.StatusServiceUnavailable), true},
+		{testAPIError(http.StatusGatewayTimeout), true},
+		{testAPIError(http.StatusNotFound), false},
+		{testAPIError(http.StatusUnprocessableEntity), false},
+	}
+	for i, tt := range tests {
+		if transient := isTransient(tt.err); transient != tt.transient {
+			t.Errorf("%d: mismatched transient for %v, actual %v expected %v", i, tt.err, transient, tt.transient)
+		}
+	}
+}
+
+func TestRetryOnTransient(t *testing.T) {
+	tests := []struct {
+		count    int
+		failures []error
+		calls    int
+		err      bool
+	}{
+		// succeeds straight away, or after some retries
+		{3, nil, 1, false},
+		{3, []error{testAPIError(http.StatusServiceUnavailable), testAPIError(http.StatusTooManyRequests)}, 3, false},
+		// gives up after count retries
+		{1, []error{testAPIError(http.StatusBadGateway), testAPIError(http.StatusBadGateway)}, 2, true},
+		{0, []error{testAPIError(http.StatusBadGateway)}, 1, true},
+		// not retried
+		{3, []error{testAPIError(http.StatusUnprocessableEntity)}, 1, true},
+	}
+	for i, tt := range tests {
+		r := apiRetry{count: tt.count, baseDelay: time.Millisecond}
+		failures := tt.failures
+		var calls int
+		err := r.retryOnTransient(context.Background(), "test", func() error {
+			calls++
+			if len(failures) == 0 {
+				return nil
+			}
+			err := failures[0]
+			failures = failures[1:]
+			return err
+		})
+		switch {
+		case tt.err && err == nil:
+			t.Errorf("%d: expected an error, had none", i)
+		case !tt.err && err != nil:
+			t.Errorf("%d: unexpected error: %v", i, err)
+		case calls != tt.calls:
+			t.Errorf("%d: mismatched calls, actual %d expected %d", i, calls, tt.calls)
+		}
+	}
+}
+
+func TestRetryOnTransientCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := apiRetry{count: 3, baseDelay: time.Hour}
+	var calls int
+	err := r.retryOnTransient(ctx, "test", func() error {
+		calls++
+		cancel()
+		return testAPIError(http.StatusServiceUnavailable)
+	})
+	if err == nil || (!isTransient(errors.Unwrap(err)) && !errors.Is(err, context.Canceled)) {
+		t.Errorf("expected the transient or the cancelled error, had %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("mismatched calls, actual %d expected 1", calls)
+	}
+
+	// once it is done, no call is made at all
+	calls = 0
+	err = r.retryOnTransient(ctx, "test", func() error {
+		calls++
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the cancelled error, had %v", err)
+	}
+	if calls != 0 {
+		t.Errorf("mismatched calls, actual %d expected 0", calls)
+	}
+}
+
+func TestRetryOnTransientAbortsHungCall(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	release := make(chan struct{})
+	defer close(release)
+	r := apiRetry{count: 3, baseDelay: time.Millisecond}
+	start := time.Now()
+	err := r.retryOnTransient(ctx, "test", func() error {
+		<-release
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline error, had %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("returned %s after the deadline, rather than promptly", elapsed)
+	}
+}
+
+func TestRetryMutationOnTransientRunsToEnd(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r := apiRetry{count: 3, baseDelay: time.Millisecond}
+	var done bool
+	// the call outlasts the deadline, and its result is not lost
+	err := r.retryMutationOnTransient(ctx, "test", func() error {
+		<-ctx.Done()
+		done = true
+		return nil
+	})
+	if err != nil || !done {
+		t.Errorf("expected the call run to its end, had %v, done %t", err, done)
+	}
+
+	// once it is done, no call is made at all
+	err = r.retryMutationOnTransient(ctx, "test", func() error {
+		t.Errorf("unexpected call after the deadline")
+		return nil
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline error, had %v", err)
+	}
+}
+
+func TestReconcileServicesRetriesTransient(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", nil)
+	// the API flaps: the list fails twice, then the request once
+	ips := &fakeProjectIPs{failures: []error{
+		testAPIError(http.StatusServiceUnavailable),
+		testAPIError(http.StatusTooManyRequests),
+		nil,
+		testAPIError(http.StatusBadGateway),
+	}}
+	l, lb := testGetLoadBalancers(ips, svc)
+	l.retry = apiRetry{count: 3, baseDelay: time.Millisecond}
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.failures) != 0 {
+		t.Errorf("expected every failure retried, remaining %v", ips.failures)
+	}
+	if len(ips.reservations) != 1 || len(lb.services) != 1 {
+		t.Errorf("expected one reservation advertised, have %v and %v", ips.reservations, lb.services)
+	}
+}
+
+func TestReconcileServicesNotRetried(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", nil)
+	ips := &fakeProjectIPs{failures: []error{
+		testAPIError(http.StatusUnprocessableEntity),
+		testAPIError(http.StatusServiceUnavailable),
+	}}
+	l, _ := testGetLoadBalancers(ips, svc)
+	l.retry = apiRetry{count: 3, baseDelay: time.Millisecond}
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err == nil {
+		t.Fatal("expected an error, had none")
+	}
+	if len(ips.failures) != 1 {
+		t.Errorf("expected a single call, remaining failures %v", ips.failures)
+	}
+}
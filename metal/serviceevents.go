@@ -0,0 +1,48 @@
+package metal
+
+import (
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	eventComponent = "cloud-provider-equinix-metal"
+
+	// the reasons of the events on services
+	eventReasonEIPRequested     = "EIPRequested"
+	eventReasonEIPRequestFailed = "EIPRequestFailed"
+	eventReasonEIPAssigned      = "EIPAssigned"
+	eventReasonEIPReleased      = "EIPReleased"
+	// eventReasonEIPQuotaExceeded the request of an EIP failed as the project has no quota left
+	eventReasonEIPQuotaExceeded = "EIPQuotaExceeded"
+	// eventReasonEIPApprovalRequired the request of an EIP failed as it needs approval
+	eventReasonEIPApprovalRequired = "EIPApprovalRequired"
+	// eventReasonNotOwned the loadBalancerIP of the service is not of the project
+	eventReasonNotOwned = "LoadBalancerIPNotOwned"
+	// eventReasonEIPReservationInvalid the reservation the service is pinned to cannot be used
+	eventReasonEIPReservationInvalid = "EIPReservationInvalid"
+	// eventReasonEIPNotApproved the address of the service is outside the approved CIDR
+	eventReasonEIPNotApproved = "EIPNotApproved"
+	// eventReasonSyncFailed the reconcile of the service failed; the others still are reconciled
+	eventReasonSyncFailed = "SyncLoadBalancerFailed"
+)
+
+// newEventRecorder get a recorder of events on kubernetes objects, e.g. services
+func newEventRecorder(k8sclient kubernetes.Interface) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedv1.EventSinkImpl{Interface: k8sclient.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: eventComponent})
+}
+
+// serviceEvent record an event on a service, so that it shows with the service, e.g. in kubectl
+// describe, rather than only in the logs. None is recorded without a recorder, e.g. before init,
+// in a dry run, or without a service, e.g. for the reservation of one that is gone.
+func (l *loadBalancers) serviceEvent(svc *v1.Service, eventType, reason, messageFmt string, args ...interface{}) {
+	if l.recorder == nil || l.dryRun || svc == nil {
+		return
+	}
+	l.recorder.Eventf(svc, eventType, reason, messageFmt, args...)
+}
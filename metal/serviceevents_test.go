@@ -0,0 +1,80 @@
+package metal
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// testEventReasons get the reasons of the events recorded so far
+func testEventReasons(recorder *record.FakeRecorder) []string {
+	reasons := []string{}
+	for {
+		select {
+		case e := <-recorder.Events:
+			reasons = append(reasons, strings.SplitN(e, " ", 3)[1])
+		default:
+			return reasons
+		}
+	}
+}
+
+func TestReconcileServicesServiceEvents(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", nil)
+	ips := &fakeProjectIPs{}
+	l, _ := testGetLoadBalancers(ips, testNamespace("default", nil), svc)
+	recorder := record.NewFakeRecorder(10)
+	l.recorder = recorder
+	ctx := context.Background()
+
+	if err := l.reconcileServices(ctx, []*v1.Service{svc}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error adding service: %v", err)
+	}
+	if reasons := strings.Join(testEventReasons(recorder), ","); reasons != eventReasonEIPRequested+","+eventReasonEIPAssigned {
+		t.Errorf("mismatched events adding, actual %s", reasons)
+	}
+	if err := l.reconcileServices(ctx, []*v1.Service{svc}, ModeRemove); err != nil {
+		t.Fatalf("unexpected error removing service: %v", err)
+	}
+	if reasons := strings.Join(testEventReasons(recorder), ","); reasons != eventReasonEIPReleased {
+		t.Errorf("mismatched events removing, actual %s", reasons)
+	}
+}
+
+func TestReconcileServicesServiceEventRequestFailed(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", nil)
+	// the list of the reconcile succeeds, the request then fails
+	ips := &fakeProjectIPs{failures: []error{nil, errors.New("quota exceeded")}}
+	l, _ := testGetLoadBalancers(ips, svc)
+	recorder := record.NewFakeRecorder(10)
+	l.recorder = recorder
+
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err == nil {
+		t.Fatal("expected an error")
+	}
+	select {
+	case e := <-recorder.Events:
+		if !strings.HasPrefix(e, v1.EventTypeWarning+" "+eventReasonEIPRequestFailed+" ") || !strings.Contains(e, "quota exceeded") {
+			t.Errorf("mismatched event %s", e)
+		}
+	default:
+		t.Error("no event")
+	}
+	// and the failure of its reconcile
+	if reasons := strings.Join(testEventReasons(recorder), ","); reasons != eventReasonSyncFailed {
+		t.Errorf("mismatched events after the failed request, actual %s", reasons)
+	}
+
+	// nothing in a dry run
+	l.dryRun = true
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error in dry run: %v", err)
+	}
+	if reasons := testEventReasons(recorder); len(reasons) != 0 {
+		t.Errorf("unexpected events in dry run %v", reasons)
+	}
+}
@@ -0,0 +1,48 @@
+package metal
+
+import (
+	"sync"
+)
+
+// serviceLocks serializes work on a single service identity, i.e. namespace/name, or the
+// share key of the services that share an EIP, see serviceIdentity.
+// Because reservations are found by a tag derived from the identity, a service
+// that is deleted and quickly recreated with the same name would otherwise race
+// the removal of the old reservation against the assignment of a new one.
+type serviceLocks struct {
+	mu    sync.Mutex
+	locks map[string]*serviceLock
+}
+
+type serviceLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newServiceLocks() *serviceLocks {
+	return &serviceLocks{locks: map[string]*serviceLock{}}
+}
+
+// lock block until no other holder has the given identity, and return the function
+// to release it. Entries are discarded once nobody holds or waits on them.
+func (s *serviceLocks) lock(key string) func() {
+	s.mu.Lock()
+	l, ok := s.locks[key]
+	if !ok {
+		l = &serviceLock{}
+		s.locks[key] = l
+	}
+	l.refs++
+	s.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		s.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(s.locks, key)
+		}
+		s.mu.Unlock()
+	}
+}
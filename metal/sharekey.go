@@ -0,0 +1,172 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+const annotationEIPShareKey = "metal.equinix.com/eip-share-key"
+
+// shareKey get the key by which the service shares its EIP with the other services of its
+// namespace with the same key, e.g. to expose different ports on one address, or "" if it has an
+// EIP of its own
+func shareKey(svc *v1.Service) string {
+	if svc == nil {
+		return ""
+	}
+	return svc.Annotations[annotationEIPShareKey]
+}
+
+// serviceIdentity get what the service tag of the service is the hash of: its namespace and
+// name, or for a service that shares its EIP, its namespace and share key. As names cannot
+// contain a slash, the two cannot collide.
+func serviceIdentity(svc *v1.Service) string {
+	if key := shareKey(svc); key != "" {
+		return fmt.Sprintf("share/%s/%s", svc.Namespace, key)
+	}
+	return serviceRep(svc)
+}
+
+// poolName get the name under which the address of the service is given to the implementation;
+// services that share an EIP share the pool too, so that it does not change with whichever of
+// them was reconciled last
+func poolName(svc *v1.Service) string {
+	if key := shareKey(svc); key != "" {
+		return fmt.Sprintf("%s/share:%s", svc.Namespace, key)
+	}
+	return serviceRep(svc)
+}
+
+// sharingServices get the other services that share the EIP of the removed service, by name; it
+// may be released, and its address withdrawn, only once none remains. A service being deleted
+// does not count, nor does one that we do not manage.
+func (l *loadBalancers) sharingServices(ctx context.Context, svc *v1.Service) ([]string, error) {
+	key := shareKey(svc)
+	if key == "" {
+		return nil, nil
+	}
+	list, err := l.k8sclient.CoreV1().Services(svc.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list services sharing the EIP of %s: %v", serviceRep(svc), err)
+	}
+	svcs := []*v1.Service{}
+	for i := range list.Items {
+		svcs = append(svcs, &list.Items[i])
+	}
+	names := []string{}
+	for _, other := range loadBalancerServices(svcs, l.class, l.excludedNS) {
+		if other.Name == svc.Name || other.DeletionTimestamp != nil || shareKey(other) != key {
+			continue
+		}
+		names = append(names, serviceRep(other))
+	}
+	return names, nil
+}
+
+// sharedReservation get the IPv4 reservation that the service shares with others, from the
+// reservations as they are now, or nil if there is none yet. The services that share it are
+// serialized on their identity, so one that is reconciled after another finds it.
+func (l *loadBalancers) sharedReservation(ctx context.Context, svc *v1.Service) (*packngo.IPAddressReservation, error) {
+	ips, err := l.listReservations(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to retrieve IP reservations for project %s: %w", l.project, err)
+	}
+	ipv4s := withoutStandby(ipReservationsWithoutTag(ipv6FamilyTag, ips))
+	return ipReservationByAllTags([]string{serviceTag(svc), emTag, clusterTag(l.clusterID)}, ipv4s), nil
+}
+
+// retagShareKeys move the reservation of each service of which the identity changed, e.g. as its
+// share key was added, changed or removed, see serviceIdentity, over to its current service tag,
+// so that it keeps its address rather than the reservation being taken for an orphan and
+// released, and get the reservations as they now are. The reservation is found by the assigned
+// address of the service; it is moved only if the identity has none of its own yet, it is not of
+// a shared block, and no other service still has the old tag, e.g. one that keeps the old share
+// key.
+func (l *loadBalancers) retagShareKeys(ctx context.Context, svcs []*v1.Service, ips []packngo.IPAddressReservation) ([]packngo.IPAddressReservation, error) {
+	current := make([]packngo.IPAddressReservation, len(ips))
+	copy(current, ips)
+	clsTag := clusterTag(l.clusterID)
+	for _, svc := range svcs {
+		addr := l.assignedIP(svc)
+		if addr == "" || svc.DeletionTimestamp != nil {
+			continue
+		}
+		svcTag := serviceTag(svc)
+		if ipReservationByAllTags([]string{emTag, clsTag, svcTag}, current) != nil {
+			continue
+		}
+		ipr := ipReservationByAddress(addr, current)
+		if ipr == nil || !hasTag(ipr.Tags, emTag) || !hasTag(ipr.Tags, clsTag) || hasTag(ipr.Tags, sharedBlockTag) {
+			continue
+		}
+		oldTag, ok := singleServiceTag(ipr.Tags)
+		if !ok {
+			continue
+		}
+		held, err := l.heldByOther(ctx, svc, oldTag)
+		if err != nil {
+			return nil, err
+		}
+		if held {
+			continue
+		}
+		tags := make([]string, 0, len(ipr.Tags))
+		for _, tag := range ipr.Tags {
+			if tag == oldTag {
+				tag = svcTag
+			}
+			tags = append(tags, tag)
+		}
+		klog.V(2).Infof("moving IP reservation %s of %s over to the identity %s of %s, from %s to %s", ipr.ID, ipr.Address, serviceIdentity(svc), serviceRep(svc), oldTag, svcTag)
+		updated, _, err := l.updateTags(ctx, ipr.ID, tags)
+		if err != nil {
+			return nil, fmt.Errorf("failed to move IP reservation %s over to the identity of %s: %w", ipr.ID, serviceRep(svc), err)
+		}
+		if updated != nil {
+			*ipr = *updated
+		} else {
+			ipr.Tags = tags
+		}
+	}
+	return current, nil
+}
+
+// singleServiceTag get the service tag of the tags, if they have exactly one
+func singleServiceTag(tags []string) (string, bool) {
+	var found string
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, "service=") {
+			continue
+		}
+		if found != "" {
+			return "", false
+		}
+		found = tag
+	}
+	return found, found != ""
+}
+
+// heldByOther whether another service, of any namespace or class, has the given service tag, or
+// its legacy form
+func (l *loadBalancers) heldByOther(ctx context.Context, svc *v1.Service, tag string) (bool, error) {
+	list, err := l.k8sclient.CoreV1().Services("").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return false, fmt.Errorf("unable to list services: %v", err)
+	}
+	for i := range list.Items {
+		other := &list.Items[i]
+		if serviceRep(other) == serviceRep(svc) || other.DeletionTimestamp != nil {
+			continue
+		}
+		if serviceTag(other) == tag || legacyServiceTag(other) == tag {
+			return true, nil
+		}
+	}
+	return false, nil
+}
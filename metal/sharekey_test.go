@@ -0,0 +1,177 @@
+package metal
+
+import (
+	"context"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestServiceTagShareKey(t *testing.T) {
+	shared := map[string]string{annotationEIPShareKey: "web"}
+	tests := []struct {
+		a, b  *v1.Service
+		equal bool
+	}{
+		{testLoadBalancerService("default", "http", shared), testLoadBalancerService("default", "https", shared), true},
+		{testLoadBalancerService("default", "http", nil), testLoadBalancerService("default", "https", nil), false},
+		{testLoadBalancerService("default", "http", shared), testLoadBalancerService("default", "https", map[string]string{annotationEIPShareKey: "api"}), false},
+		// the key is of the namespace
+		{testLoadBalancerService("default", "http", shared), testLoadBalancerService("other", "https", shared), false},
+		// nor does a key collide with the name of a service
+		{testLoadBalancerService("default", "http", shared), testLoadBalancerService("share", "default", nil), false},
+	}
+	for i, tt := range tests {
+		if equal := serviceTag(tt.a) == serviceTag(tt.b); equal != tt.equal {
+			t.Errorf("%d: mismatched tags %s and %s, expected equal %t", i, serviceTag(tt.a), serviceTag(tt.b), tt.equal)
+		}
+	}
+}
+
+func TestReconcileServicesShareKey(t *testing.T) {
+	annotations := map[string]string{annotationEIPShareKey: "web"}
+	http := testLoadBalancerService("default", "http", annotations)
+	https := testLoadBalancerService("default", "https", annotations)
+	ips := &fakeProjectIPs{}
+	l, lb := testGetLoadBalancers(ips, http, https)
+	ctx := context.Background()
+	current := func(svc *v1.Service) *v1.Service {
+		updated, err := l.k8sclient.CoreV1().Services(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unable to get service: %v", err)
+		}
+		return updated
+	}
+
+	// both get the one EIP, requested once, in a single pool
+	if err := l.reconcileServices(ctx, []*v1.Service{http, https}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.requests) != 1 {
+		t.Fatalf("expected a single request, had %d", len(ips.requests))
+	}
+	addr, id := ips.reservations[0].Address, ips.reservations[0].ID
+	for _, svc := range []*v1.Service{http, https} {
+		if ip := current(svc).Spec.LoadBalancerIP; ip != addr {
+			t.Errorf("service %s has address %q instead of %s", svc.Name, ip, addr)
+		}
+	}
+	if len(lb.services) != 1 || lb.services[addr+"/32"] != "default/share:web" {
+		t.Errorf("expected the shared pool for %s only, have %v", addr, lb.services)
+	}
+
+	// a sync keeps it, and does not request another
+	if err := l.reconcileServices(ctx, []*v1.Service{current(http), current(https)}, ModeSync); err != nil {
+		t.Fatalf("unexpected error on sync: %v", err)
+	}
+	if len(ips.requests) != 1 || len(ips.removed) != 0 || len(lb.services) != 1 {
+		t.Errorf("sync changed the shared EIP: requests %d, removed %v, services %v", len(ips.requests), ips.removed, lb.services)
+	}
+
+	// removing the first keeps it advertised and reserved for the second
+	removed := current(http)
+	if err := l.k8sclient.CoreV1().Services("default").Delete(ctx, "http", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unable to delete service: %v", err)
+	}
+	if err := l.reconcileServices(ctx, []*v1.Service{removed}, ModeRemove); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := l.EnsureLoadBalancerDeleted(ctx, "", removed); err != nil {
+		t.Fatalf("unexpected error on delete: %v", err)
+	}
+	if len(ips.removed) != 0 {
+		t.Errorf("expected no reservation removed while shared, removed %v", ips.removed)
+	}
+	if _, ok := lb.services[addr+"/32"]; !ok {
+		t.Errorf("shared EIP %s no longer advertised, have %v", addr, lb.services)
+	}
+
+	// removing the last releases it
+	removed = current(https)
+	if err := l.k8sclient.CoreV1().Services("default").Delete(ctx, "https", metav1.DeleteOptions{}); err != nil {
+		t.Fatalf("unable to delete service: %v", err)
+	}
+	if err := l.reconcileServices(ctx, []*v1.Service{removed}, ModeRemove); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.removed) != 1 || ips.removed[0] != id {
+		t.Errorf("expected the shared reservation removed, removed %v", ips.removed)
+	}
+	if _, ok := lb.services[addr+"/32"]; ok {
+		t.Errorf("released EIP %s still advertised", addr)
+	}
+}
+
+func TestReconcileServicesShareKeyChanged(t *testing.T) {
+	web := testLoadBalancerService("default", "web", nil)
+	ips := &fakeProjectIPs{}
+	l, lb := testGetLoadBalancers(ips, web)
+	ctx := context.Background()
+	current := func(name string) *v1.Service {
+		updated, err := l.k8sclient.CoreV1().Services("default").Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unable to get service: %v", err)
+		}
+		return updated
+	}
+	setKey := func(name, key string) *v1.Service {
+		svc := current(name)
+		svc.Annotations = map[string]string{}
+		if key != "" {
+			svc.Annotations[annotationEIPShareKey] = key
+		}
+		updated, err := l.k8sclient.CoreV1().Services("default").Update(ctx, svc, metav1.UpdateOptions{})
+		if err != nil {
+			t.Fatalf("unable to update service: %v", err)
+		}
+		return updated
+	}
+
+	if err := l.reconcileServices(ctx, []*v1.Service{web}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	addr, id := ips.reservations[0].Address, ips.reservations[0].ID
+
+	// adding, changing and removing the key each keep the reservation, moved to the new tag
+	for _, key := range []string{"front", "edge", ""} {
+		svc := setKey("web", key)
+		if err := l.reconcileServices(ctx, []*v1.Service{svc}, ModeSync); err != nil {
+			t.Fatalf("key %q: unexpected error: %v", key, err)
+		}
+		if len(ips.requests) != 1 || len(ips.removed) != 0 {
+			t.Fatalf("key %q: expected the reservation kept, had requests %d and removed %v", key, len(ips.requests), ips.removed)
+		}
+		if !hasTag(ips.reservations[0].Tags, serviceTag(svc)) {
+			t.Errorf("key %q: reservation has tags %v, expected %s", key, ips.reservations[0].Tags, serviceTag(svc))
+		}
+		if ip := current("web").Spec.LoadBalancerIP; ip != addr {
+			t.Errorf("key %q: service has address %q instead of %s", key, ip, addr)
+		}
+		if _, ok := lb.services[addr+"/32"]; !ok {
+			t.Errorf("key %q: %s no longer advertised, have %v", key, addr, lb.services)
+		}
+	}
+
+	// one that no longer shares leaves the EIP to the one that still does
+	setKey("web", "front")
+	api := testLoadBalancerService("default", "api", map[string]string{annotationEIPShareKey: "front"})
+	api.Spec.LoadBalancerIP = addr
+	if _, err := l.k8sclient.CoreV1().Services("default").Create(ctx, api, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("unable to create service: %v", err)
+	}
+	if err := l.reconcileServices(ctx, []*v1.Service{current("web"), current("api")}, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	svc := setKey("web", "")
+	if err := l.reconcileServices(ctx, []*v1.Service{svc, current("api")}, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	shared := ipReservationByAddress(addr, ips.reservations)
+	if shared == nil || shared.ID != id || !hasTag(shared.Tags, serviceTag(current("api"))) {
+		t.Errorf("expected reservation %s kept for the shared key, have %+v", id, shared)
+	}
+	if len(ips.removed) != 0 {
+		t.Errorf("expected no reservation removed, removed %v", ips.removed)
+	}
+}
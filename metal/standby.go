@@ -0,0 +1,115 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+const (
+	annotationEIPStandby = "metal.equinix.com/eip-standby"
+	annotationEIPActive  = "metal.equinix.com/eip-active"
+	standbyTag           = "role=standby"
+
+	eipActivePrimary = "primary"
+	eipActiveStandby = "standby"
+)
+
+// standby report if the service asks for a standby reservation, as well as its primary one
+func (l *loadBalancers) standby(svc *v1.Service) bool {
+	return l.standbyFacility != "" && svc.Annotations[annotationEIPStandby] == "true"
+}
+
+// standbyActive report if the standby address of the service is the one to advertise
+func standbyActive(svc *v1.Service) bool {
+	return svc.Annotations[annotationEIPActive] == eipActiveStandby
+}
+
+// withoutStandby get the reservations that are not standby ones, so that the primary of a service
+// is found by its tags
+func withoutStandby(ips []packngo.IPAddressReservation) []packngo.IPAddressReservation {
+	return ipReservationsWithoutTag(standbyTag, ips)
+}
+
+// reconcileStandby make sure a service that asks for it has a standby reservation, in the standby
+// facility, and switch the advertised address between the primary and standby ones as the
+// eip-active annotation says. Both reservations carry the same tags, plus the role tag on the
+// standby, and both are kept whichever is active; only the active one is set as the loadBalancerIP
+// and advertised.
+//
+// It returns the address the rest of addService is to use: the standby address when it is active,
+// "" when switching back, so that the primary is found and written again, and otherwise svcIP
+// as it is. The reservations are returned with the standby one, if it was just created.
+func (l *loadBalancers) reconcileStandby(ctx context.Context, svc *v1.Service, ips []packngo.IPAddressReservation, svcIP string) (string, []packngo.IPAddressReservation, error) {
+	if !l.standby(svc) {
+		return svcIP, ips, nil
+	}
+	var err error
+	svcName := serviceRep(svc)
+	key := svcName + "/standby"
+	tags := []string{emTag, serviceTag(svc), clusterTag(l.clusterID), standbyTag}
+	ipReservation := ipReservationByAllTags(tags, ipReservationsWithoutTag(ipv6FamilyTag, ips))
+	if ipReservation == nil {
+		if ipReservation, err = l.pendingReservation(ctx, key); err != nil {
+			return svcIP, ips, err
+		}
+	}
+	if ipReservation == nil {
+		klog.V(2).Infof("no standby IP found for %s, requesting in facility %s", svcName, l.standbyFacility)
+		facility := l.standbyFacility
+		req := packngo.IPReservationRequest{
+			Type:                   "public_ipv4",
+			Quantity:               1,
+			Description:            fmt.Sprintf("%s (%s)", l.describeReservation(svc), standbyTag),
+			Facility:               &facility,
+			Tags:                   append(append(tags, l.serviceLabelTags(svc)...), l.serviceAdditionalTags(svc)...),
+			FailOnApprovalRequired: l.failOnApprovalRequired(svc),
+		}
+		ipReservation, err = l.requestReservation(ctx, svc, &req, func(ips []packngo.IPAddressReservation) []*packngo.IPAddressReservation {
+			return ipReservationsByAllTags(tags, ipReservationsWithoutTag(ipv6FamilyTag, ips))
+		})
+		if err != nil {
+			return svcIP, ips, fmt.Errorf("failed to request a standby IP for the load balancer: %w", err)
+		}
+		ips = append(append([]packngo.IPAddressReservation{}, ips...), *ipReservation)
+	}
+	// until the standby has an address, there is nothing to switch to
+	if !l.hasAddress(key, ipReservation) {
+		return svcIP, ips, nil
+	}
+	l.updateLabelTags(ctx, svc, ipReservation)
+
+	switch {
+	case standbyActive(svc) && svcIP != ipReservation.Address:
+		klog.Infof("promoting standby IP %s of %s, in place of %q", ipReservation.Address, svcName, svcIP)
+		if err := l.unadvertise(ctx, svc, svcIP, ips); err != nil {
+			return svcIP, ips, err
+		}
+		if err := l.writeServiceIP(ctx, svc, ipReservation.Address); err != nil {
+			return svcIP, ips, err
+		}
+		return ipReservation.Address, ips, nil
+	case !standbyActive(svc) && svcIP == ipReservation.Address:
+		klog.Infof("returning %s to its primary IP from standby IP %s", svcName, svcIP)
+		if err := l.unadvertise(ctx, svc, svcIP, ips); err != nil {
+			return svcIP, ips, err
+		}
+		return "", ips, nil
+	}
+	return svcIP, ips, nil
+}
+
+// unadvertise stop advertising an address of a service, if it has one and advertises it at all
+func (l *loadBalancers) unadvertise(ctx context.Context, svc *v1.Service, svcIP string, ips []packngo.IPAddressReservation) error {
+	if svcIP == "" || allocateOnly(svc) {
+		return nil
+	}
+	svcIPCidr := advertisedCIDR(svc, svcIP, ipReservationByAddress(svcIP, ips))
+	if err := l.implementor.RemoveService(ctx, svcIPCidr); err != nil {
+		return fmt.Errorf("error removing IP %s from configmap for %s: %v", svcIPCidr, serviceRep(svc), err)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package metal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestReconcileServicesStandby(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", map[string]string{annotationEIPStandby: "true"})
+	ips := &fakeProjectIPs{}
+	l, lb := testGetLoadBalancers(ips, svc)
+	l.standbyFacility = "ams1"
+	current := func() *v1.Service {
+		existing, err := l.k8sclient.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("unable to get service: %v", err)
+		}
+		return existing
+	}
+	reconcile := func(step string, active string, mode UpdateMode) {
+		updated := current()
+		if active != "" {
+			updated.Annotations[annotationEIPActive] = active
+			var err error
+			if updated, err = l.k8sclient.CoreV1().Services("default").Update(context.Background(), updated, metav1.UpdateOptions{}); err != nil {
+				t.Fatalf("%s: unable to update service: %v", step, err)
+			}
+		}
+		if err := l.reconcileServices(context.Background(), []*v1.Service{updated}, mode); err != nil {
+			t.Fatalf("%s: unexpected error: %v", step, err)
+		}
+	}
+
+	// creation reserves a primary in the facility and a standby in the standby facility, and advertises the primary
+	reconcile("create", "", ModeAdd)
+	if len(ips.requests) != 2 {
+		t.Fatalf("expected 2 requests, had %d", len(ips.requests))
+	}
+	var primary, standby string
+	for _, ipr := range ips.reservations {
+		switch {
+		case ipr.Facility == nil:
+			t.Errorf("reservation %s has no facility", ipr.ID)
+		case ipr.Facility.Code == testFacility && ipReservationByAllTags([]string{standbyTag}, []packngo.IPAddressReservation{ipr}) == nil:
+			primary = ipr.Address
+		case ipr.Facility.Code == "ams1" && ipReservationByAllTags([]string{emTag, serviceTag(svc), clusterTag(testClusterID), standbyTag}, []packngo.IPAddressReservation{ipr}) != nil:
+			standby = ipr.Address
+		}
+	}
+	if primary == "" || standby == "" {
+		t.Fatalf("expected a primary in %s and a tagged standby in ams1, have %v", testFacility, ips.reservations)
+	}
+	checkActive := func(step, addr string) {
+		updated := current()
+		if updated.Spec.LoadBalancerIP != addr {
+			t.Errorf("%s: mismatched loadBalancerIP, actual %s expected %s", step, updated.Spec.LoadBalancerIP, addr)
+		}
+		if len(lb.services) != 1 || lb.services[addr+"/32"] != "default/web" {
+			t.Errorf("%s: expected only %s advertised, have %v", step, addr, lb.services)
+		}
+		if len(ips.requests) != 2 || len(ips.removed) != 0 {
+			t.Errorf("%s: reservations changed: %d requests, removed %v", step, len(ips.requests), ips.removed)
+		}
+	}
+	checkActive("create", primary)
+
+	// a sync keeps both
+	reconcile("sync", "", ModeSync)
+	checkActive("sync", primary)
+
+	// promotion swaps the advertised address, and keeps the primary reservation
+	reconcile("promote", eipActiveStandby, ModeAdd)
+	checkActive("promote", standby)
+	reconcile("sync promoted", "", ModeSync)
+	checkActive("sync promoted", standby)
+
+	// and back
+	reconcile("fail back", eipActivePrimary, ModeAdd)
+	checkActive("fail back", primary)
+
+	// removal releases both
+	reconcile("remove", "", ModeRemove)
+	if len(ips.removed) != 2 || len(ips.reservations) != 0 {
+		t.Errorf("expected both reservations removed, removed %v, remaining %v", ips.removed, ips.reservations)
+	}
+}
+
+func TestReconcileServicesStandbyDisabled(t *testing.T) {
+	// without a standby facility the annotation does nothing
+	svc := testLoadBalancerService("default", "web", map[string]string{annotationEIPStandby: "true"})
+	ips := &fakeProjectIPs{}
+	l, _ := testGetLoadBalancers(ips, svc)
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.requests) != 1 {
+		t.Errorf("expected only the primary request, had %d", len(ips.requests))
+	}
+}
+
+func TestReconcileServicesSyncNoLongerStandby(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", map[string]string{annotationEIPStandby: "true"})
+	ips := &fakeProjectIPs{}
+	l, lb := testGetLoadBalancers(ips, svc)
+	l.standbyFacility = "ams1"
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	standby := ipReservationByAllTags([]string{standbyTag}, ips.reservations)
+	if standby == nil {
+		t.Fatal("no standby reserved")
+	}
+	standbyID := standby.ID
+
+	updated, _ := l.k8sclient.CoreV1().Services("default").Get(context.Background(), "web", metav1.GetOptions{})
+	delete(updated.Annotations, annotationEIPStandby)
+	if err := l.reconcileServices(context.Background(), []*v1.Service{updated}, ModeSync); err != nil {
+		t.Fatalf("unexpected error on sync: %v", err)
+	}
+	if len(ips.removed) != 1 || ips.removed[0] != standbyID {
+		t.Errorf("mismatched removed, actual %v expected [%s]", ips.removed, standbyID)
+	}
+	if len(lb.services) != 1 || lb.services[updated.Spec.LoadBalancerIP+"/32"] != "default/web" {
+		t.Errorf("primary no longer advertised, have %v", lb.services)
+	}
+}
@@ -0,0 +1,101 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers"
+	"k8s.io/klog/v2"
+)
+
+type reconcileSummaryKey struct{}
+
+// reconcileSummary the counts of what a single reconcile pass did, logged as one line at the end
+// of it. Items are services or nodes: added, or changed, if the pass did anything for them,
+// unchanged if it did not, removed, or failed. Reservations are counted as they are created and
+// released, wherever in the pass that is, so they are carried in the context.
+type reconcileSummary struct {
+	name      string
+	mode      UpdateMode
+	added     int
+	removed   int
+	unchanged int
+	failed    int
+	created   int
+	released  int
+	// changes the config changes of the implementation, if it counts them
+	changes     loadbalancers.ChangeCounter
+	changesBase uint64
+}
+
+// newReconcileSummary start the summary of a pass, and get the context that carries it
+func newReconcileSummary(ctx context.Context, name string, mode UpdateMode, impl loadbalancers.LB) (context.Context, *reconcileSummary) {
+	s := &reconcileSummary{name: name, mode: mode}
+	if counter, ok := impl.(loadbalancers.ChangeCounter); ok {
+		s.changes = counter
+		s.changesBase = counter.Changes()
+	}
+	return context.WithValue(ctx, reconcileSummaryKey{}, s), s
+}
+
+// summaryFrom get the summary of the pass that the context is of, if any
+func summaryFrom(ctx context.Context) *reconcileSummary {
+	s, _ := ctx.Value(reconcileSummaryKey{}).(*reconcileSummary)
+	return s
+}
+
+// reservation count a reservation event of the pass
+func (s *reconcileSummary) reservation(eventType string) {
+	if s == nil {
+		return
+	}
+	switch eventType {
+	case reservationEventCreated:
+		s.created++
+	case reservationEventDeleted:
+		s.released++
+	}
+}
+
+// configChanges the config changes of the implementation so far in the pass, and whether it
+// counts them at all
+func (s *reconcileSummary) configChanges() (uint64, bool) {
+	if s.changes == nil {
+		return 0, false
+	}
+	return s.changes.Changes() - s.changesBase, true
+}
+
+// activity a mark of everything done so far in the pass, to tell if an item changed anything
+func (s *reconcileSummary) activity() uint64 {
+	changes, _ := s.configChanges()
+	return uint64(s.created+s.released) + changes
+}
+
+// item count an item that was added, or updated, by the pass, given the activity before it. If
+// the implementation does not count its changes, it cannot be told unchanged, so counts as added.
+func (s *reconcileSummary) item(before uint64, err error) {
+	switch {
+	case err != nil:
+		s.failed++
+	case s.activity() != before || s.changes == nil:
+		s.added++
+	default:
+		s.unchanged++
+	}
+}
+
+func (s *reconcileSummary) String() string {
+	changed := "unknown"
+	if changes, ok := s.configChanges(); ok {
+		changed = fmt.Sprintf("%t", changes > 0)
+	}
+	return fmt.Sprintf("%s: %s summary: %d added, %d removed, %d unchanged, %d failed; reservations %d created, %d released; config changed: %s",
+		s.name, s.mode, s.added, s.removed, s.unchanged, s.failed, s.created, s.released, changed)
+}
+
+// log the summary, at info level whatever the verbosity, so that the outcome of each pass can be
+// seen without the lines of each item
+func (s *reconcileSummary) log() {
+	klog.Info(s.String())
+}
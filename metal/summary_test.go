@@ -0,0 +1,72 @@
+package metal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestReconcileServicesSummary(t *testing.T) {
+	a := testLoadBalancerService("default", "a", nil)
+	b := testLoadBalancerService("default", "b", nil)
+	ips := &fakeProjectIPs{}
+	l, _ := testGetLoadBalancers(ips, a, b)
+	var summary *reconcileSummary
+	l.logSummary = func(s *reconcileSummary) { summary = s }
+
+	tests := []struct {
+		step     string
+		svcs     []*v1.Service
+		mode     UpdateMode
+		expected string
+	}{
+		{"add", []*v1.Service{a, b}, ModeAdd, "loadbalancer.reconcileServices(): add summary: 2 added, 0 removed, 0 unchanged, 0 failed; reservations 2 created, 0 released; config changed: true"},
+		{"sync", []*v1.Service{a, b}, ModeSync, "loadbalancer.reconcileServices(): sync summary: 0 added, 0 removed, 2 unchanged, 0 failed; reservations 0 created, 0 released; config changed: false"},
+		// b is gone, so its reservation is released as an orphan
+		{"sync without b", []*v1.Service{a}, ModeSync, "loadbalancer.reconcileServices(): sync summary: 0 added, 1 removed, 1 unchanged, 0 failed; reservations 0 created, 1 released; config changed: true"},
+		{"remove", []*v1.Service{a}, ModeRemove, "loadbalancer.reconcileServices(): remove summary: 0 added, 1 removed, 0 unchanged, 0 failed; reservations 0 created, 1 released; config changed: true"},
+	}
+	for _, tt := range tests {
+		// the services as last written, with their addresses
+		svcs := []*v1.Service{}
+		for _, svc := range tt.svcs {
+			current, err := l.k8sclient.CoreV1().Services(svc.Namespace).Get(context.Background(), svc.Name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatalf("%s: unable to get service: %v", tt.step, err)
+			}
+			svcs = append(svcs, current)
+		}
+		summary = nil
+		if err := l.reconcileServices(context.Background(), svcs, tt.mode); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.step, err)
+		}
+		if summary == nil {
+			t.Fatalf("%s: no summary", tt.step)
+		}
+		if actual := summary.String(); actual != tt.expected {
+			t.Errorf("%s: mismatched summary\nactual   %s\nexpected %s", tt.step, actual, tt.expected)
+		}
+	}
+}
+
+func TestReconcileNodesSummary(t *testing.T) {
+	l, lb, _ := testHoldLoadBalancers(false, "")
+	var summary *reconcileSummary
+	l.logSummary = func(s *reconcileSummary) { summary = s }
+	lb.nodes["c"] = loadbalancers.Node{Name: "c"}
+
+	// a stays, b is new, c is gone, and d cannot be looked up yet
+	d := testReadyNode("d", true, nil)
+	d.Spec.ProviderID = ""
+	nodes := []*v1.Node{testReadyNode("a", true, nil), testReadyNode("b", true, nil), d}
+	if err := l.reconcileNodes(context.Background(), nodes, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := "loadbalancers.reconcileNodes(): sync summary: 1 added, 1 removed, 1 unchanged, 0 failed; reservations 0 created, 0 released; config changed: true"
+	if summary == nil || summary.String() != expected {
+		t.Errorf("mismatched summary\nactual   %v\nexpected %s", summary, expected)
+	}
+}
@@ -0,0 +1,105 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+// currentServiceTags get the tags with those of the service of the legacy form, see
+// legacyServiceTag, replaced by those of the current one: its service tag, and its allocation tags
+// in a shared block. It reports whether any was replaced.
+func currentServiceTags(svc *v1.Service, tags []string) ([]string, bool) {
+	legacy, current := legacyServiceTag(svc), serviceTag(svc)
+	legacyHash, currentHash := strings.TrimPrefix(legacy, "service="), strings.TrimPrefix(current, "service=")
+	replaced := make([]string, 0, len(tags))
+	var changed bool
+	for _, tag := range tags {
+		switch {
+		case tag == legacy:
+			tag = current
+			changed = true
+		case strings.HasPrefix(tag, allocationTagPrefix) && strings.HasSuffix(tag, ","+legacyHash):
+			tag = strings.TrimSuffix(tag, legacyHash) + currentHash
+			changed = true
+		}
+		replaced = append(replaced, tag)
+	}
+	return replaced, changed
+}
+
+// withCurrentServiceTags get a copy of the reservations with the tags of the services of the
+// legacy form replaced by those of the current one, and the indexes of those that had any, so
+// that they are found by the current tags. The reservations themselves are not changed.
+func withCurrentServiceTags(svcs []*v1.Service, ips []packngo.IPAddressReservation) ([]packngo.IPAddressReservation, []int) {
+	legacy := map[string]*v1.Service{}
+	for _, svc := range svcs {
+		legacy[strings.TrimPrefix(legacyServiceTag(svc), "service=")] = svc
+	}
+	current := make([]packngo.IPAddressReservation, len(ips))
+	copy(current, ips)
+	changed := []int{}
+	for i := range current {
+		var migrated bool
+		for _, svc := range legacyServices(current[i].Tags, legacy) {
+			tags, ok := currentServiceTags(svc, current[i].Tags)
+			if ok {
+				current[i].Tags = tags
+				migrated = true
+			}
+		}
+		if migrated {
+			changed = append(changed, i)
+		}
+	}
+	return current, changed
+}
+
+// legacyServices get the services of which the tags have a legacy service or allocation tag
+func legacyServices(tags []string, legacy map[string]*v1.Service) []*v1.Service {
+	svcs := []*v1.Service{}
+	for _, tag := range tags {
+		var hash string
+		switch {
+		case strings.HasPrefix(tag, "service="):
+			hash = strings.TrimPrefix(tag, "service=")
+		case strings.HasPrefix(tag, allocationTagPrefix):
+			parts := strings.SplitN(strings.TrimPrefix(tag, allocationTagPrefix), ",", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			hash = parts[1]
+		default:
+			continue
+		}
+		if svc, ok := legacy[hash]; ok {
+			svcs = append(svcs, svc)
+		}
+	}
+	return svcs
+}
+
+// migrateServiceTags re-tag the reservations of the services that still have tags of the legacy
+// form, from before their hash was base64url encoded, with those of the current one, then those
+// of services of which the share key changed, see retagShareKeys, so that they are not taken for
+// orphans, and get the reservations as they now are. On an error, nothing more should be done
+// with the reservations, as those not migrated would not be found.
+func (l *loadBalancers) migrateServiceTags(ctx context.Context, svcs []*v1.Service, ips []packngo.IPAddressReservation) ([]packngo.IPAddressReservation, error) {
+	current, changed := withCurrentServiceTags(svcs, ips)
+	for _, i := range changed {
+		ipr := &current[i]
+		klog.V(2).Infof("migrating the service tags of IP reservation %s from %v to %v", ipr.ID, ips[i].Tags, ipr.Tags)
+		updated, _, err := l.updateTags(ctx, ipr.ID, ipr.Tags)
+		if err != nil {
+			return nil, fmt.Errorf("failed to migrate the service tags of IP reservation %s: %w", ipr.ID, err)
+		}
+		if updated != nil {
+			current[i] = *updated
+		}
+	}
+	return l.retagShareKeys(ctx, svcs, current)
+}
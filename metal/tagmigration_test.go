@@ -0,0 +1,115 @@
+package metal
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestServiceTagEncoding(t *testing.T) {
+	// enough services that some hash has a / or + in standard base64
+	var legacyAwkward bool
+	for i := 0; i < 50; i++ {
+		svc := testLoadBalancerService("default", strings.Repeat("a", i+1), nil)
+		tag := serviceTag(svc)
+		if strings.ContainsAny(strings.TrimPrefix(tag, "service="), "/+=") {
+			t.Errorf("service tag %s has characters awkward in tags", tag)
+		}
+		if !knownTagScheme([]string{tag}) || !knownTagScheme([]string{legacyServiceTag(svc)}) {
+			t.Errorf("tags %s and %s not both known", tag, legacyServiceTag(svc))
+		}
+		legacyAwkward = legacyAwkward || strings.ContainsAny(legacyServiceTag(svc), "/+")
+	}
+	if !legacyAwkward {
+		t.Errorf("no legacy tag with / or +, the test does not cover them")
+	}
+}
+
+func TestCurrentServiceTags(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", nil)
+	other := testLoadBalancerService("default", "other", nil)
+	legacyHash := strings.TrimPrefix(legacyServiceTag(svc), "service=")
+	currentHash := strings.TrimPrefix(serviceTag(svc), "service=")
+	tests := []struct {
+		tags     []string
+		expected []string
+		changed  bool
+	}{
+		{[]string{emTag, legacyServiceTag(svc)}, []string{emTag, serviceTag(svc)}, true},
+		{[]string{emTag, serviceTag(svc)}, []string{emTag, serviceTag(svc)}, false},
+		{[]string{emTag, legacyServiceTag(other)}, []string{emTag, legacyServiceTag(other)}, false},
+		{
+			[]string{sharedBlockTag, legacyServiceTag(svc), allocationTagPrefix + "147.75.1.1," + legacyHash},
+			[]string{sharedBlockTag, serviceTag(svc), allocationTagPrefix + "147.75.1.1," + currentHash},
+			true,
+		},
+	}
+	for i, tt := range tests {
+		tags, changed := currentServiceTags(svc, tt.tags)
+		if changed != tt.changed || strings.Join(tags, " ") != strings.Join(tt.expected, " ") {
+			t.Errorf("%d: mismatched tags, actual %v %t expected %v %t", i, tags, changed, tt.expected, tt.changed)
+		}
+	}
+}
+
+func TestReconcileServicesMigratesLegacyTags(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", nil)
+	svc.Spec.LoadBalancerIP = "147.75.1.1"
+	legacy := packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{
+		ID:      "legacy",
+		Address: "147.75.1.1",
+		CIDR:    32,
+		Tags:    []string{emTag, legacyServiceTag(svc), clusterTag(testClusterID)},
+	}}
+	ips := &fakeProjectIPs{reservations: []packngo.IPAddressReservation{legacy}}
+	l, lb := testGetLoadBalancers(ips, svc)
+
+	// neither a new reservation, nor the release of the one of the old tag as an orphan
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeSync); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(ips.requests) != 0 || len(ips.removed) != 0 {
+		t.Errorf("expected the reservation kept, had requests %v and removed %v", ips.requests, ips.removed)
+	}
+	if lb.services["147.75.1.1/32"] != "default/web" {
+		t.Errorf("expected 147.75.1.1/32 advertised, have %v", lb.services)
+	}
+	// and it now has the current tag
+	if len(ips.reservations) != 1 {
+		t.Fatalf("expected 1 reservation, have %v", ips.reservations)
+	}
+	tags := ips.reservations[0].Tags
+	if ipReservationByAllTags([]string{serviceTag(svc)}, ips.reservations) == nil || ipReservationByAllTags([]string{legacyServiceTag(svc)}, ips.reservations) != nil {
+		t.Errorf("reservation not re-tagged, has tags %v", tags)
+	}
+	// which is found without a change on the next pass
+	ips.requests, ips.removed = nil, nil
+	if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeSync); err != nil {
+		t.Fatalf("unexpected error on next pass: %v", err)
+	}
+	if len(ips.requests) != 0 || len(ips.removed) != 0 {
+		t.Errorf("next pass changed reservations, requests %v removed %v", ips.requests, ips.removed)
+	}
+}
+
+func TestReleaseOrphansLegacyTags(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", nil)
+	gone := testLoadBalancerService("default", "gone", nil)
+	reservation := func(id string, tags ...string) packngo.IPAddressReservation {
+		return packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{ID: id, Address: "147.75.1." + id, CIDR: 32, Tags: tags}}
+	}
+	ips := &fakeProjectIPs{reservations: []packngo.IPAddressReservation{
+		reservation("1", emTag, legacyServiceTag(svc), clusterTag(testClusterID)),
+		reservation("2", emTag, legacyServiceTag(gone), clusterTag(testClusterID)),
+	}}
+	l, _ := testGetLoadBalancers(ips, svc)
+	if err := l.releaseOrphans(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Join(ips.removed, ",") != "2" {
+		t.Errorf("expected only the orphan of the legacy tag removed, removed %v", ips.removed)
+	}
+}
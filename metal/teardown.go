@@ -0,0 +1,85 @@
+package metal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+)
+
+// Teardown remove all the state the CCM manages, e.g. to uninstall it: the address pools and peers
+// it added to the loadbalancer config, and every EIP reservation of the cluster. It runs once,
+// without the controllers, against the cluster of restConfig, and is safe to run again, e.g. after
+// it failed part way, as a second run finds nothing left to remove.
+func Teardown(ctx context.Context, metalConfig Config, restConfig *rest.Config) error {
+	client, err := newMetalClient(ctx, metalConfig)
+	if err != nil {
+		return err
+	}
+	k8sclient, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return fmt.Errorf("unable to create kubernetes client: %v", err)
+	}
+	c, err := newCloud(metalConfig, client, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create new cloud handler: %v", err)
+	}
+	l := c.(*cloud).loadBalancer.(*loadBalancers)
+	if l.metallbMode == MetalLBModeCRD {
+		if l.dynamicClient, err = dynamic.NewForConfig(restConfig); err != nil {
+			return fmt.Errorf("unable to create dynamic kubernetes client: %v", err)
+		}
+	}
+	if err := l.init(k8sclient); err != nil {
+		return err
+	}
+	// without a loadbalancer implementation, init leaves it unset, yet there may be reservations
+	if l.clusterID == "" {
+		systemNamespace, err := k8sclient.CoreV1().Namespaces().Get(ctx, "kube-system", metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get kube-system namespace: %v", err)
+		}
+		l.clusterID = string(systemNamespace.UID)
+	}
+	return l.teardown(ctx)
+}
+
+// teardown withdraw every address and peer from the loadbalancer, then release every reservation of
+// the cluster, returning those of a pool to it. The loadbalancer goes first, so that no node still
+// advertises an address once it is released. Retained reservations no longer are the CCM's, so
+// they are kept.
+func (l *loadBalancers) teardown(ctx context.Context) error {
+	if l.implementor != nil {
+		klog.Info("teardown: removing all services and nodes from the loadbalancer")
+		if err := l.implementor.SyncServices(ctx, map[string]bool{}); err != nil {
+			return fmt.Errorf("failed to remove services from the loadbalancer: %w", err)
+		}
+		if err := l.implementor.SyncNodes(ctx, map[string]loadbalancers.Node{}); err != nil {
+			return fmt.Errorf("failed to remove nodes from the loadbalancer: %w", err)
+		}
+	}
+	ips, err := l.listReservations(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to retrieve IP reservations for project %s: %w", l.project, err)
+	}
+	for _, ipr := range ipReservationsByAllTags([]string{emTag, clusterTag(l.clusterID)}, ips) {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("teardown stopped, remaining reservations kept: %w", err)
+		}
+		klog.Infof("teardown: releasing IP reservation %s of %s with tags %v", ipr.ID, ipr.Address, ipr.Tags)
+		if isPoolReservation(ipr) {
+			err = l.returnToPool(ctx, "", ipr)
+		} else {
+			err = l.removeReservation(ctx, nil, ipr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
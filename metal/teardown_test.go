@@ -0,0 +1,91 @@
+package metal
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers"
+	"github.com/equinix/cloud-provider-equinix-metal/metal/loadbalancers/metallb"
+	"github.com/packethost/packngo"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestTeardown(t *testing.T) {
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "config", Namespace: "metallb-system"},
+		Data:       map[string]string{"config": ""},
+	}
+	web := testLoadBalancerService("default", "web", nil)
+	reservation := func(id string, tags ...string) packngo.IPAddressReservation {
+		return packngo.IPAddressReservation{IpAddressCommon: packngo.IpAddressCommon{ID: id, Address: "147.75.1." + id, CIDR: 32, Tags: tags}}
+	}
+	ips := &fakeProjectIPs{reservations: []packngo.IPAddressReservation{
+		reservation("1", emTag, serviceTag(web), clusterTag(testClusterID)),
+		reservation("2", emTag, sharedBlockTag, clusterTag(testClusterID), allocationTagPrefix+"147.75.1.2,"+strings.TrimPrefix(serviceTag(web), "service=")),
+		reservation("3", emTag, serviceTag(web), clusterTag(testClusterID), poolTag("prod")),
+		// neither retained, nor of another cluster, nor not of the CCM at all
+		reservation("4", emRetainedTag, serviceTag(web), clusterTag(testClusterID)),
+		reservation("5", emTag, serviceTag(web), clusterTag("other-cluster")),
+		reservation("6", "env=prod"),
+	}}
+	l, _ := testGetLoadBalancers(ips, cm)
+	l.implementor = metallb.NewLB(l.k8sclient, "")
+	ctx := context.Background()
+	if err := l.implementor.AddService(ctx, "default/web", "147.75.1.1/32", loadbalancers.ServiceOptions{}); err != nil {
+		t.Fatalf("unable to add service: %v", err)
+	}
+	if err := l.implementor.AddNode(ctx, "node-a", 65000, 65530, "", "", "169.254.255.1", "169.254.255.2"); err != nil {
+		t.Fatalf("unable to add node: %v", err)
+	}
+
+	if err := l.teardown(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	saved, err := l.k8sclient.CoreV1().ConfigMaps("metallb-system").Get(ctx, "config", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("unable to get configmap: %v", err)
+	}
+	cfg, err := metallb.ParseConfig([]byte(saved.Data["config"]))
+	if err != nil {
+		t.Fatalf("unable to parse config: %v", err)
+	}
+	if len(cfg.Pools) != 0 || len(cfg.Peers) != 0 {
+		t.Errorf("expected no pools or peers left, have %v and %v", cfg.Pools, cfg.Peers)
+	}
+	removed := append([]string{}, ips.removed...)
+	sort.Strings(removed)
+	if strings.Join(removed, ",") != "1,2" {
+		t.Errorf("mismatched removed reservations, actual %v expected 1,2", removed)
+	}
+	remaining := map[string][]string{}
+	for _, ipr := range ips.reservations {
+		remaining[ipr.ID] = ipr.Tags
+	}
+	if strings.Join(remaining["3"], ",") != poolTag("prod") {
+		t.Errorf("pool reservation not returned to its pool, has tags %v", remaining["3"])
+	}
+	for _, id := range []string{"4", "5", "6"} {
+		if _, ok := remaining[id]; !ok {
+			t.Errorf("reservation %s removed", id)
+		}
+	}
+
+	// a second run finds nothing to remove, and changes nothing
+	client := l.k8sclient.(*fake.Clientset)
+	client.ClearActions()
+	if err := l.teardown(ctx); err != nil {
+		t.Fatalf("unexpected error on second run: %v", err)
+	}
+	if len(ips.removed) != 2 || len(ips.reservations) != 4 {
+		t.Errorf("second run changed reservations, removed %v remaining %v", ips.removed, ips.reservations)
+	}
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "update" {
+			t.Errorf("second run updated %s", action.GetResource().Resource)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package metal
+
+import (
+	"context"
+	"reflect"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// localTrafficPolicy report if the service is of externalTrafficPolicy: Local, so that its traffic
+// must only reach the nodes of its endpoints, as it is not forwarded to other nodes
+func localTrafficPolicy(svc *v1.Service) bool {
+	return svc.Spec.ExternalTrafficPolicy == v1.ServiceExternalTrafficPolicyTypeLocal
+}
+
+// advertiseFrom get the nodes from which to advertise the address of the service: for a service of
+// externalTrafficPolicy: Local, those of its ready endpoints, else nil, for all. If its endpoints
+// cannot be got, or none is ready, it is nil too, and left to the implementation, e.g. metallb,
+// which does not announce such a service from nodes without its endpoints either.
+func (l *loadBalancers) advertiseFrom(ctx context.Context, svc *v1.Service) []string {
+	if !localTrafficPolicy(svc) {
+		return nil
+	}
+	endpoints, err := l.serviceEndpoints(ctx, svc)
+	if err != nil {
+		klog.V(2).Infof("no endpoints of %s of local traffic policy, advertising from all nodes: %v", serviceRep(svc), err)
+		return nil
+	}
+	nodes := endpointsNodes(endpoints)
+	if len(nodes) == 0 {
+		klog.V(2).Infof("no ready endpoints of %s of local traffic policy, advertising from all nodes", serviceRep(svc))
+		return nil
+	}
+	return nodes
+}
+
+// serviceEndpoints get the endpoints of the service, from the informer if it is started, so that a
+// sync does not get those of every service from the API, else live
+func (l *loadBalancers) serviceEndpoints(ctx context.Context, svc *v1.Service) (*v1.Endpoints, error) {
+	if l.endpointsLister != nil {
+		return l.endpointsLister.Endpoints(svc.Namespace).Get(svc.Name)
+	}
+	return l.k8sclient.CoreV1().Endpoints(svc.Namespace).Get(ctx, svc.Name, metav1.GetOptions{})
+}
+
+// endpointsNodes get the names of the nodes of the ready addresses of the endpoints, sorted
+func endpointsNodes(endpoints *v1.Endpoints) []string {
+	seen := map[string]bool{}
+	nodes := []string{}
+	for _, subset := range endpoints.Subsets {
+		for _, addr := range subset.Addresses {
+			if addr.NodeName != nil && !seen[*addr.NodeName] {
+				seen[*addr.NodeName] = true
+				nodes = append(nodes, *addr.NodeName)
+			}
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// endpointsNodesChanged report if the nodes of the ready endpoints changed, so that a service of
+// local traffic policy is to be advertised from others; any other change of the endpoints, e.g. of
+// a pod on the same node, leaves it as it is
+func endpointsNodesChanged(old, endpoints *v1.Endpoints) bool {
+	return !reflect.DeepEqual(endpointsNodes(old), endpointsNodes(endpoints))
+}
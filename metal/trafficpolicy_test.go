@@ -0,0 +1,92 @@
+package metal
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// testEndpoints get the endpoints of the service, with a ready address on each of the nodes, and a
+// not ready one on each of notReady
+func testEndpoints(ns, name string, nodes []string, notReady ...string) *v1.Endpoints {
+	subset := v1.EndpointSubset{}
+	for i := range nodes {
+		subset.Addresses = append(subset.Addresses, v1.EndpointAddress{IP: "10.0.0.1", NodeName: &nodes[i]})
+	}
+	for i := range notReady {
+		subset.NotReadyAddresses = append(subset.NotReadyAddresses, v1.EndpointAddress{IP: "10.0.0.2", NodeName: &notReady[i]})
+	}
+	return &v1.Endpoints{ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name}, Subsets: []v1.EndpointSubset{subset}}
+}
+
+func TestReconcileServicesLocalTrafficPolicy(t *testing.T) {
+	tests := []struct {
+		description string
+		policy      v1.ServiceExternalTrafficPolicyType
+		endpoints   *v1.Endpoints
+		expected    []string
+	}{
+		{"local", v1.ServiceExternalTrafficPolicyTypeLocal, testEndpoints("default", "web", []string{"node-c", "node-a", "node-a"}, "node-b"), []string{"node-a", "node-c"}},
+		{"cluster", v1.ServiceExternalTrafficPolicyTypeCluster, testEndpoints("default", "web", []string{"node-a"}), nil},
+		// left to the implementation
+		{"local without ready endpoints", v1.ServiceExternalTrafficPolicyTypeLocal, testEndpoints("default", "web", nil, "node-b"), nil},
+		{"local without endpoints", v1.ServiceExternalTrafficPolicyTypeLocal, nil, nil},
+	}
+	for _, tt := range tests {
+		svc := testLoadBalancerService("default", "web", nil)
+		svc.Spec.ExternalTrafficPolicy = tt.policy
+		objects := []runtime.Object{svc}
+		if tt.endpoints != nil {
+			objects = append(objects, tt.endpoints)
+		}
+		l, lb := testGetLoadBalancers(&fakeProjectIPs{}, objects...)
+		if err := l.reconcileServices(context.Background(), []*v1.Service{svc}, ModeAdd); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.description, err)
+		}
+		opts, ok := lb.options["default/web"]
+		if !ok {
+			t.Fatalf("%s: service not added, load balancer %v", tt.description, lb.services)
+		}
+		if !reflect.DeepEqual(opts.AdvertiseFrom, tt.expected) {
+			t.Errorf("%s: mismatched nodes advertising, actual %v expected %v", tt.description, opts.AdvertiseFrom, tt.expected)
+		}
+	}
+}
+
+func TestAdvertiseFromEndpointsLister(t *testing.T) {
+	svc := testLoadBalancerService("default", "web", nil)
+	svc.Spec.ExternalTrafficPolicy = v1.ServiceExternalTrafficPolicyTypeLocal
+	// the API has other endpoints than the informer, so it tells which one is asked
+	l, _ := testGetLoadBalancers(&fakeProjectIPs{}, svc, testEndpoints("default", "web", []string{"node-api"}))
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	if err := indexer.Add(testEndpoints("default", "web", []string{"node-informer"})); err != nil {
+		t.Fatalf("unable to add endpoints: %v", err)
+	}
+	l.endpointsLister = corelisters.NewEndpointsLister(indexer)
+	if nodes := l.advertiseFrom(context.Background(), svc); !reflect.DeepEqual(nodes, []string{"node-informer"}) {
+		t.Errorf("mismatched nodes advertising, actual %v expected those of the informer", nodes)
+	}
+}
+
+func TestEndpointsNodesChanged(t *testing.T) {
+	tests := []struct {
+		old, endpoints *v1.Endpoints
+		changed        bool
+	}{
+		{testEndpoints("default", "web", []string{"a", "b"}), testEndpoints("default", "web", []string{"b", "a", "a"}), false},
+		{testEndpoints("default", "web", []string{"a"}), testEndpoints("default", "web", []string{"a"}, "b"), false},
+		{testEndpoints("default", "web", []string{"a"}), testEndpoints("default", "web", []string{"a", "b"}), true},
+		{testEndpoints("default", "web", []string{"a"}, "b"), testEndpoints("default", "web", []string{"b"}), true},
+	}
+	for i, tt := range tests {
+		if changed := endpointsNodesChanged(tt.old, tt.endpoints); changed != tt.changed {
+			t.Errorf("%d: mismatched changed, actual %t expected %t", i, changed, tt.changed)
+		}
+	}
+}
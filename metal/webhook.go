@@ -0,0 +1,70 @@
+package metal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"k8s.io/klog/v2"
+)
+
+// webhookPost a payload to POST, and what it is, for the log should it fail
+type webhookPost struct {
+	description string
+	payload     interface{}
+}
+
+// webhookPoster POSTs each payload as json to a URL, for the webhook sinks, which each decide
+// what to post and when. Payloads are buffered and sent by a single goroutine, best-effort; if
+// the buffer is full, or the POST fails, the payload is dropped.
+type webhookPoster struct {
+	url    string
+	client *http.Client
+	posts  chan webhookPost
+}
+
+func newWebhookPoster(url string, client *http.Client, size int) *webhookPoster {
+	w := &webhookPoster{
+		url:    url,
+		client: client,
+		posts:  make(chan webhookPost, size),
+	}
+	go w.run()
+	return w
+}
+
+// post queue the payload without blocking, and report if it was, rather than dropped because the
+// buffer is full
+func (w *webhookPoster) post(description string, payload interface{}) bool {
+	select {
+	case w.posts <- webhookPost{description: description, payload: payload}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *webhookPoster) run() {
+	for p := range w.posts {
+		if err := w.send(p.payload); err != nil {
+			klog.Errorf("failed to send %s: %v", p.description, err)
+		}
+	}
+}
+
+func (w *webhookPoster) send(payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}